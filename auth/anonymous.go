@@ -0,0 +1,93 @@
+package auth
+
+import (
+    "code.google.com/p/go-uuid/uuid"
+    "strings"
+    "unicode/utf8"
+)
+
+// RFC4505 ANONYMOUS mechanism.
+//
+//    message = [ email / token ]
+type anonymous struct{}
+
+func (anonymous) Name() string {
+    return "ANONYMOUS"
+}
+
+func (anonymous) Priority() int {
+    return PriorityAnonymous
+}
+
+// ANONYMOUS mechanism, server side. The entity is given a random localpart
+// for the lifetime of the stream and its identity is marked anonymous, so
+// that stanza handlers can restrict what it may do.
+type AnonymousServer struct {
+    anonymous
+}
+
+func NewAnonymousServer() *AnonymousServer {
+    return &AnonymousServer{}
+}
+
+func (m *AnonymousServer) Available(ctx *Context) bool {
+    return true
+}
+
+func (m *AnonymousServer) NewExchange(ctx *Context) ServerExchange {
+    return &anonymousServerExchange{}
+}
+
+type anonymousServerExchange struct {
+    started  bool
+    username string
+}
+
+func (e *anonymousServerExchange) Identity() Identity {
+    return Identity{Username: e.username, Anonymous: true}
+}
+
+// The trace information is limited to 255 characters and otherwise ignored.
+func (e *anonymousServerExchange) Next(response []byte) ([]byte, bool, error) {
+    // Without an initial response the server sends an empty challenge
+    if response == nil && !e.started {
+        e.started = true
+        return []byte{}, false, nil
+    }
+    if !utf8.Valid(response) || utf8.RuneCount(response) > 255 {
+        return nil, false, SASLMalformedRequestError
+    }
+
+    e.username = strings.Replace(uuid.New(), "-", "", -1)
+    return nil, true, nil
+}
+
+// ANONYMOUS mechanism, client side.
+type AnonymousClient struct {
+    anonymous
+    trace string
+}
+
+func NewAnonymousClient(trace string) *AnonymousClient {
+    return &AnonymousClient{trace: trace}
+}
+
+func (m *AnonymousClient) NewExchange(ctx *Context) (ClientExchange, error) {
+    return &anonymousClientExchange{trace: m.trace}, nil
+}
+
+type anonymousClientExchange struct {
+    trace string
+}
+
+func (e *anonymousClientExchange) Start() ([]byte, error) {
+    return []byte(e.trace), nil
+}
+
+func (e *anonymousClientExchange) Next(challenge []byte) ([]byte, error) {
+    return []byte(e.trace), nil
+}
+
+func (e *anonymousClientExchange) Completed() bool {
+    return true
+}
@@ -0,0 +1,21 @@
+package auth
+
+import (
+    "github.com/stretchr/testify/assert"
+    "testing"
+)
+
+// Every anonymous session gets its own temporary localpart
+func Test_AnonymousUnique(t *testing.T) {
+    server := NewAnonymousServer()
+    ctx := &Context{Domain: "example.com"}
+
+    first, err := testExchange(server.NewExchange(ctx), mustClientExchange(t, NewAnonymousClient(""), ctx))
+    assert.NoError(t, err)
+    assert.True(t, first.Anonymous)
+    assert.NotEmpty(t, first.Username)
+
+    second, err := testExchange(server.NewExchange(ctx), mustClientExchange(t, NewAnonymousClient("support"), ctx))
+    assert.NoError(t, err)
+    assert.NotEqual(t, first.Username, second.Username)
+}
@@ -1,36 +1,197 @@
 package auth
 
 import (
+    "crypto/tls"
     "errors"
-    "github.com/zonyitoo/goxmpp/stream"
+    "sort"
 )
 
-type SASLAuthenticate struct{}
+var (
+    SASLUnexpectedChallengeError = errors.New("Unexpected SASL challenge")
+    SASLNoMechanismError         = errors.New("No acceptable SASL mechanism")
 
-type SASLAuthenticator interface {
-    Process(*stream.Reader, *stream.Writer, string) bool
+    // Errors returned by a ServerExchange, each reported to the initiating
+    // entity as the matching <failure/> condition.
+    SASLMalformedRequestError     = errors.New("Malformed SASL request")
+    SASLIncorrectEncodingError    = errors.New("Incorrect SASL encoding")
+    SASLInvalidAuthzidError       = errors.New("Invalid authorization identity")
+    SASLNotAuthorizedError        = errors.New("Not authorized")
+    SASLEncryptionRequiredError   = errors.New("Encryption required")
+    SASLTemporaryAuthFailureError = errors.New("Temporary authentication failure")
+)
+
+// Priorities of the built-in mechanisms. Stronger mechanisms have a higher
+// priority; the server advertises them first and the client picks the one
+// with the highest priority it supports.
+const (
+    PriorityAnonymous       = 0
+    PriorityPlain           = 10
+    PrioritySCRAMSHA1       = 30
+    PrioritySCRAMSHA256     = 40
+    PrioritySCRAMSHA1Plus   = 50
+    PrioritySCRAMSHA256Plus = 60
+    PriorityExternal        = 70
+)
+
+// Context describes the stream an exchange runs on.
+type Context struct {
+    // The domain served by, or connected to on, the stream
+    Domain string
+    // The TLS state of the stream, nil if it is not encrypted
+    TLS *tls.ConnectionState
+    // Whether the TLS state belongs to the transport carrying the stream,
+    // such as HTTPS for BOSH, rather than to the stream itself. Such a
+    // channel is not bound to.
+    TransportTLS bool
+    // The domain the initiating server claimed in its stream header, on
+    // streams between servers
+    From string
+    // The mechanisms the receiving entity offers on the stream. Filled in by
+    // the Authenticator for server exchanges.
+    Offered []string
+}
+
+// Whether the mechanism is offered on the stream.
+func (ctx *Context) Offers(name string) bool {
+    for _, offered := range ctx.Offered {
+        if offered == name {
+            return true
+        }
+    }
+    return false
+}
+
+// The identity established by a successful exchange.
+type Identity struct {
+    // Localpart of the account at the domain of the stream
+    Username string
+    // Set for temporary identities, see the ANONYMOUS mechanism
+    Anonymous bool
+    // Domain of an authenticated server, see DomainExternalServer
+    Domain string
+}
+
+// Mechanism is the part of a SASL mechanism shared by both sides.
+type Mechanism interface {
+    Name() string
+    Priority() int
+}
+
+// ServerMechanism is the receiving side of a SASL mechanism.
+type ServerMechanism interface {
+    Mechanism
+    // Whether the mechanism can be used on the stream, e.g. channel binding
+    // requires TLS. Unavailable mechanisms are not advertised.
+    Available(ctx *Context) bool
+    // Creates the state of a single exchange.
+    NewExchange(ctx *Context) ServerExchange
+}
+
+// ServerExchange is one authentication attempt on the receiving side. Next
+// is called with the initial response, nil if there was none, and then with
+// every response of the initiating entity. It returns the next challenge, or
+// done together with the additional data with success (nil if there is none)
+// once the entity is authenticated. Errors are one of the SASL*Error values.
+type ServerExchange interface {
+    Next(response []byte) (challenge []byte, done bool, err error)
+    // The authenticated identity, valid once done.
+    Identity() Identity
+}
+
+// ClientMechanism is the initiating side of a SASL mechanism, configured with
+// the credentials of the entity.
+type ClientMechanism interface {
+    Mechanism
+    // Creates the state of a single exchange. An error means that the
+    // mechanism cannot be used on the stream.
+    NewExchange(ctx *Context) (ClientExchange, error)
+}
+
+// ClientExchange is one authentication attempt on the initiating side. Start
+// returns the initial response and Next is called with every challenge, and
+// with the additional data with success if the server sent any. Success is
+// only accepted once Completed, e.g. after a mechanism with mutual
+// authentication has verified the server.
+type ClientExchange interface {
+    Start() ([]byte, error)
+    Next(challenge []byte) ([]byte, error)
+    Completed() bool
+}
+
+// Authenticator holds the mechanisms the receiving entity supports, ordered
+// by priority.
+type Authenticator struct {
+    mechanisms []ServerMechanism
 }
 
-type SASLAuthencatorFactory func() SASLAuthenticator
+func NewAuthenticator() *Authenticator {
+    return &Authenticator{}
+}
 
-type SASLAuthenticateManager struct {
-    mechanisms map[string]SASLAuthencatorFactory
+// Registers a mechanism, replacing any other with the same name.
+func (a *Authenticator) Register(m ServerMechanism) {
+    for i, registered := range a.mechanisms {
+        if registered.Name() == m.Name() {
+            a.mechanisms = append(a.mechanisms[:i], a.mechanisms[i+1:]...)
+            break
+        }
+    }
+    a.mechanisms = append(a.mechanisms, m)
+    sort.SliceStable(a.mechanisms, func(i, j int) bool {
+        return a.mechanisms[i].Priority() > a.mechanisms[j].Priority()
+    })
 }
 
-func NewAuthenticateManager() *SASLAuthenticateManager {
-    return &SASLAuthenticateManager{
-        mechanisms: make(map[string]SASLAuthencatorFactory),
+// The names of all registered mechanisms, strongest first.
+func (a *Authenticator) Mechanisms() []string {
+    names := make([]string, len(a.mechanisms))
+    for i, m := range a.mechanisms {
+        names[i] = m.Name()
     }
+    return names
 }
 
-func (am *SASLAuthenticateManager) GetAuthenticator(mechanism string) (SASLAuthenticator, error) {
-    if auth, ok := am.mechanisms[mechanism]; !ok {
-        return nil, errors.New("Mechanism does not exist")
-    } else {
-        return auth(), nil
+// The names of the mechanisms available on the stream, strongest first.
+func (a *Authenticator) Offered(ctx *Context) []string {
+    var names []string
+    for _, m := range a.mechanisms {
+        if m.Available(ctx) {
+            names = append(names, m.Name())
+        }
     }
+    return names
 }
 
-func (am *SASLAuthenticateManager) SetAuthenticator(mechanism string, a SASLAuthencatorFactory) {
-    am.mechanisms[mechanism] = a
+// Starts an exchange with the named mechanism. Returns nil if the mechanism
+// is unknown or not available on the stream.
+func (a *Authenticator) Start(name string, ctx *Context) ServerExchange {
+    for _, m := range a.mechanisms {
+        if m.Name() == name && m.Available(ctx) {
+            c := *ctx
+            c.Offered = a.Offered(ctx)
+            return m.NewExchange(&c)
+        }
+    }
+    return nil
+}
+
+// Picks the mechanism with the highest priority that is both offered by the
+// receiving entity and usable on the stream, and starts an exchange with it.
+func Select(mechanisms []ClientMechanism, offered []string, ctx *Context) (ClientMechanism, ClientExchange, error) {
+    sorted := append([]ClientMechanism{}, mechanisms...)
+    sort.SliceStable(sorted, func(i, j int) bool {
+        return sorted[i].Priority() > sorted[j].Priority()
+    })
+
+    c := *ctx
+    c.Offered = offered
+    for _, m := range sorted {
+        if !c.Offers(m.Name()) {
+            continue
+        }
+        if exchange, err := m.NewExchange(&c); err == nil {
+            return m, exchange, nil
+        }
+    }
+    return nil, nil, SASLNoMechanismError
 }
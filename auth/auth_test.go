@@ -0,0 +1,135 @@
+package auth
+
+import (
+    "crypto/tls"
+    "github.com/stretchr/testify/assert"
+    "testing"
+)
+
+func testSCRAMCredentials(h *SCRAMHash, username, password string) SCRAMCredentials {
+    keys := NewSCRAMKeys(h, password, []byte("salt"), 4096)
+    return SCRAMCredentialsFunc(func(name string, hash *SCRAMHash) (*SCRAMKeys, error) {
+        if name != username || hash != h {
+            return nil, nil
+        }
+        return keys, nil
+    })
+}
+
+func testPlainCredentials(username, password string) PlainCredentials {
+    return PlainCredentialsFunc(func(name, pass string) (bool, error) {
+        return name == username && pass == password, nil
+    })
+}
+
+// Runs both sides of an exchange against each other.
+func testExchange(server ServerExchange, client ClientExchange) (Identity, error) {
+    response, err := client.Start()
+    if err != nil {
+        return Identity{}, err
+    }
+    for {
+        challenge, done, err := server.Next(response)
+        if err != nil {
+            return Identity{}, err
+        }
+        if done {
+            if challenge != nil {
+                if _, err := client.Next(challenge); err != nil {
+                    return Identity{}, err
+                }
+            }
+            return server.Identity(), nil
+        }
+        if response, err = client.Next(challenge); err != nil {
+            return Identity{}, err
+        }
+    }
+}
+
+func Test_AuthenticatorPriority(t *testing.T) {
+    credentials := testSCRAMCredentials(SCRAMSHA1, "juliet", "r0m30")
+    authenticator := NewAuthenticator()
+    authenticator.Register(NewAnonymousServer())
+    authenticator.Register(NewPlainServer(testPlainCredentials("juliet", "r0m30")))
+    authenticator.Register(NewSCRAMServer(SCRAMSHA1, credentials))
+    authenticator.Register(NewSCRAMPlusServer(SCRAMSHA256, credentials))
+    authenticator.Register(NewSCRAMServer(SCRAMSHA256, credentials))
+
+    assert.Equal(t, []string{"SCRAM-SHA-256-PLUS", "SCRAM-SHA-256", "SCRAM-SHA-1", "PLAIN", "ANONYMOUS"},
+        authenticator.Mechanisms())
+    // Channel binding and PLAIN require TLS
+    assert.Equal(t, []string{"SCRAM-SHA-256", "SCRAM-SHA-1", "ANONYMOUS"},
+        authenticator.Offered(&Context{Domain: "example.com"}))
+
+    // Registering a mechanism again replaces it
+    authenticator.Register(NewPlainServer(testPlainCredentials("romeo", "j")))
+    assert.Equal(t, []string{"SCRAM-SHA-256-PLUS", "SCRAM-SHA-256", "SCRAM-SHA-1", "PLAIN", "ANONYMOUS"},
+        authenticator.Mechanisms())
+
+    assert.Nil(t, authenticator.Start("DIGEST-MD5", &Context{Domain: "example.com"}))
+    assert.Nil(t, authenticator.Start("SCRAM-SHA-256-PLUS", &Context{Domain: "example.com"}))
+    assert.NotNil(t, authenticator.Start("SCRAM-SHA-1", &Context{Domain: "example.com"}))
+}
+
+func Test_Select(t *testing.T) {
+    mechanisms := []ClientMechanism{
+        NewPlainClient("", "juliet", "r0m30"),
+        NewSCRAMClient(SCRAMSHA1, "", "juliet", "r0m30"),
+        NewSCRAMPlusClient(SCRAMSHA1, ChannelBindingTLSExporter, "", "juliet", "r0m30"),
+        NewSCRAMClient(SCRAMSHA256, "", "juliet", "r0m30"),
+    }
+    ctx := &Context{Domain: "example.com"}
+
+    m, _, err := Select(mechanisms, []string{"PLAIN", "SCRAM-SHA-1", "SCRAM-SHA-256"}, ctx)
+    assert.NoError(t, err)
+    assert.Equal(t, "SCRAM-SHA-256", m.Name())
+
+    // SCRAM-SHA-1-PLUS cannot be used without TLS
+    m, _, err = Select(mechanisms, []string{"SCRAM-SHA-1-PLUS", "SCRAM-SHA-1"}, ctx)
+    assert.NoError(t, err)
+    assert.Equal(t, "SCRAM-SHA-1", m.Name())
+
+    _, _, err = Select(mechanisms, []string{"SCRAM-SHA-1-PLUS", "EXTERNAL"}, ctx)
+    assert.Equal(t, SASLNoMechanismError, err)
+
+    // PLAIN cannot be used without TLS either
+    _, _, err = Select(mechanisms, []string{"PLAIN"}, ctx)
+    assert.Equal(t, SASLNoMechanismError, err)
+    m, _, err = Select(mechanisms, []string{"PLAIN"}, &Context{Domain: "example.com", TLS: &tls.ConnectionState{}})
+    assert.NoError(t, err)
+    assert.Equal(t, "PLAIN", m.Name())
+}
+
+func Test_Plain(t *testing.T) {
+    server := NewPlainServer(testPlainCredentials("juliet", "r0m30"))
+    ctx := &Context{Domain: "example.com", TLS: &tls.ConnectionState{}}
+
+    identity, err := testExchange(server.NewExchange(ctx), mustClientExchange(t, NewPlainClient("", "juliet", "r0m30"), ctx))
+    assert.NoError(t, err)
+    assert.Equal(t, Identity{Username: "juliet"}, identity)
+
+    _, err = testExchange(server.NewExchange(ctx), mustClientExchange(t, NewPlainClient("", "juliet", "wrong"), ctx))
+    assert.Equal(t, SASLNotAuthorizedError, err)
+
+    _, err = testExchange(server.NewExchange(ctx),
+        mustClientExchange(t, NewPlainClient("romeo@example.com", "juliet", "r0m30"), ctx))
+    assert.Equal(t, SASLInvalidAuthzidError, err)
+
+    // The password must not be sent in the clear
+    plaintext := &Context{Domain: "example.com"}
+    assert.True(t, server.Available(ctx))
+    assert.False(t, server.Available(plaintext))
+    _, err = NewPlainClient("", "juliet", "r0m30").NewExchange(plaintext)
+    assert.Equal(t, SASLEncryptionRequiredError, err)
+    _, _, err = server.NewExchange(plaintext).Next(encodePlain("", "juliet", "r0m30"))
+    assert.Equal(t, SASLEncryptionRequiredError, err)
+}
+
+func mustClientExchange(t *testing.T, m ClientMechanism, ctx *Context) ClientExchange {
+    exchange, err := m.NewExchange(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return exchange
+}
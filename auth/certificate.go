@@ -0,0 +1,213 @@
+package auth
+
+import (
+    "crypto/x509"
+    "encoding/asn1"
+    "errors"
+    "github.com/zonyitoo/goxmpp/basic"
+    "strings"
+)
+
+var (
+    CertificateDomainMismatchError = errors.New("Certificate is not valid for the domain")
+)
+
+var (
+    oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+    // RFC6120 Section 13.7.1.4
+    oidXmppAddr = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 8, 5}
+    // RFC4985 Section 2
+    oidSRVName = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 8, 7}
+)
+
+// The service of the SRV-IDs identifying servers (RFC6120 Section 13.7.1.2.1).
+const srvServiceServer = "_xmpp-server."
+
+// CertificateMapper maps a verified client certificate to the bare JIDs it
+// identifies. The domain is the one served by the stream and may be used to
+// complete identities that carry no domain, such as a common name.
+type CertificateMapper func(cert *x509.Certificate, domain string) []*xmpp.JID
+
+// Maps the id-on-xmppAddr subjectAltName entries of the certificate.
+func XmppAddrMapper(cert *x509.Certificate, domain string) []*xmpp.JID {
+    return parseJIDs(certificateOtherNames(cert, oidXmppAddr))
+}
+
+// Maps the rfc822Name subjectAltName entries of the certificate.
+func EmailMapper(cert *x509.Certificate, domain string) []*xmpp.JID {
+    return parseJIDs(cert.EmailAddresses)
+}
+
+// Maps the subject common name, either a bare JID or a localpart of the
+// served domain.
+func CommonNameMapper(cert *x509.Certificate, domain string) []*xmpp.JID {
+    cn := cert.Subject.CommonName
+    if cn == "" {
+        return nil
+    }
+    if !strings.Contains(cn, "@") {
+        cn += "@" + domain
+    }
+    return parseJIDs([]string{cn})
+}
+
+// Combines mappers, keeping the identities in the order of the mappers.
+func ChainMappers(mappers ...CertificateMapper) CertificateMapper {
+    return func(cert *x509.Certificate, domain string) []*xmpp.JID {
+        var jids []*xmpp.JID
+        for _, mapper := range mappers {
+            jids = append(jids, mapper(cert, domain)...)
+        }
+        return jids
+    }
+}
+
+func parseJIDs(addrs []string) []*xmpp.JID {
+    var jids []*xmpp.JID
+    for _, addr := range addrs {
+        if jid, err := xmpp.NewJIDFromString(addr); err == nil && jid.Resource == "" {
+            jids = append(jids, jid)
+        }
+    }
+    return jids
+}
+
+// RFC6120 Section 13.7.1.2 and RFC6125 Section 6
+//
+// Checks that the certificate of a server is valid for domain. The domain
+// must match one of the identifiers of the subjectAltName extension:
+//
+//  - a dNSName, where a wildcard may replace the complete leftmost label
+//    and matches exactly one label, e.g. *.example.com matches
+//    chat.example.com but neither example.com nor a.chat.example.com
+//  - an SRV-ID for the _xmpp-server service, e.g. _xmpp-server.example.com
+//  - an XmppAddr holding only the domain
+//
+// The subject common name is only considered as a dNSName if the extension
+// carries none of these identifiers. Comparison is case-insensitive.
+func VerifyDomain(cert *x509.Certificate, domain string) error {
+    domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+    if domain == "" {
+        return CertificateDomainMismatchError
+    }
+
+    srvNames := certificateOtherNames(cert, oidSRVName)
+    xmppAddrs := certificateOtherNames(cert, oidXmppAddr)
+    for _, name := range cert.DNSNames {
+        if matchDNSName(name, domain) {
+            return nil
+        }
+    }
+    for _, name := range srvNames {
+        name = strings.ToLower(name)
+        if strings.HasPrefix(name, srvServiceServer) && name[len(srvServiceServer):] == domain {
+            return nil
+        }
+    }
+    for _, addr := range xmppAddrs {
+        if strings.ToLower(addr) == domain {
+            return nil
+        }
+    }
+
+    if len(cert.DNSNames) == 0 && len(srvNames) == 0 && len(xmppAddrs) == 0 &&
+        matchDNSName(cert.Subject.CommonName, domain) {
+        return nil
+    }
+    return CertificateDomainMismatchError
+}
+
+// Verifies the certificate chain a peer presented during the TLS handshake,
+// leaf first, against roots for the given usage, and checks that the leaf is
+// valid for domain. With nil roots the system roots are used.
+func VerifyPeerDomain(certs []*x509.Certificate, roots *x509.CertPool, usage x509.ExtKeyUsage, domain string) error {
+    if len(certs) == 0 {
+        return CertificateDomainMismatchError
+    }
+    intermediates := x509.NewCertPool()
+    for _, cert := range certs[1:] {
+        intermediates.AddCert(cert)
+    }
+    _, err := certs[0].Verify(x509.VerifyOptions{
+        Roots:         roots,
+        Intermediates: intermediates,
+        KeyUsages:     []x509.ExtKeyUsage{usage},
+    })
+    if err != nil {
+        return err
+    }
+    return VerifyDomain(certs[0], domain)
+}
+
+// RFC6125 Section 6.4.3
+func matchDNSName(name, domain string) bool {
+    name = strings.ToLower(strings.TrimSuffix(name, "."))
+    if name == "" {
+        return false
+    }
+    if !strings.HasPrefix(name, "*.") {
+        return name == domain
+    }
+    dot := strings.Index(domain, ".")
+    // Wildcards directly below a top-level domain, e.g. *.com, are refused
+    if dot <= 0 || !strings.Contains(name[2:], ".") {
+        return false
+    }
+    return domain[dot+1:] == name[2:]
+}
+
+// RFC6120 Section 13.7.1.4 and RFC4985 Section 2
+//
+//    id-on-xmppAddr OBJECT IDENTIFIER ::= { id-on 5 }
+//    XmppAddr ::= UTF8String
+//
+//    id-on-dnsSRV OBJECT IDENTIFIER ::= { id-on 7 }
+//    SRVName ::= IA5String (SIZE (1..MAX))
+//
+// carried as otherNames in the subjectAltName extension. Returns the values
+// of the otherNames of the given type.
+func certificateOtherNames(cert *x509.Certificate, oid asn1.ObjectIdentifier) []string {
+    var names []string
+    for _, ext := range cert.Extensions {
+        if !ext.Id.Equal(oidSubjectAltName) {
+            continue
+        }
+        var seq asn1.RawValue
+        if rest, err := asn1.Unmarshal(ext.Value, &seq); err != nil || len(rest) != 0 || !seq.IsCompound {
+            continue
+        }
+
+        rest := seq.Bytes
+        for len(rest) > 0 {
+            var name asn1.RawValue
+            var err error
+            if rest, err = asn1.Unmarshal(rest, &name); err != nil {
+                break
+            }
+            // otherName [0] IMPLICIT SEQUENCE { type-id, [0] EXPLICIT value }
+            if name.Class != asn1.ClassContextSpecific || name.Tag != 0 {
+                continue
+            }
+            var other struct {
+                TypeId asn1.ObjectIdentifier
+                Value  asn1.RawValue
+            }
+            if _, err := asn1.UnmarshalWithParams(name.FullBytes, &other, "tag:0"); err != nil {
+                continue
+            }
+            if !other.TypeId.Equal(oid) || other.Value.Class != asn1.ClassContextSpecific || other.Value.Tag != 0 {
+                continue
+            }
+            // Raw values are not unwrapped from their explicit tag
+            var value asn1.RawValue
+            if _, err := asn1.Unmarshal(other.Value.Bytes, &value); err != nil || value.Class != asn1.ClassUniversal {
+                continue
+            }
+            switch value.Tag {
+            case asn1.TagUTF8String, asn1.TagIA5String:
+                names = append(names, string(value.Bytes))
+            }
+        }
+    }
+    return names
+}
@@ -0,0 +1,108 @@
+package auth
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/asn1"
+    "github.com/stretchr/testify/assert"
+    "testing"
+)
+
+// Encodes a subjectAltName extension holding the given otherNames, values
+// being UTF8Strings for XmppAddrs and IA5Strings for SRV-IDs.
+func testOtherNamesExtension(t *testing.T, oid asn1.ObjectIdentifier, values ...string) pkix.Extension {
+    params := "tag:0,explicit,utf8"
+    if oid.Equal(oidSRVName) {
+        params = "tag:0,explicit,ia5"
+    }
+    var names []asn1.RawValue
+    for _, value := range values {
+        encoded, err := asn1.MarshalWithParams(value, params)
+        if err != nil {
+            t.Fatal(err)
+        }
+        der, err := asn1.MarshalWithParams(struct {
+            TypeId asn1.ObjectIdentifier
+            Value  asn1.RawValue
+        }{oid, asn1.RawValue{FullBytes: encoded}}, "tag:0")
+        if err != nil {
+            t.Fatal(err)
+        }
+        names = append(names, asn1.RawValue{FullBytes: der})
+    }
+    value, err := asn1.Marshal(names)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return pkix.Extension{Id: oidSubjectAltName, Value: value}
+}
+
+func Test_VerifyDomainDNSName(t *testing.T) {
+    cert := &x509.Certificate{DNSNames: []string{"example.com", "chat.example.net"}}
+    assert.NoError(t, VerifyDomain(cert, "example.com"))
+    assert.NoError(t, VerifyDomain(cert, "EXAMPLE.com."))
+    assert.NoError(t, VerifyDomain(cert, "chat.example.net"))
+    assert.Equal(t, CertificateDomainMismatchError, VerifyDomain(cert, "example.net"))
+    assert.Equal(t, CertificateDomainMismatchError, VerifyDomain(cert, "www.example.com"))
+}
+
+// RFC6125 Section 6.4.3
+func Test_VerifyDomainWildcard(t *testing.T) {
+    cert := &x509.Certificate{DNSNames: []string{"*.example.com"}}
+    assert.NoError(t, VerifyDomain(cert, "chat.example.com"))
+    assert.Error(t, VerifyDomain(cert, "example.com"))
+    assert.Error(t, VerifyDomain(cert, "muc.chat.example.com"))
+    assert.Error(t, VerifyDomain(cert, "chat.example.net"))
+
+    // Only the complete leftmost label, and never directly below a top-level domain
+    assert.Error(t, VerifyDomain(&x509.Certificate{DNSNames: []string{"*.com"}}, "example.com"))
+    assert.Error(t, VerifyDomain(&x509.Certificate{DNSNames: []string{"chat.*.com"}}, "chat.example.com"))
+}
+
+func Test_VerifyDomainSRVName(t *testing.T) {
+    cert := &x509.Certificate{Extensions: []pkix.Extension{
+        testOtherNamesExtension(t, oidSRVName, "_xmpp-server.example.com", "_xmpp-client.example.net"),
+    }}
+    assert.NoError(t, VerifyDomain(cert, "example.com"))
+    // Only the service of servers proves a server domain
+    assert.Error(t, VerifyDomain(cert, "example.net"))
+}
+
+func Test_VerifyDomainXmppAddr(t *testing.T) {
+    cert := &x509.Certificate{Extensions: []pkix.Extension{
+        testOtherNamesExtension(t, oidXmppAddr, "example.com", "juliet@example.net"),
+    }}
+    assert.NoError(t, VerifyDomain(cert, "example.com"))
+    assert.Error(t, VerifyDomain(cert, "example.net"))
+}
+
+// RFC6125 Section 6.4.4
+func Test_VerifyDomainCommonName(t *testing.T) {
+    cert := &x509.Certificate{Subject: pkix.Name{CommonName: "example.com"}}
+    assert.NoError(t, VerifyDomain(cert, "example.com"))
+
+    // The common name is ignored once the certificate has other identifiers
+    cert.DNSNames = []string{"example.net"}
+    assert.Error(t, VerifyDomain(cert, "example.com"))
+    cert.DNSNames = nil
+    cert.Extensions = []pkix.Extension{testOtherNamesExtension(t, oidSRVName, "_xmpp-server.example.net")}
+    assert.Error(t, VerifyDomain(cert, "example.com"))
+}
+
+func Test_DomainExternalServer(t *testing.T) {
+    exchange := NewDomainExternalServer(nil).NewExchange(&Context{Domain: "example.net", From: "example.com"})
+    identity, err := testExchange(exchange, mustClientExchange(t, NewExternalClient("example.com"),
+        &Context{TLS: &tls.ConnectionState{}}))
+    assert.NoError(t, err)
+    assert.Equal(t, "example.com", identity.Domain)
+    assert.Empty(t, identity.Username)
+
+    exchange = NewDomainExternalServer(nil).NewExchange(&Context{Domain: "example.net", From: "example.com"})
+    _, err = testExchange(exchange, mustClientExchange(t, NewExternalClient("example.org"),
+        &Context{TLS: &tls.ConnectionState{}}))
+    assert.Equal(t, SASLInvalidAuthzidError, err)
+
+    // Not available without a certificate
+    assert.False(t, NewDomainExternalServer(nil).Available(&Context{From: "example.com", TLS: &tls.ConnectionState{}}))
+}
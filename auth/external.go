@@ -0,0 +1,172 @@
+package auth
+
+import (
+    "crypto/x509"
+    "github.com/zonyitoo/goxmpp/basic"
+)
+
+// RFC6120 Section 6.3.4 and XEP-0178 EXTERNAL mechanism.
+type external struct{}
+
+func (external) Name() string {
+    return "EXTERNAL"
+}
+
+func (external) Priority() int {
+    return PriorityExternal
+}
+
+// EXTERNAL mechanism, server side.
+//
+// The entity is authenticated by the client certificate it presented during
+// the TLS negotiation. The certificate must have been verified, so the TLS
+// configuration of the stream needs ClientCAs and a ClientAuth of at least
+// tls.VerifyClientCertIfGiven. The mechanism is only available if the mapper
+// finds an identity of the served domain in the certificate.
+type ExternalServer struct {
+    external
+    mapper CertificateMapper
+}
+
+func NewExternalServer(mapper CertificateMapper) *ExternalServer {
+    return &ExternalServer{mapper: mapper}
+}
+
+// The identities of the served domain in the verified client certificate.
+func (m *ExternalServer) identities(ctx *Context) []*xmpp.JID {
+    if ctx.TLS == nil || len(ctx.TLS.VerifiedChains) == 0 {
+        return nil
+    }
+    var identities []*xmpp.JID
+    for _, jid := range m.mapper(ctx.TLS.VerifiedChains[0][0], ctx.Domain) {
+        if jid.Domain == ctx.Domain && jid.Local != "" {
+            identities = append(identities, jid)
+        }
+    }
+    return identities
+}
+
+func (m *ExternalServer) Available(ctx *Context) bool {
+    return len(m.identities(ctx)) > 0
+}
+
+func (m *ExternalServer) NewExchange(ctx *Context) ServerExchange {
+    return &externalServerExchange{identities: m.identities(ctx)}
+}
+
+type externalServerExchange struct {
+    identities []*xmpp.JID
+    started    bool
+    username   string
+}
+
+func (e *externalServerExchange) Identity() Identity {
+    return Identity{Username: e.username}
+}
+
+// The response is the authorization identity. If it is empty the first
+// identity of the certificate is used, otherwise it must be one of them.
+func (e *externalServerExchange) Next(response []byte) ([]byte, bool, error) {
+    // Without an initial response the server sends an empty challenge
+    if response == nil && !e.started {
+        e.started = true
+        return []byte{}, false, nil
+    }
+
+    if len(response) == 0 {
+        e.username = e.identities[0].Local
+        return nil, true, nil
+    }
+    for _, jid := range e.identities {
+        if jid.BareJID.String() == string(response) {
+            e.username = jid.Local
+            return nil, true, nil
+        }
+    }
+    return nil, false, SASLInvalidAuthzidError
+}
+
+// EXTERNAL mechanism, client side. The client certificate is configured in
+// the TLS configuration of the stream.
+type ExternalClient struct {
+    external
+    authzid string
+}
+
+func NewExternalClient(authzid string) *ExternalClient {
+    return &ExternalClient{authzid: authzid}
+}
+
+// Fails if the stream is not encrypted.
+func (m *ExternalClient) NewExchange(ctx *Context) (ClientExchange, error) {
+    if ctx.TLS == nil {
+        return nil, SASLEncryptionRequiredError
+    }
+    return &externalClientExchange{authzid: m.authzid}, nil
+}
+
+type externalClientExchange struct {
+    authzid string
+}
+
+func (e *externalClientExchange) Start() ([]byte, error) {
+    return []byte(e.authzid), nil
+}
+
+func (e *externalClientExchange) Next(challenge []byte) ([]byte, error) {
+    return []byte(e.authzid), nil
+}
+
+func (e *externalClientExchange) Completed() bool {
+    return true
+}
+
+// XEP-0178 Section 3 EXTERNAL mechanism for streams between servers, server
+// side.
+//
+// The initiating server is authenticated as the domain it claimed in the
+// stream header if its certificate is issued by one of roots and is valid for
+// the domain, see VerifyDomain. The certificate is verified by the mechanism,
+// so the TLS configuration of the stream only needs to request it with a
+// ClientAuth of tls.RequestClientCert; peers without a valid certificate can
+// then still authenticate otherwise, e.g. with dialback.
+type DomainExternalServer struct {
+    external
+    roots *x509.CertPool
+}
+
+func NewDomainExternalServer(roots *x509.CertPool) *DomainExternalServer {
+    return &DomainExternalServer{roots: roots}
+}
+
+func (m *DomainExternalServer) Available(ctx *Context) bool {
+    if ctx.TLS == nil || len(ctx.TLS.PeerCertificates) == 0 || ctx.From == "" {
+        return false
+    }
+    return VerifyPeerDomain(ctx.TLS.PeerCertificates, m.roots, x509.ExtKeyUsageClientAuth, ctx.From) == nil
+}
+
+func (m *DomainExternalServer) NewExchange(ctx *Context) ServerExchange {
+    return &domainExternalServerExchange{domain: ctx.From}
+}
+
+type domainExternalServerExchange struct {
+    domain  string
+    started bool
+}
+
+func (e *domainExternalServerExchange) Identity() Identity {
+    return Identity{Domain: e.domain}
+}
+
+// The authorization identity is either empty or the domain of the certificate.
+func (e *domainExternalServerExchange) Next(response []byte) ([]byte, bool, error) {
+    if response == nil && !e.started {
+        e.started = true
+        return []byte{}, false, nil
+    }
+    if len(response) == 0 || string(response) == e.domain {
+        return nil, true, nil
+    }
+    return nil, false, SASLInvalidAuthzidError
+}
@@ -0,0 +1,148 @@
+package auth
+
+import (
+    "bytes"
+    "github.com/zonyitoo/goxmpp/basic"
+)
+
+// PlainCredentials verifies the password presented with the PLAIN mechanism.
+// A non-nil error reports that the backend could not be consulted.
+type PlainCredentials interface {
+    VerifyPassword(username, password string) (bool, error)
+}
+
+// Adapts an ordinary function to the PlainCredentials interface.
+type PlainCredentialsFunc func(username, password string) (bool, error)
+
+func (f PlainCredentialsFunc) VerifyPassword(username, password string) (bool, error) {
+    return f(username, password)
+}
+
+// RFC4616 PLAIN mechanism.
+//
+//    message   = [authzid] UTF8NUL authcid UTF8NUL passwd
+type plain struct{}
+
+func (plain) Name() string {
+    return "PLAIN"
+}
+
+func (plain) Priority() int {
+    return PriorityPlain
+}
+
+func encodePlain(authzid, authcid, password string) []byte {
+    return []byte(authzid + "\x00" + authcid + "\x00" + password)
+}
+
+func decodePlain(message []byte) (authzid, authcid, password string, err error) {
+    fields := bytes.Split(message, []byte{0})
+    if len(fields) != 3 || len(fields[1]) == 0 || len(fields[2]) == 0 {
+        return "", "", "", SASLMalformedRequestError
+    }
+    return string(fields[0]), string(fields[1]), string(fields[2]), nil
+}
+
+// PLAIN mechanism, server side. The password is sent in the clear, so the
+// mechanism is neither offered nor accepted on streams that are not protected
+// by TLS.
+type PlainServer struct {
+    plain
+    credentials PlainCredentials
+}
+
+func NewPlainServer(credentials PlainCredentials) *PlainServer {
+    return &PlainServer{credentials: credentials}
+}
+
+func (m *PlainServer) Available(ctx *Context) bool {
+    return ctx.TLS != nil
+}
+
+func (m *PlainServer) NewExchange(ctx *Context) ServerExchange {
+    return &plainServerExchange{
+        credentials: m.credentials,
+        domain:      ctx.Domain,
+        encrypted:   ctx.TLS != nil,
+    }
+}
+
+type plainServerExchange struct {
+    credentials PlainCredentials
+    domain      string
+    encrypted   bool
+    started     bool
+    username    string
+}
+
+func (e *plainServerExchange) Identity() Identity {
+    return Identity{Username: e.username}
+}
+
+// The authzid, if present, must be the bare JID of the authenticated account.
+func (e *plainServerExchange) Next(response []byte) ([]byte, bool, error) {
+    if !e.encrypted {
+        return nil, false, SASLEncryptionRequiredError
+    }
+    // Without an initial response the server sends an empty challenge
+    if response == nil && !e.started {
+        e.started = true
+        return []byte{}, false, nil
+    }
+
+    authzid, authcid, password, err := decodePlain(response)
+    if err != nil {
+        return nil, false, err
+    }
+    if authzid != "" && authzid != xmpp.NewJID(authcid, e.domain, "").String() {
+        return nil, false, SASLInvalidAuthzidError
+    }
+
+    if ok, err := e.credentials.VerifyPassword(authcid, password); err != nil {
+        return nil, false, SASLTemporaryAuthFailureError
+    } else if !ok {
+        return nil, false, SASLNotAuthorizedError
+    }
+    e.username = authcid
+    return nil, true, nil
+}
+
+// PLAIN mechanism, client side. Like the server, it refuses to send the
+// password on streams that are not protected by TLS.
+type PlainClient struct {
+    plain
+    authzid  string
+    authcid  string
+    password string
+}
+
+func NewPlainClient(authzid, authcid, password string) *PlainClient {
+    return &PlainClient{
+        authzid:  authzid,
+        authcid:  authcid,
+        password: password,
+    }
+}
+
+func (m *PlainClient) NewExchange(ctx *Context) (ClientExchange, error) {
+    if ctx.TLS == nil {
+        return nil, SASLEncryptionRequiredError
+    }
+    return &plainClientExchange{message: encodePlain(m.authzid, m.authcid, m.password)}, nil
+}
+
+type plainClientExchange struct {
+    message []byte
+}
+
+func (e *plainClientExchange) Start() ([]byte, error) {
+    return e.message, nil
+}
+
+func (e *plainClientExchange) Next(challenge []byte) ([]byte, error) {
+    return nil, SASLUnexpectedChallengeError
+}
+
+func (e *plainClientExchange) Completed() bool {
+    return true
+}
@@ -0,0 +1,642 @@
+package auth
+
+import (
+    "code.google.com/p/go-uuid/uuid"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha1"
+    "crypto/sha256"
+    "crypto/subtle"
+    "crypto/tls"
+    "encoding/base64"
+    "errors"
+    "github.com/zonyitoo/goxmpp/basic"
+    "hash"
+    "strconv"
+    "strings"
+)
+
+var (
+    SCRAMServerSignatureError           = errors.New("SCRAM server signature mismatch")
+    SCRAMChannelBindingError            = errors.New("Channel binding unavailable")
+    SCRAMUnsupportedChannelBindingError = errors.New("Unsupported channel binding type")
+    SCRAMIterationCountError            = errors.New("SCRAM iteration count too large")
+)
+
+// RFC5929 Section 3 and RFC9266 channel binding types.
+const (
+    ChannelBindingTLSUnique   = "tls-unique"
+    ChannelBindingTLSExporter = "tls-exporter"
+)
+
+// Channel binding types in order of preference. tls-unique is not defined
+// for TLS 1.3, where only tls-exporter is available.
+var channelBindingTypes = []string{ChannelBindingTLSExporter, ChannelBindingTLSUnique}
+
+// Returns the channel binding data of the given type for the TLS connection.
+// There is none before the handshake completed.
+func channelBindingData(state *tls.ConnectionState, binding string) ([]byte, error) {
+    if !state.HandshakeComplete {
+        return nil, SCRAMChannelBindingError
+    }
+    switch binding {
+    case ChannelBindingTLSUnique:
+        if len(state.TLSUnique) == 0 {
+            return nil, SCRAMChannelBindingError
+        }
+        return state.TLSUnique, nil
+    case ChannelBindingTLSExporter:
+        data, err := state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+        if err != nil {
+            return nil, SCRAMChannelBindingError
+        }
+        return data, nil
+    }
+    return nil, SCRAMUnsupportedChannelBindingError
+}
+
+// Whether any channel binding type is available on the TLS connection.
+func channelBindingAvailable(state *tls.ConnectionState) bool {
+    if state == nil {
+        return false
+    }
+    for _, binding := range channelBindingTypes {
+        if _, err := channelBindingData(state, binding); err == nil {
+            return true
+        }
+    }
+    return false
+}
+
+// The hash function a SCRAM mechanism is built on (RFC5802 Section 4), and
+// the priorities of the mechanisms using it.
+type SCRAMHash struct {
+    Name         string
+    New          func() hash.Hash
+    Priority     int
+    PlusPriority int
+}
+
+var (
+    SCRAMSHA1 = &SCRAMHash{
+        Name:         "SHA-1",
+        New:          sha1.New,
+        Priority:     PrioritySCRAMSHA1,
+        PlusPriority: PrioritySCRAMSHA1Plus,
+    }
+    SCRAMSHA256 = &SCRAMHash{
+        Name:         "SHA-256",
+        New:          sha256.New,
+        Priority:     PrioritySCRAMSHA256,
+        PlusPriority: PrioritySCRAMSHA256Plus,
+    }
+)
+
+// The name of the SASL mechanism, e.g. SCRAM-SHA-1.
+func (h *SCRAMHash) Mechanism() string {
+    return "SCRAM-" + h.Name
+}
+
+// The name of the SASL mechanism with channel binding, e.g. SCRAM-SHA-1-PLUS.
+func (h *SCRAMHash) PlusMechanism() string {
+    return h.Mechanism() + "-PLUS"
+}
+
+func (h *SCRAMHash) hmac(key, data []byte) []byte {
+    mac := hmac.New(h.New, key)
+    mac.Write(data)
+    return mac.Sum(nil)
+}
+
+func (h *SCRAMHash) sum(data []byte) []byte {
+    d := h.New()
+    d.Write(data)
+    return d.Sum(nil)
+}
+
+// RFC5802 Section 2.2
+//
+//    Hi(str, salt, i):
+//    U1   := HMAC(str, salt + INT(1))
+//    U2   := HMAC(str, U1)
+//    ...
+//    Hi := U1 XOR U2 XOR ... XOR Ui
+func (h *SCRAMHash) hi(password string, salt []byte, iterations int) []byte {
+    u := h.hmac([]byte(password), append(append([]byte{}, salt...), 0, 0, 0, 1))
+    result := append([]byte{}, u...)
+    for i := 1; i < iterations; i++ {
+        u = h.hmac([]byte(password), u)
+        for j := range result {
+            result[j] ^= u[j]
+        }
+    }
+    return result
+}
+
+// The salted and iterated form of a password kept by the server. The
+// plaintext password cannot be recovered from it.
+type SCRAMKeys struct {
+    Salt       []byte
+    Iterations int
+    StoredKey  []byte
+    ServerKey  []byte
+}
+
+// RFC5802 Section 3
+//
+//    SaltedPassword  := Hi(Normalize(password), salt, i)
+//    ClientKey       := HMAC(SaltedPassword, "Client Key")
+//    StoredKey       := H(ClientKey)
+//    ServerKey       := HMAC(SaltedPassword, "Server Key")
+func NewSCRAMKeys(h *SCRAMHash, password string, salt []byte, iterations int) *SCRAMKeys {
+    salted := h.hi(password, salt, iterations)
+    return &SCRAMKeys{
+        Salt:       salt,
+        Iterations: iterations,
+        StoredKey:  h.sum(h.hmac(salted, []byte("Client Key"))),
+        ServerKey:  h.hmac(salted, []byte("Server Key")),
+    }
+}
+
+// SCRAMCredentials looks up the keys of an account for the given hash. It
+// returns nil keys if the account does not exist; a non-nil error reports
+// that the backend could not be consulted.
+type SCRAMCredentials interface {
+    SCRAMKeys(username string, h *SCRAMHash) (*SCRAMKeys, error)
+}
+
+// Adapts an ordinary function to the SCRAMCredentials interface.
+type SCRAMCredentialsFunc func(username string, h *SCRAMHash) (*SCRAMKeys, error)
+
+func (f SCRAMCredentialsFunc) SCRAMKeys(username string, h *SCRAMHash) (*SCRAMKeys, error) {
+    return f(username, h)
+}
+
+// RFC5802 SCRAM mechanisms. SCRAM-PLUS variants bind the authentication to
+// the TLS channel (RFC5802 Section 6).
+type scram struct {
+    hash *SCRAMHash
+    plus bool
+}
+
+func (m *scram) Name() string {
+    if m.plus {
+        return m.hash.PlusMechanism()
+    }
+    return m.hash.Mechanism()
+}
+
+func (m *scram) Priority() int {
+    if m.plus {
+        return m.hash.PlusPriority
+    }
+    return m.hash.Priority
+}
+
+// The iteration count announced for unknown users by default.
+const SCRAMMockIterations = 4096
+
+// The largest iteration count a client accepts. Each iteration costs an HMAC,
+// so a server could otherwise keep the client busy for as long as it likes.
+const SCRAMMaxIterations = 1 << 20
+
+// SCRAM mechanism, server side.
+//
+// RFC5802 Section 5.1: unknown users get a challenge like any other, with a
+// salt derived from their name and a server secret, and fail with the proof,
+// so that the exchange does not tell which accounts exist.
+type SCRAMServer struct {
+    scram
+    credentials SCRAMCredentials
+    mockSecret  []byte
+    // Generates the server part of the nonce, random by default.
+    Nonce func() string
+    // The iteration count announced for unknown users, which should be the
+    // one of the accounts.
+    MockIterations int
+}
+
+func NewSCRAMServer(h *SCRAMHash, credentials SCRAMCredentials) *SCRAMServer {
+    secret := make([]byte, 32)
+    rand.Read(secret)
+    return &SCRAMServer{
+        scram:          scram{hash: h},
+        credentials:    credentials,
+        mockSecret:     secret,
+        Nonce:          uuid.New,
+        MockIterations: SCRAMMockIterations,
+    }
+}
+
+// The salt and iteration count announced for an unknown user, which are the
+// same in every exchange.
+func (m *SCRAMServer) mockKeys(username string) *SCRAMKeys {
+    mac := hmac.New(sha256.New, m.mockSecret)
+    mac.Write([]byte(username))
+    return &SCRAMKeys{
+        Salt:       mac.Sum(nil)[:16],
+        Iterations: m.MockIterations,
+    }
+}
+
+// SCRAM-PLUS mechanism, server side. It is only available on TLS streams for
+// which tls-exporter or tls-unique data can be obtained, and not when TLS is
+// provided by the transport.
+func NewSCRAMPlusServer(h *SCRAMHash, credentials SCRAMCredentials) *SCRAMServer {
+    m := NewSCRAMServer(h, credentials)
+    m.plus = true
+    return m
+}
+
+func (m *SCRAMServer) Available(ctx *Context) bool {
+    return !m.plus || !ctx.TransportTLS && channelBindingAvailable(ctx.TLS)
+}
+
+func (m *SCRAMServer) NewExchange(ctx *Context) ServerExchange {
+    e := &scramServerExchange{
+        hash:        m.hash,
+        credentials: m.credentials,
+        domain:      ctx.Domain,
+        newNonce:    m.Nonce,
+        mockKeys:    m.mockKeys,
+    }
+    if m.plus {
+        e.state = ctx.TLS
+    } else {
+        e.plusOffered = ctx.Offers(m.hash.PlusMechanism())
+    }
+    return e
+}
+
+type scramServerExchange struct {
+    hash        *SCRAMHash
+    credentials SCRAMCredentials
+    domain      string
+    newNonce    func() string
+    mockKeys    func(username string) *SCRAMKeys
+    // Set for -PLUS mechanisms
+    state *tls.ConnectionState
+    // Whether the -PLUS variant is offered on the stream, for non-PLUS mechanisms
+    plusOffered bool
+
+    username        string
+    gs2Header       string
+    clientFirstBare string
+    serverFirst     string
+    nonce           string
+    channelBinding  []byte
+    keys            *SCRAMKeys
+    // Whether the account does not exist and keys are mock ones
+    unknown         bool
+}
+
+func (e *scramServerExchange) Identity() Identity {
+    return Identity{Username: e.username}
+}
+
+func (e *scramServerExchange) Next(response []byte) ([]byte, bool, error) {
+    if e.serverFirst == "" {
+        // No initial response, ask for the client-first-message
+        if len(response) == 0 {
+            return []byte{}, false, nil
+        }
+        challenge, err := e.clientFirst(string(response))
+        return challenge, false, err
+    }
+    signature, err := e.clientFinal(string(response))
+    return signature, err == nil, err
+}
+
+// RFC5802 Section 7
+//
+//    client-first-message = gs2-header client-first-message-bare
+//    gs2-header           = gs2-cbind-flag "," [ authzid ] ","
+//    client-first-message-bare = [reserved-mext ","] username "," nonce ["," extensions]
+func (e *scramServerExchange) clientFirst(msg string) ([]byte, error) {
+    parts := strings.SplitN(msg, ",", 3)
+    if len(parts) != 3 {
+        return nil, SASLMalformedRequestError
+    }
+
+    // RFC5802 Section 6
+    //
+    // "y" means that the client supports channel binding but thinks the
+    // server does not. If the server offered a -PLUS mechanism, the
+    // advertisement has been tampered with.
+    var cbData []byte
+    switch {
+    case parts[0] == "n":
+        if e.state != nil {
+            return nil, SASLMalformedRequestError
+        }
+    case parts[0] == "y":
+        if e.state != nil {
+            return nil, SASLMalformedRequestError
+        }
+        if e.plusOffered {
+            return nil, SASLNotAuthorizedError
+        }
+    case strings.HasPrefix(parts[0], "p="):
+        if e.state == nil {
+            return nil, SASLMalformedRequestError
+        }
+        var err error
+        if cbData, err = channelBindingData(e.state, parts[0][2:]); err != nil {
+            return nil, SASLNotAuthorizedError
+        }
+    default:
+        return nil, SASLMalformedRequestError
+    }
+    authzid := ""
+    if parts[1] != "" {
+        if !strings.HasPrefix(parts[1], "a=") {
+            return nil, SASLMalformedRequestError
+        }
+        var err error
+        if authzid, err = scramUnescape(parts[1][2:]); err != nil {
+            return nil, err
+        }
+    }
+
+    attrs, err := scramAttributes(parts[2])
+    if err != nil {
+        return nil, err
+    }
+    if len(attrs) < 2 || attrs[0].key != 'n' || attrs[1].key != 'r' || attrs[1].value == "" {
+        return nil, SASLMalformedRequestError
+    }
+    username, err := scramUnescape(attrs[0].value)
+    if err != nil || username == "" {
+        return nil, SASLMalformedRequestError
+    }
+    if authzid != "" && authzid != xmpp.NewJID(username, e.domain, "").String() {
+        return nil, SASLInvalidAuthzidError
+    }
+
+    keys, err := e.credentials.SCRAMKeys(username, e.hash)
+    if err != nil {
+        return nil, SASLTemporaryAuthFailureError
+    }
+    if keys == nil {
+        keys = e.mockKeys(username)
+        e.unknown = true
+    }
+
+    e.username = username
+    e.keys = keys
+    e.gs2Header = parts[0] + "," + parts[1] + ","
+    e.channelBinding = cbData
+    e.clientFirstBare = parts[2]
+    e.nonce = attrs[1].value + e.newNonce()
+    e.serverFirst = "r=" + e.nonce +
+        ",s=" + base64.StdEncoding.EncodeToString(keys.Salt) +
+        ",i=" + strconv.Itoa(keys.Iterations)
+    return []byte(e.serverFirst), nil
+}
+
+// RFC5802 Section 7
+//
+//    client-final-message-without-proof = channel-binding "," nonce ["," extensions]
+//    client-final-message = client-final-message-without-proof "," proof
+func (e *scramServerExchange) clientFinal(msg string) ([]byte, error) {
+    idx := strings.LastIndex(msg, ",p=")
+    if idx < 0 {
+        return nil, SASLMalformedRequestError
+    }
+    withoutProof := msg[:idx]
+    proof, err := base64.StdEncoding.DecodeString(msg[idx+3:])
+    if err != nil {
+        return nil, SASLIncorrectEncodingError
+    }
+
+    attrs, err := scramAttributes(withoutProof)
+    if err != nil {
+        return nil, err
+    }
+    if len(attrs) < 2 || attrs[0].key != 'c' || attrs[1].key != 'r' {
+        return nil, SASLMalformedRequestError
+    }
+    if attrs[0].value != scramChannelBinding(e.gs2Header, e.channelBinding) {
+        return nil, SASLNotAuthorizedError
+    }
+    if attrs[1].value != e.nonce {
+        return nil, SASLNotAuthorizedError
+    }
+
+    //    AuthMessage     := client-first-message-bare + "," +
+    //                       server-first-message + "," +
+    //                       client-final-message-without-proof
+    //    ClientSignature := HMAC(StoredKey, AuthMessage)
+    //    ClientKey       := ClientProof XOR ClientSignature
+    //    ServerSignature := HMAC(ServerKey, AuthMessage)
+    authMessage := scramAuthMessage(e.clientFirstBare, e.serverFirst, withoutProof)
+    signature := e.hash.hmac(e.keys.StoredKey, authMessage)
+    if e.unknown || len(proof) != len(signature) {
+        return nil, SASLNotAuthorizedError
+    }
+    clientKey := make([]byte, len(proof))
+    for i := range proof {
+        clientKey[i] = proof[i] ^ signature[i]
+    }
+    if subtle.ConstantTimeCompare(e.hash.sum(clientKey), e.keys.StoredKey) != 1 {
+        return nil, SASLNotAuthorizedError
+    }
+
+    serverSignature := e.hash.hmac(e.keys.ServerKey, authMessage)
+    return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
+
+//    AuthMessage := client-first-message-bare + "," +
+//                   server-first-message + "," +
+//                   client-final-message-without-proof
+func scramAuthMessage(clientFirstBare, serverFirst, clientFinalWithoutProof string) []byte {
+    return []byte(clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof)
+}
+
+// The value of the c attribute: the GS2 header followed by the channel
+// binding data, if any.
+func scramChannelBinding(gs2Header string, data []byte) string {
+    return base64.StdEncoding.EncodeToString(append([]byte(gs2Header), data...))
+}
+
+type scramAttribute struct {
+    key   byte
+    value string
+}
+
+// Splits a SCRAM message into its attribute-value pairs, keeping their order.
+func scramAttributes(msg string) ([]scramAttribute, error) {
+    var attrs []scramAttribute
+    for _, part := range strings.Split(msg, ",") {
+        if len(part) < 2 || part[1] != '=' {
+            return nil, SASLMalformedRequestError
+        }
+        attrs = append(attrs, scramAttribute{key: part[0], value: part[2:]})
+    }
+    return attrs, nil
+}
+
+// RFC5802 Section 5.1: "," and "=" in names are encoded as "=2C" and "=3D".
+func scramUnescape(name string) (string, error) {
+    if !strings.Contains(name, "=") {
+        return name, nil
+    }
+    var out strings.Builder
+    for i := 0; i < len(name); i++ {
+        if name[i] != '=' {
+            out.WriteByte(name[i])
+            continue
+        }
+        switch {
+        case strings.HasPrefix(name[i:], "=2C"):
+            out.WriteByte(',')
+        case strings.HasPrefix(name[i:], "=3D"):
+            out.WriteByte('=')
+        default:
+            return "", SASLMalformedRequestError
+        }
+        i += 2
+    }
+    return out.String(), nil
+}
+
+func scramEscape(name string) string {
+    return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(name)
+}
+
+// SCRAM mechanism, client side.
+type SCRAMClient struct {
+    scram
+    // Channel binding type, empty for mechanisms without -PLUS
+    binding  string
+    authzid  string
+    authcid  string
+    password string
+    // Generates the client nonce, random by default.
+    Nonce func() string
+}
+
+func NewSCRAMClient(h *SCRAMHash, authzid, authcid, password string) *SCRAMClient {
+    return &SCRAMClient{
+        scram:    scram{hash: h},
+        authzid:  authzid,
+        authcid:  authcid,
+        password: password,
+        Nonce:    uuid.New,
+    }
+}
+
+// SCRAM-PLUS mechanism, client side, binding to the TLS channel with the
+// given channel binding type.
+func NewSCRAMPlusClient(h *SCRAMHash, binding, authzid, authcid, password string) *SCRAMClient {
+    m := NewSCRAMClient(h, authzid, authcid, password)
+    m.plus = true
+    m.binding = binding
+    return m
+}
+
+// Fails for -PLUS mechanisms if the stream is not encrypted or the channel
+// binding type is not available. Without -PLUS, the client tells the server
+// that it could have bound to the channel if no -PLUS mechanism was offered
+// (RFC5802 Section 6), so that a stripped offer is detected.
+func (m *SCRAMClient) NewExchange(ctx *Context) (ClientExchange, error) {
+    e := &scramClientExchange{
+        hash:     m.hash,
+        password: m.password,
+    }
+    flag := "n"
+    if !m.plus && !ctx.TransportTLS && channelBindingAvailable(ctx.TLS) && !ctx.Offers(m.hash.PlusMechanism()) {
+        flag = "y"
+    }
+    if m.plus {
+        if ctx.TLS == nil {
+            return nil, SCRAMChannelBindingError
+        }
+        data, err := channelBindingData(ctx.TLS, m.binding)
+        if err != nil {
+            return nil, err
+        }
+        e.channelBinding = data
+        flag = "p=" + m.binding
+    }
+    e.gs2Header = flag + ",,"
+    if m.authzid != "" {
+        e.gs2Header = flag + ",a=" + scramEscape(m.authzid) + ","
+    }
+    e.clientNonce = m.Nonce()
+    e.clientFirstBare = "n=" + scramEscape(m.authcid) + ",r=" + e.clientNonce
+    return e, nil
+}
+
+type scramClientExchange struct {
+    hash            *SCRAMHash
+    password        string
+    gs2Header       string
+    channelBinding  []byte
+    clientFirstBare string
+    clientNonce     string
+    serverSignature []byte
+    verified        bool
+}
+
+func (e *scramClientExchange) Start() ([]byte, error) {
+    return []byte(e.gs2Header + e.clientFirstBare), nil
+}
+
+// Answers the server-first-message with the proof, then verifies the server
+// signature sent with the server-final-message.
+func (e *scramClientExchange) Next(challenge []byte) ([]byte, error) {
+    if e.serverSignature != nil {
+        attrs, err := scramAttributes(string(challenge))
+        if err != nil || len(attrs) < 1 || attrs[0].key != 'v' {
+            return nil, SASLUnexpectedChallengeError
+        }
+        signature, err := base64.StdEncoding.DecodeString(attrs[0].value)
+        if err != nil || !hmac.Equal(signature, e.serverSignature) {
+            return nil, SCRAMServerSignatureError
+        }
+        e.verified = true
+        return []byte{}, nil
+    }
+
+    serverFirst := string(challenge)
+    attrs, err := scramAttributes(serverFirst)
+    if err != nil || len(attrs) < 3 || attrs[0].key != 'r' || attrs[1].key != 's' || attrs[2].key != 'i' {
+        return nil, SASLUnexpectedChallengeError
+    }
+    nonce := attrs[0].value
+    if !strings.HasPrefix(nonce, e.clientNonce) || nonce == e.clientNonce {
+        return nil, SASLUnexpectedChallengeError
+    }
+    salt, err := base64.StdEncoding.DecodeString(attrs[1].value)
+    if err != nil {
+        return nil, SASLUnexpectedChallengeError
+    }
+    iterations, err := strconv.Atoi(attrs[2].value)
+    if err != nil || iterations < 1 {
+        return nil, SASLUnexpectedChallengeError
+    }
+    if iterations > SCRAMMaxIterations {
+        return nil, SCRAMIterationCountError
+    }
+
+    salted := e.hash.hi(e.password, salt, iterations)
+    clientKey := e.hash.hmac(salted, []byte("Client Key"))
+    storedKey := e.hash.sum(clientKey)
+    serverKey := e.hash.hmac(salted, []byte("Server Key"))
+
+    withoutProof := "c=" + scramChannelBinding(e.gs2Header, e.channelBinding) + ",r=" + nonce
+    authMessage := scramAuthMessage(e.clientFirstBare, serverFirst, withoutProof)
+    signature := e.hash.hmac(storedKey, authMessage)
+    proof := make([]byte, len(clientKey))
+    for i := range clientKey {
+        proof[i] = clientKey[i] ^ signature[i]
+    }
+    e.serverSignature = e.hash.hmac(serverKey, authMessage)
+    return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// RFC5802 Section 5: the server is authenticated by its signature.
+func (e *scramClientExchange) Completed() bool {
+    return e.verified
+}
@@ -0,0 +1,209 @@
+package auth
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "github.com/stretchr/testify/assert"
+    "math/big"
+    "net"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+// Returns the states of both ends of a completed TLS handshake.
+func testTLSStates(t *testing.T) (*tls.ConnectionState, *tls.ConnectionState) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        Subject:      pkix.Name{CommonName: "example.com"},
+        DNSNames:     []string{"example.com"},
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(time.Hour),
+        KeyUsage:     x509.KeyUsageDigitalSignature,
+        ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    cconn, sconn := net.Pipe()
+    defer cconn.Close()
+    defer sconn.Close()
+    server := tls.Server(sconn, &tls.Config{
+        Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+    })
+    client := tls.Client(cconn, &tls.Config{InsecureSkipVerify: true})
+    done := make(chan error, 1)
+    go func() {
+        done <- server.Handshake()
+    }()
+    if err := client.Handshake(); err != nil {
+        t.Fatal(err)
+    }
+    if err := <-done; err != nil {
+        t.Fatal(err)
+    }
+    clientState, serverState := client.ConnectionState(), server.ConnectionState()
+    return &clientState, &serverState
+}
+
+func Test_SCRAM(t *testing.T) {
+    for _, h := range []*SCRAMHash{SCRAMSHA1, SCRAMSHA256} {
+        server := NewSCRAMServer(h, testSCRAMCredentials(h, "juliet", "r0m30"))
+        ctx := &Context{Domain: "example.com", Offered: []string{h.Mechanism()}}
+
+        identity, err := testExchange(server.NewExchange(ctx),
+            mustClientExchange(t, NewSCRAMClient(h, "", "juliet", "r0m30"), ctx))
+        assert.NoError(t, err)
+        assert.Equal(t, Identity{Username: "juliet"}, identity)
+
+        _, err = testExchange(server.NewExchange(ctx),
+            mustClientExchange(t, NewSCRAMClient(h, "", "juliet", "tybalt"), ctx))
+        assert.Equal(t, SASLNotAuthorizedError, err)
+
+        _, err = testExchange(server.NewExchange(ctx),
+            mustClientExchange(t, NewSCRAMClient(h, "", "romeo", "r0m30"), ctx))
+        assert.Equal(t, SASLNotAuthorizedError, err)
+    }
+}
+
+// RFC5802 Section 5.1: names are escaped in the exchange
+func Test_SCRAMEscape(t *testing.T) {
+    server := NewSCRAMServer(SCRAMSHA1, testSCRAMCredentials(SCRAMSHA1, "a,b=c", "r0m30"))
+    ctx := &Context{Domain: "example.com"}
+
+    identity, err := testExchange(server.NewExchange(ctx),
+        mustClientExchange(t, NewSCRAMClient(SCRAMSHA1, "", "a,b=c", "r0m30"), ctx))
+    assert.NoError(t, err)
+    assert.Equal(t, "a,b=c", identity.Username)
+}
+
+// A client that supports channel binding but was not offered a -PLUS
+// mechanism sends the "y" flag. If the server did offer one, the
+// advertisement was tampered with.
+func Test_SCRAMDowngrade(t *testing.T) {
+    server := NewSCRAMServer(SCRAMSHA1, testSCRAMCredentials(SCRAMSHA1, "juliet", "r0m30"))
+    client := NewSCRAMClient(SCRAMSHA1, "", "juliet", "r0m30")
+    downgrade := func(ctx *Context) ClientExchange {
+        exchange := mustClientExchange(t, client, ctx).(*scramClientExchange)
+        exchange.gs2Header = "y,,"
+        return exchange
+    }
+
+    ctx := &Context{Domain: "example.com", Offered: []string{"SCRAM-SHA-1-PLUS", "SCRAM-SHA-1"}}
+    _, err := testExchange(server.NewExchange(ctx), downgrade(ctx))
+    assert.Equal(t, SASLNotAuthorizedError, err)
+
+    ctx = &Context{Domain: "example.com", Offered: []string{"SCRAM-SHA-1"}}
+    _, err = testExchange(server.NewExchange(ctx), downgrade(ctx))
+    assert.NoError(t, err)
+}
+
+// RFC5802 Section 6: a client that could bind to the channel but was not
+// offered a -PLUS mechanism sends "y", so that a stripped offer is detected.
+func Test_SCRAMChannelBindingFlag(t *testing.T) {
+    server := NewSCRAMServer(SCRAMSHA1, testSCRAMCredentials(SCRAMSHA1, "juliet", "r0m30"))
+    client := NewSCRAMClient(SCRAMSHA1, "", "juliet", "r0m30")
+    clientState, serverState := testTLSStates(t)
+
+    ctx := &Context{Domain: "example.com", TLS: clientState, Offered: []string{"SCRAM-SHA-1"}}
+    first, err := mustClientExchange(t, client, ctx).Start()
+    assert.NoError(t, err)
+    assert.True(t, strings.HasPrefix(string(first), "y,,"))
+
+    // -PLUS was hidden from the offer the client saw
+    sctx := &Context{Domain: "example.com", TLS: serverState, Offered: []string{"SCRAM-SHA-1-PLUS", "SCRAM-SHA-1"}}
+    _, err = testExchange(server.NewExchange(sctx), mustClientExchange(t, client, ctx))
+    assert.Equal(t, SASLNotAuthorizedError, err)
+
+    sctx = &Context{Domain: "example.com", TLS: serverState, Offered: []string{"SCRAM-SHA-1"}}
+    identity, err := testExchange(server.NewExchange(sctx), mustClientExchange(t, client, ctx))
+    assert.NoError(t, err)
+    assert.Equal(t, "juliet", identity.Username)
+
+    // A client offered -PLUS that picks the plain mechanism does not claim
+    // support, and neither does one on a stream whose TLS is the transport's
+    for _, ctx := range []*Context{
+        {Domain: "example.com", TLS: clientState, Offered: []string{"SCRAM-SHA-1-PLUS", "SCRAM-SHA-1"}},
+        {Domain: "example.com", TLS: clientState, TransportTLS: true, Offered: []string{"SCRAM-SHA-1"}},
+        {Domain: "example.com", Offered: []string{"SCRAM-SHA-1"}},
+    } {
+        first, err := mustClientExchange(t, client, ctx).Start()
+        assert.NoError(t, err)
+        assert.True(t, strings.HasPrefix(string(first), "n,,"))
+    }
+}
+
+// The client refuses to spend unbounded work on the server's iteration count
+func Test_SCRAMIterationCount(t *testing.T) {
+    ctx := &Context{Domain: "example.com"}
+    for _, iterations := range []int{SCRAMMaxIterations + 1, 1<<31 - 1} {
+        server := NewSCRAMServer(SCRAMSHA1, testSCRAMCredentials(SCRAMSHA1, "juliet", "r0m30"))
+        server.MockIterations = iterations
+        client := mustClientExchange(t, NewSCRAMClient(SCRAMSHA1, "", "romeo", "r0m30"), ctx)
+
+        first, _ := client.Start()
+        challenge, _, err := server.NewExchange(ctx).Next(first)
+        assert.NoError(t, err)
+        assert.Contains(t, string(challenge), ",i="+strconv.Itoa(iterations))
+        _, err = client.Next(challenge)
+        assert.Equal(t, SCRAMIterationCountError, err)
+    }
+}
+
+// The client verifies the server signature sent with success
+func Test_SCRAMServerSignature(t *testing.T) {
+    server := NewSCRAMServer(SCRAMSHA1, testSCRAMCredentials(SCRAMSHA1, "juliet", "r0m30"))
+    ctx := &Context{Domain: "example.com"}
+    exchange := server.NewExchange(ctx)
+    client := mustClientExchange(t, NewSCRAMClient(SCRAMSHA1, "", "juliet", "r0m30"), ctx)
+
+    first, _ := client.Start()
+    challenge, _, err := exchange.Next(first)
+    assert.NoError(t, err)
+    final, err := client.Next(challenge)
+    assert.NoError(t, err)
+    verifier, done, err := exchange.Next(final)
+    assert.True(t, done)
+    assert.NoError(t, err)
+
+    _, err = client.Next([]byte("v=dGFtcGVyZWQ="))
+    assert.Equal(t, SCRAMServerSignatureError, err)
+    assert.False(t, client.Completed())
+
+    _, err = client.Next(verifier)
+    assert.NoError(t, err)
+    assert.True(t, client.Completed())
+}
+
+// RFC5802 Section 5.1: unknown users are told apart only by the proof
+func Test_SCRAMUnknownUser(t *testing.T) {
+    server := NewSCRAMServer(SCRAMSHA1, testSCRAMCredentials(SCRAMSHA1, "juliet", "r0m30"))
+    ctx := &Context{Domain: "example.com"}
+    serverFirst := func(username string) string {
+        challenge, done, err := server.NewExchange(ctx).Next([]byte("n,,n=" + username + ",r=abcd"))
+        assert.NoError(t, err)
+        assert.False(t, done)
+        // Without the nonce
+        return string(challenge)[strings.Index(string(challenge), ",s="):]
+    }
+
+    romeo := serverFirst("romeo")
+    assert.Equal(t, romeo, serverFirst("romeo"))
+    assert.NotEqual(t, romeo, serverFirst("tybalt"))
+    assert.True(t, strings.HasSuffix(romeo, ",i=4096"))
+
+    _, err := testExchange(server.NewExchange(ctx),
+        mustClientExchange(t, NewSCRAMClient(SCRAMSHA1, "", "romeo", "r0m30"), ctx))
+    assert.Equal(t, SASLNotAuthorizedError, err)
+}
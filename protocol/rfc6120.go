@@ -17,8 +17,15 @@ const (
 )
 
 const (
-    XMPP_DNS_SRV_CLIENT = "xmpp-client"
-    XMPP_DNS_SRV_SERVER = "xmpp-server"
+    XMPP_DNS_SRV_CLIENT     = "xmpp-client"
+    XMPP_DNS_SRV_SERVER     = "xmpp-server"
+    XMPP_DNS_SRV_CLIENT_TLS = "xmpps-client" // XEP-0368
+)
+
+// XEP-0368 Section 4
+const (
+    XMPP_ALPN_CLIENT = "xmpp-client"
+    XMPP_ALPN_SERVER = "xmpp-server"
 )
 
 type StreamTag xml.Name
@@ -36,6 +43,7 @@ var (
     TAG_SASL_RESPONSE          xml.Name = xml.Name{Space: XMLNS_XMPP_SASL, Local: "response"}
     TAG_SASL_SUCCESS           xml.Name = xml.Name{Space: XMLNS_XMPP_SASL, Local: "success"}
     TAG_SASL_FAILURE           xml.Name = xml.Name{Space: XMLNS_XMPP_SASL, Local: "failure"}
+    TAG_SASL_ABORT             xml.Name = xml.Name{Space: XMLNS_XMPP_SASL, Local: "abort"}
     TAG_STANZA_IQ_CLIENT       xml.Name = xml.Name{Space: XMLNS_JABBER_CLIENT, Local: "iq"}
     TAG_STANZA_IQ_SERVER       xml.Name = xml.Name{Space: XMLNS_JABBER_SERVER, Local: "iq"}
     TAG_STANZA_PRESENCE_CLIENT xml.Name = xml.Name{Space: XMLNS_JABBER_CLIENT, Local: "presence"}
@@ -45,9 +53,25 @@ var (
 
     // Extensions
     // XEP-0138
-    TAG_STREAM_COMPRESSION_COMPRESS   xml.Name = xml.Name{Space: XMLNS_STREAM_FEATURE_COMPRESSION, Local: "compress"}
-    TAG_STREAM_COMPRESSION_FAILURE    xml.Name = xml.Name{Space: XMLNS_STREAM_FEATURE_COMPRESSION, Local: "failure"}
-    TAG_STREAM_COMPRESSION_COMPRESSED xml.Name = xml.Name{Space: XMLNS_STREAM_FEATURE_COMPRESSION, Local: "compressed"}
+    TAG_STREAM_COMPRESSION_COMPRESS   xml.Name = xml.Name{Space: XMLNS_PROTOCOL_COMPRESSION, Local: "compress"}
+    TAG_STREAM_COMPRESSION_FAILURE    xml.Name = xml.Name{Space: XMLNS_PROTOCOL_COMPRESSION, Local: "failure"}
+    TAG_STREAM_COMPRESSION_COMPRESSED xml.Name = xml.Name{Space: XMLNS_PROTOCOL_COMPRESSION, Local: "compressed"}
+    // XEP-0198
+    TAG_SM_ENABLE  xml.Name = xml.Name{Space: XMLNS_SM3, Local: "enable"}
+    TAG_SM_ENABLED xml.Name = xml.Name{Space: XMLNS_SM3, Local: "enabled"}
+    TAG_SM_REQUEST xml.Name = xml.Name{Space: XMLNS_SM3, Local: "r"}
+    TAG_SM_ANSWER  xml.Name = xml.Name{Space: XMLNS_SM3, Local: "a"}
+    TAG_SM_RESUME  xml.Name = xml.Name{Space: XMLNS_SM3, Local: "resume"}
+    TAG_SM_RESUMED xml.Name = xml.Name{Space: XMLNS_SM3, Local: "resumed"}
+    TAG_SM_FAILED  xml.Name = xml.Name{Space: XMLNS_SM3, Local: "failed"}
+    // XEP-0220
+    TAG_DIALBACK_RESULT xml.Name = xml.Name{Space: XMLNS_JABBER_SERVER_DIALBACK, Local: "result"}
+    TAG_DIALBACK_VERIFY xml.Name = xml.Name{Space: XMLNS_JABBER_SERVER_DIALBACK, Local: "verify"}
+    // XEP-0114
+    TAG_COMPONENT_HANDSHAKE       xml.Name = xml.Name{Space: XMLNS_COMPONENT_ACCEPT, Local: "handshake"}
+    TAG_STANZA_IQ_COMPONENT       xml.Name = xml.Name{Space: XMLNS_COMPONENT_ACCEPT, Local: "iq"}
+    TAG_STANZA_PRESENCE_COMPONENT xml.Name = xml.Name{Space: XMLNS_COMPONENT_ACCEPT, Local: "presence"}
+    TAG_STANZA_MESSAGE_COMPONENT  xml.Name = xml.Name{Space: XMLNS_COMPONENT_ACCEPT, Local: "message"}
 )
 
 var TAG_MAP map[xml.Name]reflect.Type = map[xml.Name]reflect.Type{
@@ -62,6 +86,7 @@ var TAG_MAP map[xml.Name]reflect.Type = map[xml.Name]reflect.Type{
     TAG_SASL_SUCCESS:           reflect.TypeOf(XMPPSASLSuccess{}),
     TAG_SASL_RESPONSE:          reflect.TypeOf(XMPPSASLResponse{}),
     TAG_SASL_FAILURE:           reflect.TypeOf(XMPPSASLFailure{}),
+    TAG_SASL_ABORT:             reflect.TypeOf(XMPPSASLAbort{}),
     TAG_STANZA_IQ_CLIENT:       reflect.TypeOf(XMPPStanzaIQ{}),
     TAG_STANZA_IQ_SERVER:       reflect.TypeOf(XMPPStanzaIQ{}),
     TAG_STANZA_PRESENCE_CLIENT: reflect.TypeOf(XMPPStanzaPresence{}),
@@ -74,6 +99,22 @@ var TAG_MAP map[xml.Name]reflect.Type = map[xml.Name]reflect.Type{
     TAG_STREAM_COMPRESSION_COMPRESS:   reflect.TypeOf(XMPPStreamCompressionCompress{}),
     TAG_STREAM_COMPRESSION_FAILURE:    reflect.TypeOf(XMPPStreamCompressionFailure{}),
     TAG_STREAM_COMPRESSION_COMPRESSED: reflect.TypeOf(XMPPStreamCompressionCompressed{}),
+    // XEP-0198
+    TAG_SM_ENABLE:  reflect.TypeOf(XMPPSMEnable{}),
+    TAG_SM_ENABLED: reflect.TypeOf(XMPPSMEnabled{}),
+    TAG_SM_REQUEST: reflect.TypeOf(XMPPSMRequest{}),
+    TAG_SM_ANSWER:  reflect.TypeOf(XMPPSMAnswer{}),
+    TAG_SM_RESUME:  reflect.TypeOf(XMPPSMResume{}),
+    TAG_SM_RESUMED: reflect.TypeOf(XMPPSMResumed{}),
+    TAG_SM_FAILED:  reflect.TypeOf(XMPPSMFailed{}),
+    // XEP-0220
+    TAG_DIALBACK_RESULT: reflect.TypeOf(XMPPDialbackResult{}),
+    TAG_DIALBACK_VERIFY: reflect.TypeOf(XMPPDialbackVerify{}),
+    // XEP-0114
+    TAG_COMPONENT_HANDSHAKE:       reflect.TypeOf(XMPPComponentHandshake{}),
+    TAG_STANZA_IQ_COMPONENT:       reflect.TypeOf(XMPPStanzaIQ{}),
+    TAG_STANZA_PRESENCE_COMPONENT: reflect.TypeOf(XMPPStanzaPresence{}),
+    TAG_STANZA_MESSAGE_COMPONENT:  reflect.TypeOf(XMPPStanzaMessage{}),
 }
 
 // RFC6120 Section 4
@@ -100,6 +141,8 @@ type XMPPStreamFeatures struct {
     // Extensions
     Register    *XMPPStreamFeatureRegister    `xml:",omitempty"` // XEP-0077
     Compression *XMPPStreamFeatureCompression `xml:",omitempty"` // XEP-0138
+    SM          *XMPPStreamFeatureSM          `xml:",omitempty"` // XEP-0198
+    Dialback    *XMPPStreamFeatureDialback    `xml:",omitempty"` // XEP-0220
 }
 
 type XMPPRequired struct {
@@ -850,13 +893,13 @@ type XMPPStanzaErrorDescriptiveText struct {
 type XMPPStanzaError struct {
     XMLName xml.Name                        `xml:"error"`
     Type    string                          `xml:"type,attr"`
-    Code    int                             `xml:"code,attr"` // Defined in XEP-0086, which is already deprecated!
+    Code    int                             `xml:"code,attr,omitempty"` // Defined in XEP-0086, which is already deprecated!
     By      string                          `xml:"by,attr,omitempty"`
     Text    *XMPPStanzaErrorDescriptiveText `xml:",omitempty"`
 
     XMPPStanzaErrorGroup
 
-    ApplicationSpecificConditions string `xml:",any,innerxml,omitempty"`
+    ApplicationSpecificConditions []XMPPCustom `xml:",any,omitempty"`
 }
 
 type XMPPStanzaErrorGroup struct {
@@ -1128,7 +1171,7 @@ type XMPPStanzaErrorSubscriptionRequired struct {
 type XMPPStanzaErrorUndefinedCondition struct {
     XMLName xml.Name                        `xml:"urn:ietf:params:xml:ns:xmpp-stanzas undefined-condition"`
     Text    *XMPPStanzaErrorDescriptiveText `xml:",omitempty"`
-    Error   string                          `xml:",innerxml,omitempty"`
+    Error   string                          `xml:",innerxml"`
 }
 
 // RFC6120 Section 8.3.3.22
@@ -1139,7 +1182,7 @@ type XMPPStanzaErrorUndefinedCondition struct {
 type XMPPStanzaErrorUnexpectedRequest struct {
     XMLName xml.Name                        `xml:"urn:ietf:params:xml:ns:xmpp-stanzas unexpected-request"`
     Text    *XMPPStanzaErrorDescriptiveText `xml:",omitempty"`
-    Error   string                          `xml:",innerxml,omitempty"`
+    Error   string                          `xml:",innerxml"`
 }
 
 type XMPPCustom struct {
@@ -1149,8 +1192,22 @@ type XMPPCustom struct {
 
 const stream_response_begin_fmt = `<stream:stream from='%s' to='%s' version='%s' xml:lang='%s' id='%s' xmlns='%s' xmlns:stream='%s'>`
 
+// Server-to-server streams also declare the dialback namespace (XEP-0220 Section 2.1)
+const stream_server_begin_fmt = `<stream:stream from='%s' to='%s' version='%s' xml:lang='%s' id='%s' xmlns='%s' xmlns:stream='%s' xmlns:db='` +
+    XMLNS_JABBER_SERVER_DIALBACK + `'>`
+
+// Component streams have neither a version nor features (XEP-0114 Section 3)
+const stream_component_begin_fmt = `<stream:stream from='%s' to='%s' id='%s' xmlns='%s' xmlns:stream='%s'>`
+
 func GenXMPPStreamHeader(s *XMPPStream) string {
-    return fmt.Sprintf(stream_response_begin_fmt,
+    if s.Xmlns == XMLNS_COMPONENT_ACCEPT {
+        return fmt.Sprintf(stream_component_begin_fmt, s.From, s.To, s.Id, s.Xmlns, XMLNS_STREAM)
+    }
+    format := stream_response_begin_fmt
+    if s.Xmlns == XMLNS_JABBER_SERVER {
+        format = stream_server_begin_fmt
+    }
+    return fmt.Sprintf(format,
         s.From,
         s.To,
         s.Version,
@@ -0,0 +1,35 @@
+package protocol
+
+import (
+    "encoding/xml"
+)
+
+const (
+    XMLNS_XMPP_FRAMING      = "urn:ietf:params:xml:ns:xmpp-framing"
+    XMPP_WEBSOCKET_PROTOCOL = "xmpp"
+)
+
+var (
+    TAG_FRAMING_OPEN  xml.Name = xml.Name{Space: XMLNS_XMPP_FRAMING, Local: "open"}
+    TAG_FRAMING_CLOSE xml.Name = xml.Name{Space: XMLNS_XMPP_FRAMING, Local: "close"}
+)
+
+// RFC7395 Section 3.4
+//
+// Opens a framed stream in place of the stream header.
+type XMPPFramingOpen struct {
+    XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-framing open"`
+    From    string   `xml:"from,attr,omitempty"`
+    To      string   `xml:"to,attr,omitempty"`
+    Id      string   `xml:"id,attr,omitempty"`
+    Version string   `xml:"version,attr"`
+    XMLLang string   `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+}
+
+// RFC7395 Section 3.6
+//
+// Closes a framed stream in place of the end of the stream root.
+type XMPPFramingClose struct {
+    XMLName     xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-framing close"`
+    SeeOtherURI string   `xml:"see-other-uri,attr,omitempty"`
+}
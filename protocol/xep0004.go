@@ -11,7 +11,7 @@ const (
 type XMPPXData struct {
     XMLName xml.Name         `xml:"jabber:x:data x"`
     Type    string           `xml:"type,attr,omitempty"`
-    Fields  []XMPPXDataField `xml:",omitempty"`
+    Fields  []XMPPXDataField `xml:"field,omitempty"`
     Title   string           `xml:"title,omitempty"`
 }
 
@@ -28,7 +28,7 @@ type XMPPXDataField struct {
     Label          string                        `xml:"label,attr,omitempty"`
     Type           string                        `xml:"type,attr,omitempty"`
     Values         []string                      `xml:"value,omitempty"`
-    OptionalValues []XMPPXDataFieldOptionalValue `xml:",omitempty"`
+    OptionalValues []XMPPXDataFieldOptionalValue `xml:"option,omitempty"`
     Required       *XMPPRequired                 `xml:",omitempty"`
     Desc           string                        `xml:"desc,omitempty"`
 }
@@ -54,10 +54,10 @@ type XMPPXDataFieldOptionalValue struct {
 
 type XMPPXDataItem struct {
     XMLName xml.Name         `xml:"item"`
-    Fields  []XMPPXDataField `xml:",omitempty"`
+    Fields  []XMPPXDataField `xml:"field,omitempty"`
 }
 
 type XMPPXDataReported struct {
     XMLName xml.Name         `xml:"reported"`
-    Fields  []XMPPXDataField `xml:",omitempty"`
+    Fields  []XMPPXDataField `xml:"field,omitempty"`
 }
@@ -0,0 +1,19 @@
+package protocol
+
+import (
+    "encoding/xml"
+)
+
+const (
+    XMLNS_COMPONENT_ACCEPT = "jabber:component:accept"
+)
+
+// XEP-0114 Section 3
+//
+// Sent by the component with the hex encoded SHA-1 hash of the stream id
+// concatenated with the shared secret, and echoed empty by the server once
+// the component is authenticated.
+type XMPPComponentHandshake struct {
+    XMLName xml.Name `xml:"jabber:component:accept handshake"`
+    Digest  string   `xml:",chardata"`
+}
@@ -0,0 +1,51 @@
+package protocol
+
+import (
+    "encoding/xml"
+)
+
+const (
+    XMLNS_HTTP_BIND = "http://jabber.org/protocol/httpbind"
+    XMLNS_XBOSH     = "urn:xmpp:xbosh" // XEP-0206
+)
+
+const (
+    BOSH_VERSION        = "1.11"
+    BOSH_TYPE_TERMINATE = "terminate"
+)
+
+// XEP-0124 Section 17.2
+const (
+    BOSH_CONDITION_BAD_REQUEST         = "bad-request"
+    BOSH_CONDITION_HOST_UNKNOWN        = "host-unknown"
+    BOSH_CONDITION_ITEM_NOT_FOUND      = "item-not-found"
+    BOSH_CONDITION_POLICY_VIOLATION    = "policy-violation"
+    BOSH_CONDITION_REMOTE_STREAM_ERROR = "remote-stream-error"
+)
+
+// XEP-0124 Section 4
+//
+// The wrapper of every HTTP request and response of a BOSH session. The
+// elements it wraps are kept as they were received in Payload. The xmpp
+// attributes are those of XEP-0206.
+type BOSHBody struct {
+    XMLName          xml.Name `xml:"http://jabber.org/protocol/httpbind body"`
+    Rid              string   `xml:"rid,attr,omitempty"`
+    Sid              string   `xml:"sid,attr,omitempty"`
+    To               string   `xml:"to,attr,omitempty"`
+    From             string   `xml:"from,attr,omitempty"`
+    XMLLang          string   `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+    Ver              string   `xml:"ver,attr,omitempty"`
+    Wait             string   `xml:"wait,attr,omitempty"`
+    Hold             string   `xml:"hold,attr,omitempty"`
+    Requests         string   `xml:"requests,attr,omitempty"`
+    Polling          string   `xml:"polling,attr,omitempty"`
+    Inactivity       string   `xml:"inactivity,attr,omitempty"`
+    Authid           string   `xml:"authid,attr,omitempty"`
+    Type             string   `xml:"type,attr,omitempty"`
+    Condition        string   `xml:"condition,attr,omitempty"`
+    XMPPVersion      string   `xml:"urn:xmpp:xbosh version,attr,omitempty"`
+    XMPPRestart      string   `xml:"urn:xmpp:xbosh restart,attr,omitempty"`
+    XMPPRestartLogic string   `xml:"urn:xmpp:xbosh restartlogic,attr,omitempty"`
+    Payload          []byte   `xml:",innerxml"`
+}
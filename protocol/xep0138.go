@@ -4,7 +4,10 @@ import (
     "encoding/xml"
 )
 
-const XMLNS_STREAM_FEATURE_COMPRESSION = "http://jabber.org/features/compress"
+const (
+    XMLNS_STREAM_FEATURE_COMPRESSION = "http://jabber.org/features/compress"
+    XMLNS_PROTOCOL_COMPRESSION       = "http://jabber.org/protocol/compress"
+)
 
 type XMPPStreamFeatureCompression struct {
     XMLName xml.Name `xml:"http://jabber.org/features/compress compression"`
@@ -17,16 +20,16 @@ const (
 )
 
 type XMPPStreamCompressionCompress struct {
-    XMLName xml.Name `xml:"http://jabber.org/features/compress compress"`
+    XMLName xml.Name `xml:"http://jabber.org/protocol/compress compress"`
     Methods []string `xml:"method,omitempty"`
 }
 
 type XMPPStreamCompressionCompressed struct {
-    XMLName xml.Name `xml:"http://jabber.org/features/compress compressed"`
+    XMLName xml.Name `xml:"http://jabber.org/protocol/compress compressed"`
 }
 
 type XMPPStreamCompressionFailure struct {
-    XMLName           xml.Name                                       `xml:"http://jabber.org/features/compress failure"`
+    XMLName           xml.Name                                       `xml:"http://jabber.org/protocol/compress failure"`
     UnsupportedMethod *XMPPStreamCompressionFailureUnsupportedMethod `xml:",omitempty"`
     SetupFailed       *XMPPStreamCompressionFailureSetupFailed       `xml:",omitempty"`
     ProcessingFailed  *XMPPStreamCompressionFailureProcessingFailed  `xml:",omitempty"`
@@ -0,0 +1,62 @@
+package protocol
+
+import (
+    "encoding/xml"
+)
+
+const (
+    XMLNS_SM3 = "urn:xmpp:sm:3"
+)
+
+type XMPPStreamFeatureSM struct {
+    XMLName xml.Name `xml:"urn:xmpp:sm:3 sm"`
+}
+
+// XEP-0198 Section 3
+//
+// The 'max' attribute is the preferred maximum resumption time in seconds.
+type XMPPSMEnable struct {
+    XMLName xml.Name `xml:"urn:xmpp:sm:3 enable"`
+    Resume  string   `xml:"resume,attr,omitempty"`
+    Max     int      `xml:"max,attr,omitempty"`
+}
+
+type XMPPSMEnabled struct {
+    XMLName  xml.Name `xml:"urn:xmpp:sm:3 enabled"`
+    Id       string   `xml:"id,attr,omitempty"`
+    Resume   string   `xml:"resume,attr,omitempty"`
+    Max      int      `xml:"max,attr,omitempty"`
+    Location string   `xml:"location,attr,omitempty"`
+}
+
+// XEP-0198 Section 4
+type XMPPSMRequest struct {
+    XMLName xml.Name `xml:"urn:xmpp:sm:3 r"`
+}
+
+// The 'h' attribute is the number of stanzas handled by the sender of the
+// answer, modulo 2^32.
+type XMPPSMAnswer struct {
+    XMLName xml.Name `xml:"urn:xmpp:sm:3 a"`
+    H       uint32   `xml:"h,attr"`
+}
+
+// XEP-0198 Section 5
+type XMPPSMResume struct {
+    XMLName xml.Name `xml:"urn:xmpp:sm:3 resume"`
+    H       uint32   `xml:"h,attr"`
+    PrevId  string   `xml:"previd,attr"`
+}
+
+type XMPPSMResumed struct {
+    XMLName xml.Name `xml:"urn:xmpp:sm:3 resumed"`
+    H       uint32   `xml:"h,attr"`
+    PrevId  string   `xml:"previd,attr"`
+}
+
+// Sent when enabling or resuming fails, with a stanza error condition.
+type XMPPSMFailed struct {
+    XMLName xml.Name `xml:"urn:xmpp:sm:3 failed"`
+    H       *uint32  `xml:"h,attr,omitempty"`
+    XMPPStanzaErrorGroup
+}
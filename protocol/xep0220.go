@@ -0,0 +1,48 @@
+package protocol
+
+import (
+    "encoding/xml"
+)
+
+const (
+    XMLNS_JABBER_SERVER_DIALBACK = "jabber:server:dialback"
+    XMLNS_FEATURES_DIALBACK      = "urn:xmpp:features:dialback"
+)
+
+const (
+    XMPP_DIALBACK_TYPE_VALID   = "valid"
+    XMPP_DIALBACK_TYPE_INVALID = "invalid"
+    XMPP_DIALBACK_TYPE_ERROR   = "error"
+)
+
+// XEP-0220 Section 2.1
+type XMPPStreamFeatureDialback struct {
+    XMLName xml.Name `xml:"urn:xmpp:features:dialback dialback"`
+}
+
+// XEP-0220 Section 2.1.1 and 2.4
+//
+// Sent by the Originating Server with the dialback key, and by the Receiving
+// Server with the result of the verification.
+type XMPPDialbackResult struct {
+    XMLName xml.Name         `xml:"jabber:server:dialback result"`
+    From    string           `xml:"from,attr"`
+    To      string           `xml:"to,attr"`
+    Type    string           `xml:"type,attr,omitempty"`
+    Key     string           `xml:",chardata"`
+    Error   *XMPPStanzaError `xml:",omitempty"`
+}
+
+// XEP-0220 Section 2.3
+//
+// Sent by the Receiving Server to the Authoritative Server to check a key,
+// which answers with the result.
+type XMPPDialbackVerify struct {
+    XMLName xml.Name         `xml:"jabber:server:dialback verify"`
+    From    string           `xml:"from,attr"`
+    To      string           `xml:"to,attr"`
+    Id      string           `xml:"id,attr"`
+    Type    string           `xml:"type,attr,omitempty"`
+    Key     string           `xml:",chardata"`
+    Error   *XMPPStanzaError `xml:",omitempty"`
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+    "github.com/zonyitoo/goxmpp/protocol"
+    "github.com/zonyitoo/goxmpp/stream"
+)
+
+// AnonymousPolicy decides which stanzas sessions authenticated with the
+// ANONYMOUS mechanism may send. Refused stanzas are answered with a
+// <forbidden/> error.
+type AnonymousPolicy interface {
+    AllowIQ(*protocol.XMPPStanzaIQ, stream.Streamer) bool
+    AllowMessage(*protocol.XMPPStanzaMessage, stream.Streamer) bool
+    AllowPresence(*protocol.XMPPStanzaPresence, stream.Streamer) bool
+    // Called when an anonymous session closes, to discard any state kept for
+    // its temporary JID.
+    Release(stream.Streamer)
+}
+
+// DefaultAnonymousPolicy refuses roster management and in-band registration,
+// neither of which makes sense for a temporary account.
+type DefaultAnonymousPolicy struct{}
+
+func (p *DefaultAnonymousPolicy) AllowIQ(iq *protocol.XMPPStanzaIQ, s stream.Streamer) bool {
+    return iq.Roster == nil && iq.Register == nil
+}
+
+func (p *DefaultAnonymousPolicy) AllowMessage(*protocol.XMPPStanzaMessage, stream.Streamer) bool {
+    return true
+}
+
+func (p *DefaultAnonymousPolicy) AllowPresence(*protocol.XMPPStanzaPresence, stream.Streamer) bool {
+    return true
+}
+
+func (p *DefaultAnonymousPolicy) Release(stream.Streamer) {}
+
+// Applies the policy to anonymous sessions before routing their stanzas.
+type anonymousFilter struct {
+    policy AnonymousPolicy
+    router *Router
+}
+
+func (f *anonymousFilter) HandleIQ(iq *protocol.XMPPStanzaIQ, s stream.Streamer) error {
+    if s.IsAnonymous() && !f.policy.AllowIQ(iq, s) {
+        return f.router.bounceIQ(iq, s.Writer(), protocol.XMPP_STANZA_ERROR_TYPE_AUTH,
+            protocol.XMPPStanzaErrorGroup{Forbidden: &protocol.XMPPStanzaErrorForbidden{}})
+    }
+    return f.router.HandleIQ(iq, s)
+}
+
+func (f *anonymousFilter) HandleMessage(msg *protocol.XMPPStanzaMessage, s stream.Streamer) error {
+    if s.IsAnonymous() && !f.policy.AllowMessage(msg, s) {
+        return f.router.bounceMessage(msg, s.Writer(), protocol.XMPP_STANZA_ERROR_TYPE_AUTH,
+            protocol.XMPPStanzaErrorGroup{Forbidden: &protocol.XMPPStanzaErrorForbidden{}})
+    }
+    return f.router.HandleMessage(msg, s)
+}
+
+func (f *anonymousFilter) HandlePresence(presence *protocol.XMPPStanzaPresence, s stream.Streamer) error {
+    if s.IsAnonymous() && !f.policy.AllowPresence(presence, s) {
+        return f.router.bouncePresence(presence, s.Writer(), protocol.XMPP_STANZA_ERROR_TYPE_AUTH,
+            protocol.XMPPStanzaErrorGroup{Forbidden: &protocol.XMPPStanzaErrorForbidden{}})
+    }
+    return f.router.HandlePresence(presence, s)
+}
@@ -0,0 +1,671 @@
+package server
+
+import (
+    "bufio"
+    "bytes"
+    "code.google.com/p/go-uuid/uuid"
+    "crypto/tls"
+    "encoding/xml"
+    "fmt"
+    "github.com/zonyitoo/goxmpp/protocol"
+    "io"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// The limits of BOSH sessions (XEP-0124 Section 7.1). Clients may ask for a
+// shorter wait and fewer held requests.
+const (
+    BOSHMaxWait     = 60 * time.Second
+    BOSHMaxHold     = 1
+    BOSHPolling     = 2 * time.Second
+    BOSHInactivity  = 60 * time.Second
+    BOSHMaxBodySize = 1 << 20
+)
+
+// XEP-0124 and XEP-0206
+//
+// BOSHHandler is a connection manager which carries client streams over HTTP
+// requests. Every BOSH session is served by a stream of the server, with the
+// same features and stanza handling as clients connected over TCP, except for
+// STARTTLS: the HTTP connections are encrypted by the web server instead.
+// Sessions created over HTTPS count as encrypted.
+type BOSHHandler struct {
+    server     *TCPServer
+    inactivity time.Duration
+    secure     bool
+    lock       sync.Mutex
+    sessions   map[string]*boshSession
+}
+
+// Creates a connection manager for the clients of server. Features added to
+// the server afterwards are offered to the sessions created afterwards.
+func NewBOSHHandler(server *TCPServer) *BOSHHandler {
+    return &BOSHHandler{
+        server:     server,
+        inactivity: BOSHInactivity,
+        sessions:   make(map[string]*boshSession),
+    }
+}
+
+// Sets how long a session may go without a waiting request before it is
+// closed, BOSHInactivity by default.
+func (h *BOSHHandler) SetInactivity(inactivity time.Duration) {
+    h.inactivity = inactivity
+}
+
+// Declares that the requests reach the handler over a secure transport even
+// if they are not served over HTTPS, e.g. behind a proxy terminating TLS.
+func (h *BOSHHandler) SetSecure(secure bool) {
+    h.secure = secure
+}
+
+func (h *BOSHHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        w.Header().Set("Allow", "POST")
+        http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+        return
+    }
+
+    body := &protocol.BOSHBody{}
+    data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, BOSHMaxBodySize))
+    if err == nil {
+        err = xml.Unmarshal(data, body)
+    }
+
+    var response []byte
+    if err != nil {
+        response = boshTerminate(protocol.BOSH_CONDITION_BAD_REQUEST)
+    } else if body.Sid == "" {
+        response = h.create(body, r.RemoteAddr, transportState(r, h.secure))
+    } else {
+        h.lock.Lock()
+        session := h.sessions[body.Sid]
+        h.lock.Unlock()
+        if session == nil {
+            response = boshTerminate(protocol.BOSH_CONDITION_ITEM_NOT_FOUND)
+        } else {
+            response = session.handle(body)
+        }
+    }
+    w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+    w.Write(response)
+}
+
+// XEP-0124 Section 7.1
+//
+// Starts a session and its stream, and answers the request once the stream
+// features are sent.
+func (h *BOSHHandler) create(body *protocol.BOSHBody, remote string, state *tls.ConnectionState) []byte {
+    rid, err := strconv.ParseUint(body.Rid, 10, 64)
+    if err != nil {
+        return boshTerminate(protocol.BOSH_CONDITION_BAD_REQUEST)
+    }
+    if body.To != h.server.domain {
+        return boshTerminate(protocol.BOSH_CONDITION_HOST_UNKNOWN)
+    }
+
+    wait := BOSHMaxWait
+    if seconds, err := strconv.Atoi(body.Wait); err == nil && seconds >= 0 && time.Duration(seconds)*time.Second < wait {
+        wait = time.Duration(seconds) * time.Second
+    }
+    hold := BOSHMaxHold
+    if n, err := strconv.Atoi(body.Hold); err == nil && n >= 0 && n < hold {
+        hold = n
+    }
+    ver := protocol.BOSH_VERSION
+    if body.Ver != "" && boshVersionLess(body.Ver, ver) {
+        ver = body.Ver
+    }
+
+    conn, output := newBOSHConn(remote, state)
+    scs := h.server.newStream(conn, h.server.streamFeatures(false))
+    s := &boshSession{
+        handler:   h,
+        sid:       uuid.New(),
+        domain:    h.server.domain,
+        ver:       ver,
+        conn:      conn,
+        authid:    scs.Id(),
+        wait:      wait,
+        hold:      hold,
+        firstRid:  rid,
+        nextRid:   rid,
+        pending:   make(map[uint64]*boshRequest),
+        responses: make(map[uint64][]byte),
+    }
+    s.inactivity = time.AfterFunc(h.inactivity, s.expire)
+
+    h.lock.Lock()
+    h.sessions[s.sid] = s
+    h.lock.Unlock()
+
+    conn.feed(s.header())
+    go s.split(output)
+    go scs.Run()
+    return s.handle(body)
+}
+
+func (h *BOSHHandler) remove(sid string) {
+    h.lock.Lock()
+    defer h.lock.Unlock()
+    delete(h.sessions, sid)
+}
+
+// A request waiting for its response.
+type boshRequest struct {
+    rid      uint64
+    body     *protocol.BOSHBody
+    response chan []byte
+    answered bool
+}
+
+// The state of a BOSH session. The payloads of the requests are passed to
+// the stream in the order of their rid. What the stream sends is split into
+// its top level elements, which are queued until a request can be answered.
+type boshSession struct {
+    handler    *BOSHHandler
+    sid        string
+    domain     string
+    ver        string
+    authid     string
+    conn       *boshConn
+    wait       time.Duration
+    hold       int
+    firstRid   uint64
+    lock       sync.Mutex
+    nextRid    uint64
+    pending    map[uint64]*boshRequest
+    held       []*boshRequest
+    responses  map[uint64][]byte
+    output     [][]byte
+    condition  string
+    ended      bool
+    lastPoll   time.Time
+    inactivity *time.Timer
+}
+
+// Handles a request of the session and returns its response, at the latest
+// after the wait period.
+func (s *boshSession) handle(body *protocol.BOSHBody) []byte {
+    rid, err := strconv.ParseUint(body.Rid, 10, 64)
+    if err != nil {
+        return boshTerminate(protocol.BOSH_CONDITION_BAD_REQUEST)
+    }
+
+    s.lock.Lock()
+    // XEP-0124 Section 14.3: the client did not receive the response
+    if response, ok := s.responses[rid]; ok {
+        s.lock.Unlock()
+        return response
+    }
+    if s.ended {
+        s.lock.Unlock()
+        return boshTerminate(protocol.BOSH_CONDITION_ITEM_NOT_FOUND)
+    }
+    // XEP-0124 Section 14.1: only the next requests within the window
+    if rid < s.nextRid || rid >= s.nextRid+uint64(s.hold+1) || s.pending[rid] != nil {
+        s.terminate(protocol.BOSH_CONDITION_ITEM_NOT_FOUND)
+        s.lock.Unlock()
+        return boshTerminate(protocol.BOSH_CONDITION_ITEM_NOT_FOUND)
+    }
+    // XEP-0124 Section 12: sessions without held requests must not poll
+    // more often than allowed
+    if s.hold == 0 && len(bytes.TrimSpace(body.Payload)) == 0 && body.Type == "" && body.XMPPRestart != "true" {
+        now := time.Now()
+        if now.Sub(s.lastPoll) < BOSHPolling {
+            s.terminate(protocol.BOSH_CONDITION_POLICY_VIOLATION)
+            s.lock.Unlock()
+            return boshTerminate(protocol.BOSH_CONDITION_POLICY_VIOLATION)
+        }
+        s.lastPoll = now
+    } else {
+        s.lastPoll = time.Time{}
+    }
+
+    req := &boshRequest{rid: rid, body: body, response: make(chan []byte, 1)}
+    s.pending[rid] = req
+    s.process()
+    s.lock.Unlock()
+
+    timer := time.NewTimer(s.wait)
+    defer timer.Stop()
+    select {
+    case response := <-req.response:
+        return response
+    case <-timer.C:
+    }
+
+    s.lock.Lock()
+    if !req.answered {
+        s.answer(req)
+    }
+    s.lock.Unlock()
+    return <-req.response
+}
+
+// XEP-0124 Section 14.1
+//
+// Passes the requests on to the stream in the order of their rid, as far as
+// none is missing, and answers the requests that no longer need to wait.
+// Must be called with the lock held.
+func (s *boshSession) process() {
+    for {
+        req := s.pending[s.nextRid]
+        if req == nil {
+            break
+        }
+        delete(s.pending, s.nextRid)
+        s.nextRid++
+
+        // XEP-0206 Section 5
+        if req.body.XMPPRestart == "true" {
+            s.conn.feed(s.header())
+        }
+        s.conn.feed(req.body.Payload)
+        // XEP-0124 Section 13: the session ends with the stream
+        if req.body.Type == protocol.BOSH_TYPE_TERMINATE {
+            s.terminate("")
+        }
+        if !req.answered {
+            s.held = append(s.held, req)
+        }
+    }
+
+    for len(s.held) > s.hold || len(s.held) > 0 && len(s.output) > 0 {
+        s.answer(s.held[0])
+    }
+    s.idle()
+}
+
+// Responds to req with the elements queued so far. Must be called with the
+// lock held.
+func (s *boshSession) answer(req *boshRequest) {
+    for i, held := range s.held {
+        if held == req {
+            s.held = append(s.held[:i], s.held[i+1:]...)
+            break
+        }
+    }
+
+    var attrs []boshAttr
+    if req.rid == s.firstRid {
+        attrs = s.creationAttrs()
+    }
+    if s.ended {
+        attrs = append(attrs, boshAttr{"type", protocol.BOSH_TYPE_TERMINATE})
+        if s.condition != "" {
+            attrs = append(attrs, boshAttr{"condition", s.condition})
+        }
+    }
+    response := boshBody(attrs, bytes.Join(s.output, nil))
+    s.output = nil
+    req.answered = true
+    req.response <- response
+
+    // XEP-0124 Section 14.3: kept while the client may still retransmit
+    s.responses[req.rid] = response
+    for rid := range s.responses {
+        if rid+uint64(s.hold+1) < s.nextRid {
+            delete(s.responses, rid)
+        }
+    }
+    s.idle()
+}
+
+// XEP-0124 Section 7.1 and XEP-0206 Section 4
+func (s *boshSession) creationAttrs() []boshAttr {
+    return []boshAttr{
+        {"xmlns:xmpp", protocol.XMLNS_XBOSH},
+        {"xmlns:stream", protocol.XMLNS_STREAM},
+        {"sid", s.sid},
+        {"wait", strconv.Itoa(int(s.wait / time.Second))},
+        {"hold", strconv.Itoa(s.hold)},
+        {"requests", strconv.Itoa(s.hold + 1)},
+        {"polling", strconv.Itoa(int(BOSHPolling / time.Second))},
+        {"inactivity", strconv.Itoa(int(s.handler.inactivity / time.Second))},
+        {"ver", s.ver},
+        {"from", s.domain},
+        {"authid", s.authid},
+        {"xmpp:version", "1.0"},
+        {"xmpp:restartlogic", "true"},
+    }
+}
+
+// Queues an element of the stream and answers the oldest waiting request. A
+// stream error is sent with the termination of the session instead.
+func (s *boshSession) send(elem []byte, streamError bool) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    s.output = append(s.output, elem)
+    if streamError {
+        if s.condition == "" {
+            s.condition = protocol.BOSH_CONDITION_REMOTE_STREAM_ERROR
+        }
+        return
+    }
+    if len(s.held) > 0 {
+        s.answer(s.held[0])
+    }
+}
+
+// Called once the stream is closed. The waiting requests are answered with
+// the termination of the session.
+func (s *boshSession) end() {
+    s.lock.Lock()
+    s.ended = true
+    for len(s.held) > 0 {
+        s.answer(s.held[0])
+    }
+    s.inactivity.Stop()
+    s.lock.Unlock()
+    s.handler.remove(s.sid)
+}
+
+// Closes the stream as if the client closed it, which ends the session.
+// Must be called with the lock held.
+func (s *boshSession) terminate(condition string) {
+    if s.condition == "" {
+        s.condition = condition
+    }
+    s.conn.feed([]byte(protocol.XMPPStreamEndFmt))
+}
+
+// XEP-0124 Section 7.1: the inactivity period starts once no request is
+// waiting. Must be called with the lock held.
+func (s *boshSession) idle() {
+    if s.ended || len(s.held) > 0 || len(s.pending) > 0 {
+        s.inactivity.Stop()
+        return
+    }
+    s.inactivity.Reset(s.handler.inactivity)
+}
+
+func (s *boshSession) expire() {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    if !s.ended && len(s.held) == 0 && len(s.pending) == 0 {
+        s.terminate("")
+    }
+}
+
+// The stream header the client would send, which the body replaces.
+func (s *boshSession) header() []byte {
+    return []byte(fmt.Sprintf(bosh_stream_header_fmt, s.domain, protocol.XMLNS_JABBER_CLIENT, protocol.XMLNS_STREAM))
+}
+
+const bosh_stream_header_fmt = `<stream:stream to='%s' version='1.0' xmlns='%s' xmlns:stream='%s'>`
+
+// XEP-0206 Section 3
+//
+// Splits what the stream writes into its top level elements and queues them
+// for the responses. The stream headers are dropped, and stanzas are
+// qualified with the jabber:client namespace which the body does not declare.
+func (s *boshSession) split(r io.Reader) {
+    recorder := &boshRecorder{r: bufio.NewReader(r)}
+    decoder := xml.NewDecoder(recorder)
+    depth := 1
+    var start int64
+    var qualify, streamError bool
+loop:
+    for {
+        offset := decoder.InputOffset()
+        token, err := decoder.RawToken()
+        if err != nil {
+            break
+        }
+        switch t := token.(type) {
+        case xml.StartElement:
+            // Sent again after every restart
+            if t.Name.Space == "stream" && t.Name.Local == "stream" {
+                depth = 1
+                break
+            }
+            depth++
+            if depth == 2 {
+                start = offset
+                xmlns := boshAttrValue(t, "xmlns")
+                qualify = t.Name.Space == "" && xmlns == ""
+                streamError = t.Name.Local == "error" &&
+                    (t.Name.Space == "stream" || t.Name.Space == "" && xmlns == protocol.XMLNS_STREAM)
+            }
+        case xml.EndElement:
+            depth--
+            if depth == 0 {
+                break loop
+            }
+            if depth == 1 {
+                elem := recorder.bytes(start, decoder.InputOffset())
+                if qualify {
+                    elem = boshQualify(elem, len(t.Name.Local))
+                }
+                s.send(elem, streamError)
+            }
+        }
+        if depth == 1 {
+            recorder.discard(decoder.InputOffset())
+        }
+    }
+    s.end()
+
+    // The stream may still write until it closes the connection
+    io.Copy(ioutil.Discard, r)
+}
+
+func boshAttrValue(t xml.StartElement, name string) string {
+    for _, attr := range t.Attr {
+        if attr.Name.Space == "" && attr.Name.Local == name {
+            return attr.Value
+        }
+    }
+    return ""
+}
+
+// Declares the jabber:client namespace on an element named with n bytes.
+func boshQualify(elem []byte, n int) []byte {
+    qualified := append([]byte{}, elem[:1+n]...)
+    qualified = append(qualified, " xmlns='"+protocol.XMLNS_JABBER_CLIENT+"'"...)
+    return append(qualified, elem[1+n:]...)
+}
+
+// Keeps what the decoder reads, so that elements can be cut out by their
+// offsets.
+type boshRecorder struct {
+    r    *bufio.Reader
+    buf  []byte
+    base int64
+}
+
+func (b *boshRecorder) Read(p []byte) (int, error) {
+    n, err := b.r.Read(p)
+    b.buf = append(b.buf, p[:n]...)
+    return n, err
+}
+
+func (b *boshRecorder) ReadByte() (byte, error) {
+    c, err := b.r.ReadByte()
+    if err == nil {
+        b.buf = append(b.buf, c)
+    }
+    return c, err
+}
+
+func (b *boshRecorder) bytes(start, end int64) []byte {
+    return append([]byte{}, b.buf[start-b.base:end-b.base]...)
+}
+
+// Forgets what was read before offset.
+func (b *boshRecorder) discard(offset int64) {
+    b.buf = b.buf[offset-b.base:]
+    b.base = offset
+}
+
+type boshAttr struct {
+    name  string
+    value string
+}
+
+func boshBody(attrs []boshAttr, payload []byte) []byte {
+    var b bytes.Buffer
+    b.WriteString("<body xmlns='" + protocol.XMLNS_HTTP_BIND + "'")
+    for _, attr := range attrs {
+        b.WriteString(" " + attr.name + "='")
+        xml.EscapeText(&b, []byte(attr.value))
+        b.WriteString("'")
+    }
+    if len(payload) == 0 {
+        b.WriteString("/>")
+        return b.Bytes()
+    }
+    b.WriteString(">")
+    b.Write(payload)
+    b.WriteString("</body>")
+    return b.Bytes()
+}
+
+// XEP-0124 Section 17.2
+func boshTerminate(condition string) []byte {
+    return boshBody([]boshAttr{
+        {"type", protocol.BOSH_TYPE_TERMINATE},
+        {"condition", condition},
+    }, nil)
+}
+
+// Compares versions of the form major.minor.
+func boshVersionLess(a, b string) bool {
+    parse := func(ver string) (int, int) {
+        parts := strings.SplitN(ver, ".", 2)
+        major, _ := strconv.Atoi(parts[0])
+        minor := 0
+        if len(parts) == 2 {
+            minor, _ = strconv.Atoi(parts[1])
+        }
+        return major, minor
+    }
+    majorA, minorA := parse(a)
+    majorB, minorB := parse(b)
+    return majorA < majorB || majorA == majorB && minorA < minorB
+}
+
+// The TLS state of the transport a request came over. A transport declared
+// secure without TLS state gets an empty one, so its streams count as
+// encrypted.
+func transportState(r *http.Request, secure bool) *tls.ConnectionState {
+    if r.TLS != nil {
+        state := *r.TLS
+        return &state
+    }
+    if secure {
+        return &tls.ConnectionState{}
+    }
+    return nil
+}
+
+// The connection of the stream of a BOSH session. The stream reads the
+// payloads of the requests from it, and what it writes goes to the session
+// through a pipe.
+type boshConn struct {
+    lock   sync.Mutex
+    cond   *sync.Cond
+    input  bytes.Buffer
+    closed bool
+    output *io.PipeWriter
+    remote boshAddr
+    state  *tls.ConnectionState
+}
+
+func newBOSHConn(remote string, state *tls.ConnectionState) (*boshConn, io.Reader) {
+    r, w := io.Pipe()
+    c := &boshConn{output: w, remote: boshAddr(remote), state: state}
+    c.cond = sync.NewCond(&c.lock)
+    return c, r
+}
+
+func (c *boshConn) feed(data []byte) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if !c.closed {
+        c.input.Write(data)
+        c.cond.Broadcast()
+    }
+}
+
+func (c *boshConn) Read(p []byte) (int, error) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    for c.input.Len() == 0 && !c.closed {
+        c.cond.Wait()
+    }
+    if c.input.Len() == 0 {
+        return 0, io.EOF
+    }
+    return c.input.Read(p)
+}
+
+// The decoder of the stream reads byte by byte, so that nothing is buffered
+// when the stream is reset.
+func (c *boshConn) ReadByte() (byte, error) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    for c.input.Len() == 0 && !c.closed {
+        c.cond.Wait()
+    }
+    if c.input.Len() == 0 {
+        return 0, io.EOF
+    }
+    return c.input.ReadByte()
+}
+
+func (c *boshConn) Write(p []byte) (int, error) {
+    return c.output.Write(p)
+}
+
+func (c *boshConn) Close() error {
+    c.lock.Lock()
+    c.closed = true
+    c.cond.Broadcast()
+    c.lock.Unlock()
+    return c.output.Close()
+}
+
+// The TLS state of the request which created the session, nil if it was not
+// made over a secure transport.
+func (c *boshConn) TransportTLS() *tls.ConnectionState {
+    return c.state
+}
+
+func (c *boshConn) LocalAddr() net.Addr {
+    return boshAddr("")
+}
+
+func (c *boshConn) RemoteAddr() net.Addr {
+    return c.remote
+}
+
+func (c *boshConn) SetDeadline(t time.Time) error {
+    return nil
+}
+
+func (c *boshConn) SetReadDeadline(t time.Time) error {
+    return nil
+}
+
+func (c *boshConn) SetWriteDeadline(t time.Time) error {
+    return nil
+}
+
+// The address of the HTTP client which created a session.
+type boshAddr string
+
+func (a boshAddr) Network() string {
+    return "tcp"
+}
+
+func (a boshAddr) String() string {
+    return string(a)
+}
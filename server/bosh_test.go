@@ -0,0 +1,267 @@
+package server
+
+import (
+    "bytes"
+    "encoding/base64"
+    "encoding/xml"
+    "fmt"
+    "github.com/stretchr/testify/assert"
+    "github.com/zonyitoo/goxmpp/auth"
+    "github.com/zonyitoo/goxmpp/protocol"
+    "github.com/zonyitoo/goxmpp/stream"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+// Starts a server like testServer and a BOSH connection manager for it.
+// Returns the address of the server and the URL of the manager.
+func testBOSHServer(t *testing.T) (string, string) {
+    return testBOSHServerWith(t, nil)
+}
+
+// Like testBOSHServer, with setup called before the manager starts serving.
+func testBOSHServerWith(t *testing.T, setup func(*BOSHHandler)) (string, string) {
+    var server *TCPServer
+    addr := testServerWith(t, func(s *TCPServer) {
+        server = s
+    })
+    handler := NewBOSHHandler(server)
+    if setup != nil {
+        setup(handler)
+    }
+    return addr, httptest.NewServer(handler).URL
+}
+
+// A BOSH client which sends one request at a time.
+type testBOSHClient struct {
+    t   *testing.T
+    url string
+    sid string
+    rid uint64
+}
+
+// Posts a body with the given attributes and payload and parses the response.
+func (c *testBOSHClient) post(attrs, payload string) *protocol.BOSHBody {
+    data := fmt.Sprintf("<body xmlns='%s' xmlns:xmpp='%s'%s>%s</body>",
+        protocol.XMLNS_HTTP_BIND, protocol.XMLNS_XBOSH, attrs, payload)
+    resp, err := http.Post(c.url, "text/xml; charset=utf-8", strings.NewReader(data))
+    if err != nil {
+        c.t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    response, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        c.t.Fatal(err)
+    }
+    body := &protocol.BOSHBody{}
+    if err := xml.Unmarshal(response, body); err != nil {
+        c.t.Fatal(err)
+    }
+    return body
+}
+
+// Sends the next request of the session.
+func (c *testBOSHClient) request(attrs, payload string) *protocol.BOSHBody {
+    c.rid++
+    return c.post(fmt.Sprintf(" sid='%s' rid='%d'%s", c.sid, c.rid, attrs), payload)
+}
+
+// Decodes the elements of a response.
+func testBOSHElements(t *testing.T, body *protocol.BOSHBody) []protocol.Protocol {
+    var elems []protocol.Protocol
+    reader := stream.NewReader(bytes.NewReader(body.Payload))
+    for {
+        elem, err := reader.NextElement()
+        if err == io.EOF {
+            return elems
+        }
+        if err != nil {
+            t.Fatal(err)
+        }
+        elems = append(elems, elem)
+    }
+}
+
+// Expects a response holding a single element.
+func testBOSHElement(t *testing.T, body *protocol.BOSHBody) protocol.Protocol {
+    elems := testBOSHElements(t, body)
+    if len(elems) != 1 {
+        t.Fatalf("Expected a single element, got %q", body.Payload)
+    }
+    return elems[0]
+}
+
+// Creates a session, authenticates with SCRAM-SHA-1 as local and binds
+// resource.
+func testBOSHSession(t *testing.T, url, local, resource string) *testBOSHClient {
+    c := &testBOSHClient{t: t, url: url, rid: 1000}
+    created := c.post(fmt.Sprintf(" to='example.com' rid='%d' wait='1' hold='1' ver='1.11' xmpp:version='1.0'", c.rid), "")
+    c.sid = created.Sid
+    assert.NotEmpty(t, created.Sid)
+    assert.Equal(t, "true", created.XMPPRestartLogic)
+    if features, ok := testBOSHElement(t, created).(*protocol.XMPPStreamFeatures); assert.True(t, ok) {
+        assert.Nil(t, features.StartTLS)
+        if assert.NotNil(t, features.SASLMechanisms) {
+            assert.Contains(t, features.SASLMechanisms.Mechanisms, "SCRAM-SHA-1")
+            // Served over plain HTTP
+            assert.NotContains(t, features.SASLMechanisms.Mechanisms, "PLAIN")
+        }
+    }
+
+    exchange, err := auth.NewSCRAMClient(auth.SCRAMSHA1, "", local, "secret").NewExchange(&auth.Context{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    initial, err := exchange.Start()
+    if err != nil {
+        t.Fatal(err)
+    }
+    body := c.request("", fmt.Sprintf("<auth xmlns='%s' mechanism='SCRAM-SHA-1'>%s</auth>",
+        protocol.XMLNS_XMPP_SASL, base64.StdEncoding.EncodeToString(initial)))
+    challenge, ok := testBOSHElement(t, body).(*protocol.XMPPSASLChallenge)
+    if !ok {
+        t.Fatalf("Expected a challenge, got %q", body.Payload)
+    }
+    data, _ := base64.StdEncoding.DecodeString(challenge.Data)
+    response, err := exchange.Next(data)
+    if err != nil {
+        t.Fatal(err)
+    }
+    body = c.request("", fmt.Sprintf("<response xmlns='%s'>%s</response>",
+        protocol.XMLNS_XMPP_SASL, base64.StdEncoding.EncodeToString(response)))
+    if _, ok := testBOSHElement(t, body).(*protocol.XMPPSASLSuccess); !ok {
+        t.Fatalf("Expected success, got %q", body.Payload)
+    }
+
+    // XEP-0206 Section 5
+    body = c.request(" xmpp:restart='true'", "")
+    if features, ok := testBOSHElement(t, body).(*protocol.XMPPStreamFeatures); assert.True(t, ok) {
+        assert.NotNil(t, features.Bind)
+        assert.Nil(t, features.SASLMechanisms)
+    }
+
+    body = c.request("", fmt.Sprintf("<iq xmlns='jabber:client' type='set' id='bind1'><bind xmlns='%s'><resource>%s</resource></bind></iq>",
+        protocol.XMLNS_XMPP_BIND, resource))
+    if iq, ok := testBOSHElement(t, body).(*protocol.XMPPStanzaIQ); assert.True(t, ok) && assert.NotNil(t, iq.Bind) {
+        assert.Equal(t, local+"@example.com/"+resource, iq.Bind.JID)
+    }
+    return c
+}
+
+func Test_BOSHSession(t *testing.T) {
+    addr, url := testBOSHServer(t)
+    juliet := testBOSHSession(t, url, "juliet", "balcony")
+    romeo := testDial(t, addr, "romeo", "orchard")
+
+    romeo.Writer().SendElement(&protocol.XMPPStanzaMessage{
+        To:   "juliet@example.com/balcony",
+        Type: protocol.XMPP_STANZA_MESSAGE_TYPE_CHAT,
+        Body: &protocol.XMPPStanzaMessageBody{Data: "Wherefore art thou?"},
+    })
+    // The message arrives while the request is held
+    body := juliet.request("", "")
+    if msg, ok := testBOSHElement(t, body).(*protocol.XMPPStanzaMessage); assert.True(t, ok) {
+        assert.Equal(t, "romeo@example.com/orchard", msg.From)
+        assert.Equal(t, "Wherefore art thou?", msg.Body.Data)
+    }
+    // Stanzas are qualified by the namespace of the stream
+    assert.Contains(t, string(body.Payload), "<message xmlns='jabber:client'")
+
+    juliet.request("", "<message xmlns='jabber:client' to='romeo@example.com' type='chat'><body>Here</body></message>")
+    elem, err := romeo.Reader().NextElement()
+    assert.NoError(t, err)
+    if msg, ok := elem.(*protocol.XMPPStanzaMessage); assert.True(t, ok) {
+        assert.Equal(t, "juliet@example.com/balcony", msg.From)
+        assert.Equal(t, "Here", msg.Body.Data)
+    }
+}
+
+// A handler behind a secure transport offers PLAIN, but no channel binding to
+// the HTTP connections.
+func Test_BOSHSecurePlain(t *testing.T) {
+    _, url := testBOSHServerWith(t, func(h *BOSHHandler) {
+        h.SetSecure(true)
+    })
+    c := &testBOSHClient{t: t, url: url, rid: 1000}
+    created := c.post(fmt.Sprintf(" to='example.com' rid='%d' wait='1' hold='1' ver='1.11' xmpp:version='1.0'", c.rid), "")
+    c.sid = created.Sid
+    if features, ok := testBOSHElement(t, created).(*protocol.XMPPStreamFeatures); assert.True(t, ok) && assert.NotNil(t, features.SASLMechanisms) {
+        assert.Contains(t, features.SASLMechanisms.Mechanisms, "PLAIN")
+        assert.NotContains(t, features.SASLMechanisms.Mechanisms, "SCRAM-SHA-1-PLUS")
+    }
+
+    body := c.request("", fmt.Sprintf("<auth xmlns='%s' mechanism='PLAIN'>%s</auth>",
+        protocol.XMLNS_XMPP_SASL, base64.StdEncoding.EncodeToString([]byte("\x00juliet\x00secret"))))
+    if _, ok := testBOSHElement(t, body).(*protocol.XMPPSASLSuccess); !ok {
+        t.Fatalf("Expected success, got %q", body.Payload)
+    }
+}
+
+// XEP-0124 Section 14.1
+func Test_BOSHOutOfOrder(t *testing.T) {
+    addr, url := testBOSHServer(t)
+    juliet := testBOSHSession(t, url, "juliet", "balcony")
+    romeo := testDial(t, addr, "romeo", "orchard")
+
+    // The later request is answered after the wait period, but its payload
+    // is held back until the missing request arrives
+    juliet.rid++
+    body := juliet.request("", "<message xmlns='jabber:client' to='romeo@example.com'><body>2</body></message>")
+    assert.Empty(t, body.Type)
+    assert.Empty(t, body.Payload)
+    juliet.rid -= 2
+    juliet.request("", "<message xmlns='jabber:client' to='romeo@example.com'><body>1</body></message>")
+
+    for _, expected := range []string{"1", "2"} {
+        elem, err := romeo.Reader().NextElement()
+        assert.NoError(t, err)
+        if msg, ok := elem.(*protocol.XMPPStanzaMessage); assert.True(t, ok) {
+            assert.Equal(t, expected, msg.Body.Data)
+        }
+    }
+}
+
+// XEP-0124 Section 14.3
+func Test_BOSHRetransmission(t *testing.T) {
+    _, url := testBOSHServer(t)
+    juliet := testBOSHSession(t, url, "juliet", "balcony")
+
+    body := juliet.request("", "<iq xmlns='jabber:client' to='romeo@example.com/orchard' type='get' id='ping1'><ping xmlns='urn:xmpp:ping'/></iq>")
+    if iq, ok := testBOSHElement(t, body).(*protocol.XMPPStanzaIQ); assert.True(t, ok) {
+        assert.Equal(t, "ping1", iq.Id)
+    }
+    juliet.rid--
+    assert.Equal(t, body, juliet.request("", "<iq xmlns='jabber:client' to='romeo@example.com/orchard' type='get' id='ping1'><ping xmlns='urn:xmpp:ping'/></iq>"))
+
+    // Requests beyond the window terminate the session
+    juliet.rid += 2
+    body = juliet.request("", "")
+    assert.Equal(t, protocol.BOSH_TYPE_TERMINATE, body.Type)
+    assert.Equal(t, protocol.BOSH_CONDITION_ITEM_NOT_FOUND, body.Condition)
+}
+
+// XEP-0124 Section 13
+func Test_BOSHTerminate(t *testing.T) {
+    _, url := testBOSHServer(t)
+    juliet := testBOSHSession(t, url, "juliet", "balcony")
+
+    body := juliet.request(" type='terminate'", "<presence xmlns='jabber:client' type='unavailable'/>")
+    assert.Equal(t, protocol.BOSH_TYPE_TERMINATE, body.Type)
+    assert.Empty(t, body.Condition)
+
+    body = juliet.request("", "")
+    assert.Equal(t, protocol.BOSH_TYPE_TERMINATE, body.Type)
+    assert.Equal(t, protocol.BOSH_CONDITION_ITEM_NOT_FOUND, body.Condition)
+}
+
+func Test_BOSHHostUnknown(t *testing.T) {
+    _, url := testBOSHServer(t)
+    c := &testBOSHClient{t: t, url: url}
+    body := c.post(" to='example.net' rid='1' wait='1' hold='1' ver='1.11'", "")
+    assert.Equal(t, protocol.BOSH_TYPE_TERMINATE, body.Type)
+    assert.Equal(t, protocol.BOSH_CONDITION_HOST_UNKNOWN, body.Condition)
+}
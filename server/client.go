@@ -1,6 +1,7 @@
 package server
 
 import (
+    "github.com/zonyitoo/goxmpp/auth"
     "github.com/zonyitoo/goxmpp/stream"
     "net"
 )
@@ -14,9 +15,10 @@ type TCPClient struct {
     stream *stream.ServerClientStream
 }
 
-func NewTCPClient(conn net.Conn, a *stream.SASLAuthenticator, shandler stream.StanzaHandler) *TCPClient {
+func NewTCPClient(conn net.Conn, domain string, features []stream.FeatureNegotiator,
+    a *auth.Authenticator, shandler stream.StanzaHandler) *TCPClient {
     return &TCPClient{
-        stream: stream.NewServerClientStream(conn, a, shandler),
+        stream: stream.NewServerClientStream(conn, domain, features, a, shandler),
     }
 }
 
@@ -0,0 +1,90 @@
+package server
+
+import (
+    "github.com/zonyitoo/goxmpp/protocol"
+    "github.com/zonyitoo/goxmpp/stream"
+    "log"
+    "net"
+    "sync"
+)
+
+// XEP-0114
+//
+// ComponentListener accepts external components, such as gateways and bots,
+// on its listener. A component authenticates with the secret configured for
+// its domain and then receives every stanza the Router has for the domain;
+// the stanzas it sends are routed like those of a local session, from the
+// address the component chose at its domain.
+type ComponentListener struct {
+    listener net.Listener
+    router   *Router
+    lock     sync.RWMutex
+    secrets  map[string]string
+}
+
+func NewComponentListener(listener net.Listener, router *Router) *ComponentListener {
+    return &ComponentListener{
+        listener: listener,
+        router:   router,
+        secrets:  make(map[string]string),
+    }
+}
+
+// Lets a component serve domain, e.g. a subdomain of the server such as
+// bot.example.com, if it knows secret.
+func (l *ComponentListener) AddComponent(domain, secret string) {
+    l.lock.Lock()
+    defer l.lock.Unlock()
+    l.secrets[domain] = secret
+}
+
+func (l *ComponentListener) secret(domain string) (string, bool) {
+    l.lock.RLock()
+    defer l.lock.RUnlock()
+    secret, ok := l.secrets[domain]
+    return secret, ok
+}
+
+// XEP-0114 Section 3.1: a domain is served by a single component
+func (l *ComponentListener) claim(scs *stream.ServerComponentStream) bool {
+    return l.router.AddComponent(scs.Domain(), scs)
+}
+
+// Accepts components until the listener is closed.
+func (l *ComponentListener) Serve() {
+    log.Printf("Component listener listening %+v", l.listener.Addr())
+    for {
+        conn, err := l.listener.Accept()
+        if err != nil {
+            return
+        }
+        go l.serve(conn)
+    }
+}
+
+func (l *ComponentListener) serve(conn net.Conn) {
+    scs := stream.NewServerComponentStream(conn, l.secret, l.claim, &componentHandler{l.router})
+    if scs.Start() != nil {
+        return
+    }
+    log.Printf("Component %s connected from %+v", scs.Domain(), scs.RemoteAddr())
+    scs.Run()
+}
+
+// Routes the stanzas of components, whose stream has checked that they come
+// from the domain of the component.
+type componentHandler struct {
+    router *Router
+}
+
+func (h *componentHandler) HandleIQ(iq *protocol.XMPPStanzaIQ, s stream.Streamer) error {
+    return h.router.routeIQ(iq, s, s.Writer())
+}
+
+func (h *componentHandler) HandleMessage(msg *protocol.XMPPStanzaMessage, s stream.Streamer) error {
+    return h.router.routeMessage(msg, s, s.Writer())
+}
+
+func (h *componentHandler) HandlePresence(presence *protocol.XMPPStanzaPresence, s stream.Streamer) error {
+    return h.router.routePresence(presence, s, s.Writer())
+}
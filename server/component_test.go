@@ -0,0 +1,102 @@
+package server
+
+import (
+    "github.com/stretchr/testify/assert"
+    "github.com/zonyitoo/goxmpp/protocol"
+    "github.com/zonyitoo/goxmpp/stream"
+    "net"
+    "testing"
+)
+
+// Answers every message with the same body, from the address it was sent to.
+type testEchoComponent struct {
+    nopStanzaHandler
+}
+
+func (h *testEchoComponent) HandleMessage(msg *protocol.XMPPStanzaMessage, s stream.Streamer) error {
+    return s.Writer().SendElement(&protocol.XMPPStanzaMessage{
+        From: msg.To,
+        To:   msg.From,
+        Type: msg.Type,
+        Body: msg.Body,
+    })
+}
+
+// Starts a server like testServer accepting a component for bot.example.com
+// with the secret "s3cret". Returns the address of the server and the one of
+// the component listener.
+func testComponentServer(t *testing.T) (string, string) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    addr := testServerWith(t, func(s *TCPServer) {
+        s.EnableComponents(listener).AddComponent("bot.example.com", "s3cret")
+    })
+    return addr, listener.Addr().String()
+}
+
+func Test_ComponentRoute(t *testing.T) {
+    addr, componentAddr := testComponentServer(t)
+    bot, err := stream.DialComponent(componentAddr, "bot.example.com", "s3cret", &testEchoComponent{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    go bot.Run()
+    romeo := testDial(t, addr, "romeo", "orchard")
+
+    romeo.Writer().SendElement(&protocol.XMPPStanzaMessage{
+        To:   "echo@bot.example.com",
+        Type: protocol.XMPP_STANZA_MESSAGE_TYPE_CHAT,
+        Body: &protocol.XMPPStanzaMessageBody{Data: "Hello"},
+    })
+    elem, err := romeo.Reader().NextElement()
+    assert.NoError(t, err)
+    if msg, ok := elem.(*protocol.XMPPStanzaMessage); assert.True(t, ok) {
+        assert.Equal(t, "echo@bot.example.com", msg.From)
+        assert.Equal(t, "Hello", msg.Body.Data)
+    }
+}
+
+// XEP-0114 Section 3
+func Test_ComponentNotAuthorized(t *testing.T) {
+    _, componentAddr := testComponentServer(t)
+    _, err := stream.DialComponent(componentAddr, "bot.example.com", "wrong", &nopStanzaHandler{})
+    assert.Equal(t, stream.ComponentStreamNotAuthorizedError, err)
+
+    _, err = stream.DialComponent(componentAddr, "gateway.example.com", "s3cret", &nopStanzaHandler{})
+    assert.Equal(t, stream.ComponentStreamErrorReceivedError, err)
+}
+
+func Test_ComponentConflict(t *testing.T) {
+    _, componentAddr := testComponentServer(t)
+    bot, err := stream.DialComponent(componentAddr, "bot.example.com", "s3cret", &nopStanzaHandler{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer bot.Close(true)
+
+    // The conflict replaces the handshake confirmation
+    _, err = stream.DialComponent(componentAddr, "bot.example.com", "s3cret", &nopStanzaHandler{})
+    assert.Equal(t, stream.ComponentStreamConflictError, err)
+}
+
+// XEP-0114 Section 3.1
+func Test_ComponentInvalidFrom(t *testing.T) {
+    _, componentAddr := testComponentServer(t)
+    bot, err := stream.DialComponent(componentAddr, "bot.example.com", "s3cret", &nopStanzaHandler{})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    bot.Writer().SendElement(&protocol.XMPPStanzaMessage{
+        From: "juliet@example.com",
+        To:   "romeo@example.com",
+        Body: &protocol.XMPPStanzaMessageBody{Data: "Spoofed"},
+    })
+    elem, err := bot.Reader().NextElement()
+    assert.NoError(t, err)
+    if streamError, ok := elem.(*protocol.XMPPStreamError); assert.True(t, ok) {
+        assert.NotNil(t, streamError.InvalidFrom)
+    }
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+    "crypto/tls"
+    "errors"
+    "github.com/zonyitoo/goxmpp/protocol"
+    "log"
+    "net"
+    "time"
+)
+
+var (
+    DirectTLSNoConfigError = errors.New("No TLS configuration for the connection")
+)
+
+// How long a peer may take to complete the TLS handshake.
+const DirectTLSHandshakeTimeout = 30 * time.Second
+
+// XEP-0368
+//
+// DirectTLSServer accepts connections which start with a TLS handshake
+// instead of negotiating STARTTLS, e.g. on port 443 behind firewalls which
+// block or strip STARTTLS. The ALPN protocol chosen by the peer selects the
+// stream: xmpp-server connections are served by the Federation of the
+// TCPServer, if enabled, and all others as its clients. The TLS
+// configurations of the TCPServer and of its Federation are used.
+type DirectTLSServer struct {
+    listener net.Listener
+    server   *TCPServer
+    clients  chan Client
+}
+
+// Creates a direct TLS listener for server, next to its STARTTLS listener.
+func NewDirectTLSServer(listener net.Listener, server *TCPServer) *DirectTLSServer {
+    return &DirectTLSServer{
+        listener: listener,
+        server:   server,
+        clients:  make(chan Client),
+    }
+}
+
+// XEP-0368 Section 4
+//
+// Offers xmpp-server to peers which ask for it when federation is enabled,
+// and xmpp-client otherwise.
+func (s *DirectTLSServer) configForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+    if f := s.server.federation; f != nil && contains(hello.SupportedProtos, protocol.XMPP_ALPN_SERVER) {
+        config := f.serverConfig.Clone()
+        config.NextProtos = []string{protocol.XMPP_ALPN_SERVER}
+        return config, nil
+    }
+    if s.server.tlsConfig == nil {
+        return nil, DirectTLSNoConfigError
+    }
+    config := s.server.tlsConfig.Clone()
+    config.NextProtos = []string{protocol.XMPP_ALPN_CLIENT}
+    return config, nil
+}
+
+// Completes the TLS handshake, then serves other servers directly and hands
+// clients over to Accept. The streams know that they are encrypted, so they
+// do not offer STARTTLS and advertise the SASL mechanisms which need TLS.
+func (s *DirectTLSServer) handshake(conn net.Conn) {
+    tlsConn := tls.Server(conn, &tls.Config{GetConfigForClient: s.configForClient})
+    tlsConn.SetDeadline(time.Now().Add(DirectTLSHandshakeTimeout))
+    if err := tlsConn.Handshake(); err != nil {
+        log.Printf("TLS handshake with %+v failed: %s", conn.RemoteAddr(), err)
+        conn.Close()
+        return
+    }
+    tlsConn.SetDeadline(time.Time{})
+
+    if tlsConn.ConnectionState().NegotiatedProtocol == protocol.XMPP_ALPN_SERVER {
+        s.server.federation.serve(tlsConn, false)
+        return
+    }
+    s.clients <- &TCPClient{stream: s.server.newStream(tlsConn, s.server.streamFeatures(false))}
+}
+
+// Returns the next client which completed the TLS handshake.
+func (s *DirectTLSServer) Accept() Client {
+    return <-s.clients
+}
+
+func (s *DirectTLSServer) Serve() {
+    log.Printf("Direct TLS server listening %+v", s.listener.Addr())
+    go func() {
+        for {
+            conn, err := s.listener.Accept()
+            if err != nil {
+                return
+            }
+            go s.handshake(conn)
+        }
+    }()
+    for {
+        c := s.Accept()
+        log.Printf("Client %+v connected", c.Stream().RemoteAddr())
+        go c.Run()
+    }
+}
+
+func contains(list []string, s string) bool {
+    for _, item := range list {
+        if item == s {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "github.com/stretchr/testify/assert"
+    "github.com/zonyitoo/goxmpp/auth"
+    "github.com/zonyitoo/goxmpp/basic"
+    "github.com/zonyitoo/goxmpp/protocol"
+    "github.com/zonyitoo/goxmpp/stream"
+    "testing"
+)
+
+// Starts a server for example.com with a certificate issued by ca, accepting
+// any username with the password "secret" over PLAIN, SCRAM-SHA-1 and
+// SCRAM-SHA-1-PLUS, and a direct TLS listener for it. Returns the address of
+// the latter.
+func testDirectTLSServer(t *testing.T, ca *testCA) string {
+    keys := auth.NewSCRAMKeys(auth.SCRAMSHA1, "secret", []byte("salt"), 4096)
+    credentials := auth.SCRAMCredentialsFunc(func(username string, h *auth.SCRAMHash) (*auth.SCRAMKeys, error) {
+        return keys, nil
+    })
+    authenticator := auth.NewAuthenticator()
+    authenticator.Register(auth.NewSCRAMServer(auth.SCRAMSHA1, credentials))
+    authenticator.Register(auth.NewSCRAMPlusServer(auth.SCRAMSHA1, credentials))
+    authenticator.Register(auth.NewPlainServer(auth.PlainCredentialsFunc(func(username, password string) (bool, error) {
+        return password == "secret", nil
+    })))
+
+    config := ca.config(t, ca, func(c *x509.Certificate) {
+        c.DNSNames = []string{"example.com"}
+    })
+    server := NewTCPServer(testListen(t), "example.com", config, authenticator, &nopStanzaHandler{})
+    listener := testListen(t)
+    go NewDirectTLSServer(listener, server).Serve()
+    return listener.Addr().String()
+}
+
+func testDirectTLSDial(t *testing.T, addr string, config *tls.Config) *tls.Conn {
+    conn, err := tls.Dial("tcp", addr, config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return conn
+}
+
+// XEP-0368 Section 4
+func Test_DirectTLSClient(t *testing.T) {
+    ca := testNewCA(t)
+    addr := testDirectTLSServer(t, ca)
+    config := &tls.Config{
+        RootCAs:    ca.pool,
+        ServerName: "example.com",
+        NextProtos: []string{protocol.XMPP_ALPN_CLIENT},
+    }
+
+    conn := testDirectTLSDial(t, addr, config)
+    assert.Equal(t, protocol.XMPP_ALPN_CLIENT, conn.ConnectionState().NegotiatedProtocol)
+    writer, reader := stream.NewWriter(conn), stream.NewReader(conn)
+    writer.Open(&protocol.XMPPStream{
+        To:      "example.com",
+        Version: "1.0",
+        Xmlns:   protocol.XMLNS_JABBER_CLIENT,
+    })
+    reader.NextElement()
+    elem, err := reader.NextElement()
+    assert.NoError(t, err)
+    if features, ok := elem.(*protocol.XMPPStreamFeatures); assert.True(t, ok) {
+        assert.Nil(t, features.StartTLS)
+        if assert.NotNil(t, features.SASLMechanisms) {
+            assert.Contains(t, features.SASLMechanisms.Mechanisms, "SCRAM-SHA-1-PLUS")
+            assert.Contains(t, features.SASLMechanisms.Mechanisms, "PLAIN")
+        }
+    }
+    conn.Close()
+
+    // The channel is bound to the TLS connection established before the stream
+    mechanisms := []auth.ClientMechanism{
+        auth.NewSCRAMPlusClient(auth.SCRAMSHA1, auth.ChannelBindingTLSExporter, "", "juliet", "secret"),
+    }
+    conn = testDirectTLSDial(t, addr, config)
+    juliet := stream.NewClientStream(conn, xmpp.NewJID("juliet", "example.com", "balcony"), nil, mechanisms, nil)
+    if err := juliet.Start(); err != nil {
+        t.Fatal(err)
+    }
+    assert.Equal(t, "juliet@example.com/balcony", juliet.JID().String())
+}
+
+// Servers are refused unless federation is enabled
+func Test_DirectTLSServerRefused(t *testing.T) {
+    ca := testNewCA(t)
+    addr := testDirectTLSServer(t, ca)
+    _, err := tls.Dial("tcp", addr, &tls.Config{
+        RootCAs:    ca.pool,
+        ServerName: "example.com",
+        NextProtos: []string{protocol.XMPP_ALPN_SERVER},
+    })
+    assert.Error(t, err)
+}
+
+func Test_DirectTLSFederation(t *testing.T) {
+    domains := testDomains{}
+    comConfig, netConfig := testFederationConfigs(t, testNewCA(t))
+    keys := auth.NewSCRAMKeys(auth.SCRAMSHA1, "secret", []byte("salt"), 4096)
+    authenticator := auth.NewAuthenticator()
+    authenticator.Register(auth.NewSCRAMServer(auth.SCRAMSHA1,
+        auth.SCRAMCredentialsFunc(func(username string, h *auth.SCRAMHash) (*auth.SCRAMKeys, error) {
+            return keys, nil
+        })))
+    server := NewTCPServer(testListen(t), "example.net", netConfig, authenticator, &nopStanzaHandler{})
+    server.EnableFederation(testListen(t), "dialback secret", netConfig).SetDialer(domains.dial)
+    listener := testListen(t)
+    go NewDirectTLSServer(listener, server).Serve()
+
+    // crypto/tls cannot verify the SRV-ID of example.net
+    config := comConfig.Clone()
+    config.InsecureSkipVerify = true
+    config.NextProtos = []string{protocol.XMPP_ALPN_SERVER}
+    conn := testDirectTLSDial(t, listener.Addr().String(), config)
+    assert.Equal(t, protocol.XMPP_ALPN_SERVER, conn.ConnectionState().NegotiatedProtocol)
+    writer, reader := stream.NewWriter(conn), stream.NewReader(conn)
+    writer.Open(&protocol.XMPPStream{
+        From:    "example.com",
+        To:      "example.net",
+        Version: "1.0",
+        Xmlns:   protocol.XMLNS_JABBER_SERVER,
+    })
+    reader.NextElement()
+    elem, err := reader.NextElement()
+    assert.NoError(t, err)
+    if features, ok := elem.(*protocol.XMPPStreamFeatures); assert.True(t, ok) {
+        assert.Nil(t, features.StartTLS)
+        if assert.NotNil(t, features.SASLMechanisms) {
+            assert.Equal(t, []string{"EXTERNAL"}, features.SASLMechanisms.Mechanisms)
+        }
+    }
+}
@@ -0,0 +1,321 @@
+package server
+
+import (
+    "crypto/tls"
+    "github.com/zonyitoo/goxmpp/auth"
+    "github.com/zonyitoo/goxmpp/basic"
+    "github.com/zonyitoo/goxmpp/protocol"
+    "github.com/zonyitoo/goxmpp/stream"
+    "log"
+    "net"
+    "sync"
+)
+
+// Federation exchanges stanzas between the domain of a server and other
+// domains (RFC6120 Section 4.7.5). Stanzas to another domain are sent over an
+// outgoing stream, which is opened in the background on first use and kept
+// for later stanzas.
+// Streams from other servers are accepted on the listener and their stanzas
+// delivered by the Router.
+//
+// Streams in both directions must be encrypted with TLS. A server is
+// authenticated with SASL EXTERNAL if its certificate is valid for its domain
+// (RFC6120 Section 13.7.1.2), otherwise with dialback (XEP-0220) unless
+// disabled with SetDialback.
+type Federation struct {
+    listener      net.Listener
+    domain        string
+    secret        string
+    config        *tls.Config
+    serverConfig  *tls.Config
+    router        *Router
+    authenticator *auth.Authenticator
+    sasl          *stream.SASLFeature
+    dialback      *stream.DialbackFeature
+    fallback      bool
+    resolver      stream.Resolver
+    dialer        func(domain string) (net.Conn, error)
+    lock          sync.Mutex
+    outgoing      map[string]*stream.OutgoingServerStream
+    pending       map[string][]protocol.Protocol
+}
+
+// Creates the federation of domain. The secret the dialback keys are
+// generated from must be the same for all instances serving the domain.
+//
+// The certificate of config is presented to other servers in both
+// directions, so it must be valid for domain and allow both server and client
+// authentication. The certificates of other servers are verified against the
+// RootCAs of config, or its ClientCAs for incoming streams if they are set.
+func NewFederation(listener net.Listener, domain, secret string, config *tls.Config, router *Router) *Federation {
+    // The certificate of a peer is verified by auth.DomainExternalServer, so
+    // that peers without a valid certificate can still use dialback
+    serverConfig := config.Clone()
+    serverConfig.ClientAuth = tls.RequestClientCert
+    roots := config.ClientCAs
+    if roots == nil {
+        roots = config.RootCAs
+    }
+    authenticator := auth.NewAuthenticator()
+    authenticator.Register(auth.NewDomainExternalServer(roots))
+
+    f := &Federation{
+        listener:      listener,
+        domain:        domain,
+        secret:        secret,
+        config:        config,
+        serverConfig:  serverConfig,
+        router:        router,
+        authenticator: authenticator,
+        sasl:          stream.NewSASLFeature(),
+        fallback:      true,
+        resolver:      net.DefaultResolver,
+        outgoing:      make(map[string]*stream.OutgoingServerStream),
+        pending:       make(map[string][]protocol.Protocol),
+    }
+    f.dialback = stream.NewDialbackFeature(secret, f.dial, config)
+    return f
+}
+
+// Sets whether servers may authenticate with dialback when their certificate
+// does not prove their domain, in both directions. Enabled by default.
+func (f *Federation) SetDialback(enabled bool) {
+    f.fallback = enabled
+}
+
+// Sets the resolver the servers of other domains are looked up with, see
+// stream.DialService. net.DefaultResolver is used by default.
+func (f *Federation) SetResolver(r stream.Resolver) {
+    f.resolver = r
+}
+
+// Sets how the servers of other domains are connected to, replacing the
+// lookup of their SRV records.
+func (f *Federation) SetDialer(dialer func(domain string) (net.Conn, error)) {
+    f.dialer = dialer
+}
+
+func (f *Federation) dial(domain string) (net.Conn, error) {
+    if f.dialer != nil {
+        return f.dialer(domain)
+    }
+    return stream.DialService(f.resolver, domain, protocol.XMPP_DNS_SRV_SERVER, nil)
+}
+
+// Sends a stanza to another domain. The first stanza to a domain starts
+// connecting to it in the background, and stanzas are queued until the stream
+// is authenticated, so that senders never wait for the lookup, TLS or
+// dialback of a remote server.
+func (f *Federation) Route(domain string, stanza protocol.Protocol) error {
+    f.lock.Lock()
+    if oss := f.outgoing[domain]; oss != nil {
+        f.lock.Unlock()
+        return oss.Send(stanza)
+    }
+    queue, connecting := f.pending[domain]
+    f.pending[domain] = append(queue, stanza)
+    f.lock.Unlock()
+
+    if !connecting {
+        go f.connect(domain)
+    }
+    return nil
+}
+
+// Opens the outgoing stream to domain and sends the stanzas queued for it, in
+// order, before it is used for new ones. If it cannot be opened, the queued
+// stanzas are bounced to their senders.
+func (f *Federation) connect(domain string) {
+    oss, err := f.open(domain)
+    if err != nil {
+        log.Printf("Cannot connect to %s: %s", domain, err)
+    } else {
+        oss.AddCloseHandler(func(closed *stream.OutgoingServerStream) {
+            f.lock.Lock()
+            defer f.lock.Unlock()
+            if f.outgoing[domain] == closed {
+                delete(f.outgoing, domain)
+            }
+        })
+        go oss.Run()
+    }
+
+    for {
+        f.lock.Lock()
+        queue := f.pending[domain]
+        if len(queue) == 0 {
+            delete(f.pending, domain)
+            if oss != nil {
+                f.outgoing[domain] = oss
+            }
+            f.lock.Unlock()
+            return
+        }
+        f.pending[domain] = nil
+        f.lock.Unlock()
+
+        for _, stanza := range queue {
+            if oss == nil || oss.Send(stanza) != nil {
+                f.router.bounceRemote(stanza)
+            }
+        }
+    }
+}
+
+func (f *Federation) open(domain string) (*stream.OutgoingServerStream, error) {
+    conn, err := f.dial(domain)
+    if err != nil {
+        return nil, err
+    }
+    secret := ""
+    if f.fallback {
+        secret = f.secret
+    }
+    oss := stream.NewOutgoingServerStream(conn, f.domain, domain, f.config, secret)
+    if err := oss.Start(); err != nil {
+        return nil, err
+    }
+    return oss, nil
+}
+
+// Errors for stanzas from another domain are sent back over federation.
+type remoteReplier struct {
+    federation *Federation
+    domain     string
+}
+
+func (r *remoteReplier) SendElement(elem protocol.Protocol) error {
+    return r.federation.Route(r.domain, elem)
+}
+
+func (f *Federation) replyTo(domain string) replier {
+    return &remoteReplier{federation: f, domain: domain}
+}
+
+// Accepts streams from other servers until the listener is closed.
+func (f *Federation) Serve() {
+    log.Printf("Federation listening %+v", f.listener.Addr())
+    for {
+        conn, err := f.listener.Accept()
+        if err != nil {
+            return
+        }
+        go f.serve(conn, true)
+    }
+}
+
+// Runs the stream of another server. Connections accepted over direct TLS
+// (XEP-0368) are encrypted already, so STARTTLS is only offered if starttls
+// is set.
+func (f *Federation) serve(conn net.Conn, starttls bool) {
+    var features []stream.FeatureNegotiator
+    if starttls {
+        features = append(features, stream.NewTLSFeature(f.serverConfig, true))
+    }
+    features = append(features, f.sasl)
+    if f.fallback {
+        features = append(features, f.dialback)
+    }
+    sss := stream.NewServerServerStream(conn, f.domain, features, f.authenticator, &remoteHandler{f})
+    sss.SetHosts(f.hosts)
+    sss.Run()
+}
+
+// Whether stanzas to domain are accepted from other servers: those to the
+// domain of the server and to the domains of its components.
+func (f *Federation) hosts(domain string) bool {
+    return domain == f.domain || f.router.component(domain) != nil
+}
+
+// Routes the stanzas received from other domains like those of local
+// sessions, so that stanzas to the server or to the bare JID of an account
+// reach the local handler, and those to a component reach the component. The
+// stream has checked that they come from a verified domain and are addressed
+// to this one or to a component. Errors go back to the sending domain.
+type remoteHandler struct {
+    federation *Federation
+}
+
+func (h *remoteHandler) HandleIQ(iq *protocol.XMPPStanzaIQ, s stream.Streamer) error {
+    sender := h.sender(s, iq.From, iq.To)
+    defer sender.writer.Destroy()
+    return h.federation.router.routeIQ(iq, sender, h.replyTo(iq.From))
+}
+
+func (h *remoteHandler) HandleMessage(msg *protocol.XMPPStanzaMessage, s stream.Streamer) error {
+    sender := h.sender(s, msg.From, msg.To)
+    defer sender.writer.Destroy()
+    return h.federation.router.routeMessage(msg, sender, h.replyTo(msg.From))
+}
+
+func (h *remoteHandler) HandlePresence(presence *protocol.XMPPStanzaPresence, s stream.Streamer) error {
+    sender := h.sender(s, presence.From, presence.To)
+    defer sender.writer.Destroy()
+    return h.federation.router.routePresence(presence, sender, h.replyTo(presence.From))
+}
+
+// The stream the local handler sees for a stanza from another domain. Its JID
+// is the sender of the stanza, and what the handler writes is sent back over
+// federation: the incoming stream never carries stanzas back.
+type remoteSender struct {
+    stream.Streamer
+    jid    *xmpp.JID
+    writer *stream.Writer
+}
+
+func (s *remoteSender) JID() *xmpp.JID {
+    return s.jid
+}
+
+func (s *remoteSender) Writer() *stream.Writer {
+    return s.writer
+}
+
+// Handlers answer without addresses, as on client streams, so the answers
+// are addressed from the address the stanza was sent to, to its sender.
+func (h *remoteHandler) sender(s stream.Streamer, from, to string) *remoteSender {
+    jid, _ := xmpp.NewJIDFromString(from)
+    sender := &remoteSender{Streamer: s, jid: jid}
+    sender.writer = stream.NewStanzaWriter(func(stanza protocol.Protocol) {
+        if domain := addressReply(stanza, to, from); domain != "" {
+            h.federation.Route(domain, stanza)
+        }
+    })
+    return sender
+}
+
+// Fills in the addresses a stanza lacks. Returns the domain it is addressed
+// to, or "" if the address is malformed.
+func addressReply(stanza protocol.Protocol, from, to string) string {
+    switch t := stanza.(type) {
+    case *protocol.XMPPStanzaIQ:
+        t.From, t.To = defaultAddress(t.From, from), defaultAddress(t.To, to)
+        to = t.To
+    case *protocol.XMPPStanzaMessage:
+        t.From, t.To = defaultAddress(t.From, from), defaultAddress(t.To, to)
+        to = t.To
+    case *protocol.XMPPStanzaPresence:
+        t.From, t.To = defaultAddress(t.From, from), defaultAddress(t.To, to)
+        to = t.To
+    }
+    jid, err := xmpp.NewJIDFromString(to)
+    if err != nil {
+        return ""
+    }
+    return jid.Domain
+}
+
+func defaultAddress(address, fallback string) string {
+    if address == "" {
+        return fallback
+    }
+    return address
+}
+
+func (h *remoteHandler) replyTo(from string) replier {
+    jid, err := xmpp.NewJIDFromString(from)
+    if err != nil {
+        return h.federation.replyTo("")
+    }
+    return h.federation.replyTo(jid.Domain)
+}
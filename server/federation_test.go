@@ -0,0 +1,548 @@
+package server
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/asn1"
+    "errors"
+    "github.com/stretchr/testify/assert"
+    "github.com/zonyitoo/goxmpp/auth"
+    "github.com/zonyitoo/goxmpp/basic"
+    "github.com/zonyitoo/goxmpp/protocol"
+    "github.com/zonyitoo/goxmpp/stream"
+    "math/big"
+    "net"
+    "testing"
+    "time"
+)
+
+// Addresses of the server-to-server listeners of the test domains.
+type testDomains map[string]string
+
+func (d testDomains) dial(domain string) (net.Conn, error) {
+    addr, ok := d[domain]
+    if !ok {
+        return nil, errors.New("Unknown domain")
+    }
+    return net.Dial("tcp", addr)
+}
+
+func testListen(t *testing.T) net.Listener {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    return listener
+}
+
+// A certificate authority issuing the certificates of the test domains.
+type testCA struct {
+    cert *x509.Certificate
+    key  *ecdsa.PrivateKey
+    pool *x509.CertPool
+}
+
+func testNewCA(t *testing.T) *testCA {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    template := &x509.Certificate{
+        SerialNumber:          big.NewInt(1),
+        Subject:               pkix.Name{CommonName: "Test CA"},
+        NotBefore:             time.Now().Add(-time.Hour),
+        NotAfter:              time.Now().Add(time.Hour),
+        KeyUsage:              x509.KeyUsageCertSign,
+        BasicConstraintsValid: true,
+        IsCA:                  true,
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cert, err := x509.ParseCertificate(der)
+    if err != nil {
+        t.Fatal(err)
+    }
+    pool := x509.NewCertPool()
+    pool.AddCert(cert)
+    return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// Returns the TLS configuration of a server trusting ca, with a certificate
+// issued by issuer whose template is completed by setup.
+func (ca *testCA) config(t *testing.T, issuer *testCA, setup func(*x509.Certificate)) *tls.Config {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(2),
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(time.Hour),
+        KeyUsage:     x509.KeyUsageDigitalSignature,
+        ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+    }
+    setup(template)
+    der, err := x509.CreateCertificate(rand.Reader, template, issuer.cert, &key.PublicKey, issuer.key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return &tls.Config{
+        Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+        RootCAs:      ca.pool,
+    }
+}
+
+// Encodes a subjectAltName extension holding the SRV-ID of the XMPP server
+// service of domain.
+func testSRVNameExtension(t *testing.T, domain string) pkix.Extension {
+    value, err := asn1.MarshalWithParams("_xmpp-server."+domain, "tag:0,explicit,ia5")
+    if err != nil {
+        t.Fatal(err)
+    }
+    other, err := asn1.MarshalWithParams(struct {
+        TypeId asn1.ObjectIdentifier
+        Value  asn1.RawValue
+    }{asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 8, 7}, asn1.RawValue{FullBytes: value}}, "tag:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    san, err := asn1.Marshal([]asn1.RawValue{{FullBytes: other}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    return pkix.Extension{Id: asn1.ObjectIdentifier{2, 5, 29, 17}, Value: san}
+}
+
+// The configurations of example.com, with a dNSName, and example.net, with an
+// SRV-ID, both issued by ca.
+func testFederationConfigs(t *testing.T, ca *testCA) (*tls.Config, *tls.Config) {
+    comConfig := ca.config(t, ca, func(c *x509.Certificate) {
+        c.DNSNames = []string{"example.com"}
+    })
+    netConfig := ca.config(t, ca, func(c *x509.Certificate) {
+        c.ExtraExtensions = []pkix.Extension{testSRVNameExtension(t, "example.net")}
+    })
+    return comConfig, netConfig
+}
+
+// Starts a federated server for domain accepting any username with the
+// password "secret", and returns the address clients connect to.
+func testFederatedServer(t *testing.T, domains testDomains, domain string, config *tls.Config, dialback bool) string {
+    return testFederatedServerWith(t, domains, domain, config, dialback, &nopStanzaHandler{}, nil)
+}
+
+// Like testFederatedServer, passing the stanzas addressed to the server to
+// shandler, with setup called before the server starts serving if not nil.
+func testFederatedServerWith(t *testing.T, domains testDomains, domain string, config *tls.Config, dialback bool,
+    shandler stream.StanzaHandler, setup func(*TCPServer)) string {
+    keys := auth.NewSCRAMKeys(auth.SCRAMSHA1, "secret", []byte("salt"), 4096)
+    authenticator := auth.NewAuthenticator()
+    authenticator.Register(auth.NewSCRAMServer(auth.SCRAMSHA1,
+        auth.SCRAMCredentialsFunc(func(username string, h *auth.SCRAMHash) (*auth.SCRAMKeys, error) {
+            return keys, nil
+        })))
+
+    listener := testListen(t)
+    s2s := testListen(t)
+    domains[domain] = s2s.Addr().String()
+    server := NewTCPServer(listener, domain, nil, authenticator, shandler)
+    federation := server.EnableFederation(s2s, "dialback secret of "+domain, config)
+    federation.SetDialer(domains.dial)
+    federation.SetDialback(dialback)
+    if setup != nil {
+        setup(server)
+    }
+    go server.Serve()
+    return listener.Addr().String()
+}
+
+func testFederatedDial(t *testing.T, addr string, jid *xmpp.JID) *stream.ClientStream {
+    c, err := stream.Dial(addr, jid, "secret", nil, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return c
+}
+
+func testNextMessage(t *testing.T, c *stream.ClientStream) *protocol.XMPPStanzaMessage {
+    elem, err := c.Reader().NextElement()
+    if err != nil {
+        t.Fatal(err)
+    }
+    msg, ok := elem.(*protocol.XMPPStanzaMessage)
+    if !ok {
+        t.Fatalf("Expected a message, got %+v", elem)
+    }
+    return msg
+}
+
+// Both certificates prove their domain, so the servers authenticate with SASL
+// EXTERNAL and dialback is not needed
+func Test_FederationRoute(t *testing.T) {
+    domains := testDomains{}
+    comConfig, netConfig := testFederationConfigs(t, testNewCA(t))
+    julietAddr := testFederatedServer(t, domains, "example.com", comConfig, false)
+    romeoAddr := testFederatedServer(t, domains, "example.net", netConfig, false)
+    juliet := testFederatedDial(t, julietAddr, xmpp.NewJID("juliet", "example.com", "balcony"))
+    romeo := testFederatedDial(t, romeoAddr, xmpp.NewJID("romeo", "example.net", "orchard"))
+
+    juliet.Writer().SendElement(&protocol.XMPPStanzaMessage{
+        To:   "romeo@example.net",
+        Type: protocol.XMPP_STANZA_MESSAGE_TYPE_CHAT,
+        Body: &protocol.XMPPStanzaMessageBody{Data: "Wherefore art thou?"},
+    })
+    msg := testNextMessage(t, romeo)
+    assert.Equal(t, "juliet@example.com/balcony", msg.From)
+    assert.Equal(t, "Wherefore art thou?", msg.Body.Data)
+    // The stanza is delivered in the namespace of the client stream
+    assert.Equal(t, protocol.XMLNS_JABBER_CLIENT, msg.XMLName.Space)
+
+    // The answer goes over a stream in the opposite direction
+    romeo.Writer().SendElement(&protocol.XMPPStanzaMessage{
+        To:   "juliet@example.com/balcony",
+        Type: protocol.XMPP_STANZA_MESSAGE_TYPE_CHAT,
+        Body: &protocol.XMPPStanzaMessageBody{Data: "By a name I know not how to tell thee who I am"},
+    })
+    msg = testNextMessage(t, juliet)
+    assert.Equal(t, "romeo@example.net/orchard", msg.From)
+}
+
+func Test_FederationBounce(t *testing.T) {
+    domains := testDomains{}
+    comConfig, netConfig := testFederationConfigs(t, testNewCA(t))
+    julietAddr := testFederatedServer(t, domains, "example.com", comConfig, true)
+    testFederatedServer(t, domains, "example.net", netConfig, true)
+    juliet := testFederatedDial(t, julietAddr, xmpp.NewJID("juliet", "example.com", "balcony"))
+
+    // Errors from the remote domain come back over federation
+    juliet.Writer().SendElement(&protocol.XMPPStanzaMessage{
+        Id:   "msg1",
+        To:   "romeo@example.net",
+        Body: &protocol.XMPPStanzaMessageBody{Data: "Wherefore art thou?"},
+    })
+    msg := testNextMessage(t, juliet)
+    assert.Equal(t, "msg1", msg.Id)
+    assert.Equal(t, "romeo@example.net", msg.From)
+    if assert.NotNil(t, msg.Error) {
+        assert.NotNil(t, msg.Error.ServiceUnavailable)
+    }
+
+    juliet.Writer().SendElement(&protocol.XMPPStanzaMessage{
+        Id:   "msg2",
+        To:   "romeo@example.org",
+        Body: &protocol.XMPPStanzaMessageBody{Data: "Wherefore art thou?"},
+    })
+    msg = testNextMessage(t, juliet)
+    assert.Equal(t, "msg2", msg.Id)
+    if assert.NotNil(t, msg.Error) {
+        assert.NotNil(t, msg.Error.RemoteServerNotFound)
+    }
+}
+
+// Stanzas to a domain that is still being connected to are queued without
+// holding up their sender, and delivered in order once the stream is up
+func Test_FederationQueue(t *testing.T) {
+    domains := testDomains{}
+    comConfig, netConfig := testFederationConfigs(t, testNewCA(t))
+    release := make(chan struct{})
+    julietAddr := testFederatedServerWith(t, domains, "example.com", comConfig, false, &nopStanzaHandler{},
+        func(s *TCPServer) {
+            s.federation.SetDialer(func(domain string) (net.Conn, error) {
+                <-release
+                return domains.dial(domain)
+            })
+        })
+    romeoAddr := testFederatedServer(t, domains, "example.net", netConfig, false)
+    juliet := testFederatedDial(t, julietAddr, xmpp.NewJID("juliet", "example.com", "balcony"))
+    romeo := testFederatedDial(t, romeoAddr, xmpp.NewJID("romeo", "example.net", "orchard"))
+
+    for _, id := range []string{"msg1", "msg2", "msg3"} {
+        juliet.Writer().SendElement(&protocol.XMPPStanzaMessage{
+            Id:   id,
+            To:   "romeo@example.net",
+            Type: protocol.XMPP_STANZA_MESSAGE_TYPE_CHAT,
+            Body: &protocol.XMPPStanzaMessageBody{Data: "Wherefore art thou?"},
+        })
+    }
+    juliet.Writer().SendElement(&protocol.XMPPStanzaMessage{
+        Id:   "self",
+        To:   "juliet@example.com/balcony",
+        Type: protocol.XMPP_STANZA_MESSAGE_TYPE_CHAT,
+    })
+    assert.Equal(t, "self", testNextMessage(t, juliet).Id)
+
+    close(release)
+    for _, id := range []string{"msg1", "msg2", "msg3"} {
+        assert.Equal(t, id, testNextMessage(t, romeo).Id)
+    }
+}
+
+// Delivers the IQs addressed to the server to a channel, and answers them
+// without addresses like the handlers of the server if reply is set.
+type chanIQHandler struct {
+    nopStanzaHandler
+    iqs   chan *protocol.XMPPStanzaIQ
+    reply bool
+}
+
+func (h *chanIQHandler) HandleIQ(iq *protocol.XMPPStanzaIQ, s stream.Streamer) error {
+    h.iqs <- iq
+    if !h.reply {
+        return nil
+    }
+    return s.Writer().SendElement(&protocol.XMPPStanzaIQ{
+        Id:   iq.Id,
+        Type: protocol.XMPP_STANZA_IQ_TYPE_RESULT,
+    })
+}
+
+// RFC6120 Section 10.3 and 10.5.3.1: IQs from other domains to the server or
+// to the bare JID of an account are handled by the server
+func Test_FederationLocal(t *testing.T) {
+    domains := testDomains{}
+    comConfig, netConfig := testFederationConfigs(t, testNewCA(t))
+    handler := &chanIQHandler{iqs: make(chan *protocol.XMPPStanzaIQ, 2), reply: true}
+    julietAddr := testFederatedServer(t, domains, "example.com", comConfig, false)
+    testFederatedServerWith(t, domains, "example.net", netConfig, false, handler, nil)
+    juliet := testFederatedDial(t, julietAddr, xmpp.NewJID("juliet", "example.com", "balcony"))
+
+    for _, to := range []string{"example.net", "romeo@example.net"} {
+        juliet.Writer().SendElement(&protocol.XMPPStanzaIQ{
+            Id:   "ping",
+            To:   to,
+            Type: protocol.XMPP_STANZA_IQ_TYPE_GET,
+            Ping: &protocol.XMPPStanzaIQPing{},
+        })
+        iq := <-handler.iqs
+        assert.Equal(t, to, iq.To)
+        assert.Equal(t, "juliet@example.com/balcony", iq.From)
+
+        // The answer goes back over federation
+        elem, err := juliet.Reader().NextElement()
+        assert.NoError(t, err)
+        if result, ok := elem.(*protocol.XMPPStanzaIQ); assert.True(t, ok) {
+            assert.Equal(t, protocol.XMPP_STANZA_IQ_TYPE_RESULT, result.Type)
+            assert.Equal(t, "ping", result.Id)
+            assert.Equal(t, to, result.From)
+        }
+    }
+}
+
+// XEP-0114: other servers reach the components of a server over streams to
+// the domain of the component
+func Test_FederationComponent(t *testing.T) {
+    domains := testDomains{}
+    ca := testNewCA(t)
+    comConfig, _ := testFederationConfigs(t, ca)
+    netConfig := ca.config(t, ca, func(c *x509.Certificate) {
+        c.DNSNames = []string{"example.net", "bot.example.net"}
+    })
+    components := testListen(t)
+    julietAddr := testFederatedServer(t, domains, "example.com", comConfig, false)
+    testFederatedServerWith(t, domains, "example.net", netConfig, false, &nopStanzaHandler{}, func(s *TCPServer) {
+        s.EnableComponents(components).AddComponent("bot.example.net", "s3cret")
+    })
+    domains["bot.example.net"] = domains["example.net"]
+    handler := &chanIQHandler{iqs: make(chan *protocol.XMPPStanzaIQ, 1)}
+    bot, err := stream.DialComponent(components.Addr().String(), "bot.example.net", "s3cret", handler)
+    if err != nil {
+        t.Fatal(err)
+    }
+    go bot.Run()
+    juliet := testFederatedDial(t, julietAddr, xmpp.NewJID("juliet", "example.com", "balcony"))
+
+    juliet.Writer().SendElement(&protocol.XMPPStanzaIQ{
+        Id:   "ping",
+        To:   "echo@bot.example.net",
+        Type: protocol.XMPP_STANZA_IQ_TYPE_GET,
+        Ping: &protocol.XMPPStanzaIQPing{},
+    })
+    iq := <-handler.iqs
+    assert.Equal(t, "echo@bot.example.net", iq.To)
+    assert.Equal(t, "juliet@example.com/balcony", iq.From)
+}
+
+// The certificate of example.com is issued by a CA example.net does not
+// trust, so example.com authenticates with dialback
+func Test_FederationDialback(t *testing.T) {
+    domains := testDomains{}
+    ca := testNewCA(t)
+    _, netConfig := testFederationConfigs(t, ca)
+    comConfig := ca.config(t, testNewCA(t), func(c *x509.Certificate) {
+        c.DNSNames = []string{"example.com"}
+    })
+    julietAddr := testFederatedServer(t, domains, "example.com", comConfig, true)
+    romeoAddr := testFederatedServer(t, domains, "example.net", netConfig, true)
+    juliet := testFederatedDial(t, julietAddr, xmpp.NewJID("juliet", "example.com", "balcony"))
+    romeo := testFederatedDial(t, romeoAddr, xmpp.NewJID("romeo", "example.net", "orchard"))
+
+    juliet.Writer().SendElement(&protocol.XMPPStanzaMessage{
+        To:   "romeo@example.net",
+        Body: &protocol.XMPPStanzaMessageBody{Data: "Wherefore art thou?"},
+    })
+    msg := testNextMessage(t, romeo)
+    assert.Equal(t, "juliet@example.com/balcony", msg.From)
+
+    romeo.Writer().SendElement(&protocol.XMPPStanzaMessage{
+        To:   "juliet@example.com/balcony",
+        Body: &protocol.XMPPStanzaMessageBody{Data: "By a name I know not how to tell thee who I am"},
+    })
+    msg = testNextMessage(t, juliet)
+    assert.Equal(t, "romeo@example.net/orchard", msg.From)
+}
+
+// Without dialback a server needs a certificate of its domain
+func Test_FederationDialbackDisabled(t *testing.T) {
+    domains := testDomains{}
+    ca := testNewCA(t)
+    _, netConfig := testFederationConfigs(t, ca)
+    // The certificate is issued for another domain
+    comConfig := ca.config(t, ca, func(c *x509.Certificate) {
+        c.DNSNames = []string{"example.org"}
+    })
+    julietAddr := testFederatedServer(t, domains, "example.com", comConfig, true)
+    testFederatedServer(t, domains, "example.net", netConfig, false)
+    juliet := testFederatedDial(t, julietAddr, xmpp.NewJID("juliet", "example.com", "balcony"))
+
+    juliet.Writer().SendElement(&protocol.XMPPStanzaMessage{
+        Id:   "msg1",
+        To:   "romeo@example.net",
+        Body: &protocol.XMPPStanzaMessageBody{Data: "Wherefore art thou?"},
+    })
+    msg := testNextMessage(t, juliet)
+    assert.Equal(t, "msg1", msg.Id)
+    if assert.NotNil(t, msg.Error) {
+        assert.NotNil(t, msg.Error.RemoteServerNotFound)
+    }
+}
+
+// Servers must encrypt their streams before anything else
+func Test_FederationTLSRequired(t *testing.T) {
+    domains := testDomains{}
+    _, netConfig := testFederationConfigs(t, testNewCA(t))
+    testFederatedServer(t, domains, "example.net", netConfig, true)
+
+    conn, err := domains.dial("example.net")
+    if err != nil {
+        t.Fatal(err)
+    }
+    writer, reader := stream.NewWriter(conn), stream.NewReader(conn)
+    writer.Open(&protocol.XMPPStream{
+        From:    "example.com",
+        To:      "example.net",
+        Version: "1.0",
+        Xmlns:   protocol.XMLNS_JABBER_SERVER,
+    })
+    reader.NextElement()
+    elem, _ := reader.NextElement()
+    if features, ok := elem.(*protocol.XMPPStreamFeatures); assert.True(t, ok) {
+        if assert.NotNil(t, features.StartTLS) {
+            assert.NotNil(t, features.StartTLS.Required)
+        }
+        assert.Nil(t, features.Dialback)
+        assert.Nil(t, features.SASLMechanisms)
+    }
+
+    writer.SendElement(&protocol.XMPPDialbackResult{
+        From: "example.com",
+        To:   "example.net",
+        Key:  "guessed",
+    })
+    elem, err = reader.NextElement()
+    assert.NoError(t, err)
+    if streamError, ok := elem.(*protocol.XMPPStreamError); assert.True(t, ok) {
+        assert.NotNil(t, streamError.NotAuthorized)
+    }
+}
+
+// Opens a stream from "from" to "to" over conn and negotiates TLS, returning
+// the restarted stream.
+func testStartTLS(t *testing.T, conn net.Conn, from, to string, config *tls.Config) (*stream.Reader, *stream.Writer,
+    *protocol.XMPPStream, *protocol.XMPPStreamFeatures) {
+    header := &protocol.XMPPStream{
+        From:    from,
+        To:      to,
+        Version: "1.0",
+        Xmlns:   protocol.XMLNS_JABBER_SERVER,
+    }
+    writer, reader := stream.NewWriter(conn), stream.NewReader(conn)
+    writer.Open(header)
+    reader.NextElement()
+    reader.NextElement()
+    writer.SendElement(&protocol.XMPPStartTLS{})
+    if elem, err := reader.NextElement(); err != nil {
+        t.Fatal(err)
+    } else if _, ok := elem.(*protocol.XMPPTLSProceed); !ok {
+        t.Fatalf("Expected <proceed/>, got %+v", elem)
+    }
+
+    // crypto/tls cannot verify the SRV-ID of example.net
+    config = config.Clone()
+    config.InsecureSkipVerify = true
+    tlsConn := tls.Client(conn, config)
+    if err := tlsConn.Handshake(); err != nil {
+        t.Fatal(err)
+    }
+    writer.Destroy()
+    writer, reader = stream.NewWriter(tlsConn), stream.NewReader(tlsConn)
+    writer.Open(header)
+    elem, err := reader.NextElement()
+    if err != nil {
+        t.Fatal(err)
+    }
+    features, err := reader.NextElement()
+    if err != nil {
+        t.Fatal(err)
+    }
+    return reader, writer, elem.(*protocol.XMPPStream), features.(*protocol.XMPPStreamFeatures)
+}
+
+// A server that cannot prove it is authoritative for a domain cannot send
+// stanzas from it
+func Test_FederationSpoofed(t *testing.T) {
+    domains := testDomains{}
+    ca := testNewCA(t)
+    comConfig, netConfig := testFederationConfigs(t, ca)
+    testFederatedServer(t, domains, "example.com", comConfig, true)
+    testFederatedServer(t, domains, "example.net", netConfig, true)
+
+    conn, err := domains.dial("example.net")
+    if err != nil {
+        t.Fatal(err)
+    }
+    // The certificate of another domain does not prove example.com
+    spoofed := ca.config(t, ca, func(c *x509.Certificate) {
+        c.DNSNames = []string{"example.org"}
+    })
+    reader, writer, header, features := testStartTLS(t, conn, "example.com", "example.net", spoofed)
+    assert.NotNil(t, features.Dialback)
+    assert.Nil(t, features.SASLMechanisms)
+
+    writer.SendElement(&protocol.XMPPDialbackResult{
+        From: "example.com",
+        To:   "example.net",
+        Key:  stream.DialbackKey("guessed", "example.net", "example.com", header.Id),
+    })
+    elem, err := reader.NextElement()
+    assert.NoError(t, err)
+    if result, ok := elem.(*protocol.XMPPDialbackResult); assert.True(t, ok) {
+        assert.Equal(t, protocol.XMPP_DIALBACK_TYPE_INVALID, result.Type)
+    }
+
+    writer.SendElement(&protocol.XMPPStanzaMessage{
+        From: "juliet@example.com/balcony",
+        To:   "romeo@example.net",
+        Body: &protocol.XMPPStanzaMessageBody{Data: "Wherefore art thou?"},
+    })
+    elem, err = reader.NextElement()
+    assert.NoError(t, err)
+    if streamError, ok := elem.(*protocol.XMPPStreamError); assert.True(t, ok) {
+        assert.NotNil(t, streamError.InvalidFrom)
+    }
+}
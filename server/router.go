@@ -0,0 +1,383 @@
+package server
+
+import (
+    "github.com/zonyitoo/goxmpp/auth"
+    "github.com/zonyitoo/goxmpp/basic"
+    "github.com/zonyitoo/goxmpp/protocol"
+    "github.com/zonyitoo/goxmpp/storage"
+    "github.com/zonyitoo/goxmpp/stream"
+    "strings"
+    "sync"
+)
+
+// Router delivers stanzas between the client sessions of a domain following
+// RFC6120 Section 10. Stanzas addressed to the server itself, or to the bare
+// JID of an account in the case of IQs, are passed to the local handler.
+// Stanzas addressed to the domain of a component, see AddComponent, are sent
+// to the component.
+type Router struct {
+    domain     string
+    sessions   *stream.SessionRegistry
+    local      stream.StanzaHandler
+    federation *Federation
+    accounts   storage.AccountStore
+    lock       sync.RWMutex
+    components map[string]*stream.ServerComponentStream
+}
+
+func NewRouter(domain string, sessions *stream.SessionRegistry, local stream.StanzaHandler) *Router {
+    return &Router{
+        domain:     domain,
+        sessions:   sessions,
+        local:      local,
+        components: make(map[string]*stream.ServerComponentStream),
+    }
+}
+
+// Where the errors for a stanza are sent: the Writer of the local stream it
+// came from, or the federation for stanzas from other domains.
+type replier interface {
+    SendElement(protocol.Protocol) error
+}
+
+func (r *Router) Sessions() *stream.SessionRegistry {
+    return r.sessions
+}
+
+// Sets the store the accounts of the domain are kept in, so that stanzas to
+// an account that does not exist are answered with item-not-found rather than
+// service-unavailable. Without a store every account is assumed to exist.
+func (r *Router) SetAccounts(store storage.AccountStore) {
+    r.accounts = store
+}
+
+// Whether to is a JID at the domain whose account does not exist. Errors of
+// the store do not count as a missing account.
+func (r *Router) unknownAccount(to *xmpp.JID) bool {
+    if r.accounts == nil || to.Domain != r.domain || to.Local == "" {
+        return false
+    }
+    keys, err := r.accounts.SCRAMKeys(to.Local, auth.SCRAMSHA1)
+    return err == nil && keys == nil
+}
+
+// XEP-0114
+//
+// Routes the stanzas addressed to domain, or to any JID at it, to the
+// component stream until the stream is closed. Returns false if another
+// component serves the domain already.
+func (r *Router) AddComponent(domain string, s *stream.ServerComponentStream) bool {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+    if _, ok := r.components[domain]; ok {
+        return false
+    }
+    r.components[domain] = s
+    s.AddCloseHandler(func(stream.Streamer) {
+        r.lock.Lock()
+        defer r.lock.Unlock()
+        if r.components[domain] == s {
+            delete(r.components, domain)
+        }
+    })
+    return true
+}
+
+// Returns the component serving domain, or nil.
+func (r *Router) component(domain string) *stream.ServerComponentStream {
+    r.lock.RLock()
+    defer r.lock.RUnlock()
+    return r.components[domain]
+}
+
+// Parses the 'to' address. A nil JID means that the stanza is addressed to
+// the server (RFC6120 Section 10.3 and 10.4.1).
+//
+// RFC7622 Section 3.2 and 3.3: the localpart and domainpart compare without
+// regard to case, so they are folded here once for all lookups. The
+// resourcepart is case-sensitive.
+func (r *Router) resolve(to string) (*xmpp.JID, error) {
+    if to == "" {
+        return nil, nil
+    }
+    jid, err := xmpp.NewJIDFromString(to)
+    if err != nil {
+        return nil, err
+    }
+    jid.Local = strings.ToLower(jid.Local)
+    jid.Domain = strings.ToLower(jid.Domain)
+    if jid.Local == "" && jid.Domain == r.domain {
+        return nil, nil
+    }
+    return jid, nil
+}
+
+// Streams the stanza should be delivered to. A full JID without a session is
+// treated as its bare JID when fallback is set.
+func (r *Router) targets(to *xmpp.JID, fallback bool) []stream.Streamer {
+    if to.Resource != "" {
+        if s := r.sessions.Get(to); s != nil {
+            return []stream.Streamer{s}
+        }
+        if !fallback {
+            return nil
+        }
+    }
+    return r.sessions.Resources(&to.BareJID)
+}
+
+func (r *Router) HandleMessage(msg *protocol.XMPPStanzaMessage, s stream.Streamer) error {
+    msg.From = s.JID().String()
+    return r.routeMessage(msg, s, s.Writer())
+}
+
+// Routes a message whose sender has been set already. s is the stream it came
+// from, which is passed to the local handler, and errors are sent to reply.
+func (r *Router) routeMessage(msg *protocol.XMPPStanzaMessage, s stream.Streamer, reply replier) error {
+    to, err := r.resolve(msg.To)
+    if err != nil {
+        return r.bounceMessage(msg, reply, protocol.XMPP_STANZA_ERROR_TYPE_MODIFY,
+            protocol.XMPPStanzaErrorGroup{JIDMalformed: &protocol.XMPPStanzaErrorJIDMalformed{}})
+    }
+    if to == nil {
+        return r.local.HandleMessage(msg, s)
+    }
+    if c := r.component(to.Domain); c != nil {
+        return c.Send(msg)
+    }
+    if to.Domain != r.domain {
+        if !r.routeRemote(to.Domain, msg) {
+            return r.bounceMessage(msg, reply, protocol.XMPP_STANZA_ERROR_TYPE_CANCEL,
+                protocol.XMPPStanzaErrorGroup{RemoteServerNotFound: &protocol.XMPPStanzaErrorRemoteServerNotFound{}})
+        }
+        return nil
+    }
+    return r.deliverMessage(msg, to, reply)
+}
+
+// RFC6121 Section 8.5.3.2.1: messages to an unavailable resource are handled
+// as if they were addressed to the bare JID
+func (r *Router) deliverMessage(msg *protocol.XMPPStanzaMessage, to *xmpp.JID, reply replier) error {
+    if r.unknownAccount(to) {
+        return r.bounceMessage(msg, reply, protocol.XMPP_STANZA_ERROR_TYPE_CANCEL,
+            protocol.XMPPStanzaErrorGroup{ItemNotFound: &protocol.XMPPStanzaErrorItemNotFound{}})
+    }
+    targets := r.targets(to, true)
+    if len(targets) == 0 {
+        return r.bounceMessage(msg, reply, protocol.XMPP_STANZA_ERROR_TYPE_CANCEL,
+            protocol.XMPPStanzaErrorGroup{ServiceUnavailable: &protocol.XMPPStanzaErrorServiceUnavailable{}})
+    }
+    for _, target := range targets {
+        target.Writer().SendElement(msg)
+    }
+    return nil
+}
+
+func (r *Router) HandlePresence(presence *protocol.XMPPStanzaPresence, s stream.Streamer) error {
+    presence.From = s.JID().String()
+    return r.routePresence(presence, s, s.Writer())
+}
+
+func (r *Router) routePresence(presence *protocol.XMPPStanzaPresence, s stream.Streamer, reply replier) error {
+    to, err := r.resolve(presence.To)
+    if err != nil {
+        return r.bouncePresence(presence, reply, protocol.XMPP_STANZA_ERROR_TYPE_MODIFY,
+            protocol.XMPPStanzaErrorGroup{JIDMalformed: &protocol.XMPPStanzaErrorJIDMalformed{}})
+    }
+    if to == nil {
+        return r.local.HandlePresence(presence, s)
+    }
+    if c := r.component(to.Domain); c != nil {
+        return c.Send(presence)
+    }
+    if to.Domain != r.domain {
+        if !r.routeRemote(to.Domain, presence) {
+            return r.bouncePresence(presence, reply, protocol.XMPP_STANZA_ERROR_TYPE_CANCEL,
+                protocol.XMPPStanzaErrorGroup{RemoteServerNotFound: &protocol.XMPPStanzaErrorRemoteServerNotFound{}})
+        }
+        return nil
+    }
+    return r.deliverPresence(presence, to)
+}
+
+// RFC6120 Section 10.5.3: presence to an unavailable entity is silently ignored
+func (r *Router) deliverPresence(presence *protocol.XMPPStanzaPresence, to *xmpp.JID) error {
+    for _, target := range r.targets(to, false) {
+        target.Writer().SendElement(presence)
+    }
+    return nil
+}
+
+func (r *Router) HandleIQ(iq *protocol.XMPPStanzaIQ, s stream.Streamer) error {
+    iq.From = s.JID().String()
+    return r.routeIQ(iq, s, s.Writer())
+}
+
+func (r *Router) routeIQ(iq *protocol.XMPPStanzaIQ, s stream.Streamer, reply replier) error {
+    to, err := r.resolve(iq.To)
+    if err != nil {
+        return r.bounceIQ(iq, reply, protocol.XMPP_STANZA_ERROR_TYPE_MODIFY,
+            protocol.XMPPStanzaErrorGroup{JIDMalformed: &protocol.XMPPStanzaErrorJIDMalformed{}})
+    }
+
+    if to != nil && r.unknownAccount(to) {
+        return r.bounceIQ(iq, reply, protocol.XMPP_STANZA_ERROR_TYPE_CANCEL,
+            protocol.XMPPStanzaErrorGroup{ItemNotFound: &protocol.XMPPStanzaErrorItemNotFound{}})
+    }
+
+    // RFC6120 Section 10.5.3.1: the server handles IQs addressed to the bare
+    // JID of an account on behalf of the account
+    if to == nil || (to.Domain == r.domain && to.Resource == "") {
+        return r.local.HandleIQ(iq, s)
+    }
+    if c := r.component(to.Domain); c != nil {
+        return c.Send(iq)
+    }
+    if to.Domain != r.domain {
+        if !r.routeRemote(to.Domain, iq) {
+            return r.bounceIQ(iq, reply, protocol.XMPP_STANZA_ERROR_TYPE_CANCEL,
+                protocol.XMPPStanzaErrorGroup{RemoteServerNotFound: &protocol.XMPPStanzaErrorRemoteServerNotFound{}})
+        }
+        return nil
+    }
+    return r.deliverIQ(iq, to, reply)
+}
+
+func (r *Router) deliverIQ(iq *protocol.XMPPStanzaIQ, to *xmpp.JID, reply replier) error {
+    target := r.sessions.Get(to)
+    if target == nil {
+        return r.bounceIQ(iq, reply, protocol.XMPP_STANZA_ERROR_TYPE_CANCEL,
+            protocol.XMPPStanzaErrorGroup{ServiceUnavailable: &protocol.XMPPStanzaErrorServiceUnavailable{}})
+    }
+    target.Writer().SendElement(iq)
+    return nil
+}
+
+// RFC6120 Section 10.4.2
+//
+// Sends the stanza to another domain. Returns false if federation is not
+// enabled or the stream to the domain failed; stanzas that wait for a new
+// stream are bounced by the federation if it cannot be opened.
+func (r *Router) routeRemote(domain string, stanza protocol.Protocol) bool {
+    return r.federation != nil && r.federation.Route(domain, stanza) == nil
+}
+
+// Bounces a stanza that could not be sent to another domain to its sender.
+func (r *Router) bounceRemote(stanza protocol.Protocol) {
+    condition := protocol.XMPPStanzaErrorGroup{RemoteServerNotFound: &protocol.XMPPStanzaErrorRemoteServerNotFound{}}
+    switch t := stanza.(type) {
+    case *protocol.XMPPStanzaMessage:
+        if reply := r.replyTo(t.From); reply != nil {
+            r.bounceMessage(t, reply, protocol.XMPP_STANZA_ERROR_TYPE_CANCEL, condition)
+        }
+    case *protocol.XMPPStanzaPresence:
+        if reply := r.replyTo(t.From); reply != nil {
+            r.bouncePresence(t, reply, protocol.XMPP_STANZA_ERROR_TYPE_CANCEL, condition)
+        }
+    case *protocol.XMPPStanzaIQ:
+        if reply := r.replyTo(t.From); reply != nil {
+            r.bounceIQ(t, reply, protocol.XMPP_STANZA_ERROR_TYPE_CANCEL, condition)
+        }
+    }
+}
+
+// XEP-0198 Section 5
+//
+// Handles the stanzas that were sent to the session of jid but never
+// acknowledged, once the session is gone. Messages to the full JID are
+// re-routed to the other resources of the account and bounced to their sender
+// if there are none; IQs are bounced and presences dropped.
+func (r *Router) Reroute(jid *xmpp.JID, stanzas []protocol.Protocol) {
+    for _, stanza := range stanzas {
+        switch t := stanza.(type) {
+        case *protocol.XMPPStanzaMessage:
+            targets := r.sessions.Resources(&jid.BareJID)
+            if len(targets) == 0 {
+                if reply := r.replyTo(t.From); reply != nil {
+                    r.bounceMessage(t, reply, protocol.XMPP_STANZA_ERROR_TYPE_WAIT,
+                        protocol.XMPPStanzaErrorGroup{RecipientUnavailable: &protocol.XMPPStanzaErrorRecipientUnavailable{}})
+                }
+                continue
+            }
+            // Messages to the bare JID were delivered to the other resources already
+            if t.To != jid.String() {
+                continue
+            }
+            for _, target := range targets {
+                target.Writer().SendElement(t)
+            }
+        case *protocol.XMPPStanzaIQ:
+            if reply := r.replyTo(t.From); reply != nil {
+                r.bounceIQ(t, reply, protocol.XMPP_STANZA_ERROR_TYPE_WAIT,
+                    protocol.XMPPStanzaErrorGroup{RecipientUnavailable: &protocol.XMPPStanzaErrorRecipientUnavailable{}})
+            }
+        }
+    }
+}
+
+// Where errors for a stanza sent by from go: its local session if it is still
+// connected, or its domain. Returns nil if there is no way to reach it.
+func (r *Router) replyTo(from string) replier {
+    jid, err := xmpp.NewJIDFromString(from)
+    if err != nil {
+        return nil
+    }
+    if c := r.component(jid.Domain); c != nil {
+        return c.Writer()
+    }
+    if jid.Domain != r.domain {
+        if r.federation == nil {
+            return nil
+        }
+        return r.federation.replyTo(jid.Domain)
+    }
+    if sender := r.sessions.Get(jid); sender != nil {
+        return sender.Writer()
+    }
+    return nil
+}
+
+// RFC6120 Section 8.3.1
+//
+// Error stanzas are never answered with another error, to avoid loops.
+func (r *Router) bounceMessage(msg *protocol.XMPPStanzaMessage, reply replier,
+    errType string, condition protocol.XMPPStanzaErrorGroup) error {
+    if msg.Type == protocol.XMPP_STANZA_MESSAGE_TYPE_ERROR {
+        return nil
+    }
+    return reply.SendElement(&protocol.XMPPStanzaMessage{
+        From:  msg.To,
+        To:    msg.From,
+        Id:    msg.Id,
+        Type:  protocol.XMPP_STANZA_MESSAGE_TYPE_ERROR,
+        Error: &protocol.XMPPStanzaError{Type: errType, XMPPStanzaErrorGroup: condition},
+    })
+}
+
+func (r *Router) bouncePresence(presence *protocol.XMPPStanzaPresence, reply replier,
+    errType string, condition protocol.XMPPStanzaErrorGroup) error {
+    if presence.Type == protocol.XMPP_STANZA_PRESENCE_TYPE_ERROR {
+        return nil
+    }
+    return reply.SendElement(&protocol.XMPPStanzaPresence{
+        From:  presence.To,
+        To:    presence.From,
+        Id:    presence.Id,
+        Type:  protocol.XMPP_STANZA_PRESENCE_TYPE_ERROR,
+        Error: &protocol.XMPPStanzaError{Type: errType, XMPPStanzaErrorGroup: condition},
+    })
+}
+
+func (r *Router) bounceIQ(iq *protocol.XMPPStanzaIQ, reply replier,
+    errType string, condition protocol.XMPPStanzaErrorGroup) error {
+    if iq.Type == protocol.XMPP_STANZA_IQ_TYPE_ERROR || iq.Type == protocol.XMPP_STANZA_IQ_TYPE_RESULT {
+        return nil
+    }
+    return reply.SendElement(&protocol.XMPPStanzaIQ{
+        From:  iq.To,
+        To:    iq.From,
+        Id:    iq.Id,
+        Type:  protocol.XMPP_STANZA_IQ_TYPE_ERROR,
+        Error: &protocol.XMPPStanzaError{Type: errType, XMPPStanzaErrorGroup: condition},
+    })
+}
@@ -1,9 +1,13 @@
 package server
 
 import (
+    "crypto/tls"
+    "github.com/zonyitoo/goxmpp/auth"
+    "github.com/zonyitoo/goxmpp/storage"
     "github.com/zonyitoo/goxmpp/stream"
     "log"
     "net"
+    "time"
 )
 
 type Server interface {
@@ -13,28 +17,176 @@ type Server interface {
 
 type TCPServer struct {
     listener      net.Listener
-    authenticator *stream.SASLAuthenticator
-    shandler      stream.StanzaHandler
+    domain        string
+    tlsConfig     *tls.Config
+    authenticator *auth.Authenticator
+    router        *Router
+    handler       stream.StanzaHandler
+    anonymous     AnonymousPolicy
+    register      *stream.RegisterFeature
+    federation    *Federation
+    components    *ComponentListener
+    features      []stream.FeatureNegotiator
+    sessions      *stream.SessionRegistry
+    bindPolicy    stream.BindConflictPolicy
+    writerConfig  stream.WriterConfig
+    limits        stream.DecoderLimits
 }
 
-func NewTCPServer(listener net.Listener,
-    a *stream.SASLAuthenticator, shandler stream.StanzaHandler) *TCPServer {
+// Creates a server for domain. Stanzas are routed between the connected
+// clients; those addressed to the server are passed to shandler.
+func NewTCPServer(listener net.Listener, domain string, tlsConfig *tls.Config,
+    a *auth.Authenticator, shandler stream.StanzaHandler) *TCPServer {
+    sessions := stream.NewSessionRegistry()
+    router := NewRouter(domain, sessions, shandler)
     return &TCPServer{
         listener:      listener,
+        domain:        domain,
+        tlsConfig:     tlsConfig,
         authenticator: a,
-        shandler:      shandler,
+        router:        router,
+        handler:       router,
+        sessions:      sessions,
+        bindPolicy:    stream.BindConflictReplace,
+        writerConfig:  stream.DefaultWriterConfig,
+        limits:        stream.DefaultDecoderLimits,
     }
 }
 
+func (s *TCPServer) Sessions() *stream.SessionRegistry {
+    return s.sessions
+}
+
+func (s *TCPServer) Router() *Router {
+    return s.router
+}
+
+// Sets how resource conflicts are resolved for clients accepted afterwards.
+func (s *TCPServer) SetBindConflictPolicy(policy stream.BindConflictPolicy) {
+    s.bindPolicy = policy
+}
+
+// Sets how elements are queued and written to clients accepted afterwards,
+// e.g. to drop the stanzas routed to a slow client instead of stalling their
+// senders. stream.DefaultWriterConfig is used by default.
+func (s *TCPServer) SetWriterConfig(config stream.WriterConfig) {
+    s.writerConfig = config
+}
+
+// Sets the limits of what clients accepted afterwards may send. A client
+// exceeding them is disconnected with a policy-violation or
+// resource-constraint stream error. stream.DefaultDecoderLimits are used by
+// default.
+func (s *TCPServer) SetDecoderLimits(limits stream.DecoderLimits) {
+    s.limits = limits
+}
+
+// Restricts the stanzas of anonymous sessions accepted afterwards and
+// releases their state when they close. Without a policy they are routed like
+// those of any other session.
+func (s *TCPServer) SetAnonymousPolicy(policy AnonymousPolicy) {
+    s.anonymous = policy
+    if policy == nil {
+        s.handler = s.router
+        return
+    }
+    s.handler = &anonymousFilter{policy: policy, router: s.router}
+}
+
+// XEP-0077
+//
+// Lets clients accepted afterwards register accounts in the store before
+// authenticating, and manage their account once authenticated. Stanzas to
+// accounts missing from the store are bounced with item-not-found.
+func (s *TCPServer) EnableRegistration(store storage.AccountStore) {
+    s.register = stream.NewRegisterFeature(store)
+    s.router.SetAccounts(store)
+    s.router.local = stream.NewRegisterHandler(store, s.sessions, s.router.local)
+}
+
+// XEP-0198
+//
+// Offers stream management to clients accepted afterwards. Sessions can be
+// resumed within timeout after their connection is lost; the stanzas they
+// never acknowledged are then re-routed or bounced by the Router.
+func (s *TCPServer) EnableStreamManagement(timeout time.Duration) {
+    s.AddFeature(stream.NewSMFeature(s.sessions, timeout, s.router.Reroute))
+}
+
+// RFC6120 Section 4.7.5
+//
+// Accepts streams from other servers on listener and routes the stanzas
+// addressed to other domains over server-to-server streams. The streams are
+// encrypted with config and authenticated with the certificate of the domain,
+// or with dialback keys generated from secret. The returned Federation can be
+// configured until Serve is called.
+func (s *TCPServer) EnableFederation(listener net.Listener, secret string, config *tls.Config) *Federation {
+    s.federation = NewFederation(listener, s.domain, secret, config, s.router)
+    s.router.federation = s.federation
+    return s.federation
+}
+
+// XEP-0114
+//
+// Accepts external components on listener. The domains they may serve and
+// their secrets are added to the returned ComponentListener.
+func (s *TCPServer) EnableComponents(listener net.Listener) *ComponentListener {
+    s.components = NewComponentListener(listener, s.router)
+    return s.components
+}
+
+// Appends a stream feature to the pipeline of every client accepted afterwards.
+func (s *TCPServer) AddFeature(f stream.FeatureNegotiator) {
+    s.features = append(s.features, f)
+}
+
 func (s *TCPServer) Accept() Client {
     conn, err := s.listener.Accept()
     if err != nil {
         panic(err)
     }
-    return NewTCPClient(conn, s.authenticator, s.shandler)
+    return &TCPClient{stream: s.newStream(conn, s.streamFeatures(true))}
+}
+
+// Creates the stream of a client connected over any transport.
+func (s *TCPServer) newStream(conn net.Conn, features []stream.FeatureNegotiator) *stream.ServerClientStream {
+    scs := stream.NewServerClientStream(conn, s.domain, features, s.authenticator, s.handler)
+    scs.Writer().SetConfig(s.writerConfig)
+    scs.Reader().SetLimits(s.limits)
+    if policy := s.anonymous; policy != nil {
+        scs.AddCloseHandler(func(st stream.Streamer) {
+            if st.IsAnonymous() {
+                policy.Release(st)
+            }
+        })
+    }
+    return scs
+}
+
+// The features negotiated on every client stream: STARTTLS if TLS is
+// configured and offered on the transport, in-band registration if enabled,
+// SASL, resource binding and those added with AddFeature.
+func (s *TCPServer) streamFeatures(starttls bool) []stream.FeatureNegotiator {
+    var features []stream.FeatureNegotiator
+    if starttls && s.tlsConfig != nil {
+        features = append(features, stream.NewTLSFeature(s.tlsConfig, true))
+    }
+    if s.register != nil {
+        features = append(features, s.register)
+    }
+    features = append(features,
+        stream.NewSASLFeature(),
+        stream.NewBindFeature(s.sessions, s.bindPolicy))
+    return append(features, s.features...)
 }
 
 func (s *TCPServer) Serve() {
+    if s.federation != nil {
+        go s.federation.Serve()
+    }
+    if s.components != nil {
+        go s.components.Serve()
+    }
     log.Printf("Server listening %+v", s.listener.Addr())
     for {
         c := s.Accept()
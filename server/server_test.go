@@ -1 +1,370 @@
 package server
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "github.com/stretchr/testify/assert"
+    "github.com/zonyitoo/goxmpp/auth"
+    "github.com/zonyitoo/goxmpp/basic"
+    "github.com/zonyitoo/goxmpp/protocol"
+    "github.com/zonyitoo/goxmpp/storage"
+    "github.com/zonyitoo/goxmpp/stream"
+    "net"
+    "testing"
+    "time"
+)
+
+type nopStanzaHandler struct{}
+
+func (h *nopStanzaHandler) HandleIQ(*protocol.XMPPStanzaIQ, stream.Streamer) error {
+    return nil
+}
+
+func (h *nopStanzaHandler) HandleMessage(*protocol.XMPPStanzaMessage, stream.Streamer) error {
+    return nil
+}
+
+func (h *nopStanzaHandler) HandlePresence(*protocol.XMPPStanzaPresence, stream.Streamer) error {
+    return nil
+}
+
+// Starts a server for example.com accepting any username with the password
+// "secret".
+func testServer(t *testing.T) string {
+    return testServerWith(t, nil)
+}
+
+// Like testServer, with setup called before the server starts serving.
+func testServerWith(t *testing.T, setup func(*TCPServer)) string {
+    keys := auth.NewSCRAMKeys(auth.SCRAMSHA1, "secret", []byte("salt"), 4096)
+    authenticator := auth.NewAuthenticator()
+    authenticator.Register(auth.NewSCRAMServer(auth.SCRAMSHA1,
+        auth.SCRAMCredentialsFunc(func(username string, h *auth.SCRAMHash) (*auth.SCRAMKeys, error) {
+            if h != auth.SCRAMSHA1 {
+                return nil, nil
+            }
+            return keys, nil
+        })))
+    // Only offered on encrypted streams
+    authenticator.Register(auth.NewSCRAMPlusServer(auth.SCRAMSHA1,
+        auth.SCRAMCredentialsFunc(func(username string, h *auth.SCRAMHash) (*auth.SCRAMKeys, error) {
+            return keys, nil
+        })))
+    authenticator.Register(auth.NewPlainServer(auth.PlainCredentialsFunc(func(username, password string) (bool, error) {
+        return password == "secret", nil
+    })))
+
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    server := NewTCPServer(listener, "example.com", nil, authenticator, &nopStanzaHandler{})
+    if setup != nil {
+        setup(server)
+    }
+    go server.Serve()
+    return listener.Addr().String()
+}
+
+func testDial(t *testing.T, addr, local, resource string) *stream.ClientStream {
+    c, err := stream.Dial(addr, xmpp.NewJID(local, "example.com", resource), "secret", nil, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return c
+}
+
+func Test_RouteMessage(t *testing.T) {
+    addr := testServer(t)
+    juliet := testDial(t, addr, "juliet", "balcony")
+    romeo := testDial(t, addr, "romeo", "orchard")
+
+    romeo.Writer().SendElement(&protocol.XMPPStanzaMessage{
+        To:   "juliet@example.com",
+        Type: protocol.XMPP_STANZA_MESSAGE_TYPE_CHAT,
+        Body: &protocol.XMPPStanzaMessageBody{Data: "Wherefore art thou?"},
+    })
+
+    elem, err := juliet.Reader().NextElement()
+    assert.NoError(t, err)
+    if msg, ok := elem.(*protocol.XMPPStanzaMessage); assert.True(t, ok) {
+        assert.Equal(t, "romeo@example.com/orchard", msg.From)
+        assert.Equal(t, "Wherefore art thou?", msg.Body.Data)
+    }
+}
+
+func Test_RouteServiceUnavailable(t *testing.T) {
+    addr := testServer(t)
+    romeo := testDial(t, addr, "romeo", "orchard")
+
+    romeo.Writer().SendElement(&protocol.XMPPStanzaIQ{
+        To:   "juliet@example.com/balcony",
+        Id:   "ping1",
+        Type: protocol.XMPP_STANZA_IQ_TYPE_GET,
+        Ping: &protocol.XMPPStanzaIQPing{},
+    })
+
+    elem, err := romeo.Reader().NextElement()
+    assert.NoError(t, err)
+    if iq, ok := elem.(*protocol.XMPPStanzaIQ); assert.True(t, ok) {
+        assert.Equal(t, protocol.XMPP_STANZA_IQ_TYPE_ERROR, iq.Type)
+        assert.Equal(t, "ping1", iq.Id)
+        if assert.NotNil(t, iq.Error) {
+            assert.NotNil(t, iq.Error.ServiceUnavailable)
+        }
+    }
+}
+
+// The localpart and domainpart of the recipient are not case-sensitive
+func Test_RouteCaseInsensitive(t *testing.T) {
+    addr := testServer(t)
+    juliet := testDial(t, addr, "juliet", "balcony")
+    romeo := testDial(t, addr, "romeo", "orchard")
+
+    romeo.Writer().SendElement(&protocol.XMPPStanzaMessage{
+        To:   "Juliet@Example.COM/balcony",
+        Type: protocol.XMPP_STANZA_MESSAGE_TYPE_CHAT,
+        Body: &protocol.XMPPStanzaMessageBody{Data: "Wherefore art thou?"},
+    })
+    msg := testNextMessage(t, juliet)
+    assert.Equal(t, "romeo@example.com/orchard", msg.From)
+    assert.Equal(t, "Wherefore art thou?", msg.Body.Data)
+}
+
+// Stanzas to an account the domain does not have are answered with
+// item-not-found, those to an account without sessions with
+// service-unavailable
+func Test_RouteItemNotFound(t *testing.T) {
+    store := storage.NewMemoryStore()
+    assert.NoError(t, store.CreateUser("juliet", "secret"))
+    assert.NoError(t, store.CreateUser("romeo", "secret"))
+    addr := testServerWith(t, func(s *TCPServer) {
+        s.Router().SetAccounts(store)
+    })
+    romeo := testDial(t, addr, "romeo", "orchard")
+
+    for to, missing := range map[string]bool{
+        "tybalt@example.com/street": true,
+        "Tybalt@example.com":        true,
+        "juliet@example.com/garden": false,
+        "Juliet@example.com":        false,
+    } {
+        romeo.Writer().SendElement(&protocol.XMPPStanzaMessage{
+            Id:   to,
+            To:   to,
+            Type: protocol.XMPP_STANZA_MESSAGE_TYPE_CHAT,
+            Body: &protocol.XMPPStanzaMessageBody{Data: "Wherefore art thou?"},
+        })
+        msg := testNextMessage(t, romeo)
+        assert.Equal(t, to, msg.Id)
+        if assert.NotNil(t, msg.Error) {
+            assert.Equal(t, missing, msg.Error.ItemNotFound != nil)
+            assert.Equal(t, !missing, msg.Error.ServiceUnavailable != nil)
+        }
+    }
+
+    romeo.Writer().SendElement(&protocol.XMPPStanzaIQ{
+        To:   "tybalt@example.com",
+        Id:   "ping1",
+        Type: protocol.XMPP_STANZA_IQ_TYPE_GET,
+        Ping: &protocol.XMPPStanzaIQPing{},
+    })
+    elem, err := romeo.Reader().NextElement()
+    assert.NoError(t, err)
+    if iq, ok := elem.(*protocol.XMPPStanzaIQ); assert.True(t, ok) {
+        assert.Equal(t, "ping1", iq.Id)
+        if assert.NotNil(t, iq.Error) {
+            assert.NotNil(t, iq.Error.ItemNotFound)
+        }
+    }
+}
+
+// Records the sessions released by the policy.
+type testAnonymousPolicy struct {
+    DefaultAnonymousPolicy
+    released chan string
+}
+
+func (p *testAnonymousPolicy) Release(s stream.Streamer) {
+    p.released <- s.JID().String()
+}
+
+func Test_AnonymousPolicy(t *testing.T) {
+    authenticator := auth.NewAuthenticator()
+    authenticator.Register(auth.NewAnonymousServer())
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    server := NewTCPServer(listener, "example.com", nil, authenticator, &nopStanzaHandler{})
+    policy := &testAnonymousPolicy{released: make(chan string, 1)}
+    server.SetAnonymousPolicy(policy)
+    go server.Serve()
+
+    conn, err := net.Dial("tcp", listener.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    mechanisms := []auth.ClientMechanism{auth.NewAnonymousClient("")}
+    guest := stream.NewClientStream(conn, xmpp.NewJID("", "example.com", ""), nil, mechanisms, nil)
+    if err := guest.Start(); err != nil {
+        t.Fatal(err)
+    }
+
+    guest.Writer().SendElement(&protocol.XMPPStanzaIQ{
+        Id:     "roster1",
+        Type:   protocol.XMPP_STANZA_IQ_TYPE_GET,
+        Roster: &protocol.XMPPStanzaIQRosterQuery{},
+    })
+
+    elem, err := guest.Reader().NextElement()
+    assert.NoError(t, err)
+    if iq, ok := elem.(*protocol.XMPPStanzaIQ); assert.True(t, ok) {
+        assert.Equal(t, "roster1", iq.Id)
+        assert.Equal(t, protocol.XMPP_STANZA_IQ_TYPE_ERROR, iq.Type)
+        assert.NotNil(t, iq.Error.Forbidden)
+    }
+
+    go guest.Run()
+    guest.Close(true)
+    assert.Equal(t, guest.JID().String(), <-policy.released)
+}
+
+// Registration requires an encrypted stream, so the client connects with
+// direct TLS
+func Test_Registration(t *testing.T) {
+    store := storage.NewMemoryStore()
+    ca := testNewCA(t)
+    config := ca.config(t, ca, func(c *x509.Certificate) {
+        c.DNSNames = []string{"example.com"}
+    })
+    server := NewTCPServer(testListen(t), "example.com", config, storage.NewAuthenticator(store), &nopStanzaHandler{})
+    server.EnableRegistration(store)
+    listener := testListen(t)
+    go NewDirectTLSServer(listener, server).Serve()
+    addr := listener.Addr().String()
+    clientConfig := &tls.Config{
+        RootCAs:    ca.pool,
+        ServerName: "example.com",
+        NextProtos: []string{protocol.XMPP_ALPN_CLIENT},
+    }
+
+    // Register before authenticating
+    conn := testDirectTLSDial(t, addr, clientConfig)
+    writer := stream.NewWriter(conn)
+    writer.Open(&protocol.XMPPStream{To: "example.com", Version: "1.0", Xmlns: protocol.XMLNS_JABBER_CLIENT})
+    reader := stream.NewReader(conn)
+    reader.NextElement()
+    elem, err := reader.NextElement()
+    assert.NoError(t, err)
+    if features, ok := elem.(*protocol.XMPPStreamFeatures); assert.True(t, ok) {
+        assert.NotNil(t, features.Register)
+    }
+    writer.SendElement(&protocol.XMPPStanzaIQ{
+        Id:       "reg1",
+        Type:     protocol.XMPP_STANZA_IQ_TYPE_SET,
+        Register: &protocol.XMPPStanzaIQRegisterQuery{Username: "juliet", Password: "r0m30"},
+    })
+    elem, err = reader.NextElement()
+    if iq, ok := elem.(*protocol.XMPPStanzaIQ); assert.True(t, ok) {
+        assert.Equal(t, protocol.XMPP_STANZA_IQ_TYPE_RESULT, iq.Type)
+    }
+    conn.Close()
+
+    mechanisms := []auth.ClientMechanism{auth.NewSCRAMClient(auth.SCRAMSHA1, "", "juliet", "r0m30")}
+    juliet := stream.NewClientStream(testDirectTLSDial(t, addr, clientConfig),
+        xmpp.NewJID("juliet", "example.com", "balcony"), nil, mechanisms, nil)
+    if err := juliet.Start(); err != nil {
+        t.Fatal(err)
+    }
+
+    // Change the password
+    juliet.Writer().SendElement(&protocol.XMPPStanzaIQ{
+        Id:       "change1",
+        Type:     protocol.XMPP_STANZA_IQ_TYPE_SET,
+        Register: &protocol.XMPPStanzaIQRegisterQuery{Username: "juliet", Password: "wherefore"},
+    })
+    elem, err = juliet.Reader().NextElement()
+    if iq, ok := elem.(*protocol.XMPPStanzaIQ); assert.True(t, ok) {
+        assert.Equal(t, "change1", iq.Id)
+        assert.Equal(t, protocol.XMPP_STANZA_IQ_TYPE_RESULT, iq.Type)
+    }
+    ok, _ := store.VerifyPassword("juliet", "wherefore")
+    assert.True(t, ok)
+
+    // Cancel the registration, which terminates the session
+    juliet.Writer().SendElement(&protocol.XMPPStanzaIQ{
+        Id:       "unreg1",
+        Type:     protocol.XMPP_STANZA_IQ_TYPE_SET,
+        Register: &protocol.XMPPStanzaIQRegisterQuery{Remove: &protocol.XMPPStanzaIQRegisterRemove{}},
+    })
+    elem, err = juliet.Reader().NextElement()
+    if iq, ok := elem.(*protocol.XMPPStanzaIQ); assert.True(t, ok) {
+        assert.Equal(t, "unreg1", iq.Id)
+        assert.Equal(t, protocol.XMPP_STANZA_IQ_TYPE_RESULT, iq.Type)
+    }
+    elem, err = juliet.Reader().NextElement()
+    if streamError, ok := elem.(*protocol.XMPPStreamError); assert.True(t, ok) {
+        assert.NotNil(t, streamError.NotAuthorized)
+    }
+    users, _ := store.Users()
+    assert.Empty(t, users)
+}
+
+// Enables stream management on the client and loses its connection after
+// receiving a message it never acknowledges.
+func testLoseConnection(t *testing.T, juliet, romeo *stream.ClientStream) {
+    juliet.Writer().SendElement(&protocol.XMPPSMEnable{Resume: "true"})
+    elem, err := juliet.Reader().NextElement()
+    assert.NoError(t, err)
+    assert.IsType(t, &protocol.XMPPSMEnabled{}, elem)
+
+    romeo.Writer().SendElement(&protocol.XMPPStanzaMessage{
+        To:   "juliet@example.com/balcony",
+        Id:   "msg1",
+        Type: protocol.XMPP_STANZA_MESSAGE_TYPE_CHAT,
+        Body: &protocol.XMPPStanzaMessageBody{Data: "Wherefore art thou?"},
+    })
+    elem, err = juliet.Reader().NextElement()
+    assert.NoError(t, err)
+    assert.IsType(t, &protocol.XMPPStanzaMessage{}, elem)
+    juliet.Close(false)
+}
+
+// Unacknowledged messages go to the other resources when the session expires
+func Test_StreamManagementReroute(t *testing.T) {
+    addr := testServerWith(t, func(s *TCPServer) {
+        s.EnableStreamManagement(50 * time.Millisecond)
+    })
+    juliet := testDial(t, addr, "juliet", "balcony")
+    garden := testDial(t, addr, "juliet", "garden")
+    romeo := testDial(t, addr, "romeo", "orchard")
+    testLoseConnection(t, juliet, romeo)
+
+    elem, err := garden.Reader().NextElement()
+    assert.NoError(t, err)
+    if msg, ok := elem.(*protocol.XMPPStanzaMessage); assert.True(t, ok) {
+        assert.Equal(t, "msg1", msg.Id)
+        assert.Equal(t, "romeo@example.com/orchard", msg.From)
+    }
+}
+
+// And are bounced to the sender when there are none
+func Test_StreamManagementBounce(t *testing.T) {
+    addr := testServerWith(t, func(s *TCPServer) {
+        s.EnableStreamManagement(50 * time.Millisecond)
+    })
+    juliet := testDial(t, addr, "juliet", "balcony")
+    romeo := testDial(t, addr, "romeo", "orchard")
+    testLoseConnection(t, juliet, romeo)
+
+    elem, err := romeo.Reader().NextElement()
+    assert.NoError(t, err)
+    if msg, ok := elem.(*protocol.XMPPStanzaMessage); assert.True(t, ok) {
+        assert.Equal(t, "msg1", msg.Id)
+        assert.Equal(t, protocol.XMPP_STANZA_MESSAGE_TYPE_ERROR, msg.Type)
+        if assert.NotNil(t, msg.Error) {
+            assert.NotNil(t, msg.Error.RecipientUnavailable)
+        }
+    }
+}
@@ -0,0 +1,355 @@
+package server
+
+import (
+    "bufio"
+    "crypto/rand"
+    "crypto/sha1"
+    "crypto/tls"
+    "encoding/base64"
+    "encoding/binary"
+    "errors"
+    "github.com/zonyitoo/goxmpp/protocol"
+    "github.com/zonyitoo/goxmpp/stream"
+    "io"
+    "log"
+    "net"
+    "net/http"
+    "strings"
+    "sync"
+)
+
+var (
+    WebSocketProtocolError        = errors.New("WebSocket protocol error")
+    WebSocketMessageTooLargeError = errors.New("WebSocket message too large")
+    WebSocketClosedError          = errors.New("WebSocket is closed")
+)
+
+// The largest message a client may send.
+const WebSocketMaxMessageSize = 1 << 20
+
+// RFC6455 Section 1.3
+const websocket_guid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// RFC6455 Section 5.2
+const (
+    webSocketOpContinuation = 0x0
+    webSocketOpText         = 0x1
+    webSocketOpBinary       = 0x2
+    webSocketOpClose        = 0x8
+    webSocketOpPing         = 0x9
+    webSocketOpPong         = 0xa
+)
+
+// RFC7395
+//
+// WebSocketServer accepts XMPP streams over WebSocket connections on its
+// listener. The clients are served like those of the TCPServer it is created
+// for, except for STARTTLS: the connections are encrypted by the web server
+// instead. Connections upgraded over HTTPS count as encrypted.
+type WebSocketServer struct {
+    listener net.Listener
+    server   *TCPServer
+    clients  chan *WebSocketClient
+    secure   bool
+}
+
+// Creates a WebSocket server for the clients of server. Features added to the
+// server afterwards are offered to the clients accepted afterwards.
+func NewWebSocketServer(listener net.Listener, server *TCPServer) *WebSocketServer {
+    return &WebSocketServer{
+        listener: listener,
+        server:   server,
+        clients:  make(chan *WebSocketClient),
+    }
+}
+
+// Declares that the connections reach the server over a secure transport even
+// if they are not upgraded over HTTPS, e.g. behind a proxy terminating TLS.
+func (s *WebSocketServer) SetSecure(secure bool) {
+    s.secure = secure
+}
+
+// RFC6455 Section 4.2 and RFC7395 Section 3.3.1
+//
+// Upgrades a request to a WebSocket carrying the xmpp subprotocol. The client
+// is handed over to Accept, so the server may also be mounted on another HTTP
+// server as long as Accept is called.
+func (s *WebSocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    key := r.Header.Get("Sec-WebSocket-Key")
+    if r.Method != "GET" || key == "" ||
+        !headerContains(r.Header, "Connection", "upgrade") ||
+        !headerContains(r.Header, "Upgrade", "websocket") ||
+        r.Header.Get("Sec-WebSocket-Version") != "13" {
+        w.Header().Set("Sec-WebSocket-Version", "13")
+        http.Error(w, "WebSocket upgrade required", http.StatusBadRequest)
+        return
+    }
+    if !headerContains(r.Header, "Sec-WebSocket-Protocol", protocol.XMPP_WEBSOCKET_PROTOCOL) {
+        http.Error(w, "The xmpp subprotocol is required", http.StatusBadRequest)
+        return
+    }
+    hijacker, ok := w.(http.Hijacker)
+    if !ok {
+        http.Error(w, "Cannot upgrade the connection", http.StatusInternalServerError)
+        return
+    }
+    conn, rw, err := hijacker.Hijack()
+    if err != nil {
+        return
+    }
+
+    rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+        "Upgrade: websocket\r\n" +
+        "Connection: Upgrade\r\n" +
+        "Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n" +
+        "Sec-WebSocket-Protocol: " + protocol.XMPP_WEBSOCKET_PROTOCOL + "\r\n\r\n")
+    if err := rw.Flush(); err != nil {
+        conn.Close()
+        return
+    }
+
+    wsConn := newWebSocketConn(conn, rw.Reader, false)
+    wsConn.state = transportState(r, s.secure)
+    s.clients <- &WebSocketClient{stream: s.server.newStream(wsConn, s.server.streamFeatures(false))}
+}
+
+// Returns the next client whose connection was upgraded.
+func (s *WebSocketServer) Accept() Client {
+    return <-s.clients
+}
+
+func (s *WebSocketServer) Serve() {
+    log.Printf("WebSocket server listening %+v", s.listener.Addr())
+    go http.Serve(s.listener, s)
+    for {
+        c := s.Accept()
+        log.Printf("Client %+v connected", c.Stream().RemoteAddr())
+        go c.Run()
+    }
+}
+
+type WebSocketClient struct {
+    stream *stream.ServerClientStream
+}
+
+func (c *WebSocketClient) Stream() stream.Streamer {
+    return c.stream
+}
+
+func (c *WebSocketClient) Run() {
+    c.stream.Run()
+}
+
+// RFC6455 Section 4.2.2
+func webSocketAccept(key string) string {
+    sum := sha1.Sum([]byte(key + websocket_guid))
+    return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Whether a comma separated header lists token, ignoring case.
+func headerContains(header http.Header, name, token string) bool {
+    for _, value := range header[http.CanonicalHeaderKey(name)] {
+        for _, t := range strings.Split(value, ",") {
+            if strings.EqualFold(strings.TrimSpace(t), token) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// RFC6455 Section 5
+//
+// A WebSocket connection. Every Write is sent as a text message, which holds
+// a single framed element (RFC7395 Section 3.3.3), and Read returns the
+// payloads of the messages received in order. Pings are answered while
+// reading.
+type webSocketConn struct {
+    net.Conn
+    r       *bufio.Reader
+    // Frames are masked on the client side
+    mask    bool
+    message []byte
+    wlock   sync.Mutex
+    closing bool
+    // The TLS state of the transport, nil unless it is secure
+    state   *tls.ConnectionState
+}
+
+func newWebSocketConn(conn net.Conn, r *bufio.Reader, mask bool) *webSocketConn {
+    return &webSocketConn{Conn: conn, r: r, mask: mask}
+}
+
+// The stream exchanges <open/> and <close/> instead of a stream root.
+func (c *webSocketConn) IsFramed() bool {
+    return true
+}
+
+func (c *webSocketConn) TransportTLS() *tls.ConnectionState {
+    return c.state
+}
+
+func (c *webSocketConn) Read(p []byte) (int, error) {
+    for len(c.message) == 0 {
+        message, err := c.readMessage()
+        if err != nil {
+            return 0, err
+        }
+        c.message = message
+    }
+    n := copy(p, c.message)
+    c.message = c.message[n:]
+    return n, nil
+}
+
+// Reads the next data message, answering the control frames received before.
+func (c *webSocketConn) readMessage() ([]byte, error) {
+    var message []byte
+    started := false
+    for {
+        fin, opcode, payload, err := c.readFrame()
+        if err != nil {
+            return nil, err
+        }
+        switch opcode {
+        case webSocketOpPing:
+            c.writeFrame(webSocketOpPong, payload)
+            continue
+        case webSocketOpPong:
+            continue
+        case webSocketOpClose:
+            // RFC6455 Section 5.5.1: the status code is echoed
+            if len(payload) > 2 {
+                payload = payload[:2]
+            }
+            c.writeFrame(webSocketOpClose, payload)
+            return nil, io.EOF
+        case webSocketOpText, webSocketOpBinary:
+            if started {
+                return nil, WebSocketProtocolError
+            }
+            started = true
+        case webSocketOpContinuation:
+            if !started {
+                return nil, WebSocketProtocolError
+            }
+        default:
+            return nil, WebSocketProtocolError
+        }
+
+        if len(message)+len(payload) > WebSocketMaxMessageSize {
+            return nil, WebSocketMessageTooLargeError
+        }
+        message = append(message, payload...)
+        if fin {
+            return message, nil
+        }
+    }
+}
+
+// RFC6455 Section 5.2
+func (c *webSocketConn) readFrame() (bool, byte, []byte, error) {
+    var header [2]byte
+    if _, err := io.ReadFull(c.r, header[:]); err != nil {
+        return false, 0, nil, err
+    }
+    fin := header[0]&0x80 != 0
+    opcode := header[0] & 0x0f
+    masked := header[1]&0x80 != 0
+    length := uint64(header[1] & 0x7f)
+    switch length {
+    case 126:
+        var ext [2]byte
+        if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+            return false, 0, nil, err
+        }
+        length = uint64(binary.BigEndian.Uint16(ext[:]))
+    case 127:
+        var ext [8]byte
+        if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+            return false, 0, nil, err
+        }
+        length = binary.BigEndian.Uint64(ext[:])
+    }
+    // Section 5.1: only clients mask their frames
+    if masked == c.mask {
+        return false, 0, nil, WebSocketProtocolError
+    }
+    if length > WebSocketMaxMessageSize {
+        return false, 0, nil, WebSocketMessageTooLargeError
+    }
+
+    var key [4]byte
+    if masked {
+        if _, err := io.ReadFull(c.r, key[:]); err != nil {
+            return false, 0, nil, err
+        }
+    }
+    payload := make([]byte, length)
+    if _, err := io.ReadFull(c.r, payload); err != nil {
+        return false, 0, nil, err
+    }
+    if masked {
+        for i := range payload {
+            payload[i] ^= key[i%4]
+        }
+    }
+    return fin, opcode, payload, nil
+}
+
+func (c *webSocketConn) Write(p []byte) (int, error) {
+    if err := c.writeFrame(webSocketOpText, p); err != nil {
+        return 0, err
+    }
+    return len(p), nil
+}
+
+// Nothing is sent after the close frame (RFC6455 Section 5.5.1).
+func (c *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+    c.wlock.Lock()
+    defer c.wlock.Unlock()
+    if c.closing {
+        return WebSocketClosedError
+    }
+    if opcode == webSocketOpClose {
+        c.closing = true
+    }
+
+    frame := []byte{0x80 | opcode, 0}
+    switch length := len(payload); {
+    case length < 126:
+        frame[1] = byte(length)
+    case length <= 0xffff:
+        frame[1] = 126
+        frame = append(frame, 0, 0)
+        binary.BigEndian.PutUint16(frame[2:], uint16(length))
+    default:
+        frame[1] = 127
+        frame = append(frame, 0, 0, 0, 0, 0, 0, 0, 0)
+        binary.BigEndian.PutUint64(frame[2:], uint64(length))
+    }
+    if c.mask {
+        frame[1] |= 0x80
+        var key [4]byte
+        if _, err := rand.Read(key[:]); err != nil {
+            return err
+        }
+        frame = append(frame, key[:]...)
+        start := len(frame)
+        frame = append(frame, payload...)
+        for i := range frame[start:] {
+            frame[start+i] ^= key[i%4]
+        }
+    } else {
+        frame = append(frame, payload...)
+    }
+    _, err := c.Conn.Write(frame)
+    return err
+}
+
+// RFC6455 Section 7.1.1: the close frame with a normal closure precedes
+// closing the TCP connection.
+func (c *webSocketConn) Close() error {
+    c.writeFrame(webSocketOpClose, []byte{0x03, 0xe8})
+    return c.Conn.Close()
+}
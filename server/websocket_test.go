@@ -0,0 +1,160 @@
+package server
+
+import (
+    "bufio"
+    "crypto/tls"
+    "github.com/stretchr/testify/assert"
+    "github.com/zonyitoo/goxmpp/auth"
+    "github.com/zonyitoo/goxmpp/basic"
+    "github.com/zonyitoo/goxmpp/protocol"
+    "github.com/zonyitoo/goxmpp/stream"
+    "io"
+    "net"
+    "net/http"
+    "testing"
+)
+
+// Starts a server like testServer and a WebSocket server for it. Returns the
+// addresses of both.
+func testWebSocketServer(t *testing.T) (string, string) {
+    return testWebSocketServerWith(t, nil)
+}
+
+// Like testWebSocketServer, with setup called before the WebSocket server
+// starts serving.
+func testWebSocketServerWith(t *testing.T, setup func(*WebSocketServer)) (string, string) {
+    var server *TCPServer
+    addr := testServerWith(t, func(s *TCPServer) {
+        server = s
+    })
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    wsServer := NewWebSocketServer(listener, server)
+    if setup != nil {
+        setup(wsServer)
+    }
+    go wsServer.Serve()
+    return addr, listener.Addr().String()
+}
+
+// Opens a WebSocket connection with the xmpp subprotocol.
+func testWebSocketDial(t *testing.T, addr string) *webSocketConn {
+    conn, err := net.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    key := "dGhlIHNhbXBsZSBub25jZQ=="
+    req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+    req.Header.Set("Connection", "Upgrade")
+    req.Header.Set("Upgrade", "websocket")
+    req.Header.Set("Sec-WebSocket-Version", "13")
+    req.Header.Set("Sec-WebSocket-Key", key)
+    req.Header.Set("Sec-WebSocket-Protocol", "xmpp")
+    if err := req.Write(conn); err != nil {
+        t.Fatal(err)
+    }
+
+    r := bufio.NewReader(conn)
+    resp, err := http.ReadResponse(r, req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+    // RFC6455 Section 1.3
+    assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+    assert.Equal(t, "xmpp", resp.Header.Get("Sec-WebSocket-Protocol"))
+    return newWebSocketConn(conn, r, true)
+}
+
+func Test_WebSocketSession(t *testing.T) {
+    addr, wsAddr := testWebSocketServer(t)
+    conn := testWebSocketDial(t, wsAddr)
+    mechanisms := []auth.ClientMechanism{auth.NewSCRAMClient(auth.SCRAMSHA1, "", "juliet", "secret")}
+    juliet := stream.NewClientStream(conn, xmpp.NewJID("juliet", "example.com", "balcony"), nil, mechanisms, nil)
+    if err := juliet.Start(); err != nil {
+        t.Fatal(err)
+    }
+    assert.Equal(t, "juliet@example.com/balcony", juliet.JID().String())
+    romeo := testDial(t, addr, "romeo", "orchard")
+
+    romeo.Writer().SendElement(&protocol.XMPPStanzaMessage{
+        To:   "juliet@example.com/balcony",
+        Type: protocol.XMPP_STANZA_MESSAGE_TYPE_CHAT,
+        Body: &protocol.XMPPStanzaMessageBody{Data: "Wherefore art thou?"},
+    })
+    elem, err := juliet.Reader().NextElement()
+    assert.NoError(t, err)
+    if msg, ok := elem.(*protocol.XMPPStanzaMessage); assert.True(t, ok) {
+        assert.Equal(t, "romeo@example.com/orchard", msg.From)
+        assert.Equal(t, "Wherefore art thou?", msg.Body.Data)
+    }
+
+    juliet.Writer().SendElement(&protocol.XMPPStanzaMessage{
+        To:   "romeo@example.com",
+        Type: protocol.XMPP_STANZA_MESSAGE_TYPE_CHAT,
+        Body: &protocol.XMPPStanzaMessageBody{Data: "Here"},
+    })
+    elem, err = romeo.Reader().NextElement()
+    assert.NoError(t, err)
+    if msg, ok := elem.(*protocol.XMPPStanzaMessage); assert.True(t, ok) {
+        assert.Equal(t, "juliet@example.com/balcony", msg.From)
+        assert.Equal(t, "Here", msg.Body.Data)
+    }
+}
+
+// A server behind a secure transport offers PLAIN, but no channel binding to
+// the upgraded connection.
+func Test_WebSocketSecurePlain(t *testing.T) {
+    _, wsAddr := testWebSocketServerWith(t, func(s *WebSocketServer) {
+        s.SetSecure(true)
+    })
+    conn := testWebSocketDial(t, wsAddr)
+    // The client is connected over wss as far as it is concerned
+    conn.state = &tls.ConnectionState{}
+    mechanisms := []auth.ClientMechanism{auth.NewPlainClient("", "juliet", "secret")}
+    juliet := stream.NewClientStream(conn, xmpp.NewJID("juliet", "example.com", "balcony"), nil, mechanisms, nil)
+    if err := juliet.Start(); err != nil {
+        t.Fatal(err)
+    }
+    assert.Equal(t, "juliet@example.com/balcony", juliet.JID().String())
+}
+
+// RFC7395 Section 3.4 and 3.6
+func Test_WebSocketFraming(t *testing.T) {
+    _, wsAddr := testWebSocketServer(t)
+    conn := testWebSocketDial(t, wsAddr)
+
+    conn.Write([]byte("<open xmlns='urn:ietf:params:xml:ns:xmpp-framing' to='example.com' version='1.0'/>"))
+    message, err := conn.readMessage()
+    assert.NoError(t, err)
+    assert.Contains(t, string(message), `<open xmlns="urn:ietf:params:xml:ns:xmpp-framing" from="example.com"`)
+    // Every element is a message of its own
+    message, err = conn.readMessage()
+    assert.NoError(t, err)
+    assert.Regexp(t, `^<features xmlns="http://etherx.jabber.org/streams">.*</features>$`, string(message))
+
+    conn.Write([]byte("<close xmlns='urn:ietf:params:xml:ns:xmpp-framing'/>"))
+    message, err = conn.readMessage()
+    assert.NoError(t, err)
+    assert.Equal(t, `<close xmlns="urn:ietf:params:xml:ns:xmpp-framing"></close>`, string(message))
+    _, err = conn.readMessage()
+    assert.Equal(t, io.EOF, err)
+}
+
+// RFC7395 Section 3.3.1
+func Test_WebSocketSubprotocolRequired(t *testing.T) {
+    _, wsAddr := testWebSocketServer(t)
+    req, _ := http.NewRequest("GET", "http://"+wsAddr+"/", nil)
+    req.Header.Set("Connection", "Upgrade")
+    req.Header.Set("Upgrade", "websocket")
+    req.Header.Set("Sec-WebSocket-Version", "13")
+    req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp.Body.Close()
+    assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+    "crypto/rand"
+    "crypto/subtle"
+    "errors"
+    "github.com/zonyitoo/goxmpp/auth"
+)
+
+var (
+    AccountExistsError   = errors.New("Account already exists")
+    AccountNotFoundError = errors.New("Account does not exist")
+    InvalidUsernameError = errors.New("Invalid username")
+    InvalidPasswordError = errors.New("Invalid password")
+)
+
+// The iteration count of the SCRAM keys derived for new passwords.
+const DefaultIterations = 4096
+
+// Hashes for which SCRAM keys are kept, so that every SCRAM mechanism the
+// library provides can be offered.
+var scramHashes = []*auth.SCRAMHash{auth.SCRAMSHA1, auth.SCRAMSHA256}
+
+// AccountStore keeps the user accounts of a domain. Accounts are identified
+// by the localpart of their JID.
+//
+// The store implements both auth.PlainCredentials and auth.SCRAMCredentials,
+// so that the SASL mechanisms can authenticate against it directly.
+type AccountStore interface {
+    CreateUser(username, password string) error
+    DeleteUser(username string) error
+    ChangePassword(username, password string) error
+    // Returns nil keys if the account does not exist.
+    SCRAMKeys(username string, h *auth.SCRAMHash) (*auth.SCRAMKeys, error)
+    VerifyPassword(username, password string) (bool, error)
+    // The usernames of all accounts, in no particular order.
+    Users() ([]string, error)
+}
+
+// Account is the stored form of an account. The password itself is not kept,
+// only the SCRAM keys derived from it, indexed by the name of the hash.
+type Account struct {
+    Keys map[string]*auth.SCRAMKeys
+}
+
+// Derives the keys of every supported hash from the password with a fresh
+// random salt.
+func NewAccount(password string) (*Account, error) {
+    if password == "" {
+        return nil, InvalidPasswordError
+    }
+    salt := make([]byte, 16)
+    if _, err := rand.Read(salt); err != nil {
+        return nil, err
+    }
+    account := &Account{Keys: make(map[string]*auth.SCRAMKeys)}
+    for _, h := range scramHashes {
+        account.Keys[h.Name] = auth.NewSCRAMKeys(h, password, salt, DefaultIterations)
+    }
+    return account, nil
+}
+
+// RFC5802 Section 3
+//
+// The password is verified by deriving the StoredKey again with the stored
+// salt and iteration count.
+func (a *Account) VerifyPassword(password string) bool {
+    for _, h := range scramHashes {
+        if keys := a.Keys[h.Name]; keys != nil {
+            derived := auth.NewSCRAMKeys(h, password, keys.Salt, keys.Iterations)
+            return subtle.ConstantTimeCompare(derived.StoredKey, keys.StoredKey) == 1
+        }
+    }
+    return false
+}
+
+// Usernames are the localparts of JIDs and cannot be empty.
+func validateUsername(username string) error {
+    if username == "" {
+        return InvalidUsernameError
+    }
+    for _, c := range username {
+        switch c {
+        case '@', '/', '"', '&', '\'', ':', '<', '>', ' ':
+            return InvalidUsernameError
+        }
+    }
+    return nil
+}
+
+// Creates an authenticator offering every SASL mechanism that can be backed
+// by the store: SCRAM with and without channel binding, and PLAIN.
+func NewAuthenticator(store AccountStore) *auth.Authenticator {
+    authenticator := auth.NewAuthenticator()
+    for _, h := range scramHashes {
+        authenticator.Register(auth.NewSCRAMServer(h, store))
+        authenticator.Register(auth.NewSCRAMPlusServer(h, store))
+    }
+    authenticator.Register(auth.NewPlainServer(store))
+    return authenticator
+}
@@ -0,0 +1,68 @@
+package storage
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+)
+
+// FileStore keeps accounts in a JSON file. The whole file is rewritten after
+// every change and atomically replaces the previous version, so that a crash
+// never leaves a partially written store behind.
+type FileStore struct {
+    *MemoryStore
+    path string
+}
+
+// Opens the store kept at path. The file is created with the first account
+// if it does not exist.
+func OpenFileStore(path string) (*FileStore, error) {
+    f := &FileStore{
+        MemoryStore: NewMemoryStore(),
+        path:        path,
+    }
+    data, err := ioutil.ReadFile(path)
+    if err != nil && !os.IsNotExist(err) {
+        return nil, err
+    }
+    if len(data) > 0 {
+        if err := json.Unmarshal(data, &f.accounts); err != nil {
+            return nil, err
+        }
+    }
+    if f.accounts == nil {
+        f.accounts = make(map[string]*Account)
+    }
+    f.persist = f.save
+    return f, nil
+}
+
+// Writes the accounts to a temporary file in the same directory and renames
+// it over the store.
+func (f *FileStore) save(accounts map[string]*Account) error {
+    data, err := json.MarshalIndent(accounts, "", "  ")
+    if err != nil {
+        return err
+    }
+
+    // The temporary file is only readable by the owner
+    tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+    if err != nil {
+        return err
+    }
+    _, err = tmp.Write(data)
+    if err == nil {
+        err = tmp.Sync()
+    }
+    if cerr := tmp.Close(); err == nil {
+        err = cerr
+    }
+    if err == nil {
+        err = os.Rename(tmp.Name(), f.path)
+    }
+    if err != nil {
+        os.Remove(tmp.Name())
+    }
+    return err
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+    "github.com/stretchr/testify/assert"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func testStorePath(t *testing.T) string {
+    dir, err := ioutil.TempDir("", "goxmpp-storage")
+    if err != nil {
+        t.Fatal(err)
+    }
+    return filepath.Join(dir, "accounts.json")
+}
+
+func Test_FileStore(t *testing.T) {
+    path := testStorePath(t)
+    defer os.RemoveAll(filepath.Dir(path))
+
+    store, err := OpenFileStore(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    testAccountStore(t, store)
+}
+
+// Accounts survive reopening the store
+func Test_FileStoreDurable(t *testing.T) {
+    path := testStorePath(t)
+    defer os.RemoveAll(filepath.Dir(path))
+
+    store, err := OpenFileStore(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    assert.NoError(t, store.CreateUser("juliet", "r0m30"))
+    assert.NoError(t, store.CreateUser("romeo", "j"))
+    assert.NoError(t, store.DeleteUser("romeo"))
+
+    reopened, err := OpenFileStore(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    users, _ := reopened.Users()
+    assert.Equal(t, []string{"juliet"}, users)
+    ok, _ := reopened.VerifyPassword("juliet", "r0m30")
+    assert.True(t, ok)
+
+    // No temporary files are left behind
+    entries, _ := ioutil.ReadDir(filepath.Dir(path))
+    assert.Len(t, entries, 1)
+}
+
+// A failed write leaves the store unchanged
+func Test_FileStoreWriteFailure(t *testing.T) {
+    path := testStorePath(t)
+    store, err := OpenFileStore(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    assert.NoError(t, store.CreateUser("juliet", "r0m30"))
+
+    os.RemoveAll(filepath.Dir(path))
+    assert.Error(t, store.CreateUser("romeo", "j"))
+    assert.Error(t, store.DeleteUser("juliet"))
+    users, _ := store.Users()
+    assert.Equal(t, []string{"juliet"}, users)
+}
+
+func Test_FileStoreCorrupt(t *testing.T) {
+    path := testStorePath(t)
+    defer os.RemoveAll(filepath.Dir(path))
+
+    assert.NoError(t, ioutil.WriteFile(path, []byte("{"), 0600))
+    _, err := OpenFileStore(path)
+    assert.Error(t, err)
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+    "github.com/zonyitoo/goxmpp/auth"
+    "sync"
+)
+
+// MemoryStore keeps accounts in memory. They are lost when the process exits.
+type MemoryStore struct {
+    lock     sync.RWMutex
+    accounts map[string]*Account
+    // Called with the lock held after every change. If it fails the change
+    // is reverted.
+    persist func(map[string]*Account) error
+}
+
+func NewMemoryStore() *MemoryStore {
+    return &MemoryStore{
+        accounts: make(map[string]*Account),
+    }
+}
+
+// Replaces the account of username, deleting it if account is nil. exists
+// tells whether the account must already exist.
+func (m *MemoryStore) set(username string, account *Account, exists bool) error {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    old, ok := m.accounts[username]
+    if ok != exists {
+        if ok {
+            return AccountExistsError
+        }
+        return AccountNotFoundError
+    }
+
+    if account == nil {
+        delete(m.accounts, username)
+    } else {
+        m.accounts[username] = account
+    }
+    if m.persist == nil {
+        return nil
+    }
+    if err := m.persist(m.accounts); err != nil {
+        if ok {
+            m.accounts[username] = old
+        } else {
+            delete(m.accounts, username)
+        }
+        return err
+    }
+    return nil
+}
+
+func (m *MemoryStore) CreateUser(username, password string) error {
+    if err := validateUsername(username); err != nil {
+        return err
+    }
+    account, err := NewAccount(password)
+    if err != nil {
+        return err
+    }
+    return m.set(username, account, false)
+}
+
+func (m *MemoryStore) DeleteUser(username string) error {
+    return m.set(username, nil, true)
+}
+
+func (m *MemoryStore) ChangePassword(username, password string) error {
+    account, err := NewAccount(password)
+    if err != nil {
+        return err
+    }
+    return m.set(username, account, true)
+}
+
+func (m *MemoryStore) SCRAMKeys(username string, h *auth.SCRAMHash) (*auth.SCRAMKeys, error) {
+    m.lock.RLock()
+    defer m.lock.RUnlock()
+    if account, ok := m.accounts[username]; ok {
+        return account.Keys[h.Name], nil
+    }
+    return nil, nil
+}
+
+func (m *MemoryStore) VerifyPassword(username, password string) (bool, error) {
+    m.lock.RLock()
+    account, ok := m.accounts[username]
+    m.lock.RUnlock()
+    return ok && account.VerifyPassword(password), nil
+}
+
+func (m *MemoryStore) Users() ([]string, error) {
+    m.lock.RLock()
+    defer m.lock.RUnlock()
+    users := make([]string, 0, len(m.accounts))
+    for username := range m.accounts {
+        users = append(users, username)
+    }
+    return users, nil
+}
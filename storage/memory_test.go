@@ -0,0 +1,82 @@
+package storage
+
+import (
+    "github.com/stretchr/testify/assert"
+    "github.com/zonyitoo/goxmpp/auth"
+    "sort"
+    "testing"
+)
+
+// Exercises the AccountStore contract shared by all backends.
+func testAccountStore(t *testing.T, store AccountStore) {
+    assert.NoError(t, store.CreateUser("juliet", "r0m30"))
+    assert.NoError(t, store.CreateUser("romeo", "j"))
+    assert.Equal(t, AccountExistsError, store.CreateUser("juliet", "other"))
+    assert.Equal(t, InvalidUsernameError, store.CreateUser("", "secret"))
+    assert.Equal(t, InvalidUsernameError, store.CreateUser("nurse@example.com", "secret"))
+    assert.Equal(t, InvalidPasswordError, store.CreateUser("nurse", ""))
+
+    ok, err := store.VerifyPassword("juliet", "r0m30")
+    assert.NoError(t, err)
+    assert.True(t, ok)
+    ok, _ = store.VerifyPassword("juliet", "wrong")
+    assert.False(t, ok)
+    ok, _ = store.VerifyPassword("tybalt", "r0m30")
+    assert.False(t, ok)
+
+    keys, err := store.SCRAMKeys("juliet", auth.SCRAMSHA256)
+    assert.NoError(t, err)
+    if assert.NotNil(t, keys) {
+        expected := auth.NewSCRAMKeys(auth.SCRAMSHA256, "r0m30", keys.Salt, keys.Iterations)
+        assert.Equal(t, expected, keys)
+    }
+    keys, err = store.SCRAMKeys("tybalt", auth.SCRAMSHA1)
+    assert.NoError(t, err)
+    assert.Nil(t, keys)
+
+    assert.NoError(t, store.ChangePassword("juliet", "wherefore"))
+    ok, _ = store.VerifyPassword("juliet", "wherefore")
+    assert.True(t, ok)
+    ok, _ = store.VerifyPassword("juliet", "r0m30")
+    assert.False(t, ok)
+    assert.Equal(t, AccountNotFoundError, store.ChangePassword("tybalt", "secret"))
+
+    users, err := store.Users()
+    assert.NoError(t, err)
+    sort.Strings(users)
+    assert.Equal(t, []string{"juliet", "romeo"}, users)
+
+    assert.NoError(t, store.DeleteUser("romeo"))
+    assert.Equal(t, AccountNotFoundError, store.DeleteUser("romeo"))
+    users, _ = store.Users()
+    assert.Equal(t, []string{"juliet"}, users)
+}
+
+func Test_MemoryStore(t *testing.T) {
+    testAccountStore(t, NewMemoryStore())
+}
+
+// The SASL mechanisms authenticate against the store
+func Test_StoreAuthenticator(t *testing.T) {
+    store := NewMemoryStore()
+    assert.NoError(t, store.CreateUser("juliet", "r0m30"))
+
+    authenticator := NewAuthenticator(store)
+    assert.Equal(t, []string{"SCRAM-SHA-256-PLUS", "SCRAM-SHA-1-PLUS", "SCRAM-SHA-256", "SCRAM-SHA-1", "PLAIN"},
+        authenticator.Mechanisms())
+
+    ctx := &auth.Context{Domain: "example.com"}
+    server := authenticator.Start("SCRAM-SHA-256", ctx)
+    client, err := auth.NewSCRAMClient(auth.SCRAMSHA256, "", "juliet", "r0m30").NewExchange(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+    first, _ := client.Start()
+    challenge, _, err := server.Next(first)
+    assert.NoError(t, err)
+    final, _ := client.Next(challenge)
+    _, done, err := server.Next(final)
+    assert.NoError(t, err)
+    assert.True(t, done)
+    assert.Equal(t, "juliet", server.Identity().Username)
+}
@@ -1,39 +1,138 @@
 package stream
 
 import (
+    "crypto/tls"
+    "encoding/base64"
+    "github.com/zonyitoo/goxmpp/auth"
     "github.com/zonyitoo/goxmpp/protocol"
+    "net"
 )
 
-type SASLAuthenticateHandler func(*protocol.XMPPSASLAuth, Streamer) bool
+// SecureTransport is implemented by transports which are encrypted outside of
+// the stream, such as BOSH and WebSocket connections over HTTPS. Their streams
+// count as encrypted without negotiating STARTTLS. TransportTLS returns nil
+// if the transport is not secure.
+type SecureTransport interface {
+    TransportTLS() *tls.ConnectionState
+}
 
-type SASLAuthenticator struct {
-    handlers map[string]SASLAuthenticateHandler
+func transportTLS(conn net.Conn) *tls.ConnectionState {
+    if c, ok := conn.(*compressConn); ok {
+        conn = c.Conn
+    }
+    if t, ok := conn.(SecureTransport); ok {
+        return t.TransportTLS()
+    }
+    return nil
 }
 
-func NewSASLAuthenticator() *SASLAuthenticator {
-    return &SASLAuthenticator{
-        handlers: make(map[string]SASLAuthenticateHandler),
+// The context SASL mechanisms see of the stream.
+func authContext(s Streamer) *auth.Context {
+    ctx := &auth.Context{Domain: s.Domain()}
+    if tlsConn, ok := tlsConnOf(s.Conn()); ok {
+        state := tlsConn.ConnectionState()
+        ctx.TLS = &state
+    } else if state := transportTLS(s.Conn()); state != nil {
+        ctx.TLS = state
+        ctx.TransportTLS = true
+    }
+    if sss, ok := s.(*ServerServerStream); ok {
+        ctx.From = sss.Peer()
     }
+    return ctx
 }
 
-func (a *SASLAuthenticator) SetMechanism(name string, handler SASLAuthenticateHandler) {
-    a.handlers[name] = handler
+// RFC6120 Section 6.4.2 - 6.4.6
+//
+// Runs the challenge-response exchange of the receiving entity until the
+// mechanism either succeeds or fails, and reports the outcome to the
+// initiating entity.
+func serverExchange(exchange auth.ServerExchange, initial *protocol.XMPPSASLAuth, s Streamer) (auth.Identity, bool) {
+    var response []byte
+    if initial.Data != "" {
+        var err error
+        if response, err = decodeSASLData(initial.Data); err != nil {
+            return auth.Identity{}, sendSASLFailure(s, saslFailure(auth.SASLIncorrectEncodingError))
+        }
+    }
+
+    for {
+        challenge, done, err := exchange.Next(response)
+        if err != nil {
+            return auth.Identity{}, sendSASLFailure(s, saslFailure(err))
+        }
+        if done {
+            success := &protocol.XMPPSASLSuccess{}
+            if challenge != nil {
+                success.Data = encodeSASLData(challenge)
+            }
+            s.Writer().SendElement(success)
+            return exchange.Identity(), true
+        }
+        s.Writer().SendElement(&protocol.XMPPSASLChallenge{Data: encodeSASLData(challenge)})
+
+        elem, err := s.Reader().NextElement()
+        if err != nil {
+            return auth.Identity{}, false
+        }
+        var resp *protocol.XMPPSASLResponse
+        switch t := elem.(type) {
+        case *protocol.XMPPSASLResponse:
+            resp = t
+        case *protocol.XMPPSASLAbort:
+            // RFC6120 Section 6.4.4
+            return auth.Identity{}, sendSASLFailure(s, &protocol.XMPPSASLFailure{
+                Aborted: &protocol.XMPPSASLErrorAborted{},
+            })
+        default:
+            // Anything else, e.g. a new <auth/>, is out of order
+            return auth.Identity{}, sendSASLFailure(s, saslFailure(auth.SASLMalformedRequestError))
+        }
+        if response, err = decodeSASLData(resp.Data); err != nil {
+            return auth.Identity{}, sendSASLFailure(s, saslFailure(auth.SASLIncorrectEncodingError))
+        }
+    }
+}
+
+// Sends the failure to the initiating entity and reports the authentication
+// as unsuccessful.
+func sendSASLFailure(s Streamer, failure *protocol.XMPPSASLFailure) bool {
+    s.Writer().SendElement(failure)
+    return false
+}
+
+// Maps an error returned by a mechanism to the <failure/> element sent to the
+// initiating entity. Unknown errors are reported as temporary failures.
+func saslFailure(err error) *protocol.XMPPSASLFailure {
+    switch err {
+    case auth.SASLMalformedRequestError:
+        return &protocol.XMPPSASLFailure{MalformedRequest: &protocol.XMPPSASLErrorMalformedRequest{}}
+    case auth.SASLIncorrectEncodingError:
+        return &protocol.XMPPSASLFailure{IncorrectEncoding: &protocol.XMPPSASLErrorIncorrectEncoding{}}
+    case auth.SASLInvalidAuthzidError:
+        return &protocol.XMPPSASLFailure{InvalidAuthzid: &protocol.XMPPSASLErrorInvalidAuthzid{}}
+    case auth.SASLNotAuthorizedError:
+        return &protocol.XMPPSASLFailure{NotAuthorized: &protocol.XMPPSASLErrorNotAuthorized{}}
+    case auth.SASLEncryptionRequiredError:
+        return &protocol.XMPPSASLFailure{EncryptionRequired: &protocol.XMPPSASLErrorEncryptionRequired{}}
+    }
+    return &protocol.XMPPSASLFailure{TemporaryAuthFailure: &protocol.XMPPSASLErrorTemporaryAuthFailure{}}
 }
 
-func (a *SASLAuthenticator) CallMechanism(name string, auth *protocol.XMPPSASLAuth, s Streamer) bool {
-    if handler, ok := a.handlers[name]; !ok {
-        return false
-    } else {
-        return handler(auth, s)
+// RFC6120 Section 6.4.2
+//
+// A zero-length initial response or challenge is transmitted as a single
+// equals sign.
+func encodeSASLData(data []byte) string {
+    if len(data) == 0 {
+        return "="
     }
+    return base64.StdEncoding.EncodeToString(data)
 }
 
-func (a *SASLAuthenticator) Mechanisms() []string {
-    mech := make([]string, len(a.handlers))
-    idx := 0
-    for k, _ := range a.handlers {
-        mech[idx] = k
-        idx++
+func decodeSASLData(data string) ([]byte, error) {
+    if data == "" || data == "=" {
+        return []byte{}, nil
     }
-    return mech
+    return base64.StdEncoding.DecodeString(data)
 }
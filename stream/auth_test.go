@@ -0,0 +1,134 @@
+package stream
+
+import (
+    "github.com/stretchr/testify/assert"
+    "github.com/zonyitoo/goxmpp/auth"
+    "github.com/zonyitoo/goxmpp/protocol"
+    "net"
+    "testing"
+)
+
+// Opens a stream to the server side of conn by hand and returns the reader
+// and writer positioned after the stream features.
+func testRawClient(t *testing.T, conn net.Conn) (*Reader, *Writer) {
+    writer := NewWriter(conn)
+    writer.Open(&protocol.XMPPStream{
+        To:      "example.com",
+        Version: "1.0",
+        Xmlns:   protocol.XMLNS_JABBER_CLIENT,
+    })
+    reader := NewReader(conn)
+    for i := 0; i < 2; i++ {
+        if _, err := reader.NextElement(); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return reader, writer
+}
+
+func testSASLAuth(mechanism, data string) *protocol.XMPPSASLAuth {
+    return &protocol.XMPPSASLAuth{Mechanism: mechanism, Data: encodeSASLData([]byte(data))}
+}
+
+func testSASLServer(t *testing.T, retries int) (*Reader, *Writer) {
+    cconn, sconn := testConnPair(t)
+    authenticator := testPlainAuthenticator()
+    authenticator.Register(auth.NewSCRAMServer(auth.SCRAMSHA1,
+        testSCRAMCredentials(auth.SCRAMSHA1, "juliet", "r0m30")))
+    sasl := NewSASLFeature()
+    sasl.SetRetries(retries)
+    server := NewServerClientStream(sconn, "example.com", []FeatureNegotiator{sasl},
+        authenticator, &nopStanzaHandler{})
+    go server.Run()
+    return testRawClient(t, cconn)
+}
+
+func Test_SASLRetry(t *testing.T) {
+    reader, writer := testSASLServer(t, 2)
+
+    writer.SendElement(testSASLAuth("PLAIN", "\x00juliet\x00r0m3o"))
+    elem, err := reader.NextElement()
+    assert.NoError(t, err)
+    if failure, ok := elem.(*protocol.XMPPSASLFailure); assert.True(t, ok) {
+        assert.NotNil(t, failure.NotAuthorized)
+    }
+
+    writer.SendElement(testSASLAuth("PLAIN", "\x00juliet\x00r0m30"))
+    elem, err = reader.NextElement()
+    assert.NoError(t, err)
+    assert.IsType(t, &protocol.XMPPSASLSuccess{}, elem)
+}
+
+func Test_SASLRetriesExceeded(t *testing.T) {
+    reader, writer := testSASLServer(t, 1)
+
+    for i := 0; i < 2; i++ {
+        writer.SendElement(testSASLAuth("PLAIN", "\x00juliet\x00r0m3o"))
+        elem, err := reader.NextElement()
+        assert.NoError(t, err)
+        assert.IsType(t, &protocol.XMPPSASLFailure{}, elem)
+    }
+    elem, err := reader.NextElement()
+    assert.NoError(t, err)
+    if streamError, ok := elem.(*protocol.XMPPStreamError); assert.True(t, ok) {
+        assert.NotNil(t, streamError.PolicyViolation)
+    }
+}
+
+func Test_SASLInvalidMechanism(t *testing.T) {
+    reader, writer := testSASLServer(t, 2)
+
+    writer.SendElement(testSASLAuth("DIGEST-MD5", ""))
+    elem, err := reader.NextElement()
+    assert.NoError(t, err)
+    if failure, ok := elem.(*protocol.XMPPSASLFailure); assert.True(t, ok) {
+        assert.NotNil(t, failure.InvalidMechanism)
+    }
+}
+
+func Test_SASLAbort(t *testing.T) {
+    reader, writer := testSASLServer(t, 2)
+
+    writer.SendElement(testSASLAuth("SCRAM-SHA-1", "n,,n=juliet,r=abcdef"))
+    elem, err := reader.NextElement()
+    assert.NoError(t, err)
+    assert.IsType(t, &protocol.XMPPSASLChallenge{}, elem)
+
+    writer.SendElement(&protocol.XMPPSASLAbort{})
+    elem, err = reader.NextElement()
+    assert.NoError(t, err)
+    if failure, ok := elem.(*protocol.XMPPSASLFailure); assert.True(t, ok) {
+        assert.NotNil(t, failure.Aborted)
+    }
+
+    // The stream is still open for another attempt
+    writer.SendElement(testSASLAuth("PLAIN", "\x00juliet\x00r0m30"))
+    elem, err = reader.NextElement()
+    assert.NoError(t, err)
+    assert.IsType(t, &protocol.XMPPSASLSuccess{}, elem)
+}
+
+func Test_SASLOutOfOrder(t *testing.T) {
+    reader, writer := testSASLServer(t, 2)
+
+    // <response/> without an exchange in progress
+    writer.SendElement(&protocol.XMPPSASLResponse{Data: "="})
+    elem, err := reader.NextElement()
+    assert.NoError(t, err)
+    if failure, ok := elem.(*protocol.XMPPSASLFailure); assert.True(t, ok) {
+        assert.NotNil(t, failure.MalformedRequest)
+    }
+
+    // <auth/> while waiting for a <response/>
+    writer.SendElement(testSASLAuth("SCRAM-SHA-1", "n,,n=juliet,r=abcdef"))
+    elem, err = reader.NextElement()
+    assert.NoError(t, err)
+    assert.IsType(t, &protocol.XMPPSASLChallenge{}, elem)
+
+    writer.SendElement(testSASLAuth("PLAIN", "\x00juliet\x00r0m30"))
+    elem, err = reader.NextElement()
+    assert.NoError(t, err)
+    if failure, ok := elem.(*protocol.XMPPSASLFailure); assert.True(t, ok) {
+        assert.NotNil(t, failure.MalformedRequest)
+    }
+}
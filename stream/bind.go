@@ -0,0 +1,128 @@
+package stream
+
+import (
+    "code.google.com/p/go-uuid/uuid"
+    "github.com/zonyitoo/goxmpp/basic"
+    "github.com/zonyitoo/goxmpp/protocol"
+    "strings"
+)
+
+// What to do when a client requests a resource that is bound to another
+// stream (RFC6120 Section 7.7.2.2).
+type BindConflictPolicy int
+
+const (
+    // Reply with a <conflict/> stanza error and let the client retry.
+    BindConflictReject BindConflictPolicy = iota
+    // Terminate the existing session with a <conflict/> stream error.
+    BindConflictReplace
+    // Bind the new session to a resource generated by the server.
+    BindConflictRename
+)
+
+// RFC6120 Section 7
+type BindFeature struct {
+    sessions *SessionRegistry
+    policy   BindConflictPolicy
+}
+
+func NewBindFeature(sessions *SessionRegistry, policy BindConflictPolicy) *BindFeature {
+    return &BindFeature{
+        sessions: sessions,
+        policy:   policy,
+    }
+}
+
+func (f *BindFeature) Offered(s Streamer) bool {
+    return s.IsAuthenticated() && !isBound(s)
+}
+
+func (f *BindFeature) Mandatory(s Streamer) bool {
+    return !isBound(s)
+}
+
+func (f *BindFeature) RequiresRestart() bool {
+    return false
+}
+
+func (f *BindFeature) Advertise(features *protocol.XMPPStreamFeatures, s Streamer) {
+    features.Bind = &protocol.XMPPBind{}
+}
+
+func (f *BindFeature) Handles(elem protocol.Protocol, s Streamer) bool {
+    iq, ok := elem.(*protocol.XMPPStanzaIQ)
+    return ok && iq.Bind != nil && iq.Type == protocol.XMPP_STANZA_IQ_TYPE_SET
+}
+
+func (f *BindFeature) Negotiate(elem protocol.Protocol, s Streamer) (bool, error) {
+    iq := elem.(*protocol.XMPPStanzaIQ)
+    if s.JID() == nil {
+        return false, sendBindError(s, iq, protocol.XMPP_STANZA_ERROR_TYPE_CANCEL,
+            protocol.XMPPStanzaErrorGroup{
+                InternalServerError: &protocol.XMPPStanzaErrorInternalServerError{},
+            })
+    }
+
+    // RFC6120 Section 7.7.2.1
+    //
+    // A resourcepart MUST NOT be zero octets in length and MUST NOT be more than
+    // 1023 octets in length.
+    resource := strings.TrimSpace(iq.Bind.Resource)
+    if len(resource) > 1023 {
+        return false, sendBindError(s, iq, protocol.XMPP_STANZA_ERROR_TYPE_MODIFY,
+            protocol.XMPPStanzaErrorGroup{
+                BadRequest: &protocol.XMPPStanzaErrorBadRequest{},
+            })
+    }
+    if resource == "" {
+        resource = generateResource()
+    }
+
+    jid := xmpp.NewJID(s.JID().Local, s.JID().Domain, resource)
+    replaced, ok := f.sessions.Claim(s, jid, f.policy)
+    if !ok {
+        return false, sendBindError(s, iq, protocol.XMPP_STANZA_ERROR_TYPE_CANCEL,
+            protocol.XMPPStanzaErrorGroup{
+                Conflict: &protocol.XMPPStanzaErrorConflict{},
+            })
+    }
+    if replaced != nil {
+        replaced.Writer().SendElement(&protocol.XMPPStreamError{
+            Conflict: &protocol.XMPPStreamErrorConflict{},
+        })
+        replaced.Close(true)
+    }
+    jid = s.JID()
+    s.AddCloseHandler(f.sessions.Unbind)
+
+    err := s.Writer().SendElement(&protocol.XMPPStanzaIQ{
+        Id:   iq.Id,
+        Type: protocol.XMPP_STANZA_IQ_TYPE_RESULT,
+        Bind: &protocol.XMPPBind{
+            JID: jid.String(),
+        },
+    })
+    return true, err
+}
+
+func isBound(s Streamer) bool {
+    return s.JID() != nil && s.JID().Resource != ""
+}
+
+func generateResource() string {
+    return strings.Replace(uuid.New(), "-", "", -1)
+}
+
+// Replies to the bind request with a stanza error. The stream stays open, so
+// the client can try again.
+func sendBindError(s Streamer, iq *protocol.XMPPStanzaIQ, errType string,
+    condition protocol.XMPPStanzaErrorGroup) error {
+    return s.Writer().SendElement(&protocol.XMPPStanzaIQ{
+        Id:   iq.Id,
+        Type: protocol.XMPP_STANZA_IQ_TYPE_ERROR,
+        Error: &protocol.XMPPStanzaError{
+            Type:                 errType,
+            XMPPStanzaErrorGroup: condition,
+        },
+    })
+}
@@ -0,0 +1,96 @@
+package stream
+
+import (
+    "github.com/stretchr/testify/assert"
+    "github.com/zonyitoo/goxmpp/basic"
+    "github.com/zonyitoo/goxmpp/protocol"
+    "net"
+    "sync"
+    "sync/atomic"
+    "testing"
+)
+
+func testBindClient(t *testing.T, sessions *SessionRegistry, policy BindConflictPolicy,
+    resource string) (*ClientStream, error) {
+    cconn, sconn := testConnPair(t)
+
+    features := []FeatureNegotiator{NewSASLFeature(), NewBindFeature(sessions, policy)}
+    server := NewServerClientStream(sconn, "example.com", features, testPlainAuthenticator(), &nopStanzaHandler{})
+    go server.Run()
+
+    jid := xmpp.NewJID("juliet", "example.com", resource)
+    client := NewClientStream(cconn, jid, nil, testPlainMechanisms(), nil)
+    return client, client.Start()
+}
+
+func Test_BindGeneratedResource(t *testing.T) {
+    sessions := NewSessionRegistry()
+    client, err := testBindClient(t, sessions, BindConflictReject, "")
+    assert.NoError(t, err)
+    assert.NotEmpty(t, client.JID().Resource)
+    assert.NotNil(t, sessions.Get(client.JID()))
+    client.Close(true)
+}
+
+func Test_BindConflictReject(t *testing.T) {
+    sessions := NewSessionRegistry()
+    first, err := testBindClient(t, sessions, BindConflictReject, "balcony")
+    assert.NoError(t, err)
+
+    _, err = testBindClient(t, sessions, BindConflictReject, "balcony")
+    assert.Equal(t, ClientStreamBindFailureError, err)
+    first.Close(true)
+}
+
+func Test_BindConflictRename(t *testing.T) {
+    sessions := NewSessionRegistry()
+    first, err := testBindClient(t, sessions, BindConflictRename, "balcony")
+    assert.NoError(t, err)
+
+    second, err := testBindClient(t, sessions, BindConflictRename, "balcony")
+    assert.NoError(t, err)
+    assert.NotEqual(t, first.JID().String(), second.JID().String())
+    first.Close(true)
+    second.Close(true)
+}
+
+func Test_BindConflictReplace(t *testing.T) {
+    sessions := NewSessionRegistry()
+    first, err := testBindClient(t, sessions, BindConflictReplace, "balcony")
+    assert.NoError(t, err)
+    old := sessions.Get(first.JID())
+
+    second, err := testBindClient(t, sessions, BindConflictReplace, "balcony")
+    assert.NoError(t, err)
+    assert.Equal(t, "juliet@example.com/balcony", second.JID().String())
+    assert.True(t, old != sessions.Get(second.JID()))
+
+    // The replaced session is terminated
+    elem, err := first.Reader().NextElement()
+    assert.NoError(t, err)
+    if streamErr, ok := elem.(*protocol.XMPPStreamError); assert.True(t, ok) {
+        assert.NotNil(t, streamErr.Conflict)
+    }
+    second.Close(true)
+}
+
+// Concurrent binds of a JID cannot both pass the conflict check
+func Test_SessionClaimConcurrent(t *testing.T) {
+    sessions := NewSessionRegistry()
+    var wg sync.WaitGroup
+    var claimed int32
+    for i := 0; i < 8; i++ {
+        conn, _ := net.Pipe()
+        s := NewServerClientStream(conn, "example.com", nil, nil, &nopStanzaHandler{})
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            if _, ok := sessions.Claim(s, xmpp.NewJID("juliet", "example.com", "balcony"), BindConflictReject); ok {
+                atomic.AddInt32(&claimed, 1)
+            }
+        }()
+    }
+    wg.Wait()
+    assert.Equal(t, int32(1), claimed)
+    assert.Len(t, sessions.Resources(&xmpp.NewJID("juliet", "example.com", "").BareJID), 1)
+}
@@ -0,0 +1,483 @@
+package stream
+
+import (
+    "code.google.com/p/go-uuid/uuid"
+    "crypto/tls"
+    "errors"
+    "github.com/zonyitoo/goxmpp/auth"
+    "github.com/zonyitoo/goxmpp/basic"
+    "github.com/zonyitoo/goxmpp/protocol"
+    "net"
+    "sync"
+)
+
+var (
+    ClientStreamUnexpectedElementError = errors.New("Unexpected element")
+    ClientStreamStreamError            = errors.New("Stream error received")
+    ClientStreamTLSRequiredError       = errors.New("TLS is required by the server")
+    ClientStreamTLSUnavailableError    = errors.New("TLS is not offered by the server")
+    ClientStreamTLSFailureError        = errors.New("TLS negotiation failed")
+    ClientStreamNoMechanismError       = errors.New("No acceptable SASL mechanism")
+    ClientStreamAuthFailureError       = errors.New("SASL authentication failed")
+    ClientStreamAuthIncompleteError    = errors.New("SASL success before the exchange completed")
+    ClientStreamBindFailureError       = errors.New("Resource binding failed")
+    ClientStreamCompressionError       = errors.New("Stream compression failed")
+)
+
+type ClientStream struct {
+    conn            net.Conn
+    jid             *xmpp.JID
+    tlsConfig       *tls.Config
+    id              string
+    mechanisms      []auth.ClientMechanism
+    writer          *Writer
+    reader          *Reader
+    isAuthenticated bool
+    isAnonymous     bool
+    compression     bool
+    stanzaHandler   StanzaHandler
+    closeHandlers   []func(Streamer)
+    closeLock       sync.Mutex
+    closeOnce       sync.Once
+}
+
+// Dial connects to addr and negotiates a client session for jid with the
+// given password, using the strongest of SCRAM-SHA-256(-PLUS),
+// SCRAM-SHA-1(-PLUS) and PLAIN that the server offers. The returned stream
+// is authenticated and bound.
+func Dial(addr string, jid *xmpp.JID, password string,
+    tlsConfig *tls.Config, shandler StanzaHandler) (*ClientStream, error) {
+    conn, err := net.Dial("tcp", addr)
+    if err != nil {
+        return nil, err
+    }
+    return startPasswordSession(conn, jid, password, tlsConfig, shandler)
+}
+
+// RFC6120 Section 3.2
+//
+// DialDomain is Dial for the server of the domain of jid, found with the
+// resolver, see DialService. A nil resolver uses net.DefaultResolver.
+func DialDomain(r Resolver, jid *xmpp.JID, password string,
+    tlsConfig *tls.Config, shandler StanzaHandler) (*ClientStream, error) {
+    if r == nil {
+        r = net.DefaultResolver
+    }
+    conn, err := DialService(r, jid.Domain, protocol.XMPP_DNS_SRV_CLIENT, tlsConfig)
+    if err != nil {
+        return nil, err
+    }
+    return startPasswordSession(conn, jid, password, tlsConfig, shandler)
+}
+
+func startPasswordSession(conn net.Conn, jid *xmpp.JID, password string,
+    tlsConfig *tls.Config, shandler StanzaHandler) (*ClientStream, error) {
+    mechanisms := []auth.ClientMechanism{
+        auth.NewSCRAMPlusClient(auth.SCRAMSHA256, auth.ChannelBindingTLSExporter, "", jid.Local, password),
+        auth.NewSCRAMPlusClient(auth.SCRAMSHA1, auth.ChannelBindingTLSExporter, "", jid.Local, password),
+        auth.NewSCRAMClient(auth.SCRAMSHA256, "", jid.Local, password),
+        auth.NewSCRAMClient(auth.SCRAMSHA1, "", jid.Local, password),
+        auth.NewPlainClient("", jid.Local, password),
+    }
+    cs := NewClientStream(conn, jid, tlsConfig, mechanisms, shandler)
+    if err := cs.Start(); err != nil {
+        return nil, err
+    }
+    return cs, nil
+}
+
+// Creates a client stream for jid over conn. The mechanisms are tried in
+// order of priority among those the server offers.
+func NewClientStream(conn net.Conn, jid *xmpp.JID, tlsConfig *tls.Config,
+    mechanisms []auth.ClientMechanism, shandler StanzaHandler) *ClientStream {
+    return &ClientStream{
+        conn:          conn,
+        jid:           jid,
+        tlsConfig:     tlsConfig,
+        mechanisms:    mechanisms,
+        reader:        NewReader(conn),
+        writer:        NewWriter(conn),
+        stanzaHandler: shandler,
+    }
+}
+
+func (cs *ClientStream) Id() string {
+    return cs.id
+}
+
+func (cs *ClientStream) Domain() string {
+    return cs.jid.Domain
+}
+
+// JID returns the address of the session; after Start it is the full JID
+// assigned by the server.
+func (cs *ClientStream) JID() *xmpp.JID {
+    return cs.jid
+}
+
+func (cs *ClientStream) SetJID(jid *xmpp.JID) {
+    cs.jid = jid
+}
+
+// Start negotiates TLS, SASL, compression if enabled and resource binding
+// with the server. On error the stream is closed.
+func (cs *ClientStream) Start() error {
+    if err := cs.negotiate(); err != nil {
+        cs.Close(false)
+        return err
+    }
+    return nil
+}
+
+func (cs *ClientStream) open() (*protocol.XMPPStreamFeatures, error) {
+    cs.Writer().Open(&protocol.XMPPStream{
+        From:    cs.jid.BareJID.String(),
+        To:      cs.jid.Domain,
+        Version: "1.0",
+        Xmlns:   protocol.XMLNS_JABBER_CLIENT,
+    })
+
+    header, err := cs.Reader().NextElement()
+    if err != nil {
+        return nil, err
+    }
+    if t, ok := header.(*protocol.XMPPStream); !ok {
+        return nil, ClientStreamUnexpectedElementError
+    } else {
+        cs.id = t.Id
+    }
+
+    elem, err := cs.Reader().NextElement()
+    if err != nil {
+        return nil, err
+    }
+    switch t := elem.(type) {
+    case *protocol.XMPPStreamFeatures:
+        return t, nil
+    case *protocol.XMPPStreamError:
+        return nil, ClientStreamStreamError
+    default:
+        return nil, ClientStreamUnexpectedElementError
+    }
+}
+
+func (cs *ClientStream) negotiate() error {
+    for {
+        features, err := cs.open()
+        if err != nil {
+            return err
+        }
+
+        if cs.tlsConfig != nil && !cs.IsEncrypted() {
+            if features.StartTLS == nil {
+                return ClientStreamTLSUnavailableError
+            }
+            if err := cs.startTLS(); err != nil {
+                return err
+            }
+            cs.Reset()
+            continue
+        } else if features.StartTLS != nil && features.StartTLS.Required != nil && !cs.IsEncrypted() {
+            return ClientStreamTLSRequiredError
+        }
+
+        switch {
+        case features.SASLMechanisms != nil && !cs.IsAuthenticated():
+            if err := cs.authenticate(features.SASLMechanisms.Mechanisms); err != nil {
+                return err
+            }
+            cs.isAuthenticated = true
+            cs.Reset()
+        case cs.compression && !cs.IsCompressed() && offersZlib(features.Compression):
+            compressed, err := cs.compress()
+            if err != nil {
+                return err
+            }
+            if compressed {
+                cs.Reset()
+                continue
+            }
+            // The server refused; the stream goes on uncompressed
+            if features.Bind != nil {
+                return cs.bind()
+            }
+            return nil
+        case features.Bind != nil:
+            return cs.bind()
+        default:
+            return nil
+        }
+    }
+}
+
+func (cs *ClientStream) startTLS() error {
+    cs.Writer().SendElement(&protocol.XMPPStartTLS{})
+    resp, err := cs.Reader().NextElement()
+    if err != nil {
+        return err
+    }
+    if _, ok := resp.(*protocol.XMPPTLSProceed); !ok {
+        return ClientStreamTLSFailureError
+    }
+
+    config := cs.tlsConfig
+    if config.ServerName == "" {
+        config = config.Clone()
+        config.ServerName = cs.jid.Domain
+    }
+    tlsConn := tls.Client(cs.conn, config)
+    if err := tlsConn.Handshake(); err != nil {
+        return err
+    }
+    cs.conn = tlsConn
+    return nil
+}
+
+func offersZlib(compression *protocol.XMPPStreamFeatureCompression) bool {
+    if compression == nil {
+        return false
+    }
+    for _, method := range compression.Methods {
+        if method == protocol.XMPP_STREAM_FEATURE_COMPRESSION_METHOD_ZLIB {
+            return true
+        }
+    }
+    return false
+}
+
+// XEP-0138 Section 5
+//
+// Returns false if the server answered with a <failure/>, in which case the
+// stream stays uncompressed.
+func (cs *ClientStream) compress() (bool, error) {
+    cs.Writer().SendElement(&protocol.XMPPStreamCompressionCompress{
+        Methods: []string{protocol.XMPP_STREAM_FEATURE_COMPRESSION_METHOD_ZLIB},
+    })
+    resp, err := cs.Reader().NextElement()
+    if err != nil {
+        return false, err
+    }
+    switch resp.(type) {
+    case *protocol.XMPPStreamCompressionCompressed:
+    case *protocol.XMPPStreamCompressionFailure:
+        return false, nil
+    default:
+        return false, ClientStreamUnexpectedElementError
+    }
+
+    conn, err := newCompressConn(cs.conn)
+    if err != nil {
+        return false, ClientStreamCompressionError
+    }
+    cs.conn = conn
+    return true, nil
+}
+
+func (cs *ClientStream) authenticate(offered []string) error {
+    mechanism, exchange, err := auth.Select(cs.mechanisms, offered, authContext(cs))
+    if err != nil {
+        return ClientStreamNoMechanismError
+    }
+
+    initial, err := exchange.Start()
+    if err != nil {
+        return err
+    }
+    cs.Writer().SendElement(&protocol.XMPPSASLAuth{
+        Mechanism: mechanism.Name(),
+        Data:      encodeSASLData(initial),
+    })
+
+    for {
+        elem, err := cs.Reader().NextElement()
+        if err != nil {
+            return err
+        }
+        switch t := elem.(type) {
+        case *protocol.XMPPSASLChallenge:
+            challenge, err := decodeSASLData(t.Data)
+            if err != nil {
+                cs.Writer().SendElement(&protocol.XMPPSASLAbort{})
+                return err
+            }
+            resp, err := exchange.Next(challenge)
+            if err != nil {
+                cs.Writer().SendElement(&protocol.XMPPSASLAbort{})
+                return err
+            }
+            cs.Writer().SendElement(&protocol.XMPPSASLResponse{Data: encodeSASLData(resp)})
+        case *protocol.XMPPSASLSuccess:
+            cs.isAnonymous = mechanism.Name() == "ANONYMOUS"
+            // RFC6120 Section 6.3.10: additional data with success, e.g. the
+            // SCRAM server signature, is verified by the mechanism
+            if t.Data != "" {
+                data, err := decodeSASLData(t.Data)
+                if err != nil {
+                    return err
+                }
+                if _, err := exchange.Next(data); err != nil {
+                    return err
+                }
+            }
+            // A server which skips the rest of the exchange is not
+            // authenticated
+            if !exchange.Completed() {
+                return ClientStreamAuthIncompleteError
+            }
+            return nil
+        case *protocol.XMPPSASLFailure:
+            return ClientStreamAuthFailureError
+        default:
+            return ClientStreamUnexpectedElementError
+        }
+    }
+}
+
+func (cs *ClientStream) bind() error {
+    id := uuid.New()
+    cs.Writer().SendElement(&protocol.XMPPStanzaIQ{
+        Id:   id,
+        Type: protocol.XMPP_STANZA_IQ_TYPE_SET,
+        Bind: &protocol.XMPPBind{
+            Resource: cs.jid.Resource,
+        },
+    })
+
+    elem, err := cs.Reader().NextElement()
+    if err != nil {
+        return err
+    }
+    iq, ok := elem.(*protocol.XMPPStanzaIQ)
+    if !ok || iq.Id != id || iq.Type != protocol.XMPP_STANZA_IQ_TYPE_RESULT || iq.Bind == nil {
+        return ClientStreamBindFailureError
+    }
+
+    jid, err := xmpp.NewJIDFromString(iq.Bind.JID)
+    if err != nil {
+        return ClientStreamBindFailureError
+    }
+    cs.jid = jid
+    return nil
+}
+
+func (cs *ClientStream) RemoteAddr() net.Addr {
+    return cs.conn.RemoteAddr()
+}
+
+func (cs *ClientStream) Writer() *Writer {
+    return cs.writer
+}
+
+func (cs *ClientStream) Reader() *Reader {
+    return cs.reader
+}
+
+func (cs *ClientStream) IsAnonymous() bool {
+    return cs.isAnonymous
+}
+
+func (cs *ClientStream) IsAuthenticated() bool {
+    return cs.isAuthenticated
+}
+
+func (cs *ClientStream) IsEncrypted() bool {
+    _, ok := tlsConnOf(cs.conn)
+    return ok
+}
+
+func (cs *ClientStream) IsCompressed() bool {
+    return isCompressed(cs.conn)
+}
+
+// XEP-0138
+//
+// Requests zlib compression after authentication if the server offers it.
+// Must be called before Start.
+func (cs *ClientStream) SetCompression(enabled bool) {
+    cs.compression = enabled
+}
+
+func (cs *ClientStream) SetAuthenticated(authenticated bool) {
+    cs.isAuthenticated = authenticated
+}
+
+func (cs *ClientStream) SetAnonymous(anonymous bool) {
+    cs.isAnonymous = anonymous
+}
+
+func (cs *ClientStream) SASLAuthenticator() *auth.Authenticator {
+    return nil
+}
+
+func (cs *ClientStream) Conn() net.Conn {
+    return cs.conn
+}
+
+func (cs *ClientStream) SetConn(conn net.Conn) {
+    cs.conn = conn
+}
+
+func (cs *ClientStream) Reset() {
+    cs.reader = NewReaderWithLimits(cs.conn, cs.reader.Limits())
+    cs.writer.Destroy()
+    cs.writer = NewWriterWithConfig(cs.conn, cs.writer.Config())
+}
+
+func (cs *ClientStream) Run() {
+    for {
+        elem, err := cs.Reader().NextElement()
+        if err != nil {
+            cs.Close(false)
+            return
+        }
+
+        switch t := elem.(type) {
+        case *protocol.XMPPStanzaIQ:
+            if cs.stanzaHandler.HandleIQ(t, cs) != nil {
+                cs.Close(true)
+                return
+            }
+        case *protocol.XMPPStanzaMessage:
+            if cs.stanzaHandler.HandleMessage(t, cs) != nil {
+                cs.Close(true)
+                return
+            }
+        case *protocol.XMPPStanzaPresence:
+            if cs.stanzaHandler.HandlePresence(t, cs) != nil {
+                cs.Close(true)
+                return
+            }
+        case *protocol.XMPPStreamError, *protocol.XMPPStreamEnd:
+            cs.Close(true)
+            return
+        }
+    }
+}
+
+func (cs *ClientStream) AddCloseHandler(handler func(Streamer)) {
+    cs.closeLock.Lock()
+    defer cs.closeLock.Unlock()
+    cs.closeHandlers = append(cs.closeHandlers, handler)
+}
+
+func (cs *ClientStream) Close(withCloseTag bool) error {
+    var err error
+    cs.closeOnce.Do(func() {
+        if withCloseTag {
+            err = cs.Writer().Close()
+        } else {
+            err = cs.Writer().Destroy()
+        }
+        if cerr := cs.conn.Close(); err == nil {
+            err = cerr
+        }
+
+        cs.closeLock.Lock()
+        handlers := cs.closeHandlers
+        cs.closeLock.Unlock()
+        for _, handler := range handlers {
+            handler(cs)
+        }
+    })
+    return err
+}
@@ -0,0 +1,245 @@
+package stream
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "github.com/stretchr/testify/assert"
+    "github.com/zonyitoo/goxmpp/auth"
+    "github.com/zonyitoo/goxmpp/basic"
+    "github.com/zonyitoo/goxmpp/protocol"
+    "math/big"
+    "net"
+    "regexp"
+    "sync"
+    "testing"
+    "time"
+)
+
+// Generates a self-signed certificate for example.com and returns the server
+// and client TLS configurations trusting it.
+func testTLSConfigs(t *testing.T) (*tls.Config, *tls.Config) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    template := &x509.Certificate{
+        SerialNumber:          big.NewInt(1),
+        Subject:               pkix.Name{CommonName: "example.com"},
+        DNSNames:              []string{"example.com"},
+        NotBefore:             time.Now().Add(-time.Hour),
+        NotAfter:              time.Now().Add(time.Hour),
+        KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+        ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+        BasicConstraintsValid: true,
+        IsCA:                  true,
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cert, err := x509.ParseCertificate(der)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    pool := x509.NewCertPool()
+    pool.AddCert(cert)
+    server := &tls.Config{
+        Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+    }
+    client := &tls.Config{
+        RootCAs: pool,
+    }
+    return server, client
+}
+
+// Returns both ends of a loopback TCP connection.
+func testConnPair(t *testing.T) (net.Conn, net.Conn) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer listener.Close()
+
+    cconn, err := net.Dial("tcp", listener.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    sconn, err := listener.Accept()
+    if err != nil {
+        t.Fatal(err)
+    }
+    return cconn, sconn
+}
+
+func testServerStream(conn net.Conn, tlsConfig *tls.Config, sessions *SessionRegistry) *ServerClientStream {
+    var features []FeatureNegotiator
+    if tlsConfig != nil {
+        features = append(features, NewTLSFeature(tlsConfig, true))
+    }
+    features = append(features, NewSASLFeature(), NewBindFeature(sessions, BindConflictReplace))
+    return NewServerClientStream(conn, "example.com", features, testPlainAuthenticator(), &nopStanzaHandler{})
+}
+
+// Accepts PLAIN on unencrypted test connections.
+type testPlainServer struct {
+    *auth.PlainServer
+}
+
+func (m *testPlainServer) Available(ctx *auth.Context) bool {
+    return true
+}
+
+func (m *testPlainServer) NewExchange(ctx *auth.Context) auth.ServerExchange {
+    c := *ctx
+    c.TLS = &tls.ConnectionState{}
+    return m.PlainServer.NewExchange(&c)
+}
+
+// Sends PLAIN credentials on unencrypted test connections.
+type testPlainClientMechanism struct {
+    *auth.PlainClient
+}
+
+func (m *testPlainClientMechanism) NewExchange(ctx *auth.Context) (auth.ClientExchange, error) {
+    c := *ctx
+    c.TLS = &tls.ConnectionState{}
+    return m.PlainClient.NewExchange(&c)
+}
+
+// Logs in as juliet with the password r0m30 over PLAIN, with or without TLS.
+func testPlainMechanisms() []auth.ClientMechanism {
+    return []auth.ClientMechanism{&testPlainClientMechanism{auth.NewPlainClient("", "juliet", "r0m30")}}
+}
+
+// Accepts juliet with the password r0m30 over PLAIN.
+func testPlainAuthenticator() *auth.Authenticator {
+    authenticator := auth.NewAuthenticator()
+    authenticator.Register(&testPlainServer{auth.NewPlainServer(
+        auth.PlainCredentialsFunc(func(username, password string) (bool, error) {
+            return username == "juliet" && password == "r0m30", nil
+        }))})
+    return authenticator
+}
+
+type nopStanzaHandler struct{}
+
+func (h *nopStanzaHandler) HandleIQ(*protocol.XMPPStanzaIQ, Streamer) error {
+    return nil
+}
+
+func (h *nopStanzaHandler) HandleMessage(*protocol.XMPPStanzaMessage, Streamer) error {
+    return nil
+}
+
+func (h *nopStanzaHandler) HandlePresence(*protocol.XMPPStanzaPresence, Streamer) error {
+    return nil
+}
+
+func Test_ClientStream(t *testing.T) {
+    cconn, sconn := testConnPair(t)
+
+    server := testServerStream(sconn, nil, NewSessionRegistry())
+    go server.Run()
+
+    jid := xmpp.NewJID("juliet", "example.com", "balcony")
+    client := NewClientStream(cconn, jid, nil, testPlainMechanisms(), nil)
+
+    assert.NoError(t, client.Start())
+    assert.True(t, client.IsAuthenticated())
+    assert.Equal(t, "juliet@example.com/balcony", client.JID().String())
+    assert.NoError(t, client.Close(true))
+}
+
+func Test_ClientStreamTLS(t *testing.T) {
+    cconn, sconn := testConnPair(t)
+    serverConfig, clientConfig := testTLSConfigs(t)
+
+    server := testServerStream(sconn, serverConfig, NewSessionRegistry())
+    go server.Run()
+
+    jid := xmpp.NewJID("juliet", "example.com", "balcony")
+    mechanisms := []auth.ClientMechanism{auth.NewPlainClient("", "juliet", "r0m30")}
+    client := NewClientStream(cconn, jid, clientConfig, mechanisms, nil)
+
+    assert.NoError(t, client.Start())
+    assert.True(t, client.IsEncrypted())
+    assert.True(t, client.IsAuthenticated())
+    assert.Equal(t, "juliet@example.com/balcony", client.JID().String())
+    assert.NoError(t, client.Close(true))
+}
+
+func Test_ClientStreamTLSRequired(t *testing.T) {
+    cconn, sconn := testConnPair(t)
+    serverConfig, _ := testTLSConfigs(t)
+
+    server := testServerStream(sconn, serverConfig, NewSessionRegistry())
+    go server.Run()
+
+    jid := xmpp.NewJID("juliet", "example.com", "balcony")
+    mechanisms := []auth.ClientMechanism{auth.NewPlainClient("", "juliet", "r0m30")}
+    client := NewClientStream(cconn, jid, nil, mechanisms, nil)
+
+    assert.Equal(t, ClientStreamTLSRequiredError, client.Start())
+}
+
+// Keeps what is read from the connection.
+type testRecordingConn struct {
+    net.Conn
+    lock sync.Mutex
+    read []byte
+}
+
+func (c *testRecordingConn) Read(p []byte) (int, error) {
+    n, err := c.Conn.Read(p)
+    c.lock.Lock()
+    c.read = append(c.read, p[:n]...)
+    c.lock.Unlock()
+    return n, err
+}
+
+// The IDs of the stream headers read in plaintext.
+func (c *testRecordingConn) streamIds() []string {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    var ids []string
+    for _, match := range regexp.MustCompile(`<stream:stream[^>]* id='([^']*)'`).FindAllSubmatch(c.read, -1) {
+        ids = append(ids, string(match[1]))
+    }
+    return ids
+}
+
+// RFC6120 Section 4.7.3, 5.4.3.3 and 6.4.6
+func Test_ClientStreamRestartId(t *testing.T) {
+    cconn, sconn := testConnPair(t)
+    server := testServerStream(sconn, nil, NewSessionRegistry())
+    go server.Run()
+
+    conn := &testRecordingConn{Conn: cconn}
+    mechanisms := testPlainMechanisms()
+    client := NewClientStream(conn, xmpp.NewJID("juliet", "example.com", "balcony"), nil, mechanisms, nil)
+    assert.NoError(t, client.Start())
+    ids := conn.streamIds()
+    if assert.Len(t, ids, 2) {
+        assert.NotEqual(t, ids[0], ids[1])
+        assert.Equal(t, ids[1], client.Id())
+    }
+
+    // The ID sent in plaintext is not reused after STARTTLS
+    cconn, sconn = testConnPair(t)
+    serverConfig, clientConfig := testTLSConfigs(t)
+    server = testServerStream(sconn, serverConfig, NewSessionRegistry())
+    go server.Run()
+
+    conn = &testRecordingConn{Conn: cconn}
+    client = NewClientStream(conn, xmpp.NewJID("juliet", "example.com", "balcony"), clientConfig, mechanisms, nil)
+    assert.NoError(t, client.Start())
+    ids = conn.streamIds()
+    if assert.Len(t, ids, 1) {
+        assert.NotEqual(t, ids[0], client.Id())
+    }
+}
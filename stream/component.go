@@ -0,0 +1,517 @@
+package stream
+
+import (
+    "code.google.com/p/go-uuid/uuid"
+    "crypto/sha1"
+    "crypto/subtle"
+    "encoding/hex"
+    "errors"
+    "github.com/zonyitoo/goxmpp/auth"
+    "github.com/zonyitoo/goxmpp/basic"
+    "github.com/zonyitoo/goxmpp/protocol"
+    "net"
+    "sync"
+)
+
+var (
+    ComponentStreamNotAuthorizedError = errors.New("Component handshake failed")
+    ComponentStreamErrorReceivedError = errors.New("Received a stream error")
+    ComponentStreamUnexpectedError    = errors.New("Unexpected element")
+    ComponentStreamConflictError      = errors.New("Another component serves the domain")
+)
+
+// XEP-0114 Section 3
+//
+// The digest a component authenticates with: the hex encoded SHA-1 hash of
+// the stream id followed by the shared secret.
+func ComponentHandshakeDigest(id, secret string) string {
+    sum := sha1.Sum([]byte(id + secret))
+    return hex.EncodeToString(sum[:])
+}
+
+// XEP-0114
+//
+// The server side of a stream from an external component, which serves the
+// domain it names in its stream header. The component proves that it knows
+// the secret of the domain with the handshake, after which it may send
+// stanzas from any address at the domain.
+type ServerComponentStream struct {
+    conn            net.Conn
+    id              string
+    domain          string
+    secrets         func(domain string) (string, bool)
+    claim           func(s *ServerComponentStream) bool
+    writer          *Writer
+    reader          *Reader
+    isAuthenticated bool
+    stanzaHandler   StanzaHandler
+    closeHandlers   []func(Streamer)
+    closeLock       sync.Mutex
+    closeOnce       sync.Once
+}
+
+// Creates the stream of a component. secrets returns the secret of a domain,
+// or false if no component may serve it. claim is called once the handshake
+// is verified, before it is confirmed, and returns false if another component
+// serves the domain already (XEP-0114 Section 3.1).
+func NewServerComponentStream(conn net.Conn, secrets func(domain string) (string, bool),
+    claim func(s *ServerComponentStream) bool, shandler StanzaHandler) *ServerComponentStream {
+    return &ServerComponentStream{
+        conn:          conn,
+        id:            uuid.New(),
+        secrets:       secrets,
+        claim:         claim,
+        writer:        NewWriter(conn),
+        reader:        NewReader(conn),
+        stanzaHandler: shandler,
+    }
+}
+
+func (scs *ServerComponentStream) Id() string {
+    return scs.id
+}
+
+// The domain of the component, known once Start returned.
+func (scs *ServerComponentStream) Domain() string {
+    return scs.domain
+}
+
+func (scs *ServerComponentStream) JID() *xmpp.JID {
+    return xmpp.NewJID("", scs.domain, "")
+}
+
+// The address of a component is its domain.
+func (scs *ServerComponentStream) SetJID(*xmpp.JID) {}
+
+// XEP-0114 Section 3
+//
+// Reads the stream header and the handshake of the component. On error a
+// stream error is sent and the stream is closed.
+func (scs *ServerComponentStream) Start() error {
+    header, err := scs.reader.NextElement()
+    if err != nil {
+        scs.fail(streamErrorFor(err))
+        return err
+    }
+    t, ok := header.(*protocol.XMPPStream)
+    if !ok {
+        scs.fail(&protocol.XMPPStreamError{BadFormat: &protocol.XMPPStreamErrorBadFormat{}})
+        return StreamBadFormatError
+    }
+    if t.Xmlns != protocol.XMLNS_COMPONENT_ACCEPT {
+        scs.fail(&protocol.XMPPStreamError{InvalidNamespace: &protocol.XMPPStreamErrorInvalidNamespace{}})
+        return StreamInvalidNamespaceError
+    }
+    secret, ok := scs.secrets(t.To)
+    if !ok {
+        scs.fail(&protocol.XMPPStreamError{HostUnknown: &protocol.XMPPStreamErrorHostUnknown{}})
+        return StreamHostUnknownError
+    }
+    scs.domain = t.To
+    scs.writer.Open(&protocol.XMPPStream{
+        Id:    scs.id,
+        From:  scs.domain,
+        Xmlns: protocol.XMLNS_COMPONENT_ACCEPT,
+    })
+
+    elem, err := scs.reader.NextElement()
+    if err != nil {
+        scs.fail(streamErrorFor(err))
+        return err
+    }
+    handshake, ok := elem.(*protocol.XMPPComponentHandshake)
+    if !ok {
+        scs.fail(&protocol.XMPPStreamError{NotAuthorized: &protocol.XMPPStreamErrorNotAuthorized{}})
+        return ComponentStreamUnexpectedError
+    }
+    expected := ComponentHandshakeDigest(scs.id, secret)
+    if subtle.ConstantTimeCompare([]byte(handshake.Digest), []byte(expected)) != 1 {
+        scs.fail(&protocol.XMPPStreamError{NotAuthorized: &protocol.XMPPStreamErrorNotAuthorized{}})
+        return ComponentStreamNotAuthorizedError
+    }
+    if !scs.claim(scs) {
+        scs.fail(&protocol.XMPPStreamError{Conflict: &protocol.XMPPStreamErrorConflict{}})
+        return ComponentStreamConflictError
+    }
+    scs.isAuthenticated = true
+    return scs.writer.SendElement(&protocol.XMPPComponentHandshake{})
+}
+
+func (scs *ServerComponentStream) fail(streamError *protocol.XMPPStreamError) {
+    scs.writer.SendElement(streamError)
+    scs.Close(true)
+}
+
+func (scs *ServerComponentStream) RemoteAddr() net.Addr {
+    return scs.conn.RemoteAddr()
+}
+
+func (scs *ServerComponentStream) Writer() *Writer {
+    return scs.writer
+}
+
+func (scs *ServerComponentStream) Reader() *Reader {
+    return scs.reader
+}
+
+func (scs *ServerComponentStream) IsAnonymous() bool {
+    return false
+}
+
+func (scs *ServerComponentStream) IsAuthenticated() bool {
+    return scs.isAuthenticated
+}
+
+func (scs *ServerComponentStream) IsEncrypted() bool {
+    _, ok := tlsConnOf(scs.conn)
+    return ok
+}
+
+func (scs *ServerComponentStream) SetAuthenticated(authenticated bool) {
+    scs.isAuthenticated = authenticated
+}
+
+// Components cannot be anonymous.
+func (scs *ServerComponentStream) SetAnonymous(bool) {}
+
+func (scs *ServerComponentStream) SASLAuthenticator() *auth.Authenticator {
+    return nil
+}
+
+func (scs *ServerComponentStream) Conn() net.Conn {
+    return scs.conn
+}
+
+func (scs *ServerComponentStream) SetConn(conn net.Conn) {
+    scs.conn = conn
+}
+
+func (scs *ServerComponentStream) Reset() {
+    scs.reader = NewReaderWithLimits(scs.conn, scs.reader.Limits())
+    scs.writer.Destroy()
+    scs.writer = NewWriterWithConfig(scs.conn, scs.writer.Config())
+}
+
+// XEP-0114 Section 3.1
+//
+// Stanzas must come from an address at the domain of the component and be
+// addressed to someone. Otherwise the stream is closed with an error.
+func (scs *ServerComponentStream) checkAddressing(from, to string) bool {
+    var streamError *protocol.XMPPStreamError
+    fromJID, err := xmpp.NewJIDFromString(from)
+    switch {
+    case from == "" || to == "":
+        streamError = &protocol.XMPPStreamError{
+            ImproperAddressing: &protocol.XMPPStreamErrorImproperAddressing{},
+        }
+    case err != nil || fromJID.Domain != scs.domain:
+        streamError = &protocol.XMPPStreamError{
+            InvalidFrom: &protocol.XMPPStreamErrorInvalidFrom{},
+        }
+    default:
+        return true
+    }
+    scs.fail(streamError)
+    return false
+}
+
+// Passes the stanzas of the component to the stanza handler until the stream
+// is closed. Must be called once Start succeeded.
+func (scs *ServerComponentStream) Run() {
+    for {
+        elem, err := scs.reader.NextElement()
+        if err != nil {
+            scs.fail(streamErrorFor(err))
+            return
+        }
+
+        // Stanzas are passed on without the jabber:component:accept
+        // namespace, so that they take the namespace of the stream they are
+        // delivered to
+        switch t := elem.(type) {
+        case *protocol.XMPPStanzaIQ:
+            if !scs.checkAddressing(t.From, t.To) {
+                return
+            }
+            if scs.stanzaHandler.HandleIQ(unqualified(t).(*protocol.XMPPStanzaIQ), scs) != nil {
+                scs.Close(true)
+                return
+            }
+        case *protocol.XMPPStanzaMessage:
+            if !scs.checkAddressing(t.From, t.To) {
+                return
+            }
+            if scs.stanzaHandler.HandleMessage(unqualified(t).(*protocol.XMPPStanzaMessage), scs) != nil {
+                scs.Close(true)
+                return
+            }
+        case *protocol.XMPPStanzaPresence:
+            if !scs.checkAddressing(t.From, t.To) {
+                return
+            }
+            if scs.stanzaHandler.HandlePresence(unqualified(t).(*protocol.XMPPStanzaPresence), scs) != nil {
+                scs.Close(true)
+                return
+            }
+        case *protocol.XMPPStreamEnd:
+            scs.Close(true)
+            return
+        }
+    }
+}
+
+// Sends a stanza to the component.
+func (scs *ServerComponentStream) Send(stanza protocol.Protocol) error {
+    return scs.writer.SendElement(unqualified(stanza))
+}
+
+func (scs *ServerComponentStream) AddCloseHandler(handler func(Streamer)) {
+    scs.closeLock.Lock()
+    defer scs.closeLock.Unlock()
+    scs.closeHandlers = append(scs.closeHandlers, handler)
+}
+
+func (scs *ServerComponentStream) Close(withCloseTag bool) error {
+    var err error
+    scs.closeOnce.Do(func() {
+        if withCloseTag {
+            err = scs.writer.Close()
+        } else {
+            err = scs.writer.Destroy()
+        }
+        scs.conn.Close()
+
+        scs.closeLock.Lock()
+        handlers := scs.closeHandlers
+        scs.closeLock.Unlock()
+        for _, handler := range handlers {
+            handler(scs)
+        }
+    })
+    return err
+}
+
+// XEP-0114
+//
+// The component side of a stream to a server, serving domain. Stanzas sent
+// over the stream must carry a from address at the domain.
+type ComponentStream struct {
+    conn            net.Conn
+    id              string
+    domain          string
+    secret          string
+    writer          *Writer
+    reader          *Reader
+    isAuthenticated bool
+    stanzaHandler   StanzaHandler
+    closeHandlers   []func(Streamer)
+    closeLock       sync.Mutex
+    closeOnce       sync.Once
+}
+
+// DialComponent connects to the component port of a server at addr and
+// authenticates as domain with secret.
+func DialComponent(addr, domain, secret string, shandler StanzaHandler) (*ComponentStream, error) {
+    conn, err := net.Dial("tcp", addr)
+    if err != nil {
+        return nil, err
+    }
+    cs := NewComponentStream(conn, domain, secret, shandler)
+    if err := cs.Start(); err != nil {
+        return nil, err
+    }
+    return cs, nil
+}
+
+// Creates a component stream for domain over conn. The stanzas received are
+// passed to shandler by Run.
+func NewComponentStream(conn net.Conn, domain, secret string, shandler StanzaHandler) *ComponentStream {
+    return &ComponentStream{
+        conn:          conn,
+        domain:        domain,
+        secret:        secret,
+        writer:        NewWriter(conn),
+        reader:        NewReader(conn),
+        stanzaHandler: shandler,
+    }
+}
+
+func (cs *ComponentStream) Id() string {
+    return cs.id
+}
+
+func (cs *ComponentStream) Domain() string {
+    return cs.domain
+}
+
+func (cs *ComponentStream) JID() *xmpp.JID {
+    return xmpp.NewJID("", cs.domain, "")
+}
+
+// The address of a component is its domain.
+func (cs *ComponentStream) SetJID(*xmpp.JID) {}
+
+// XEP-0114 Section 3
+//
+// Opens the stream and authenticates with the handshake. On error the stream
+// is closed.
+func (cs *ComponentStream) Start() error {
+    if err := cs.handshake(); err != nil {
+        cs.Close(false)
+        return err
+    }
+    cs.isAuthenticated = true
+    return nil
+}
+
+func (cs *ComponentStream) handshake() error {
+    cs.writer.Open(&protocol.XMPPStream{
+        To:    cs.domain,
+        Xmlns: protocol.XMLNS_COMPONENT_ACCEPT,
+    })
+    elem, err := cs.reader.NextElement()
+    if err != nil {
+        return err
+    }
+    if _, ok := elem.(*protocol.XMPPStreamError); ok {
+        return ComponentStreamErrorReceivedError
+    }
+    header, ok := elem.(*protocol.XMPPStream)
+    if !ok {
+        return ComponentStreamUnexpectedError
+    }
+    if header.Xmlns != protocol.XMLNS_COMPONENT_ACCEPT {
+        return StreamInvalidNamespaceError
+    }
+    cs.id = header.Id
+
+    cs.writer.SendElement(&protocol.XMPPComponentHandshake{
+        Digest: ComponentHandshakeDigest(cs.id, cs.secret),
+    })
+    elem, err = cs.reader.NextElement()
+    if err != nil {
+        return err
+    }
+    switch e := elem.(type) {
+    case *protocol.XMPPComponentHandshake:
+        return nil
+    case *protocol.XMPPStreamError:
+        if e.Conflict != nil {
+            return ComponentStreamConflictError
+        }
+        return ComponentStreamNotAuthorizedError
+    case *protocol.XMPPStreamEnd:
+        return ComponentStreamNotAuthorizedError
+    default:
+        return ComponentStreamUnexpectedError
+    }
+}
+
+func (cs *ComponentStream) RemoteAddr() net.Addr {
+    return cs.conn.RemoteAddr()
+}
+
+func (cs *ComponentStream) Writer() *Writer {
+    return cs.writer
+}
+
+func (cs *ComponentStream) Reader() *Reader {
+    return cs.reader
+}
+
+func (cs *ComponentStream) IsAnonymous() bool {
+    return false
+}
+
+func (cs *ComponentStream) IsAuthenticated() bool {
+    return cs.isAuthenticated
+}
+
+func (cs *ComponentStream) IsEncrypted() bool {
+    _, ok := tlsConnOf(cs.conn)
+    return ok
+}
+
+func (cs *ComponentStream) SetAuthenticated(authenticated bool) {
+    cs.isAuthenticated = authenticated
+}
+
+// Components cannot be anonymous.
+func (cs *ComponentStream) SetAnonymous(bool) {}
+
+func (cs *ComponentStream) SASLAuthenticator() *auth.Authenticator {
+    return nil
+}
+
+func (cs *ComponentStream) Conn() net.Conn {
+    return cs.conn
+}
+
+func (cs *ComponentStream) SetConn(conn net.Conn) {
+    cs.conn = conn
+}
+
+func (cs *ComponentStream) Reset() {
+    cs.reader = NewReaderWithLimits(cs.conn, cs.reader.Limits())
+    cs.writer.Destroy()
+    cs.writer = NewWriterWithConfig(cs.conn, cs.writer.Config())
+}
+
+func (cs *ComponentStream) Run() {
+    for {
+        elem, err := cs.reader.NextElement()
+        if err != nil {
+            cs.Close(false)
+            return
+        }
+
+        switch t := elem.(type) {
+        case *protocol.XMPPStanzaIQ:
+            if cs.stanzaHandler.HandleIQ(t, cs) != nil {
+                cs.Close(true)
+                return
+            }
+        case *protocol.XMPPStanzaMessage:
+            if cs.stanzaHandler.HandleMessage(t, cs) != nil {
+                cs.Close(true)
+                return
+            }
+        case *protocol.XMPPStanzaPresence:
+            if cs.stanzaHandler.HandlePresence(t, cs) != nil {
+                cs.Close(true)
+                return
+            }
+        case *protocol.XMPPStreamError, *protocol.XMPPStreamEnd:
+            cs.Close(true)
+            return
+        }
+    }
+}
+
+func (cs *ComponentStream) AddCloseHandler(handler func(Streamer)) {
+    cs.closeLock.Lock()
+    defer cs.closeLock.Unlock()
+    cs.closeHandlers = append(cs.closeHandlers, handler)
+}
+
+func (cs *ComponentStream) Close(withCloseTag bool) error {
+    var err error
+    cs.closeOnce.Do(func() {
+        if withCloseTag {
+            err = cs.writer.Close()
+        } else {
+            err = cs.writer.Destroy()
+        }
+        if cerr := cs.conn.Close(); err == nil {
+            err = cerr
+        }
+
+        cs.closeLock.Lock()
+        handlers := cs.closeHandlers
+        cs.closeLock.Unlock()
+        for _, handler := range handlers {
+            handler(cs)
+        }
+    })
+    return err
+}
@@ -0,0 +1,137 @@
+package stream
+
+import (
+    "compress/zlib"
+    "crypto/tls"
+    "github.com/zonyitoo/goxmpp/protocol"
+    "io"
+    "net"
+)
+
+// XEP-0138 Section 6
+//
+// A zlib compressed connection. Every write is followed by a sync flush, so
+// that each stanza reaches the peer as soon as it is sent instead of waiting
+// for the compressor to fill a block.
+type compressConn struct {
+    net.Conn
+    writer *zlib.Writer
+    reader io.ReadCloser
+}
+
+func newCompressConn(conn net.Conn) (*compressConn, error) {
+    writer, err := zlib.NewWriterLevel(conn, zlib.DefaultCompression)
+    if err != nil {
+        return nil, err
+    }
+    return &compressConn{
+        Conn:   conn,
+        writer: writer,
+    }, nil
+}
+
+// The zlib header is read with the first data, as the peer only starts the
+// compressed stream after <compressed/>.
+func (c *compressConn) Read(b []byte) (int, error) {
+    if c.reader == nil {
+        reader, err := zlib.NewReader(c.Conn)
+        if err != nil {
+            return 0, err
+        }
+        c.reader = reader
+    }
+    return c.reader.Read(b)
+}
+
+func (c *compressConn) Write(b []byte) (int, error) {
+    n, err := c.writer.Write(b)
+    if err != nil {
+        return n, err
+    }
+    return n, c.writer.Flush()
+}
+
+func (c *compressConn) Close() error {
+    c.writer.Close()
+    return c.Conn.Close()
+}
+
+func isCompressed(conn net.Conn) bool {
+    _, ok := conn.(*compressConn)
+    return ok
+}
+
+// Returns the TLS connection underneath the compression layer, if any.
+func tlsConnOf(conn net.Conn) (*tls.Conn, bool) {
+    if c, ok := conn.(*compressConn); ok {
+        conn = c.Conn
+    }
+    tlsConn, ok := conn.(*tls.Conn)
+    return tlsConn, ok
+}
+
+// XEP-0138
+//
+// Offered once the stream is authenticated, so that the compression state is
+// not established before the entity is known, and until a resource is bound
+// (Section 4). Only zlib is supported.
+type CompressionFeature struct{}
+
+func NewCompressionFeature() *CompressionFeature {
+    return &CompressionFeature{}
+}
+
+func (f *CompressionFeature) Offered(s Streamer) bool {
+    return s.IsAuthenticated() && !isBound(s) && !isCompressed(s.Conn())
+}
+
+func (f *CompressionFeature) Mandatory(s Streamer) bool {
+    return false
+}
+
+func (f *CompressionFeature) RequiresRestart() bool {
+    return true
+}
+
+func (f *CompressionFeature) Advertise(features *protocol.XMPPStreamFeatures, s Streamer) {
+    features.Compression = &protocol.XMPPStreamFeatureCompression{
+        Methods: []string{protocol.XMPP_STREAM_FEATURE_COMPRESSION_METHOD_ZLIB},
+    }
+}
+
+func (f *CompressionFeature) Handles(elem protocol.Protocol, s Streamer) bool {
+    _, ok := elem.(*protocol.XMPPStreamCompressionCompress)
+    return ok
+}
+
+// XEP-0138 Section 5
+//
+// A failure leaves the stream uncompressed and open, so the entity can go on
+// without compression.
+func (f *CompressionFeature) Negotiate(elem protocol.Protocol, s Streamer) (bool, error) {
+    compress := elem.(*protocol.XMPPStreamCompressionCompress)
+    if len(compress.Methods) != 1 {
+        return false, s.Writer().SendElement(&protocol.XMPPStreamCompressionFailure{
+            SetupFailed: &protocol.XMPPStreamCompressionFailureSetupFailed{},
+        })
+    }
+    if compress.Methods[0] != protocol.XMPP_STREAM_FEATURE_COMPRESSION_METHOD_ZLIB {
+        return false, s.Writer().SendElement(&protocol.XMPPStreamCompressionFailure{
+            UnsupportedMethod: &protocol.XMPPStreamCompressionFailureUnsupportedMethod{},
+        })
+    }
+
+    conn, err := newCompressConn(s.Conn())
+    if err != nil {
+        return false, s.Writer().SendElement(&protocol.XMPPStreamCompressionFailure{
+            SetupFailed: &protocol.XMPPStreamCompressionFailureSetupFailed{},
+        })
+    }
+    // <compressed/> is the last element sent uncompressed; the stream is
+    // restarted over the compressed connection
+    if err := s.Writer().SendElement(&protocol.XMPPStreamCompressionCompressed{}); err != nil {
+        return false, err
+    }
+    s.SetConn(conn)
+    return true, nil
+}
@@ -0,0 +1,162 @@
+package stream
+
+import (
+    "crypto/tls"
+    "github.com/stretchr/testify/assert"
+    "github.com/zonyitoo/goxmpp/basic"
+    "github.com/zonyitoo/goxmpp/protocol"
+    "testing"
+)
+
+// Delivers the stanzas received by the stream to a channel.
+type chanStanzaHandler struct {
+    nopStanzaHandler
+    messages chan *protocol.XMPPStanzaMessage
+}
+
+func (h *chanStanzaHandler) HandleMessage(msg *protocol.XMPPStanzaMessage, s Streamer) error {
+    h.messages <- msg
+    return nil
+}
+
+func testCompressionServer(t *testing.T, tlsConfig *tls.Config) (*ServerClientStream, *chanStanzaHandler, *ClientStream) {
+    cconn, sconn := testConnPair(t)
+    var features []FeatureNegotiator
+    if tlsConfig != nil {
+        features = append(features, NewTLSFeature(tlsConfig, true))
+    }
+    features = append(features,
+        NewSASLFeature(),
+        NewBindFeature(NewSessionRegistry(), BindConflictReplace),
+        NewCompressionFeature())
+    handler := &chanStanzaHandler{messages: make(chan *protocol.XMPPStanzaMessage, 1)}
+    server := NewServerClientStream(sconn, "example.com", features, testPlainAuthenticator(), handler)
+    go server.Run()
+
+    jid := xmpp.NewJID("juliet", "example.com", "balcony")
+    return server, handler, NewClientStream(cconn, jid, nil, testPlainMechanisms(), nil)
+}
+
+func Test_Compression(t *testing.T) {
+    server, handler, client := testCompressionServer(t, nil)
+    client.SetCompression(true)
+    assert.NoError(t, client.Start())
+    assert.True(t, client.IsCompressed())
+    assert.Equal(t, "juliet@example.com/balcony", client.JID().String())
+
+    // Stanzas are flushed one by one in both directions
+    client.Writer().SendElement(&protocol.XMPPStanzaMessage{
+        Body: &protocol.XMPPStanzaMessageBody{Data: "Wherefore art thou?"},
+    })
+    assert.Equal(t, "Wherefore art thou?", (<-handler.messages).Body.Data)
+
+    server.Writer().SendElement(&protocol.XMPPStanzaMessage{
+        Body: &protocol.XMPPStanzaMessageBody{Data: "Deny thy father"},
+    })
+    elem, err := client.Reader().NextElement()
+    assert.NoError(t, err)
+    if msg, ok := elem.(*protocol.XMPPStanzaMessage); assert.True(t, ok) {
+        assert.Equal(t, "Deny thy father", msg.Body.Data)
+    }
+    assert.NoError(t, client.Close(true))
+}
+
+// Compression is layered over TLS
+func Test_CompressionTLS(t *testing.T) {
+    serverConfig, clientConfig := testTLSConfigs(t)
+    _, handler, client := testCompressionServer(t, serverConfig)
+    client.tlsConfig = clientConfig
+    client.SetCompression(true)
+    assert.NoError(t, client.Start())
+    assert.True(t, client.IsCompressed())
+    assert.True(t, client.IsEncrypted())
+
+    client.Writer().SendElement(&protocol.XMPPStanzaMessage{
+        Body: &protocol.XMPPStanzaMessageBody{Data: "Wherefore art thou?"},
+    })
+    assert.Equal(t, "Wherefore art thou?", (<-handler.messages).Body.Data)
+    assert.NoError(t, client.Close(true))
+}
+
+func Test_CompressionDisabled(t *testing.T) {
+    _, _, client := testCompressionServer(t, nil)
+    assert.NoError(t, client.Start())
+    assert.False(t, client.IsCompressed())
+    assert.NoError(t, client.Close(true))
+}
+
+func Test_CompressionFailure(t *testing.T) {
+    cconn, sconn := testConnPair(t)
+    features := []FeatureNegotiator{NewSASLFeature(), NewCompressionFeature()}
+    server := NewServerClientStream(sconn, "example.com", features, testPlainAuthenticator(), &nopStanzaHandler{})
+    go server.Run()
+
+    // Compression is only offered after authentication
+    reader, writer := testRawClient(t, cconn)
+    writer.SendElement(testSASLAuth("PLAIN", "\x00juliet\x00r0m30"))
+    elem, err := reader.NextElement()
+    assert.NoError(t, err)
+    assert.IsType(t, &protocol.XMPPSASLSuccess{}, elem)
+    reader, writer = testRawClient(t, cconn)
+
+    writer.SendElement(&protocol.XMPPStreamCompressionCompress{Methods: []string{"lzw"}})
+    elem, err = reader.NextElement()
+    assert.NoError(t, err)
+    if failure, ok := elem.(*protocol.XMPPStreamCompressionFailure); assert.True(t, ok) {
+        assert.NotNil(t, failure.UnsupportedMethod)
+    }
+
+    writer.SendElement(&protocol.XMPPStreamCompressionCompress{})
+    elem, err = reader.NextElement()
+    assert.NoError(t, err)
+    if failure, ok := elem.(*protocol.XMPPStreamCompressionFailure); assert.True(t, ok) {
+        assert.NotNil(t, failure.SetupFailed)
+    }
+
+    // The stream is still usable without compression
+    writer.SendElement(&protocol.XMPPStreamCompressionCompress{
+        Methods: []string{protocol.XMPP_STREAM_FEATURE_COMPRESSION_METHOD_ZLIB},
+    })
+    elem, err = reader.NextElement()
+    assert.NoError(t, err)
+    assert.IsType(t, &protocol.XMPPStreamCompressionCompressed{}, elem)
+}
+
+// Compression is negotiated before resource binding
+func Test_CompressionAfterBind(t *testing.T) {
+    cconn, sconn := testConnPair(t)
+    features := []FeatureNegotiator{
+        NewSASLFeature(),
+        NewBindFeature(NewSessionRegistry(), BindConflictReplace),
+        NewCompressionFeature(),
+    }
+    server := NewServerClientStream(sconn, "example.com", features, testPlainAuthenticator(), &nopStanzaHandler{})
+    go server.Run()
+
+    reader, writer := testRawClient(t, cconn)
+    writer.SendElement(testSASLAuth("PLAIN", "\x00juliet\x00r0m30"))
+    elem, err := reader.NextElement()
+    assert.NoError(t, err)
+    assert.IsType(t, &protocol.XMPPSASLSuccess{}, elem)
+    reader, writer = testRawClient(t, cconn)
+
+    writer.SendElement(&protocol.XMPPStanzaIQ{
+        Id:   "bind",
+        Type: protocol.XMPP_STANZA_IQ_TYPE_SET,
+        Bind: &protocol.XMPPBind{Resource: "balcony"},
+    })
+    elem, err = reader.NextElement()
+    assert.NoError(t, err)
+    if iq, ok := elem.(*protocol.XMPPStanzaIQ); assert.True(t, ok) {
+        assert.Equal(t, protocol.XMPP_STANZA_IQ_TYPE_RESULT, iq.Type)
+    }
+
+    // Ignored like any unknown element
+    writer.SendElement(&protocol.XMPPStreamCompressionCompress{
+        Methods: []string{protocol.XMPP_STREAM_FEATURE_COMPRESSION_METHOD_ZLIB},
+    })
+    writer.SendBytes([]byte(protocol.XMPPStreamEndFmt))
+    elem, err = reader.NextElement()
+    assert.NoError(t, err)
+    assert.IsType(t, &protocol.XMPPStreamEnd{}, elem)
+}
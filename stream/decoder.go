@@ -1,6 +1,7 @@
 package stream
 
 import (
+    "bufio"
     "encoding/xml"
     "errors"
     "io"
@@ -8,45 +9,143 @@ import (
     "bytes"
     "github.com/zonyitoo/goxmpp/protocol"
     "reflect"
+    "time"
 )
 
 var (
     DecoderBadFormatError              = errors.New("Bad format")
     DecoderUnexpectedEndOfElementError = errors.New("Unexpected end of element")
     DecoderRestrictedXMLError          = errors.New("Restricted XML")
+    DecoderUnsupportedEncodingError    = errors.New("Unsupported encoding")
+    DecoderBadNamespacePrefixError     = errors.New("Bad namespace prefix")
 )
 
+// DecoderLimitError reports input exceeding one of the DecoderLimits. Streams
+// close with the stream error of the limit, see StreamError.
+type DecoderLimitError struct {
+    Limit              string
+    // Whether the stream consumes more than it is granted, rather than
+    // violating the policy of the service
+    ResourceConstraint bool
+}
+
+func (e *DecoderLimitError) Error() string {
+    return "Decoder limit exceeded: " + e.Limit
+}
+
+// RFC6120 Section 4.9.3.14 and 4.9.3.17
+func (e *DecoderLimitError) StreamError() *protocol.XMPPStreamError {
+    if e.ResourceConstraint {
+        return &protocol.XMPPStreamError{ResourceConstraint: &protocol.XMPPStreamErrorResourceConstraint{}}
+    }
+    return &protocol.XMPPStreamError{PolicyViolation: &protocol.XMPPStreamErrorPolicyViolation{}}
+}
+
+// The stream error closing a stream whose Reader failed with err.
+func streamErrorFor(err error) *protocol.XMPPStreamError {
+    if e, ok := err.(*DecoderLimitError); ok {
+        return e.StreamError()
+    }
+    switch err {
+    case DecoderRestrictedXMLError:
+        // RFC6120 Section 4.9.3.18
+        return &protocol.XMPPStreamError{RestrictedXML: &protocol.XMPPStreamErrorRestrictedXML{}}
+    case DecoderUnsupportedEncodingError:
+        // RFC6120 Section 4.9.3.22
+        return &protocol.XMPPStreamError{UnsupportedEncoding: &protocol.XMPPStreamErrorUnsupportedEncoding{}}
+    case DecoderBadNamespacePrefixError:
+        // RFC6120 Section 4.9.3.2
+        return &protocol.XMPPStreamError{BadNamespacePrefix: &protocol.XMPPStreamErrorBadNamespacePrefix{}}
+    }
+    return &protocol.XMPPStreamError{InvalidXML: &protocol.XMPPStreamErrorInvalidXML{}}
+}
+
+var (
+    DecoderElementSizeError     = &DecoderLimitError{Limit: "element size"}
+    DecoderDepthError           = &DecoderLimitError{Limit: "nesting depth"}
+    DecoderAttributeCountError  = &DecoderLimitError{Limit: "attribute count"}
+    DecoderAttributeLengthError = &DecoderLimitError{Limit: "attribute length"}
+    DecoderRateError            = &DecoderLimitError{Limit: "bytes per second", ResourceConstraint: true}
+)
+
+// DecoderLimits bounds the input a Decoder accepts from its peer. A limit
+// which is not positive is disabled.
+type DecoderLimits struct {
+    // Bytes of a top level element, such as a stanza, including the
+    // whitespace before it
+    MaxElementBytes    int64
+    // Nesting depth of the children of a top level element
+    MaxDepth           int
+    // Attributes of an element, including namespace declarations
+    MaxAttributes      int
+    // Bytes of the value of an attribute
+    MaxAttributeLength int
+    // Bytes read from the transport per second
+    MaxBytesPerSecond  int64
+}
+
+var DefaultDecoderLimits = DecoderLimits{
+    MaxElementBytes:    1 << 20,
+    MaxDepth:           64,
+    MaxAttributes:      64,
+    MaxAttributeLength: 64 << 10,
+}
+
 type Decoder struct {
     xmlDecoder *xml.Decoder
+    input      *limitedInput
+    limits     DecoderLimits
+    // RFC7395: elements are framed instead of enclosed in a stream root
+    framed     bool
 }
 
 func NewDecoder(r io.Reader) *Decoder {
-    return &Decoder{
-        xmlDecoder: xml.NewDecoder(r),
+    return NewDecoderWithLimits(r, DefaultDecoderLimits)
+}
+
+func NewDecoderWithLimits(r io.Reader, limits DecoderLimits) *Decoder {
+    d := &Decoder{
+        limits: limits,
+        framed: isFramed(r),
     }
+    d.input = &limitedInput{decoder: d}
+    rated := &rateLimitedInput{r: r, decoder: d}
+    if _, ok := r.(io.ByteReader); ok {
+        // Transports which are read byte by byte have nothing buffered when
+        // the stream is reset
+        d.input.r = rated
+    } else {
+        d.input.r = bufio.NewReader(rated)
+    }
+    d.xmlDecoder = xml.NewTokenDecoder(newRestrictedXML(d.input))
+    return d
+}
+
+func (d *Decoder) Limits() DecoderLimits {
+    return d.limits
+}
+
+// Changes the limits before the next element is read.
+func (d *Decoder) SetLimits(limits DecoderLimits) {
+    d.limits = limits
 }
 
 func (d *Decoder) ParseElement(startToken xml.StartElement) (protocol.Protocol, error) {
+    if err := d.checkAttributes(startToken); err != nil {
+        return nil, err
+    }
+
     var element interface{}
     if startToken.Name == protocol.TAG_STREAM {
-        streamElem := &protocol.XMPPStream{}
-        for _, attr := range startToken.Attr {
-            switch attr.Name {
-            case xml.Name{Space: "", Local: "from"}:
-                streamElem.From = attr.Value
-            case xml.Name{Space: "", Local: "to"}:
-                streamElem.To = attr.Value
-            case xml.Name{Space: "", Local: "id"}:
-                streamElem.Id = attr.Value
-            case xml.Name{Space: "", Local: "version"}:
-                streamElem.Version = attr.Value
-            case xml.Name{Space: "http://www.w3.org/XML/1998/namespace", Local: "lang"}:
-                streamElem.XMLLang = attr.Value
-            case xml.Name{Space: "", Local: "xmlns"}:
-                streamElem.Xmlns = attr.Value
-            }
+        return parseStreamHeader(startToken), nil
+    } else if d.framed && startToken.Name == protocol.TAG_FRAMING_OPEN {
+        // RFC7395 Section 3.4: <open/> is returned as the stream header of
+        // the content namespace
+        streamElem := parseStreamHeader(startToken)
+        streamElem.Xmlns = protocol.XMLNS_JABBER_CLIENT
+        if err := d.xmlDecoder.Skip(); err != nil {
+            return nil, err
         }
-        streamElem.XMLName = startToken.Name
         return streamElem, nil
     } else {
         if t, ok := protocol.TAG_MAP[startToken.Name]; !ok {
@@ -56,14 +155,247 @@ func (d *Decoder) ParseElement(startToken xml.StartElement) (protocol.Protocol,
         }
     }
 
-    if err := d.xmlDecoder.DecodeElement(element, &startToken); err != nil {
+    tokens, err := d.readElement(startToken)
+    if err != nil {
+        return nil, err
+    }
+    replay := xml.NewTokenDecoder(&tokenReplay{tokens: tokens})
+    if err := replay.DecodeElement(element, nil); err != nil {
         return nil, err
     }
 
     return element, nil
 }
 
+// Reads the tokens of the element started by startToken, checking the depth
+// and the attributes of its children before they are decoded.
+func (d *Decoder) readElement(startToken xml.StartElement) ([]xml.Token, error) {
+    tokens := []xml.Token{startToken.Copy()}
+    depth := 0
+    for {
+        token, err := d.xmlDecoder.Token()
+        if err != nil {
+            return nil, err
+        }
+        switch t := token.(type) {
+        case xml.StartElement:
+            depth++
+            if d.limits.MaxDepth > 0 && depth > d.limits.MaxDepth {
+                return nil, DecoderDepthError
+            }
+            if err := d.checkAttributes(t); err != nil {
+                return nil, err
+            }
+        case xml.EndElement:
+            if depth == 0 {
+                return append(tokens, t), nil
+            }
+            depth--
+        }
+        tokens = append(tokens, xml.CopyToken(token))
+    }
+}
+
+func (d *Decoder) checkAttributes(t xml.StartElement) error {
+    if d.limits.MaxAttributes > 0 && len(t.Attr) > d.limits.MaxAttributes {
+        return DecoderAttributeCountError
+    }
+    if d.limits.MaxAttributeLength > 0 {
+        for _, attr := range t.Attr {
+            if len(attr.Value) > d.limits.MaxAttributeLength {
+                return DecoderAttributeLengthError
+            }
+        }
+    }
+    return nil
+}
+
+// RFC6120 Section 11
+//
+// Reads the raw tokens of a stream, rejecting the XML features which streams
+// must not contain, for a xml.Decoder to resolve their namespaces.
+type restrictedXML struct {
+    decoder             *xml.Decoder
+    // Whether nothing but whitespace has been read yet, before which the XML
+    // declaration is allowed
+    initial             bool
+    // The namespace prefixes declared by each open element
+    scopes              [][]string
+    unsupportedEncoding bool
+}
+
+func newRestrictedXML(r io.Reader) *restrictedXML {
+    x := &restrictedXML{
+        decoder: xml.NewDecoder(r),
+        initial: true,
+    }
+    // RFC6120 Section 11.6: xml.Decoder calls it for any encoding but UTF-8
+    x.decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+        x.unsupportedEncoding = true
+        return nil, DecoderUnsupportedEncodingError
+    }
+    return x
+}
+
+func (x *restrictedXML) Token() (xml.Token, error) {
+    token, err := x.decoder.RawToken()
+    if err != nil {
+        if x.unsupportedEncoding {
+            return nil, DecoderUnsupportedEncodingError
+        }
+        return nil, err
+    }
+    initial := x.initial
+    if t, ok := token.(xml.CharData); !ok || len(bytes.TrimSpace(t)) != 0 {
+        x.initial = false
+    }
+
+    switch t := token.(type) {
+    case xml.StartElement:
+        if err := x.push(t); err != nil {
+            return nil, err
+        }
+    case xml.EndElement:
+        if len(x.scopes) > 0 {
+            x.scopes = x.scopes[:len(x.scopes)-1]
+        }
+    case xml.ProcInst:
+        // RFC6120 Section 11.4 and 11.1
+        if !initial || t.Target != "xml" {
+            return nil, DecoderRestrictedXMLError
+        }
+    case xml.Comment, xml.Directive:
+        // RFC6120 Section 11.1: comments, DTDs and thus entity declarations
+        return nil, DecoderRestrictedXMLError
+    }
+    return token, nil
+}
+
+// RFC6120 Section 11.2
+//
+// Opens the scope of the prefixes declared by t, whose own prefixes must be
+// declared there or by one of its ancestors.
+func (x *restrictedXML) push(t xml.StartElement) error {
+    var scope []string
+    for _, attr := range t.Attr {
+        if attr.Name.Space == "xmlns" {
+            scope = append(scope, attr.Name.Local)
+        }
+    }
+    x.scopes = append(x.scopes, scope)
+
+    if !x.declared(t.Name.Space) {
+        return DecoderBadNamespacePrefixError
+    }
+    for _, attr := range t.Attr {
+        if attr.Name.Space != "xmlns" && !x.declared(attr.Name.Space) {
+            return DecoderBadNamespacePrefixError
+        }
+    }
+    return nil
+}
+
+func (x *restrictedXML) declared(prefix string) bool {
+    if prefix == "" || prefix == "xml" {
+        return true
+    }
+    for _, scope := range x.scopes {
+        for _, declared := range scope {
+            if declared == prefix {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// Passes the tokens of an element read already to xml.Decoder.DecodeElement.
+type tokenReplay struct {
+    tokens []xml.Token
+}
+
+func (r *tokenReplay) Token() (xml.Token, error) {
+    if len(r.tokens) == 0 {
+        return nil, io.EOF
+    }
+    token := r.tokens[0]
+    r.tokens = r.tokens[1:]
+    return token, nil
+}
+
+// The input of the xml.Decoder, which counts the bytes of the current top
+// level element. It implements io.ByteReader, so that the xml.Decoder does
+// not buffer it again.
+type limitedInput struct {
+    r       io.ByteReader
+    decoder *Decoder
+    // Bytes read since the last top level element ended
+    count   int64
+}
+
+func (in *limitedInput) ReadByte() (byte, error) {
+    if max := in.decoder.limits.MaxElementBytes; max > 0 && in.count >= max {
+        return 0, DecoderElementSizeError
+    }
+    b, err := in.r.ReadByte()
+    if err == nil {
+        in.count++
+    }
+    return b, err
+}
+
+func (in *limitedInput) Read(p []byte) (int, error) {
+    if len(p) == 0 {
+        return 0, nil
+    }
+    b, err := in.ReadByte()
+    if err != nil {
+        return 0, err
+    }
+    p[0] = b
+    return 1, nil
+}
+
+// Counts the bytes read from the transport in windows of a second.
+type rateLimitedInput struct {
+    r       io.Reader
+    decoder *Decoder
+    window  time.Time
+    count   int64
+}
+
+func (in *rateLimitedInput) Read(p []byte) (int, error) {
+    n, err := in.r.Read(p)
+    if in.exceeded(n) {
+        return 0, DecoderRateError
+    }
+    return n, err
+}
+
+func (in *rateLimitedInput) ReadByte() (byte, error) {
+    b, err := in.r.(io.ByteReader).ReadByte()
+    if err == nil && in.exceeded(1) {
+        return 0, DecoderRateError
+    }
+    return b, err
+}
+
+// Counts n bytes read and tells whether the rate is exceeded.
+func (in *rateLimitedInput) exceeded(n int) bool {
+    max := in.decoder.limits.MaxBytesPerSecond
+    if max <= 0 {
+        return false
+    }
+    if now := time.Now(); now.Sub(in.window) >= time.Second {
+        in.window = now
+        in.count = 0
+    }
+    in.count += int64(n)
+    return in.count > max
+}
+
 func (d *Decoder) GetNextElement() (protocol.Protocol, error) {
+    d.input.count = 0
     // Move to First StartElement
     for {
         token, err := d.xmlDecoder.Token()
@@ -72,8 +404,16 @@ func (d *Decoder) GetNextElement() (protocol.Protocol, error) {
         }
         switch t := token.(type) {
         case xml.StartElement:
+            // RFC7395 Section 3.6
+            if d.framed && t.Name == protocol.TAG_FRAMING_CLOSE {
+                if err := d.xmlDecoder.Skip(); err != nil {
+                    return nil, err
+                }
+                return &protocol.XMPPStreamEnd{}, nil
+            }
             return d.ParseElement(t)
         case xml.ProcInst:
+            // The XML declaration
             continue
         case xml.EndElement:
             if t.Name == protocol.TAG_STREAM {
@@ -85,8 +425,28 @@ func (d *Decoder) GetNextElement() (protocol.Protocol, error) {
             if len(bytes.TrimSpace(t)) != 0 {
                 return nil, DecoderBadFormatError
             }
-        case xml.Comment:
-            return nil, DecoderRestrictedXMLError
         }
     }
 }
+
+func parseStreamHeader(startToken xml.StartElement) *protocol.XMPPStream {
+    streamElem := &protocol.XMPPStream{}
+    for _, attr := range startToken.Attr {
+        switch attr.Name {
+        case xml.Name{Space: "", Local: "from"}:
+            streamElem.From = attr.Value
+        case xml.Name{Space: "", Local: "to"}:
+            streamElem.To = attr.Value
+        case xml.Name{Space: "", Local: "id"}:
+            streamElem.Id = attr.Value
+        case xml.Name{Space: "", Local: "version"}:
+            streamElem.Version = attr.Value
+        case xml.Name{Space: "http://www.w3.org/XML/1998/namespace", Local: "lang"}:
+            streamElem.XMLLang = attr.Value
+        case xml.Name{Space: "", Local: "xmlns"}:
+            streamElem.Xmlns = attr.Value
+        }
+    }
+    streamElem.XMLName = startToken.Name
+    return streamElem
+}
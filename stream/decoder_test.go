@@ -3,6 +3,7 @@ package stream
 import (
     "bytes"
     "github.com/zonyitoo/goxmpp/protocol"
+    "strings"
     "testing"
 )
 
@@ -298,3 +299,169 @@ func BenchmarkDecoder(b *testing.B) {
         }
     }
 }
+
+// RFC7395 Section 3.4 and 3.6
+func TestDecoderFramed(t *testing.T) {
+    buf := &framedBuffer{}
+    buf.WriteString(`<open xmlns='urn:ietf:params:xml:ns:xmpp-framing' to='example.com' version='1.0'/>` +
+        `<message xmlns='jabber:client' to='romeo@example.com'><body>Hi</body></message>` +
+        `<close xmlns='urn:ietf:params:xml:ns:xmpp-framing'/>`)
+    decoder := NewDecoder(buf)
+
+    elem, err := decoder.GetNextElement()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if header, ok := elem.(*protocol.XMPPStream); !ok || header.To != "example.com" || header.Xmlns != protocol.XMLNS_JABBER_CLIENT {
+        t.Fatalf("Expected the open element, got %+v", elem)
+    }
+    elem, err = decoder.GetNextElement()
+    if msg, ok := elem.(*protocol.XMPPStanzaMessage); err != nil || !ok || msg.To != "romeo@example.com" {
+        t.Fatalf("Expected the message, got %+v, %v", elem, err)
+    }
+    elem, err = decoder.GetNextElement()
+    if _, ok := elem.(*protocol.XMPPStreamEnd); err != nil || !ok {
+        t.Fatalf("Expected the stream end, got %+v, %v", elem, err)
+    }
+}
+
+const xmpp_stream_header_sample = `<stream:stream to='example.com' version='1.0' xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams'>`
+
+// Decodes the stream header and then, within limits, the elements which
+// follow it.
+func test_DecoderWithLimits(t *testing.T, limits DecoderLimits, elems string) *Decoder {
+    decoder := NewDecoder(bytes.NewBufferString(xmpp_stream_header_sample + elems))
+    if _, err := decoder.GetNextElement(); err != nil {
+        t.Fatal(err)
+    }
+    decoder.SetLimits(limits)
+    return decoder
+}
+
+func test_DecodeWithLimits(t *testing.T, limits DecoderLimits, elem string) (protocol.Protocol, error) {
+    return test_DecoderWithLimits(t, limits, elem).GetNextElement()
+}
+
+func TestDecoderElementSize(t *testing.T) {
+    limits := DecoderLimits{MaxElementBytes: 64}
+    if _, err := test_DecodeWithLimits(t, limits, `<message><body>Hi</body></message>`); err != nil {
+        t.Fatal(err)
+    }
+    body := strings.Repeat("a", 64)
+    if _, err := test_DecodeWithLimits(t, limits, `<message><body>`+body+`</body></message>`); err != DecoderElementSizeError {
+        t.Fatalf("Expected the element size error, got %v", err)
+    }
+
+    // The budget is per element
+    decoder := test_DecoderWithLimits(t, limits, strings.Repeat(`<message><body>Hi</body></message>`, 4))
+    for i := 0; i < 4; i++ {
+        if _, err := decoder.GetNextElement(); err != nil {
+            t.Fatal(err)
+        }
+    }
+}
+
+func TestDecoderDepth(t *testing.T) {
+    limits := DecoderLimits{MaxDepth: 3}
+    if _, err := test_DecodeWithLimits(t, limits, `<message><a><b><c/></b></a></message>`); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := test_DecodeWithLimits(t, limits, `<message><a><b><c><d/></c></b></a></message>`); err != DecoderDepthError {
+        t.Fatalf("Expected the depth error, got %v", err)
+    }
+}
+
+func TestDecoderAttributes(t *testing.T) {
+    limits := DecoderLimits{MaxAttributes: 2, MaxAttributeLength: 8}
+    if _, err := test_DecodeWithLimits(t, limits, `<message to='a@b' id='1'/>`); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := test_DecodeWithLimits(t, limits, `<message><body a='1' b='2' c='3'/></message>`); err != DecoderAttributeCountError {
+        t.Fatalf("Expected the attribute count error, got %v", err)
+    }
+    if _, err := test_DecodeWithLimits(t, limits, `<message id='123456789'/>`); err != DecoderAttributeLengthError {
+        t.Fatalf("Expected the attribute length error, got %v", err)
+    }
+}
+
+func TestDecoderRate(t *testing.T) {
+    limits := DecoderLimits{MaxBytesPerSecond: 64}
+    decoder := NewDecoderWithLimits(bytes.NewBufferString(xmpp_stream_header_sample), limits)
+    if _, err := decoder.GetNextElement(); err != DecoderRateError {
+        t.Fatalf("Expected the rate error, got %v", err)
+    }
+
+    limits.MaxBytesPerSecond = 1024
+    decoder = NewDecoderWithLimits(bytes.NewBufferString(xmpp_stream_header_sample), limits)
+    if _, err := decoder.GetNextElement(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+// RFC6120 Section 4.9.3.14 and 4.9.3.17
+func TestDecoderLimitStreamError(t *testing.T) {
+    if DecoderDepthError.StreamError().PolicyViolation == nil {
+        t.Fatal("Expected a policy-violation stream error")
+    }
+    if DecoderRateError.StreamError().ResourceConstraint == nil {
+        t.Fatal("Expected a resource-constraint stream error")
+    }
+    if streamErrorFor(DecoderBadFormatError).InvalidXML == nil {
+        t.Fatal("Expected an invalid-xml stream error")
+    }
+}
+
+// RFC6120 Section 11
+func TestDecoderRestrictedXML(t *testing.T) {
+    headers := map[string]error{
+        `<?xml version='1.0' encoding='UTF-8'?>` + xmpp_stream_header_sample:      nil,
+        `<?xml version='1.0' encoding='ISO-8859-1'?>` + xmpp_stream_header_sample: DecoderUnsupportedEncodingError,
+        `<!DOCTYPE stream [<!ENTITY a 'b'>]>` + xmpp_stream_header_sample:         DecoderRestrictedXMLError,
+        `<!-- comment -->` + xmpp_stream_header_sample:                            DecoderRestrictedXMLError,
+        `<?php ?>` + xmpp_stream_header_sample:                                    DecoderRestrictedXMLError,
+        `<stream:stream to='example.com' version='1.0' xmlns='jabber:client'>`:     DecoderBadNamespacePrefixError,
+        `<stream:stream xmlns:stream='http://etherx.jabber.org/streams' a:b='c'>`:  DecoderBadNamespacePrefixError,
+    }
+    for input, expected := range headers {
+        decoder := NewDecoder(bytes.NewBufferString(input))
+        if _, err := decoder.GetNextElement(); err != expected {
+            t.Errorf("Expected %v for %s, got %v", expected, input, err)
+        }
+    }
+
+    elems := map[string]error{
+        `<message><body>Hi</body></message>`:           nil,
+        `<message xmlns:x='urn:x'><x:body/></message>`: nil,
+        `<message><x:body/></message>`:                 DecoderBadNamespacePrefixError,
+        `<?xml version='1.0'?><message/>`:              DecoderRestrictedXMLError,
+        `<message><?php ?></message>`:                  DecoderRestrictedXMLError,
+        `<message><!-- comment --></message>`:          DecoderRestrictedXMLError,
+        `<message><!DOCTYPE message></message>`:        DecoderRestrictedXMLError,
+    }
+    for input, expected := range elems {
+        if _, err := test_DecodeWithLimits(t, DefaultDecoderLimits, input); err != expected {
+            t.Errorf("Expected %v for %s, got %v", expected, input, err)
+        }
+    }
+
+    // Prefixes are declared for the element and its children only
+    decoder := test_DecoderWithLimits(t, DefaultDecoderLimits, `<message xmlns:x='urn:x'/><message><x:body/></message>`)
+    if _, err := decoder.GetNextElement(); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := decoder.GetNextElement(); err != DecoderBadNamespacePrefixError {
+        t.Fatalf("Expected the bad namespace prefix error, got %v", err)
+    }
+}
+
+func TestDecoderRestrictedXMLStreamError(t *testing.T) {
+    if streamErrorFor(DecoderRestrictedXMLError).RestrictedXML == nil {
+        t.Fatal("Expected a restricted-xml stream error")
+    }
+    if streamErrorFor(DecoderUnsupportedEncodingError).UnsupportedEncoding == nil {
+        t.Fatal("Expected an unsupported-encoding stream error")
+    }
+    if streamErrorFor(DecoderBadNamespacePrefixError).BadNamespacePrefix == nil {
+        t.Fatal("Expected a bad-namespace-prefix stream error")
+    }
+}
@@ -0,0 +1,208 @@
+package stream
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "crypto/tls"
+    "encoding/hex"
+    "errors"
+    "github.com/zonyitoo/goxmpp/basic"
+    "github.com/zonyitoo/goxmpp/protocol"
+    "net"
+    "time"
+)
+
+var (
+    DialbackVerifyFailedError = errors.New("Authoritative server did not verify the key")
+)
+
+// How long the authoritative server is given to answer a <db:verify/>.
+const DialbackVerifyTimeout = 30 * time.Second
+
+// XEP-0220 Section 2.4
+//
+// The dialback key is the hex encoded HMAC-SHA256 of the receiving server,
+// the originating server and the stream ID, keyed with the hex encoded
+// SHA-256 hash of a secret known only to the originating server.
+func DialbackKey(secret, receiving, originating, id string) string {
+    hash := sha256.Sum256([]byte(secret))
+    mac := hmac.New(sha256.New, []byte(hex.EncodeToString(hash[:])))
+    mac.Write([]byte(receiving + " " + originating + " " + id))
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// XEP-0220
+//
+// Offered on the streams of other servers. A <db:result/> carrying a key is
+// checked with the authoritative server of the originating domain over a new
+// connection opened with dial and encrypted with config; once it is valid,
+// stanzas from that domain are accepted on the stream. A <db:verify/> is
+// answered as the authoritative server of the stream's domain, using the
+// secret the keys of its outgoing streams are generated from.
+type DialbackFeature struct {
+    secret string
+    dial   func(domain string) (net.Conn, error)
+    config *tls.Config
+}
+
+func NewDialbackFeature(secret string, dial func(domain string) (net.Conn, error), config *tls.Config) *DialbackFeature {
+    return &DialbackFeature{
+        secret: secret,
+        dial:   dial,
+        config: config,
+    }
+}
+
+func (f *DialbackFeature) Offered(s Streamer) bool {
+    _, ok := s.(*ServerServerStream)
+    return ok
+}
+
+func (f *DialbackFeature) Mandatory(s Streamer) bool {
+    return false
+}
+
+func (f *DialbackFeature) RequiresRestart() bool {
+    return false
+}
+
+func (f *DialbackFeature) Advertise(features *protocol.XMPPStreamFeatures, s Streamer) {
+    features.Dialback = &protocol.XMPPStreamFeatureDialback{}
+}
+
+// Only requests are handled, results are sent back by the receiving server.
+func (f *DialbackFeature) Handles(elem protocol.Protocol, s Streamer) bool {
+    switch t := elem.(type) {
+    case *protocol.XMPPDialbackResult:
+        return t.Type == ""
+    case *protocol.XMPPDialbackVerify:
+        return t.Type == ""
+    }
+    return false
+}
+
+func (f *DialbackFeature) Negotiate(elem protocol.Protocol, s Streamer) (bool, error) {
+    sss := s.(*ServerServerStream)
+    switch t := elem.(type) {
+    case *protocol.XMPPDialbackResult:
+        return f.result(t, sss)
+    case *protocol.XMPPDialbackVerify:
+        return f.answer(t, sss)
+    }
+    return false, nil
+}
+
+// XEP-0220 Section 2.4
+//
+// As the receiving server: checks the key of the originating server. The
+// authoritative server is asked in the background, so that the stream goes on
+// reading while it answers; the result is sent once it has.
+func (f *DialbackFeature) result(result *protocol.XMPPDialbackResult, s *ServerServerStream) (bool, error) {
+    reply := &protocol.XMPPDialbackResult{
+        From: result.To,
+        To:   result.From,
+    }
+    if result.To != s.Domain() {
+        reply.Type = protocol.XMPP_DIALBACK_TYPE_ERROR
+        reply.Error = &protocol.XMPPStanzaError{
+            Type: protocol.XMPP_STANZA_ERROR_TYPE_CANCEL,
+            XMPPStanzaErrorGroup: protocol.XMPPStanzaErrorGroup{
+                ItemNotFound: &protocol.XMPPStanzaErrorItemNotFound{},
+            },
+        }
+        return false, s.Writer().SendElement(reply)
+    }
+    if jid, err := xmpp.NewJIDFromString(result.From); err != nil || jid.Domain != result.From {
+        reply.Type = protocol.XMPP_DIALBACK_TYPE_ERROR
+        reply.Error = &protocol.XMPPStanzaError{
+            Type: protocol.XMPP_STANZA_ERROR_TYPE_MODIFY,
+            XMPPStanzaErrorGroup: protocol.XMPPStanzaErrorGroup{
+                BadRequest: &protocol.XMPPStanzaErrorBadRequest{},
+            },
+        }
+        return false, s.Writer().SendElement(reply)
+    }
+
+    // The key was generated for the stream ID at the time of the request
+    go f.verifyResult(result, reply, s.Id(), s)
+    return false, nil
+}
+
+func (f *DialbackFeature) verifyResult(result, reply *protocol.XMPPDialbackResult, id string, s *ServerServerStream) {
+    valid, err := f.Verify(result.To, result.From, id, result.Key)
+    switch {
+    case err != nil:
+        reply.Type = protocol.XMPP_DIALBACK_TYPE_ERROR
+        reply.Error = &protocol.XMPPStanzaError{
+            Type: protocol.XMPP_STANZA_ERROR_TYPE_CANCEL,
+            XMPPStanzaErrorGroup: protocol.XMPPStanzaErrorGroup{
+                RemoteServerNotFound: &protocol.XMPPStanzaErrorRemoteServerNotFound{},
+            },
+        }
+    case valid:
+        reply.Type = protocol.XMPP_DIALBACK_TYPE_VALID
+        s.setVerified(result.From)
+    default:
+        reply.Type = protocol.XMPP_DIALBACK_TYPE_INVALID
+    }
+    if s.Writer().SendElement(reply) != nil {
+        s.Close(true)
+    }
+}
+
+// XEP-0220 Section 2.3
+//
+// As the authoritative server: tells the receiving server whether the key was
+// generated for the stream ID by this server.
+func (f *DialbackFeature) answer(verify *protocol.XMPPDialbackVerify, s *ServerServerStream) (bool, error) {
+    reply := &protocol.XMPPDialbackVerify{
+        From: verify.To,
+        To:   verify.From,
+        Id:   verify.Id,
+        Type: protocol.XMPP_DIALBACK_TYPE_INVALID,
+    }
+    key := DialbackKey(f.secret, verify.From, verify.To, verify.Id)
+    if verify.To == s.Domain() && hmac.Equal([]byte(key), []byte(verify.Key)) {
+        reply.Type = protocol.XMPP_DIALBACK_TYPE_VALID
+    }
+    return true, s.Writer().SendElement(reply)
+}
+
+// XEP-0220 Section 2.3
+//
+// Asks the authoritative server of originating over a new, encrypted
+// connection whether key was generated for the stream with the given ID to receiving.
+func (f *DialbackFeature) Verify(receiving, originating, id, key string) (bool, error) {
+    conn, err := f.dial(originating)
+    if err != nil {
+        return false, err
+    }
+    conn.SetDeadline(time.Now().Add(DialbackVerifyTimeout))
+    // Dialback does not rely on the certificate of the authoritative server
+    oss := NewOutgoingServerStream(conn, receiving, originating, f.config, f.secret)
+    defer oss.Close()
+
+    if _, err := oss.open(); err != nil {
+        return false, err
+    }
+    oss.writer.SendElement(&protocol.XMPPDialbackVerify{
+        From: receiving,
+        To:   originating,
+        Id:   id,
+        Key:  key,
+    })
+    for {
+        elem, err := oss.reader.NextElement()
+        if err != nil {
+            return false, err
+        }
+        switch t := elem.(type) {
+        case *protocol.XMPPDialbackVerify:
+            if t.Id == id && t.From == originating {
+                return t.Type == protocol.XMPP_DIALBACK_TYPE_VALID, nil
+            }
+        case *protocol.XMPPStreamError, *protocol.XMPPStreamEnd:
+            return false, DialbackVerifyFailedError
+        }
+    }
+}
@@ -0,0 +1,80 @@
+package stream
+
+import (
+    "errors"
+    "github.com/stretchr/testify/assert"
+    "github.com/zonyitoo/goxmpp/protocol"
+    "net"
+    "testing"
+)
+
+func Test_DialbackKey(t *testing.T) {
+    key := DialbackKey("s3cr3tf0rd14lb4ck", "example.net", "example.com", "D60000229F")
+    assert.Len(t, key, 64)
+    assert.Equal(t, key, DialbackKey("s3cr3tf0rd14lb4ck", "example.net", "example.com", "D60000229F"))
+
+    // Every input is part of the key
+    assert.NotEqual(t, key, DialbackKey("other", "example.net", "example.com", "D60000229F"))
+    assert.NotEqual(t, key, DialbackKey("s3cr3tf0rd14lb4ck", "example.org", "example.com", "D60000229F"))
+    assert.NotEqual(t, key, DialbackKey("s3cr3tf0rd14lb4ck", "example.net", "example.org", "D60000229F"))
+    assert.NotEqual(t, key, DialbackKey("s3cr3tf0rd14lb4ck", "example.net", "example.com", "D60000229E"))
+}
+
+// The authoritative server answers <db:verify/> for keys it generated
+func Test_DialbackVerify(t *testing.T) {
+    cconn, sconn := testConnPair(t)
+    features := []FeatureNegotiator{NewDialbackFeature("s3cr3tf0rd14lb4ck", nil, nil)}
+    go NewServerServerStream(sconn, "example.com", features, nil, &nopStanzaHandler{}).Run()
+
+    reader, writer := NewReader(cconn), NewWriter(cconn)
+    if _, _, err := openServerStream(reader, writer, "example.net", "example.com"); err != nil {
+        t.Fatal(err)
+    }
+    key := DialbackKey("s3cr3tf0rd14lb4ck", "example.net", "example.com", "D60000229F")
+    for id, expected := range map[string]string{
+        "D60000229F": protocol.XMPP_DIALBACK_TYPE_VALID,
+        "D60000229E": protocol.XMPP_DIALBACK_TYPE_INVALID,
+    } {
+        writer.SendElement(&protocol.XMPPDialbackVerify{From: "example.net", To: "example.com", Id: id, Key: key})
+        elem, err := reader.NextElement()
+        assert.NoError(t, err)
+        if verify, ok := elem.(*protocol.XMPPDialbackVerify); assert.True(t, ok) {
+            assert.Equal(t, id, verify.Id)
+            assert.Equal(t, "example.com", verify.From)
+            assert.Equal(t, expected, verify.Type)
+        }
+    }
+}
+
+// The receiving server keeps reading while the authoritative server is asked
+// about a key, and sends the result once it has answered
+func Test_DialbackResultAsync(t *testing.T) {
+    cconn, sconn := testConnPair(t)
+    release := make(chan struct{})
+    dial := func(domain string) (net.Conn, error) {
+        <-release
+        return nil, errors.New("unreachable")
+    }
+    features := []FeatureNegotiator{NewDialbackFeature("s3cr3tf0rd14lb4ck", dial, nil)}
+    go NewServerServerStream(sconn, "example.com", features, nil, &nopStanzaHandler{}).Run()
+
+    reader, writer := NewReader(cconn), NewWriter(cconn)
+    if _, _, err := openServerStream(reader, writer, "example.net", "example.com"); err != nil {
+        t.Fatal(err)
+    }
+    writer.SendElement(&protocol.XMPPDialbackResult{From: "example.net", To: "example.com", Key: "k3y"})
+    writer.SendElement(&protocol.XMPPDialbackVerify{From: "example.net", To: "example.com", Id: "D60000229F", Key: "k3y"})
+    elem, err := reader.NextElement()
+    assert.NoError(t, err)
+    if verify, ok := elem.(*protocol.XMPPDialbackVerify); assert.True(t, ok) {
+        assert.Equal(t, protocol.XMPP_DIALBACK_TYPE_INVALID, verify.Type)
+    }
+
+    close(release)
+    elem, err = reader.NextElement()
+    assert.NoError(t, err)
+    if result, ok := elem.(*protocol.XMPPDialbackResult); assert.True(t, ok) {
+        assert.Equal(t, protocol.XMPP_DIALBACK_TYPE_ERROR, result.Type)
+        assert.NotNil(t, result.Error.RemoteServerNotFound)
+    }
+}
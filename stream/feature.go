@@ -0,0 +1,263 @@
+package stream
+
+import (
+    "crypto/tls"
+    "errors"
+    "github.com/zonyitoo/goxmpp/auth"
+    "github.com/zonyitoo/goxmpp/basic"
+    "github.com/zonyitoo/goxmpp/protocol"
+    "sync"
+)
+
+var (
+    FeatureTLSAbortedError = errors.New("TLS negotiation aborted")
+    FeatureSASLFailedError = errors.New("SASL negotiation failed")
+)
+
+// FeatureNegotiator is a stream feature offered by the receiving entity in
+// <stream:features/>. The stream advertises every offered feature after each
+// (re)start, in the order they were added, and passes each element the
+// initiating entity sends to the first offered feature that handles it.
+type FeatureNegotiator interface {
+    // Whether the feature should be advertised on the stream in its current state.
+    Offered(Streamer) bool
+    // Whether the feature must be negotiated before stanzas can be exchanged.
+    // Features after a mandatory feature requiring a restart are not advertised.
+    Mandatory(Streamer) bool
+    // Whether the stream must be restarted once the negotiation completes.
+    RequiresRestart() bool
+    // Adds the feature to <stream:features/>.
+    Advertise(*protocol.XMPPStreamFeatures, Streamer)
+    // Whether the element belongs to the negotiation of this feature.
+    Handles(protocol.Protocol, Streamer) bool
+    // Negotiates the feature, starting with the element that the initiating
+    // entity sent. Returns true once the negotiation is completed. A non-nil
+    // error terminates the stream; the negotiator is responsible for sending
+    // any failure element before returning it.
+    Negotiate(protocol.Protocol, Streamer) (bool, error)
+}
+
+// Returns the <stream:features/> offered on the stream in its current state
+// and the features they advertise.
+func advertiseFeatures(s Streamer, all []FeatureNegotiator) (*protocol.XMPPStreamFeatures, []FeatureNegotiator) {
+    features := &protocol.XMPPStreamFeatures{}
+    var advertised []FeatureNegotiator
+    for _, f := range all {
+        if !f.Offered(s) {
+            continue
+        }
+        f.Advertise(features, s)
+        advertised = append(advertised, f)
+
+        // Nothing else can be negotiated before the stream restarts
+        if f.Mandatory(s) && f.RequiresRestart() {
+            break
+        }
+    }
+    return features, advertised
+}
+
+// Returns the advertised feature handling the element, or nil.
+func negotiatorFor(s Streamer, advertised []FeatureNegotiator, elem protocol.Protocol) FeatureNegotiator {
+    for _, f := range advertised {
+        if f.Offered(s) && f.Handles(elem, s) {
+            return f
+        }
+    }
+    return nil
+}
+
+// Whether an advertised mandatory-to-negotiate feature has not been
+// negotiated yet.
+func isNegotiating(s Streamer, advertised []FeatureNegotiator) bool {
+    for _, f := range advertised {
+        if f.Offered(s) && f.Mandatory(s) {
+            return true
+        }
+    }
+    return false
+}
+
+// RFC6120 Section 5
+type TLSFeature struct {
+    config   *tls.Config
+    required bool
+}
+
+func NewTLSFeature(config *tls.Config, required bool) *TLSFeature {
+    return &TLSFeature{
+        config:   config,
+        required: required,
+    }
+}
+
+func (f *TLSFeature) Offered(s Streamer) bool {
+    return !s.IsEncrypted() && !s.IsAuthenticated()
+}
+
+func (f *TLSFeature) Mandatory(s Streamer) bool {
+    return f.required && !s.IsEncrypted()
+}
+
+func (f *TLSFeature) RequiresRestart() bool {
+    return true
+}
+
+func (f *TLSFeature) Advertise(features *protocol.XMPPStreamFeatures, s Streamer) {
+    features.StartTLS = &protocol.XMPPStartTLS{}
+    if f.required {
+        features.StartTLS.Required = &protocol.XMPPRequired{}
+    }
+}
+
+func (f *TLSFeature) Handles(elem protocol.Protocol, s Streamer) bool {
+    switch elem.(type) {
+    case *protocol.XMPPStartTLS, *protocol.XMPPTLSAbort:
+        return true
+    }
+    return false
+}
+
+func (f *TLSFeature) Negotiate(elem protocol.Protocol, s Streamer) (bool, error) {
+    if _, ok := elem.(*protocol.XMPPTLSAbort); ok {
+        return false, FeatureTLSAbortedError
+    }
+
+    s.Writer().SendElement(&protocol.XMPPTLSProceed{})
+
+    // Wraps the underlying connection with TLS and performs the server side
+    // handshake. The connection is only replaced if the handshake succeeds.
+    tlsConn := tls.Server(s.Conn(), f.config)
+    if err := tlsConn.Handshake(); err != nil {
+        s.Writer().SendElement(&protocol.XMPPTLSFailure{})
+        return false, err
+    }
+    s.SetConn(tlsConn)
+    return true, nil
+}
+
+// The number of failed authentication attempts SASLFeature allows after the
+// first one before closing the stream.
+const DefaultSASLRetries = 3
+
+// RFC6120 Section 6
+type SASLFeature struct {
+    retries  int
+    lock     sync.Mutex
+    failures map[Streamer]int
+}
+
+func NewSASLFeature() *SASLFeature {
+    return &SASLFeature{
+        retries:  DefaultSASLRetries,
+        failures: make(map[Streamer]int),
+    }
+}
+
+// RFC6120 Section 6.4.5
+//
+// Sets how many times the initiating entity may retry after a failure, e.g.
+// to correct a mistyped password. Once exceeded the stream is closed with a
+// <policy-violation/> stream error.
+func (f *SASLFeature) SetRetries(retries int) {
+    f.retries = retries
+}
+
+// Other servers may authenticate with dialback instead, so SASL is only
+// offered to them if a mechanism is available, and never mandatory.
+func (f *SASLFeature) Offered(s Streamer) bool {
+    if _, ok := s.(*ServerServerStream); ok {
+        return !s.IsAuthenticated() && s.SASLAuthenticator() != nil &&
+            len(s.SASLAuthenticator().Offered(authContext(s))) > 0
+    }
+    return !s.IsAuthenticated()
+}
+
+func (f *SASLFeature) Mandatory(s Streamer) bool {
+    if _, ok := s.(*ServerServerStream); ok {
+        return false
+    }
+    return !s.IsAuthenticated()
+}
+
+func (f *SASLFeature) RequiresRestart() bool {
+    return true
+}
+
+func (f *SASLFeature) Advertise(features *protocol.XMPPStreamFeatures, s Streamer) {
+    features.SASLMechanisms = &protocol.XMPPSASLMechanisms{
+        Mechanisms: s.SASLAuthenticator().Offered(authContext(s)),
+    }
+}
+
+func (f *SASLFeature) Handles(elem protocol.Protocol, s Streamer) bool {
+    switch elem.(type) {
+    case *protocol.XMPPSASLAuth, *protocol.XMPPSASLResponse, *protocol.XMPPSASLAbort:
+        return true
+    }
+    return false
+}
+
+// A failed attempt leaves the stream open so that the initiating entity can
+// try again, until the number of retries is exceeded.
+func (f *SASLFeature) Negotiate(elem protocol.Protocol, s Streamer) (bool, error) {
+    switch t := elem.(type) {
+    case *protocol.XMPPSASLAuth:
+        exchange := s.SASLAuthenticator().Start(t.Mechanism, authContext(s))
+        if exchange == nil {
+            s.Writer().SendElement(&protocol.XMPPSASLFailure{
+                InvalidMechanism: &protocol.XMPPSASLErrorInvalidMechanism{},
+            })
+            return false, f.failed(s)
+        }
+        identity, ok := serverExchange(exchange, t, s)
+        if !ok {
+            return false, f.failed(s)
+        }
+        f.forget(s)
+        domain := s.Domain()
+        if identity.Domain != "" {
+            domain = identity.Domain
+        }
+        s.SetJID(xmpp.NewJID(identity.Username, domain, ""))
+        s.SetAnonymous(identity.Anonymous)
+        s.SetAuthenticated(true)
+        return true, nil
+    case *protocol.XMPPSASLAbort:
+        // There is no exchange in progress, but the abort is acknowledged
+        s.Writer().SendElement(&protocol.XMPPSASLFailure{
+            Aborted: &protocol.XMPPSASLErrorAborted{},
+        })
+        return false, nil
+    default:
+        // A <response/> outside of an exchange
+        s.Writer().SendElement(saslFailure(auth.SASLMalformedRequestError))
+        return false, f.failed(s)
+    }
+}
+
+// Records a failed attempt and terminates the stream once the retries are
+// exhausted.
+func (f *SASLFeature) failed(s Streamer) error {
+    f.lock.Lock()
+    f.failures[s]++
+    count := f.failures[s]
+    f.lock.Unlock()
+    if count == 1 {
+        s.AddCloseHandler(f.forget)
+    }
+
+    if count > f.retries {
+        s.Writer().SendElement(&protocol.XMPPStreamError{
+            PolicyViolation: &protocol.XMPPStreamErrorPolicyViolation{},
+        })
+        return FeatureSASLFailedError
+    }
+    return nil
+}
+
+func (f *SASLFeature) forget(s Streamer) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    delete(f.failures, s)
+}
@@ -0,0 +1,33 @@
+package stream
+
+import (
+    "bytes"
+    "github.com/zonyitoo/goxmpp/protocol"
+)
+
+// RFC7395 Section 3.3
+//
+// FramedTransport is implemented by transports which carry every top level
+// element in a message of its own instead of inside a stream root, such as
+// WebSocket connections. Readers and Writers of a framed transport exchange
+// <open/> and <close/> in place of the stream header and its end.
+type FramedTransport interface {
+    IsFramed() bool
+}
+
+func isFramed(transport interface{}) bool {
+    t, ok := transport.(FramedTransport)
+    return ok && t.IsFramed()
+}
+
+// Every framed element must be parsable on its own, so stanzas declare the
+// content namespace which they otherwise inherit from the stream root.
+func qualifyStanza(data []byte) []byte {
+    end := bytes.IndexAny(data, " />")
+    if end < 0 || bytes.HasPrefix(data[end:], []byte(` xmlns="`)) {
+        return data
+    }
+    qualified := append([]byte{}, data[:end]...)
+    qualified = append(qualified, ` xmlns="`+protocol.XMLNS_JABBER_CLIENT+`"`...)
+    return append(qualified, data[end:]...)
+}
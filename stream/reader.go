@@ -10,11 +10,24 @@ type Reader struct {
 }
 
 func NewReader(r io.Reader) *Reader {
+    return NewReaderWithLimits(r, DefaultDecoderLimits)
+}
+
+func NewReaderWithLimits(r io.Reader, limits DecoderLimits) *Reader {
     return &Reader{
-        decoder: NewDecoder(r),
+        decoder: NewDecoderWithLimits(r, limits),
     }
 }
 
+func (sr *Reader) Limits() DecoderLimits {
+    return sr.decoder.Limits()
+}
+
+// Changes the limits of the elements read after.
+func (sr *Reader) SetLimits(limits DecoderLimits) {
+    sr.decoder.SetLimits(limits)
+}
+
 func (sr *Reader) NextElement() (protocol.Protocol, error) {
     return sr.decoder.GetNextElement()
 }
@@ -0,0 +1,255 @@
+package stream
+
+import (
+    "github.com/zonyitoo/goxmpp/protocol"
+    "github.com/zonyitoo/goxmpp/storage"
+)
+
+const registerInstructions = "Choose a username and password to register with this server."
+
+// XEP-0077 Section 3.1
+//
+// In-band registration of a new account before the stream is authenticated.
+// The feature must be added before SASL, so that it is advertised together
+// with the SASL mechanisms. The password is sent in the clear, so, like PLAIN,
+// registration is neither offered nor accepted on streams that are not
+// encrypted.
+type RegisterFeature struct {
+    store storage.AccountStore
+}
+
+func NewRegisterFeature(store storage.AccountStore) *RegisterFeature {
+    return &RegisterFeature{store: store}
+}
+
+func (f *RegisterFeature) Offered(s Streamer) bool {
+    return !s.IsAuthenticated() && s.IsEncrypted()
+}
+
+func (f *RegisterFeature) Mandatory(s Streamer) bool {
+    return false
+}
+
+func (f *RegisterFeature) RequiresRestart() bool {
+    return false
+}
+
+func (f *RegisterFeature) Advertise(features *protocol.XMPPStreamFeatures, s Streamer) {
+    features.Register = &protocol.XMPPStreamFeatureRegister{}
+}
+
+func (f *RegisterFeature) Handles(elem protocol.Protocol, s Streamer) bool {
+    iq, ok := elem.(*protocol.XMPPStanzaIQ)
+    return ok && iq.Register != nil
+}
+
+// The stream stays unauthenticated after registering; the entity then logs
+// in with the new account as usual.
+func (f *RegisterFeature) Negotiate(elem protocol.Protocol, s Streamer) (bool, error) {
+    iq := elem.(*protocol.XMPPStanzaIQ)
+    switch iq.Type {
+    case protocol.XMPP_STANZA_IQ_TYPE_GET:
+        return false, sendRegisterResult(s, iq, registerForm())
+    case protocol.XMPP_STANZA_IQ_TYPE_SET:
+    default:
+        return false, sendRegisterError(s, iq, protocol.XMPP_STANZA_ERROR_TYPE_CANCEL,
+            protocol.XMPPStanzaErrorGroup{BadRequest: &protocol.XMPPStanzaErrorBadRequest{}})
+    }
+
+    // XEP-0077 Section 3.2: only an authenticated entity can cancel its
+    // registration
+    if iq.Register.Remove != nil {
+        return false, sendRegisterError(s, iq, protocol.XMPP_STANZA_ERROR_TYPE_AUTH,
+            protocol.XMPPStanzaErrorGroup{NotAuthorized: &protocol.XMPPStanzaErrorNotAuthorized{}})
+    }
+
+    username, password := registerCredentials(iq.Register)
+    if username == "" || password == "" {
+        return false, sendRegisterError(s, iq, protocol.XMPP_STANZA_ERROR_TYPE_MODIFY,
+            protocol.XMPPStanzaErrorGroup{NotAcceptable: &protocol.XMPPStanzaErrorNotAcceptable{}})
+    }
+    if err := f.store.CreateUser(username, password); err != nil {
+        return false, sendStoreError(s, iq, err)
+    }
+    return false, sendRegisterResult(s, iq, nil)
+}
+
+// RegisterHandler answers the XEP-0077 requests of authenticated entities:
+// querying the registration, changing the password (Section 3.3) and
+// cancelling the registration (Section 3.2). Only the sessions of accounts of
+// the domain have a registration; other senders, such as other servers and
+// components, are refused. Other stanzas are passed on.
+type RegisterHandler struct {
+    store    storage.AccountStore
+    sessions *SessionRegistry
+    next     StanzaHandler
+}
+
+func NewRegisterHandler(store storage.AccountStore, sessions *SessionRegistry, next StanzaHandler) *RegisterHandler {
+    return &RegisterHandler{
+        store:    store,
+        sessions: sessions,
+        next:     next,
+    }
+}
+
+func (h *RegisterHandler) HandleIQ(iq *protocol.XMPPStanzaIQ, s Streamer) error {
+    if iq.Register == nil {
+        return h.next.HandleIQ(iq, s)
+    }
+
+    if _, ok := s.(*ServerClientStream); !ok || s.JID() == nil || s.JID().Domain != s.Domain() {
+        return sendRegisterError(s, iq, protocol.XMPP_STANZA_ERROR_TYPE_AUTH,
+            protocol.XMPPStanzaErrorGroup{Forbidden: &protocol.XMPPStanzaErrorForbidden{}})
+    }
+    username := s.JID().Local
+    if username == "" {
+        return sendRegisterError(s, iq, protocol.XMPP_STANZA_ERROR_TYPE_CANCEL,
+            protocol.XMPPStanzaErrorGroup{NotAllowed: &protocol.XMPPStanzaErrorNotAllowed{}})
+    }
+    switch iq.Type {
+    case protocol.XMPP_STANZA_IQ_TYPE_GET:
+        return sendRegisterResult(s, iq, &protocol.XMPPStanzaIQRegisterQuery{
+            Registered: &protocol.XMPPStanzaIQRegisterRegistered{},
+            Username:   username,
+        })
+    case protocol.XMPP_STANZA_IQ_TYPE_SET:
+    default:
+        return nil
+    }
+
+    if iq.Register.Remove != nil {
+        if err := h.store.DeleteUser(username); err != nil {
+            return sendStoreError(s, iq, err)
+        }
+        if err := sendRegisterResult(s, iq, nil); err != nil {
+            return err
+        }
+        // The account no longer exists, so none of its sessions may remain
+        for _, session := range h.sessions.Resources(&s.JID().BareJID) {
+            session.Writer().SendElement(&protocol.XMPPStreamError{
+                NotAuthorized: &protocol.XMPPStreamErrorNotAuthorized{},
+            })
+            session.Close(true)
+        }
+        return nil
+    }
+
+    name, password := registerCredentials(iq.Register)
+    if name != username {
+        return sendRegisterError(s, iq, protocol.XMPP_STANZA_ERROR_TYPE_MODIFY,
+            protocol.XMPPStanzaErrorGroup{BadRequest: &protocol.XMPPStanzaErrorBadRequest{}})
+    }
+    if password == "" {
+        return sendRegisterError(s, iq, protocol.XMPP_STANZA_ERROR_TYPE_MODIFY,
+            protocol.XMPPStanzaErrorGroup{NotAcceptable: &protocol.XMPPStanzaErrorNotAcceptable{}})
+    }
+    if !s.IsEncrypted() {
+        return sendRegisterError(s, iq, protocol.XMPP_STANZA_ERROR_TYPE_CANCEL,
+            protocol.XMPPStanzaErrorGroup{NotAllowed: &protocol.XMPPStanzaErrorNotAllowed{}})
+    }
+    if err := h.store.ChangePassword(username, password); err != nil {
+        return sendStoreError(s, iq, err)
+    }
+    return sendRegisterResult(s, iq, nil)
+}
+
+func (h *RegisterHandler) HandleMessage(msg *protocol.XMPPStanzaMessage, s Streamer) error {
+    return h.next.HandleMessage(msg, s)
+}
+
+func (h *RegisterHandler) HandlePresence(presence *protocol.XMPPStanzaPresence, s Streamer) error {
+    return h.next.HandlePresence(presence, s)
+}
+
+// XEP-0077 Section 4
+//
+// The registration form is sent as a data form, as empty legacy fields cannot
+// be represented by the query. Submissions are accepted in either format.
+func registerForm() *protocol.XMPPStanzaIQRegisterQuery {
+    return &protocol.XMPPStanzaIQRegisterQuery{
+        Instructions: registerInstructions,
+        XData: &protocol.XMPPXData{
+            Type:  protocol.XMPP_X_DATA_TYPE_FORM,
+            Title: "Account Registration",
+            Fields: []protocol.XMPPXDataField{
+                {
+                    Var:    "FORM_TYPE",
+                    Type:   protocol.XMPP_X_DATA_FIELD_TYPE_HIDDEN,
+                    Values: []string{protocol.XMLNS_JABBER_IQ_REGISTER},
+                },
+                {
+                    Var:      "username",
+                    Label:    "Username",
+                    Type:     protocol.XMPP_X_DATA_FIELD_TYPE_TEXT_SINGLE,
+                    Required: &protocol.XMPPRequired{},
+                },
+                {
+                    Var:      "password",
+                    Label:    "Password",
+                    Type:     protocol.XMPP_X_DATA_FIELD_TYPE_TEXT_PRIVATE,
+                    Required: &protocol.XMPPRequired{},
+                },
+            },
+        },
+    }
+}
+
+// Takes the username and password from the legacy fields, or from a submitted
+// data form.
+func registerCredentials(query *protocol.XMPPStanzaIQRegisterQuery) (string, string) {
+    username, password := query.Username, query.Password
+    if query.XData != nil && query.XData.Type == protocol.XMPP_X_DATA_TYPE_SUBMIT {
+        for _, field := range query.XData.Fields {
+            if len(field.Values) == 0 {
+                continue
+            }
+            switch field.Var {
+            case "username":
+                username = field.Values[0]
+            case "password":
+                password = field.Values[0]
+            }
+        }
+    }
+    return username, password
+}
+
+func sendRegisterResult(s Streamer, iq *protocol.XMPPStanzaIQ, query *protocol.XMPPStanzaIQRegisterQuery) error {
+    return s.Writer().SendElement(&protocol.XMPPStanzaIQ{
+        Id:       iq.Id,
+        Type:     protocol.XMPP_STANZA_IQ_TYPE_RESULT,
+        Register: query,
+    })
+}
+
+func sendRegisterError(s Streamer, iq *protocol.XMPPStanzaIQ, errType string,
+    condition protocol.XMPPStanzaErrorGroup) error {
+    return s.Writer().SendElement(&protocol.XMPPStanzaIQ{
+        Id:       iq.Id,
+        Type:     protocol.XMPP_STANZA_IQ_TYPE_ERROR,
+        Register: iq.Register,
+        Error: &protocol.XMPPStanzaError{
+            Type:                 errType,
+            XMPPStanzaErrorGroup: condition,
+        },
+    })
+}
+
+// XEP-0077 Section 3.1 and 3.3: maps the errors of the account store to
+// stanza errors.
+func sendStoreError(s Streamer, iq *protocol.XMPPStanzaIQ, err error) error {
+    switch err {
+    case storage.AccountExistsError:
+        return sendRegisterError(s, iq, protocol.XMPP_STANZA_ERROR_TYPE_CANCEL,
+            protocol.XMPPStanzaErrorGroup{Conflict: &protocol.XMPPStanzaErrorConflict{}})
+    case storage.InvalidUsernameError, storage.InvalidPasswordError:
+        return sendRegisterError(s, iq, protocol.XMPP_STANZA_ERROR_TYPE_MODIFY,
+            protocol.XMPPStanzaErrorGroup{NotAcceptable: &protocol.XMPPStanzaErrorNotAcceptable{}})
+    case storage.AccountNotFoundError:
+        return sendRegisterError(s, iq, protocol.XMPP_STANZA_ERROR_TYPE_AUTH,
+            protocol.XMPPStanzaErrorGroup{RegistrationRequired: &protocol.XMPPStanzaErrorRegistrationRequired{}})
+    }
+    return sendRegisterError(s, iq, protocol.XMPP_STANZA_ERROR_TYPE_WAIT,
+        protocol.XMPPStanzaErrorGroup{InternalServerError: &protocol.XMPPStanzaErrorInternalServerError{}})
+}
@@ -0,0 +1,197 @@
+package stream
+
+import (
+    "crypto/tls"
+    "github.com/stretchr/testify/assert"
+    "github.com/zonyitoo/goxmpp/auth"
+    "github.com/zonyitoo/goxmpp/basic"
+    "github.com/zonyitoo/goxmpp/protocol"
+    "github.com/zonyitoo/goxmpp/storage"
+    "net"
+    "testing"
+)
+
+// A connection encrypted outside of the stream, standing in for TLS.
+type testSecureConn struct {
+    net.Conn
+}
+
+func (c *testSecureConn) TransportTLS() *tls.ConnectionState {
+    return &tls.ConnectionState{}
+}
+
+func testRegisterServer(t *testing.T, store storage.AccountStore) (*Reader, *Writer) {
+    cconn, sconn := testConnPair(t)
+    features := []FeatureNegotiator{
+        NewRegisterFeature(store),
+        NewSASLFeature(),
+        NewBindFeature(NewSessionRegistry(), BindConflictReplace),
+    }
+    server := NewServerClientStream(&testSecureConn{sconn}, "example.com", features, storage.NewAuthenticator(store), &nopStanzaHandler{})
+    go server.Run()
+    return testRawClient(t, cconn)
+}
+
+func testRegisterIQ(t *testing.T, reader *Reader, writer *Writer, iq *protocol.XMPPStanzaIQ) *protocol.XMPPStanzaIQ {
+    writer.SendElement(iq)
+    elem, err := reader.NextElement()
+    if err != nil {
+        t.Fatal(err)
+    }
+    result, ok := elem.(*protocol.XMPPStanzaIQ)
+    if !ok {
+        t.Fatalf("Expected an IQ, got %+v", elem)
+    }
+    assert.Equal(t, iq.Id, result.Id)
+    return result
+}
+
+func Test_Register(t *testing.T) {
+    store := storage.NewMemoryStore()
+    reader, writer := testRegisterServer(t, store)
+
+    result := testRegisterIQ(t, reader, writer, &protocol.XMPPStanzaIQ{
+        Id:       "reg1",
+        Type:     protocol.XMPP_STANZA_IQ_TYPE_GET,
+        Register: &protocol.XMPPStanzaIQRegisterQuery{},
+    })
+    assert.Equal(t, protocol.XMPP_STANZA_IQ_TYPE_RESULT, result.Type)
+    if assert.NotNil(t, result.Register) && assert.NotNil(t, result.Register.XData) {
+        assert.NotEmpty(t, result.Register.Instructions)
+        assert.Len(t, result.Register.XData.Fields, 3)
+    }
+
+    result = testRegisterIQ(t, reader, writer, &protocol.XMPPStanzaIQ{
+        Id:       "reg2",
+        Type:     protocol.XMPP_STANZA_IQ_TYPE_SET,
+        Register: &protocol.XMPPStanzaIQRegisterQuery{Username: "juliet", Password: "r0m30"},
+    })
+    assert.Equal(t, protocol.XMPP_STANZA_IQ_TYPE_RESULT, result.Type)
+    ok, _ := store.VerifyPassword("juliet", "r0m30")
+    assert.True(t, ok)
+
+    // The same username cannot be registered twice
+    result = testRegisterIQ(t, reader, writer, &protocol.XMPPStanzaIQ{
+        Id:   "reg3",
+        Type: protocol.XMPP_STANZA_IQ_TYPE_SET,
+        Register: &protocol.XMPPStanzaIQRegisterQuery{
+            XData: &protocol.XMPPXData{
+                Type: protocol.XMPP_X_DATA_TYPE_SUBMIT,
+                Fields: []protocol.XMPPXDataField{
+                    {Var: "username", Values: []string{"juliet"}},
+                    {Var: "password", Values: []string{"other"}},
+                },
+            },
+        },
+    })
+    assert.Equal(t, protocol.XMPP_STANZA_IQ_TYPE_ERROR, result.Type)
+    if assert.NotNil(t, result.Error) {
+        assert.NotNil(t, result.Error.Conflict)
+    }
+
+    result = testRegisterIQ(t, reader, writer, &protocol.XMPPStanzaIQ{
+        Id:       "reg4",
+        Type:     protocol.XMPP_STANZA_IQ_TYPE_SET,
+        Register: &protocol.XMPPStanzaIQRegisterQuery{Username: "romeo"},
+    })
+    assert.Equal(t, protocol.XMPP_STANZA_IQ_TYPE_ERROR, result.Type)
+    if assert.NotNil(t, result.Error) {
+        assert.NotNil(t, result.Error.NotAcceptable)
+    }
+
+    // Cancelling requires authentication
+    result = testRegisterIQ(t, reader, writer, &protocol.XMPPStanzaIQ{
+        Id:       "reg5",
+        Type:     protocol.XMPP_STANZA_IQ_TYPE_SET,
+        Register: &protocol.XMPPStanzaIQRegisterQuery{Remove: &protocol.XMPPStanzaIQRegisterRemove{}},
+    })
+    assert.Equal(t, protocol.XMPP_STANZA_IQ_TYPE_ERROR, result.Type)
+    if assert.NotNil(t, result.Error) {
+        assert.NotNil(t, result.Error.NotAuthorized)
+    }
+}
+
+// Registration is advertised with the SASL mechanisms and the new account can
+// log in
+func Test_RegisterLogin(t *testing.T) {
+    store := storage.NewMemoryStore()
+    reader, writer := testRegisterServer(t, store)
+    testRegisterIQ(t, reader, writer, &protocol.XMPPStanzaIQ{
+        Id:       "reg1",
+        Type:     protocol.XMPP_STANZA_IQ_TYPE_SET,
+        Register: &protocol.XMPPStanzaIQRegisterQuery{Username: "juliet", Password: "r0m30"},
+    })
+
+    cconn, sconn := testConnPair(t)
+    features := []FeatureNegotiator{
+        NewRegisterFeature(store),
+        NewSASLFeature(),
+        NewBindFeature(NewSessionRegistry(), BindConflictReplace),
+    }
+    server := NewServerClientStream(&testSecureConn{sconn}, "example.com", features, storage.NewAuthenticator(store), &nopStanzaHandler{})
+    go server.Run()
+
+    jid := xmpp.NewJID("juliet", "example.com", "balcony")
+    mechanisms := []auth.ClientMechanism{auth.NewSCRAMClient(auth.SCRAMSHA256, "", "juliet", "r0m30")}
+    client := NewClientStream(cconn, jid, nil, mechanisms, nil)
+    assert.NoError(t, client.Start())
+    assert.Equal(t, "juliet@example.com/balcony", client.JID().String())
+    client.Close(true)
+}
+
+// The password would be sent in the clear
+func Test_RegisterPlaintext(t *testing.T) {
+    store := storage.NewMemoryStore()
+    cconn, sconn := testConnPair(t)
+    features := []FeatureNegotiator{NewRegisterFeature(store), NewSASLFeature()}
+    server := NewServerClientStream(sconn, "example.com", features, storage.NewAuthenticator(store), &nopStanzaHandler{})
+    go server.Run()
+
+    writer := NewWriter(cconn)
+    writer.Open(&protocol.XMPPStream{To: "example.com", Version: "1.0", Xmlns: protocol.XMLNS_JABBER_CLIENT})
+    reader := NewReader(cconn)
+    reader.NextElement()
+    elem, err := reader.NextElement()
+    assert.NoError(t, err)
+    if features, ok := elem.(*protocol.XMPPStreamFeatures); assert.True(t, ok) {
+        assert.Nil(t, features.Register)
+    }
+
+    writer.SendElement(&protocol.XMPPStanzaIQ{
+        Id:       "reg1",
+        Type:     protocol.XMPP_STANZA_IQ_TYPE_SET,
+        Register: &protocol.XMPPStanzaIQRegisterQuery{Username: "juliet", Password: "r0m30"},
+    })
+    elem, err = reader.NextElement()
+    assert.NoError(t, err)
+    assert.IsType(t, &protocol.XMPPStreamError{}, elem)
+    users, _ := store.Users()
+    assert.Empty(t, users)
+}
+
+// Only the sessions of local accounts have a registration
+func Test_RegisterHandlerForbidden(t *testing.T) {
+    store := storage.NewMemoryStore()
+    store.CreateUser("juliet", "r0m30")
+    handler := NewRegisterHandler(store, NewSessionRegistry(), &nopStanzaHandler{})
+    cconn, sconn := testConnPair(t)
+    sss := NewServerServerStream(sconn, "example.com", nil, nil, &nopStanzaHandler{})
+    sss.Writer().Open(&protocol.XMPPStream{From: "example.com", Version: "1.0", Xmlns: protocol.XMLNS_JABBER_SERVER})
+    reader := NewReader(cconn)
+    reader.NextElement()
+
+    // A server authenticated with SASL EXTERNAL, and one with dialback
+    for _, jid := range []*xmpp.JID{xmpp.NewJID("", "example.net", ""), nil} {
+        sss.SetJID(jid)
+        assert.NoError(t, handler.HandleIQ(&protocol.XMPPStanzaIQ{
+            Id:       "reg1",
+            Type:     protocol.XMPP_STANZA_IQ_TYPE_GET,
+            Register: &protocol.XMPPStanzaIQRegisterQuery{},
+        }, sss))
+        elem, err := reader.NextElement()
+        assert.NoError(t, err)
+        if iq, ok := elem.(*protocol.XMPPStanzaIQ); assert.True(t, ok) && assert.NotNil(t, iq.Error) {
+            assert.NotNil(t, iq.Error.Forbidden)
+        }
+    }
+}
@@ -0,0 +1,202 @@
+package stream
+
+import (
+    "context"
+    "crypto/tls"
+    "errors"
+    "github.com/zonyitoo/goxmpp/protocol"
+    "math/rand"
+    "net"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+var (
+    ResolveServiceUnavailableError = errors.New("Domain does not offer the service")
+    ResolveNoTargetError           = errors.New("Could not connect to any host of the domain")
+)
+
+// The ports the services are reached at when the domain has no SRV records
+// (RFC6120 Section 3.2.2).
+const (
+    DefaultClientPort = 5222
+    DefaultServerPort = 5269
+)
+
+// How long connecting to a single host may take.
+const DialTimeout = 10 * time.Second
+
+// Resolver looks up the DNS records the hosts of a domain are found with.
+// net.DefaultResolver is one; tests may use a fixed table instead.
+type Resolver interface {
+    LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+    LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// A host a service of a domain is reached at.
+type ServiceTarget struct {
+    Host string
+    Port uint16
+    // XEP-0368: TLS is negotiated before the stream is opened
+    DirectTLS bool
+}
+
+// RFC6120 Section 3.2.1 and XEP-0368 Section 3
+//
+// Looks up the hosts of the service of domain, either
+// protocol.XMPP_DNS_SRV_CLIENT or protocol.XMPP_DNS_SRV_SERVER, in the order
+// they should be tried. The SRV records of the client service are combined
+// with those of protocol.XMPP_DNS_SRV_CLIENT_TLS. If the domain has no SRV
+// records the domain itself is the host, on the default port of the service,
+// unless one of the services is declared unavailable.
+func LookupService(r Resolver, domain, service string) ([]ServiceTarget, error) {
+    records, unavailable := lookupSRV(r, service, domain)
+    direct := map[*net.SRV]bool{}
+    if service == protocol.XMPP_DNS_SRV_CLIENT {
+        tlsRecords, tlsUnavailable := lookupSRV(r, protocol.XMPP_DNS_SRV_CLIENT_TLS, domain)
+        for _, record := range tlsRecords {
+            direct[record] = true
+        }
+        records = append(records, tlsRecords...)
+        unavailable = unavailable || tlsUnavailable
+    }
+
+    if len(records) == 0 && unavailable {
+        return nil, ResolveServiceUnavailableError
+    }
+    // RFC6120 Section 3.2.2
+    if len(records) == 0 {
+        port := uint16(DefaultClientPort)
+        if service == protocol.XMPP_DNS_SRV_SERVER {
+            port = DefaultServerPort
+        }
+        return []ServiceTarget{{Host: domain, Port: port}}, nil
+    }
+
+    var targets []ServiceTarget
+    for _, record := range orderSRV(records, rand.Intn) {
+        targets = append(targets, ServiceTarget{
+            Host:      strings.TrimSuffix(record.Target, "."),
+            Port:      record.Port,
+            DirectTLS: direct[record],
+        })
+    }
+    return targets, nil
+}
+
+// A failed lookup is the same as no records. A single record with the target
+// "." means that the domain decidedly does not offer the service (RFC2782),
+// which is reported as unavailable.
+func lookupSRV(r Resolver, service, domain string) ([]*net.SRV, bool) {
+    _, records, err := r.LookupSRV(context.Background(), service, "tcp", domain)
+    if err != nil {
+        return nil, false
+    }
+    if len(records) == 1 && records[0].Target == "." {
+        return nil, true
+    }
+    return records, false
+}
+
+// RFC2782
+//
+// Sorts the records by priority, lowest first, and orders those of the same
+// priority by a weighted random selection. intn returns a number in [0, n).
+func orderSRV(records []*net.SRV, intn func(n int) int) []*net.SRV {
+    sorted := append([]*net.SRV{}, records...)
+    sort.SliceStable(sorted, func(i, j int) bool {
+        return sorted[i].Priority < sorted[j].Priority
+    })
+
+    ordered := make([]*net.SRV, 0, len(sorted))
+    for start := 0; start < len(sorted); {
+        end := start
+        for end < len(sorted) && sorted[end].Priority == sorted[start].Priority {
+            end++
+        }
+
+        // Records of weight 0 come first so that they have a small chance
+        // of being selected
+        group := append([]*net.SRV{}, sorted[start:end]...)
+        sort.SliceStable(group, func(i, j int) bool {
+            return group[i].Weight == 0 && group[j].Weight != 0
+        })
+        for len(group) > 0 {
+            total := 0
+            for _, record := range group {
+                total += int(record.Weight)
+            }
+            pick := intn(total + 1)
+            selected := len(group) - 1
+            sum := 0
+            for i, record := range group {
+                sum += int(record.Weight)
+                if sum >= pick {
+                    selected = i
+                    break
+                }
+            }
+            ordered = append(ordered, group[selected])
+            group = append(group[:selected], group[selected+1:]...)
+        }
+        start = end
+    }
+    return ordered
+}
+
+// RFC6120 Section 3.2.1
+//
+// Connects to the first host of the service of domain that accepts the
+// connection, see LookupService. Connections to direct TLS hosts are returned
+// once the handshake completed with config, which is completed with the
+// domain as ServerName and the ALPN protocol of the service.
+func DialService(r Resolver, domain, service string, config *tls.Config) (net.Conn, error) {
+    targets, err := LookupService(r, domain, service)
+    if err != nil {
+        return nil, err
+    }
+    for _, target := range targets {
+        if conn, err := dialTarget(r, domain, service, target, config); err == nil {
+            return conn, nil
+        }
+    }
+    return nil, ResolveNoTargetError
+}
+
+func dialTarget(r Resolver, domain, service string, target ServiceTarget, config *tls.Config) (net.Conn, error) {
+    addrs, err := r.LookupHost(context.Background(), target.Host)
+    if err != nil {
+        return nil, err
+    }
+    port := strconv.Itoa(int(target.Port))
+    for _, addr := range addrs {
+        conn, err := net.DialTimeout("tcp", net.JoinHostPort(addr, port), DialTimeout)
+        if err != nil {
+            continue
+        }
+        if !target.DirectTLS {
+            return conn, nil
+        }
+
+        c := &tls.Config{}
+        if config != nil {
+            c = config.Clone()
+        }
+        if c.ServerName == "" {
+            c.ServerName = domain
+        }
+        // XEP-0368 Section 4
+        c.NextProtos = []string{service}
+        tlsConn := tls.Client(conn, c)
+        conn.SetDeadline(time.Now().Add(DialTimeout))
+        if err := tlsConn.Handshake(); err != nil {
+            conn.Close()
+            continue
+        }
+        conn.SetDeadline(time.Time{})
+        return tlsConn, nil
+    }
+    return nil, ResolveNoTargetError
+}
@@ -0,0 +1,213 @@
+package stream
+
+import (
+    "context"
+    "crypto/tls"
+    "github.com/stretchr/testify/assert"
+    "github.com/zonyitoo/goxmpp/basic"
+    "github.com/zonyitoo/goxmpp/protocol"
+    "net"
+    "strconv"
+    "testing"
+)
+
+// A DNS table of SRV records by _service._proto.name and of host addresses.
+type testResolver struct {
+    srv   map[string][]*net.SRV
+    hosts map[string][]string
+}
+
+func (r *testResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+    cname := "_" + service + "._" + proto + "." + name
+    records, ok := r.srv[cname]
+    if !ok {
+        return "", nil, &net.DNSError{Err: "no such host", Name: cname, IsNotFound: true}
+    }
+    return cname, records, nil
+}
+
+func (r *testResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+    addrs, ok := r.hosts[host]
+    if !ok {
+        return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+    }
+    return addrs, nil
+}
+
+func testPort(t *testing.T, addr string) uint16 {
+    _, port, err := net.SplitHostPort(addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    n, err := strconv.Atoi(port)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return uint16(n)
+}
+
+func Test_LookupServicePriority(t *testing.T) {
+    r := &testResolver{srv: map[string][]*net.SRV{
+        "_xmpp-client._tcp.example.com": {
+            {Target: "backup.example.com.", Port: 5222, Priority: 20},
+            {Target: "xmpp.example.com.", Port: 5222, Priority: 10},
+        },
+        "_xmpps-client._tcp.example.com": {
+            {Target: "tls.example.com.", Port: 5223, Priority: 15},
+        },
+    }}
+    targets, err := LookupService(r, "example.com", protocol.XMPP_DNS_SRV_CLIENT)
+    assert.NoError(t, err)
+    assert.Equal(t, []ServiceTarget{
+        {Host: "xmpp.example.com", Port: 5222},
+        {Host: "tls.example.com", Port: 5223, DirectTLS: true},
+        {Host: "backup.example.com", Port: 5222},
+    }, targets)
+
+    // Direct TLS records are only looked up for clients
+    targets, err = LookupService(r, "example.com", protocol.XMPP_DNS_SRV_SERVER)
+    assert.NoError(t, err)
+    assert.Equal(t, []ServiceTarget{{Host: "example.com", Port: DefaultServerPort}}, targets)
+}
+
+// RFC6120 Section 3.2.2
+func Test_LookupServiceFallback(t *testing.T) {
+    r := &testResolver{}
+    targets, err := LookupService(r, "example.com", protocol.XMPP_DNS_SRV_CLIENT)
+    assert.NoError(t, err)
+    assert.Equal(t, []ServiceTarget{{Host: "example.com", Port: DefaultClientPort}}, targets)
+}
+
+func Test_LookupServiceUnavailable(t *testing.T) {
+    r := &testResolver{srv: map[string][]*net.SRV{
+        "_xmpp-server._tcp.example.com": {{Target: ".", Port: 0}},
+    }}
+    _, err := LookupService(r, "example.com", protocol.XMPP_DNS_SRV_SERVER)
+    assert.Equal(t, ResolveServiceUnavailableError, err)
+
+    // Missing records do not make up for a "." record of the other service
+    r.srv["_xmpps-client._tcp.example.com"] = []*net.SRV{{Target: ".", Port: 0}}
+    _, err = LookupService(r, "example.com", protocol.XMPP_DNS_SRV_CLIENT)
+    assert.Equal(t, ResolveServiceUnavailableError, err)
+}
+
+// XEP-0368 Section 3: a "." record only rules out its own service
+func Test_LookupServiceMixed(t *testing.T) {
+    r := &testResolver{srv: map[string][]*net.SRV{
+        "_xmpp-client._tcp.example.com":  {{Target: "xmpp.example.com.", Port: 5222}},
+        "_xmpps-client._tcp.example.com": {{Target: ".", Port: 0}},
+    }}
+    targets, err := LookupService(r, "example.com", protocol.XMPP_DNS_SRV_CLIENT)
+    assert.NoError(t, err)
+    assert.Equal(t, []ServiceTarget{{Host: "xmpp.example.com", Port: 5222}}, targets)
+
+    r.srv = map[string][]*net.SRV{
+        "_xmpp-client._tcp.example.com":  {{Target: ".", Port: 0}},
+        "_xmpps-client._tcp.example.com": {{Target: "tls.example.com.", Port: 5223}},
+    }
+    targets, err = LookupService(r, "example.com", protocol.XMPP_DNS_SRV_CLIENT)
+    assert.NoError(t, err)
+    assert.Equal(t, []ServiceTarget{{Host: "tls.example.com", Port: 5223, DirectTLS: true}}, targets)
+}
+
+// RFC2782
+func Test_OrderSRVWeight(t *testing.T) {
+    records := []*net.SRV{
+        {Target: "a", Priority: 10, Weight: 60},
+        {Target: "b", Priority: 10, Weight: 0},
+        {Target: "c", Priority: 10, Weight: 40},
+        {Target: "d", Priority: 5, Weight: 0},
+    }
+    targets := func(picks ...int) []string {
+        var names []string
+        for _, record := range orderSRV(records, func(n int) int {
+            pick := picks[0]
+            picks = picks[1:]
+            return pick
+        }) {
+            names = append(names, record.Target)
+        }
+        return names
+    }
+
+    // The running sums of the weights are b: 0, a: 60 and c: 100
+    assert.Equal(t, []string{"d", "b", "a", "c"}, targets(0, 0, 0, 0))
+    assert.Equal(t, []string{"d", "a", "c", "b"}, targets(0, 1, 1, 0))
+    assert.Equal(t, []string{"d", "c", "a", "b"}, targets(0, 61, 1, 0))
+}
+
+// Hosts that refuse the connection are skipped
+func Test_DialService(t *testing.T) {
+    closed, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    closed.Close()
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer listener.Close()
+
+    r := &testResolver{
+        srv: map[string][]*net.SRV{
+            "_xmpp-server._tcp.example.com": {
+                {Target: "down.example.com.", Port: testPort(t, closed.Addr().String()), Priority: 10},
+                {Target: "unknown.example.com.", Port: 5269, Priority: 20},
+                {Target: "up.example.com.", Port: testPort(t, listener.Addr().String()), Priority: 30},
+            },
+        },
+        hosts: map[string][]string{
+            "down.example.com": {"127.0.0.1"},
+            "up.example.com":   {"127.0.0.1"},
+        },
+    }
+    conn, err := DialService(r, "example.com", protocol.XMPP_DNS_SRV_SERVER, nil)
+    if assert.NoError(t, err) {
+        assert.Equal(t, listener.Addr().String(), conn.RemoteAddr().String())
+        conn.Close()
+    }
+
+    delete(r.hosts, "up.example.com")
+    _, err = DialService(r, "example.com", protocol.XMPP_DNS_SRV_SERVER, nil)
+    assert.Equal(t, ResolveNoTargetError, err)
+}
+
+// XEP-0368
+func Test_DialDomainDirectTLS(t *testing.T) {
+    serverConfig, clientConfig := testTLSConfigs(t)
+    serverConfig.NextProtos = []string{protocol.XMPP_DNS_SRV_CLIENT}
+    listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer listener.Close()
+
+    protocols := make(chan string, 1)
+    go func() {
+        conn, err := listener.Accept()
+        if err != nil {
+            return
+        }
+        tlsConn := conn.(*tls.Conn)
+        tlsConn.Handshake()
+        protocols <- tlsConn.ConnectionState().NegotiatedProtocol
+        testServerStream(tlsConn, nil, NewSessionRegistry()).Run()
+    }()
+
+    r := &testResolver{
+        srv: map[string][]*net.SRV{
+            "_xmpps-client._tcp.example.com": {
+                {Target: "xmpp.example.com.", Port: testPort(t, listener.Addr().String())},
+            },
+        },
+        hosts: map[string][]string{"xmpp.example.com": {"127.0.0.1"}},
+    }
+    client, err := DialDomain(r, xmpp.NewJID("juliet", "example.com", "balcony"), "r0m30", clientConfig, nil)
+    if assert.NoError(t, err) {
+        assert.True(t, client.IsEncrypted())
+        assert.Equal(t, "juliet@example.com/balcony", client.JID().String())
+        client.Close(true)
+    }
+    assert.Equal(t, protocol.XMPP_DNS_SRV_CLIENT, <-protocols)
+}
@@ -0,0 +1,671 @@
+package stream
+
+import (
+    "code.google.com/p/go-uuid/uuid"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/xml"
+    "errors"
+    "github.com/zonyitoo/goxmpp/auth"
+    "github.com/zonyitoo/goxmpp/basic"
+    "github.com/zonyitoo/goxmpp/protocol"
+    "net"
+    "sync"
+)
+
+var (
+    ServerStreamBadHeaderError     = errors.New("Expected a stream header")
+    ServerStreamBadFeaturesError   = errors.New("Expected stream features")
+    ServerStreamErrorReceivedError = errors.New("Received a stream error")
+    ServerStreamDialbackError      = errors.New("Dialback was refused")
+    ServerStreamUnexpectedError    = errors.New("Unexpected element")
+    ServerStreamTLSRequiredError   = errors.New("TLS is not offered by the peer")
+    ServerStreamTLSFailureError    = errors.New("TLS negotiation failed")
+    ServerStreamNoAuthError        = errors.New("No acceptable way to authenticate")
+)
+
+// RFC6120 Section 4.7.5
+//
+// The server side of a stream from another server. Stanzas are accepted from
+// the domains the peer has proved to be authoritative for, either with SASL
+// EXTERNAL and a certificate of the domain, see auth.DomainExternalServer, or
+// with DialbackFeature; the stream is never used to send stanzas back.
+type ServerServerStream struct {
+    conn            net.Conn
+    tlsConn         *tls.Conn
+    id              string
+    domain          string
+    peer            string
+    jid             *xmpp.JID
+    features        []FeatureNegotiator
+    advertised      []FeatureNegotiator
+    writer          *Writer
+    reader          *Reader
+    authenticator   *auth.Authenticator
+    isAuthenticated bool
+    verified        map[string]bool
+    verifiedLock    sync.Mutex
+    hosts           func(domain string) bool
+    stanzaHandler   StanzaHandler
+    closeHandlers   []func(Streamer)
+    closeLock       sync.Mutex
+    closeOnce       sync.Once
+}
+
+// Creates the stream of a peer sending stanzas to domain, which negotiates
+// the given features in order. The authenticator may be nil if SASLFeature is
+// not one of them.
+func NewServerServerStream(conn net.Conn, domain string, features []FeatureNegotiator,
+    a *auth.Authenticator, shandler StanzaHandler) *ServerServerStream {
+    sss := &ServerServerStream{
+        id:            uuid.New(),
+        domain:        domain,
+        reader:        NewReader(conn),
+        writer:        NewWriter(conn),
+        authenticator: a,
+        verified:      make(map[string]bool),
+        stanzaHandler: shandler,
+    }
+    sss.SetConn(conn)
+
+    for _, f := range features {
+        sss.AddFeature(f)
+    }
+    return sss
+}
+
+func (sss *ServerServerStream) Id() string {
+    return sss.id
+}
+
+func (sss *ServerServerStream) Domain() string {
+    return sss.domain
+}
+
+// The domain the peer claimed in its stream header.
+func (sss *ServerServerStream) Peer() string {
+    return sss.peer
+}
+
+// JID returns the domain the peer authenticated as with SASL, if any.
+func (sss *ServerServerStream) JID() *xmpp.JID {
+    return sss.jid
+}
+
+func (sss *ServerServerStream) SetJID(jid *xmpp.JID) {
+    sss.jid = jid
+}
+
+// Lets peers open the stream to, and send stanzas to, the other domains for
+// which hosts returns true, such as those of components (XEP-0114). The
+// stream then serves the domain it was opened to.
+func (sss *ServerServerStream) SetHosts(hosts func(domain string) bool) {
+    sss.hosts = hosts
+}
+
+// Whether the stream accepts stanzas to domain.
+func (sss *ServerServerStream) serves(domain string) bool {
+    return domain == sss.domain || sss.hosts != nil && sss.hosts(domain)
+}
+
+func (sss *ServerServerStream) Start() error {
+    header, err := sss.Reader().NextElement()
+    if err != nil {
+        sss.Writer().SendElement(streamErrorFor(err))
+        sss.Close(true)
+        return err
+    }
+    t, ok := header.(*protocol.XMPPStream)
+    if !ok {
+        sss.Writer().SendElement(&protocol.XMPPStreamError{
+            BadFormat: &protocol.XMPPStreamErrorBadFormat{},
+        })
+        sss.Close(false)
+        return StreamBadFormatError
+    }
+    if t.Xmlns != protocol.XMLNS_JABBER_SERVER {
+        sss.Writer().SendElement(&protocol.XMPPStreamError{
+            InvalidNamespace: &protocol.XMPPStreamErrorInvalidNamespace{},
+        })
+        sss.Close(true)
+        return StreamInvalidNamespaceError
+    }
+    if t.To != "" && !sss.serves(t.To) {
+        sss.Writer().SendElement(&protocol.XMPPStreamError{
+            HostUnknown: &protocol.XMPPStreamErrorHostUnknown{},
+        })
+        sss.Close(true)
+        return StreamHostUnknownError
+    }
+    if t.To != "" {
+        sss.domain = t.To
+    }
+    sss.peer = t.From
+    sss.Writer().Open(&protocol.XMPPStream{
+        Id:      sss.Id(),
+        From:    sss.domain,
+        To:      t.From,
+        Version: "1.0",
+        Xmlns:   protocol.XMLNS_JABBER_SERVER,
+    })
+    return nil
+}
+
+func (sss *ServerServerStream) RemoteAddr() net.Addr {
+    return sss.conn.RemoteAddr()
+}
+
+func (sss *ServerServerStream) Writer() *Writer {
+    return sss.writer
+}
+
+func (sss *ServerServerStream) Reader() *Reader {
+    return sss.reader
+}
+
+func (sss *ServerServerStream) IsAnonymous() bool {
+    return false
+}
+
+func (sss *ServerServerStream) IsAuthenticated() bool {
+    return sss.isAuthenticated
+}
+
+func (sss *ServerServerStream) IsEncrypted() bool {
+    return sss.tlsConn != nil
+}
+
+func (sss *ServerServerStream) SetAuthenticated(authenticated bool) {
+    sss.isAuthenticated = authenticated
+}
+
+// Servers cannot be anonymous.
+func (sss *ServerServerStream) SetAnonymous(bool) {}
+
+func (sss *ServerServerStream) SASLAuthenticator() *auth.Authenticator {
+    return sss.authenticator
+}
+
+func (sss *ServerServerStream) Conn() net.Conn {
+    return sss.conn
+}
+
+func (sss *ServerServerStream) SetConn(conn net.Conn) {
+    if tlsConn, ok := conn.(*tls.Conn); ok {
+        sss.tlsConn = tlsConn
+    }
+    sss.conn = conn
+}
+
+func (sss *ServerServerStream) AddFeature(f FeatureNegotiator) {
+    sss.features = append(sss.features, f)
+}
+
+// RFC6120 Section 4.7.3: the restarted stream gets a new ID
+func (sss *ServerServerStream) Reset() {
+    sss.id = uuid.New()
+    sss.reader = NewReaderWithLimits(sss.conn, sss.reader.Limits())
+    sss.writer.Destroy()
+    sss.writer = NewWriterWithConfig(sss.conn, sss.writer.Config())
+}
+
+// Whether the peer may send stanzas from domain.
+func (sss *ServerServerStream) IsVerified(domain string) bool {
+    if sss.isAuthenticated && sss.jid != nil && sss.jid.Domain == domain {
+        return true
+    }
+    sss.verifiedLock.Lock()
+    defer sss.verifiedLock.Unlock()
+    return sss.verified[domain]
+}
+
+// Called once dialback verified domain, which may happen while the stream
+// reads other elements.
+func (sss *ServerServerStream) setVerified(domain string) {
+    sss.verifiedLock.Lock()
+    defer sss.verifiedLock.Unlock()
+    sss.verified[domain] = true
+}
+
+func (sss *ServerServerStream) restart() error {
+    if err := sss.Start(); err != nil {
+        return err
+    }
+    features, advertised := advertiseFeatures(sss, sss.features)
+    sss.advertised = advertised
+    return sss.Writer().SendElement(features)
+}
+
+// RFC6120 Section 8.1.1.2 and 8.1.2.2
+//
+// Stanzas must come from a verified domain and be addressed to one the stream
+// serves. Otherwise the stream is closed with an error.
+func (sss *ServerServerStream) checkAddressing(from, to string) bool {
+    var streamError *protocol.XMPPStreamError
+    fromJID, fromErr := xmpp.NewJIDFromString(from)
+    toJID, toErr := xmpp.NewJIDFromString(to)
+    switch {
+    case from == "" || to == "":
+        streamError = &protocol.XMPPStreamError{
+            ImproperAddressing: &protocol.XMPPStreamErrorImproperAddressing{},
+        }
+    case fromErr != nil || !sss.IsVerified(fromJID.Domain):
+        streamError = &protocol.XMPPStreamError{
+            InvalidFrom: &protocol.XMPPStreamErrorInvalidFrom{},
+        }
+    case toErr != nil || !sss.serves(toJID.Domain):
+        streamError = &protocol.XMPPStreamError{
+            HostUnknown: &protocol.XMPPStreamErrorHostUnknown{},
+        }
+    default:
+        return true
+    }
+    sss.Writer().SendElement(streamError)
+    sss.Close(true)
+    return false
+}
+
+func (sss *ServerServerStream) Run() {
+    if sss.restart() != nil {
+        return
+    }
+
+    for {
+        elem, err := sss.Reader().NextElement()
+        if err != nil {
+            sss.Writer().SendElement(streamErrorFor(err))
+            sss.Close(true)
+            return
+        }
+
+        if f := negotiatorFor(sss, sss.advertised, elem); f != nil {
+            completed, err := f.Negotiate(elem, sss)
+            if err != nil {
+                sss.Close(true)
+                return
+            }
+            if completed && f.RequiresRestart() {
+                sss.Reset()
+                if sss.restart() != nil {
+                    return
+                }
+            }
+            continue
+        }
+
+        if _, ok := elem.(*protocol.XMPPStreamEnd); ok {
+            sss.Close(true)
+            return
+        }
+
+        if isNegotiating(sss, sss.advertised) {
+            sss.Writer().SendElement(&protocol.XMPPStreamError{
+                NotAuthorized: &protocol.XMPPStreamErrorNotAuthorized{},
+            })
+            sss.Close(true)
+            return
+        }
+
+        // Stanzas are passed on without the jabber:server namespace, so that
+        // they take the namespace of the stream they are delivered to
+        switch t := elem.(type) {
+        case *protocol.XMPPStanzaIQ:
+            if !sss.checkAddressing(t.From, t.To) {
+                return
+            }
+            if sss.stanzaHandler.HandleIQ(unqualified(t).(*protocol.XMPPStanzaIQ), sss) != nil {
+                sss.Close(true)
+                return
+            }
+        case *protocol.XMPPStanzaMessage:
+            if !sss.checkAddressing(t.From, t.To) {
+                return
+            }
+            if sss.stanzaHandler.HandleMessage(unqualified(t).(*protocol.XMPPStanzaMessage), sss) != nil {
+                sss.Close(true)
+                return
+            }
+        case *protocol.XMPPStanzaPresence:
+            if !sss.checkAddressing(t.From, t.To) {
+                return
+            }
+            if sss.stanzaHandler.HandlePresence(unqualified(t).(*protocol.XMPPStanzaPresence), sss) != nil {
+                sss.Close(true)
+                return
+            }
+        }
+    }
+}
+
+func (sss *ServerServerStream) AddCloseHandler(handler func(Streamer)) {
+    sss.closeLock.Lock()
+    defer sss.closeLock.Unlock()
+    sss.closeHandlers = append(sss.closeHandlers, handler)
+}
+
+func (sss *ServerServerStream) Close(withCloseTag bool) error {
+    var err error
+    sss.closeOnce.Do(func() {
+        if withCloseTag {
+            err = sss.Writer().Close()
+        } else {
+            err = sss.Writer().Destroy()
+        }
+        sss.conn.Close()
+
+        sss.closeLock.Lock()
+        handlers := sss.closeHandlers
+        sss.closeLock.Unlock()
+        for _, handler := range handlers {
+            handler(sss)
+        }
+    })
+    return err
+}
+
+// RFC6120 Section 4.7.5
+//
+// A stream to another server over which the stanzas of domain addressed to
+// the remote domain are sent. Streams between servers are unidirectional, so
+// only authentication results and stream errors are expected from the peer.
+type OutgoingServerStream struct {
+    conn          net.Conn
+    id            string
+    domain        string
+    remote        string
+    config        *tls.Config
+    secret        string
+    writer        *Writer
+    reader        *Reader
+    closeHandlers []func(*OutgoingServerStream)
+    closeLock     sync.Mutex
+    closeOnce     sync.Once
+}
+
+// Creates a stream from domain to remote over conn, which is encrypted with
+// config and authenticated with SASL EXTERNAL using the certificate of
+// config. If secret is not empty, dialback keys generated from it are used
+// instead when the peer does not accept the certificate.
+func NewOutgoingServerStream(conn net.Conn, domain, remote string, config *tls.Config, secret string) *OutgoingServerStream {
+    return &OutgoingServerStream{
+        conn:   conn,
+        domain: domain,
+        remote: remote,
+        config: config,
+        secret: secret,
+        writer: NewWriter(conn),
+        reader: NewReader(conn),
+    }
+}
+
+func (oss *OutgoingServerStream) Id() string {
+    return oss.id
+}
+
+func (oss *OutgoingServerStream) Domain() string {
+    return oss.domain
+}
+
+func (oss *OutgoingServerStream) Remote() string {
+    return oss.remote
+}
+
+// Opens and encrypts the stream, then authenticates the domain with SASL
+// EXTERNAL if the peer offers it, falling back to dialback.
+func (oss *OutgoingServerStream) Start() error {
+    features, err := oss.open()
+    if err == nil {
+        err = oss.authenticate(features)
+    }
+    if err != nil {
+        oss.Close()
+        return err
+    }
+    return nil
+}
+
+// RFC6120 Section 5.4 and 13.7.2
+//
+// Opens the stream and negotiates TLS, which is mandatory between servers.
+// The certificate of the peer must be valid for the remote domain, see
+// auth.VerifyPeerDomain, unless dialback is used: the remote domain is then
+// trusted on the grounds of the DNS lookup that led to the peer, just like
+// without TLS. Returns the features of the encrypted stream.
+func (oss *OutgoingServerStream) open() (*protocol.XMPPStreamFeatures, error) {
+    _, features, err := openServerStream(oss.reader, oss.writer, oss.domain, oss.remote)
+    if err != nil {
+        return nil, err
+    }
+    if features.StartTLS == nil {
+        return nil, ServerStreamTLSRequiredError
+    }
+    oss.writer.SendElement(&protocol.XMPPStartTLS{})
+    elem, err := oss.reader.NextElement()
+    if err != nil {
+        return nil, err
+    }
+    if _, ok := elem.(*protocol.XMPPTLSProceed); !ok {
+        return nil, ServerStreamTLSFailureError
+    }
+
+    config := &tls.Config{}
+    if oss.config != nil {
+        config = oss.config.Clone()
+    }
+    config.ServerName = oss.remote
+    // crypto/tls only knows about dNSNames, the identity of the peer is
+    // checked once the handshake completed
+    verify := !config.InsecureSkipVerify
+    config.InsecureSkipVerify = true
+    tlsConn := tls.Client(oss.conn, config)
+    if err := tlsConn.Handshake(); err != nil {
+        return nil, err
+    }
+    oss.setConn(tlsConn)
+    if verify {
+        certs := tlsConn.ConnectionState().PeerCertificates
+        err := auth.VerifyPeerDomain(certs, config.RootCAs, x509.ExtKeyUsageServerAuth, oss.remote)
+        if err != nil && oss.secret == "" {
+            return nil, err
+        }
+    }
+    return oss.restart()
+}
+
+// Opens the stream again, after TLS or SASL have been negotiated.
+func (oss *OutgoingServerStream) restart() (*protocol.XMPPStreamFeatures, error) {
+    header, features, err := openServerStream(oss.reader, oss.writer, oss.domain, oss.remote)
+    if err != nil {
+        return nil, err
+    }
+    oss.id = header.Id
+    return features, nil
+}
+
+func (oss *OutgoingServerStream) setConn(conn net.Conn) {
+    oss.conn = conn
+    oss.writer.Destroy()
+    oss.writer = NewWriterWithConfig(conn, oss.writer.Config())
+    oss.reader = NewReaderWithLimits(conn, oss.reader.Limits())
+}
+
+func (oss *OutgoingServerStream) authenticate(features *protocol.XMPPStreamFeatures) error {
+    if features.SASLMechanisms != nil {
+        for _, mechanism := range features.SASLMechanisms.Mechanisms {
+            if mechanism != "EXTERNAL" {
+                continue
+            }
+            ok, err := oss.external()
+            if ok || err != nil {
+                return err
+            }
+            break
+        }
+    }
+    if oss.secret != "" && features.Dialback != nil {
+        return oss.dialback()
+    }
+    return ServerStreamNoAuthError
+}
+
+// XEP-0178 Section 3
+//
+// Authenticates as the domain with the certificate presented during the TLS
+// handshake. Returns false if the peer does not accept it.
+func (oss *OutgoingServerStream) external() (bool, error) {
+    oss.writer.SendElement(&protocol.XMPPSASLAuth{
+        Mechanism: "EXTERNAL",
+        Data:      encodeSASLData([]byte(oss.domain)),
+    })
+    for {
+        elem, err := oss.reader.NextElement()
+        if err != nil {
+            return false, err
+        }
+        switch elem.(type) {
+        case *protocol.XMPPSASLChallenge:
+            oss.writer.SendElement(&protocol.XMPPSASLResponse{Data: encodeSASLData([]byte(oss.domain))})
+        case *protocol.XMPPSASLSuccess:
+            oss.setConn(oss.conn)
+            _, err := oss.restart()
+            return err == nil, err
+        case *protocol.XMPPSASLFailure:
+            return false, nil
+        case *protocol.XMPPStreamError:
+            return false, ServerStreamErrorReceivedError
+        default:
+            return false, ServerStreamUnexpectedError
+        }
+    }
+}
+
+// XEP-0220 Section 2.1
+//
+// Sends the dialback key of the domain and waits until the receiving server
+// has verified it with its authoritative server.
+func (oss *OutgoingServerStream) dialback() error {
+    oss.writer.SendElement(&protocol.XMPPDialbackResult{
+        From: oss.domain,
+        To:   oss.remote,
+        Key:  DialbackKey(oss.secret, oss.remote, oss.domain, oss.id),
+    })
+    for {
+        elem, err := oss.reader.NextElement()
+        if err != nil {
+            return err
+        }
+        switch t := elem.(type) {
+        case *protocol.XMPPDialbackResult:
+            if t.From != oss.remote || t.To != oss.domain {
+                continue
+            }
+            if t.Type == protocol.XMPP_DIALBACK_TYPE_VALID {
+                return nil
+            }
+            return ServerStreamDialbackError
+        case *protocol.XMPPStreamError:
+            return ServerStreamErrorReceivedError
+        case *protocol.XMPPStreamEnd:
+            return ServerStreamDialbackError
+        }
+    }
+}
+
+// Reads from the peer until the stream is closed.
+func (oss *OutgoingServerStream) Run() {
+    for {
+        elem, err := oss.reader.NextElement()
+        if err != nil {
+            oss.Close()
+            return
+        }
+        switch elem.(type) {
+        case *protocol.XMPPStreamEnd, *protocol.XMPPStreamError:
+            oss.Close()
+            return
+        }
+    }
+}
+
+// Sends a stanza to the remote domain.
+func (oss *OutgoingServerStream) Send(stanza protocol.Protocol) error {
+    return oss.writer.SendElement(unqualified(stanza))
+}
+
+// Registers a function called once when the stream is closed.
+func (oss *OutgoingServerStream) AddCloseHandler(handler func(*OutgoingServerStream)) {
+    oss.closeLock.Lock()
+    defer oss.closeLock.Unlock()
+    oss.closeHandlers = append(oss.closeHandlers, handler)
+}
+
+func (oss *OutgoingServerStream) Close() error {
+    var err error
+    oss.closeOnce.Do(func() {
+        err = oss.writer.Close()
+        oss.conn.Close()
+
+        oss.closeLock.Lock()
+        handlers := oss.closeHandlers
+        oss.closeLock.Unlock()
+        for _, handler := range handlers {
+            handler(oss)
+        }
+    })
+    return err
+}
+
+// Opens a stream from domain to remote and reads the response header and,
+// for XMPP 1.0 peers, the stream features.
+func openServerStream(reader *Reader, writer *Writer, domain, remote string) (*protocol.XMPPStream,
+    *protocol.XMPPStreamFeatures, error) {
+    writer.Open(&protocol.XMPPStream{
+        From:    domain,
+        To:      remote,
+        Version: "1.0",
+        Xmlns:   protocol.XMLNS_JABBER_SERVER,
+    })
+    elem, err := reader.NextElement()
+    if err != nil {
+        return nil, nil, err
+    }
+    header, ok := elem.(*protocol.XMPPStream)
+    if !ok {
+        return nil, nil, ServerStreamBadHeaderError
+    }
+    if header.Xmlns != protocol.XMLNS_JABBER_SERVER {
+        return nil, nil, StreamInvalidNamespaceError
+    }
+
+    features := &protocol.XMPPStreamFeatures{}
+    if header.Version == "1.0" {
+        elem, err := reader.NextElement()
+        if err != nil {
+            return nil, nil, err
+        }
+        if features, ok = elem.(*protocol.XMPPStreamFeatures); !ok {
+            return nil, nil, ServerStreamBadFeaturesError
+        }
+    }
+    return header, features, nil
+}
+
+// Returns a copy of the stanza without a namespace, which is then inherited
+// from the stream it is written to.
+func unqualified(elem protocol.Protocol) protocol.Protocol {
+    switch t := elem.(type) {
+    case *protocol.XMPPStanzaIQ:
+        stanza := *t
+        stanza.XMLName = xml.Name{}
+        return &stanza
+    case *protocol.XMPPStanzaMessage:
+        stanza := *t
+        stanza.XMLName = xml.Name{}
+        return &stanza
+    case *protocol.XMPPStanzaPresence:
+        stanza := *t
+        stanza.XMLName = xml.Name{}
+        return &stanza
+    }
+    return elem
+}
@@ -0,0 +1,37 @@
+package stream
+
+import (
+    "github.com/stretchr/testify/assert"
+    "github.com/zonyitoo/goxmpp/auth"
+    "github.com/zonyitoo/goxmpp/basic"
+    "testing"
+    "time"
+)
+
+func Test_SASLAnonymous(t *testing.T) {
+    cconn, sconn := testConnPair(t)
+
+    authenticator := auth.NewAuthenticator()
+    authenticator.Register(auth.NewAnonymousServer())
+    sessions := NewSessionRegistry()
+    server := NewServerClientStream(sconn, "example.com",
+        []FeatureNegotiator{NewSASLFeature(), NewBindFeature(sessions, BindConflictReplace)},
+        authenticator, &nopStanzaHandler{})
+    go server.Run()
+
+    jid := xmpp.NewJID("", "example.com", "")
+    mechanisms := []auth.ClientMechanism{auth.NewAnonymousClient("support-chat")}
+    client := NewClientStream(cconn, jid, nil, mechanisms, nil)
+
+    assert.NoError(t, client.Start())
+    assert.True(t, client.IsAnonymous())
+    assert.NotEmpty(t, client.JID().Local)
+    assert.Equal(t, "example.com", client.JID().Domain)
+    assert.True(t, server.IsAnonymous())
+    assert.Equal(t, server, sessions.Get(client.JID()))
+
+    go client.Run()
+    client.Close(true)
+    assert.Eventually(t, func() bool { return sessions.Get(client.JID()) == nil },
+        time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,190 @@
+package stream
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/asn1"
+    "github.com/stretchr/testify/assert"
+    "github.com/zonyitoo/goxmpp/auth"
+    "github.com/zonyitoo/goxmpp/basic"
+    "math/big"
+    "net"
+    "testing"
+    "time"
+)
+
+// Generates a CA and a client certificate issued by it. The template of the
+// client certificate is completed by setup.
+func testClientCertificate(t *testing.T, setup func(*x509.Certificate)) (tls.Certificate, *x509.CertPool) {
+    caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    caTemplate := &x509.Certificate{
+        SerialNumber:          big.NewInt(1),
+        Subject:               pkix.Name{CommonName: "Test CA"},
+        NotBefore:             time.Now().Add(-time.Hour),
+        NotAfter:              time.Now().Add(time.Hour),
+        KeyUsage:              x509.KeyUsageCertSign,
+        BasicConstraintsValid: true,
+        IsCA:                  true,
+    }
+    caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ca, err := x509.ParseCertificate(caDER)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(2),
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(time.Hour),
+        KeyUsage:     x509.KeyUsageDigitalSignature,
+        ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+    }
+    setup(template)
+    der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    pool := x509.NewCertPool()
+    pool.AddCert(ca)
+    return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// Encodes a subjectAltName extension holding the given xmppAddr entries.
+func testXmppAddrExtension(t *testing.T, addrs ...string) pkix.Extension {
+    oidSubjectAltName := asn1.ObjectIdentifier{2, 5, 29, 17}
+    oidXmppAddr := asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 8, 5}
+    type otherName struct {
+        TypeId asn1.ObjectIdentifier
+        Value  string `asn1:"tag:0,explicit,utf8"`
+    }
+    var names []asn1.RawValue
+    for _, addr := range addrs {
+        der, err := asn1.MarshalWithParams(otherName{oidXmppAddr, addr}, "tag:0")
+        if err != nil {
+            t.Fatal(err)
+        }
+        names = append(names, asn1.RawValue{FullBytes: der})
+    }
+    value, err := asn1.Marshal(names)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return pkix.Extension{Id: oidSubjectAltName, Value: value}
+}
+
+// Starts a TLS server stream offering EXTERNAL with the given mapper, trusting
+// client certificates issued by the CA, and returns the client side of the
+// connection.
+func testExternalServer(t *testing.T, mapper auth.CertificateMapper, clientCAs *x509.CertPool) net.Conn {
+    cconn, sconn := testConnPair(t)
+    serverConfig, _ := testTLSConfigs(t)
+    serverConfig.ClientAuth = tls.VerifyClientCertIfGiven
+    serverConfig.ClientCAs = clientCAs
+
+    authenticator := auth.NewAuthenticator()
+    authenticator.Register(auth.NewExternalServer(mapper))
+    features := []FeatureNegotiator{
+        NewTLSFeature(serverConfig, true),
+        NewSASLFeature(),
+        NewBindFeature(NewSessionRegistry(), BindConflictReplace),
+    }
+    server := NewServerClientStream(sconn, "example.com", features, authenticator, &nopStanzaHandler{})
+    go server.Run()
+    return cconn
+}
+
+func testExternalClient(t *testing.T, conn net.Conn, cert *tls.Certificate, authzid string) (*ClientStream, error) {
+    _, clientConfig := testTLSConfigs(t)
+    // The server certificate is generated separately by testExternalServer
+    clientConfig.InsecureSkipVerify = true
+    if cert != nil {
+        clientConfig.Certificates = []tls.Certificate{*cert}
+    }
+
+    jid := xmpp.NewJID("", "example.com", "balcony")
+    mechanisms := []auth.ClientMechanism{auth.NewExternalClient(authzid)}
+    client := NewClientStream(conn, jid, clientConfig, mechanisms, nil)
+    return client, client.Start()
+}
+
+func Test_SASLExternalXmppAddr(t *testing.T) {
+    cert, pool := testClientCertificate(t, func(c *x509.Certificate) {
+        c.ExtraExtensions = []pkix.Extension{testXmppAddrExtension(t, "juliet@example.com")}
+    })
+    jids := auth.XmppAddrMapper(mustParseCertificate(t, cert), "example.com")
+    if assert.Len(t, jids, 1) {
+        assert.Equal(t, "juliet@example.com", jids[0].String())
+    }
+
+    conn := testExternalServer(t, auth.XmppAddrMapper, pool)
+    client, err := testExternalClient(t, conn, &cert, "")
+    assert.NoError(t, err)
+    assert.Equal(t, "juliet@example.com/balcony", client.JID().String())
+    client.Close(true)
+}
+
+func Test_SASLExternalAuthzid(t *testing.T) {
+    cert, pool := testClientCertificate(t, func(c *x509.Certificate) {
+        c.EmailAddresses = []string{"juliet@example.com", "nurse@example.com"}
+    })
+
+    conn := testExternalServer(t, auth.EmailMapper, pool)
+    client, err := testExternalClient(t, conn, &cert, "nurse@example.com")
+    assert.NoError(t, err)
+    assert.Equal(t, "nurse@example.com/balcony", client.JID().String())
+    client.Close(true)
+}
+
+func Test_SASLExternalInvalidAuthzid(t *testing.T) {
+    cert, pool := testClientCertificate(t, func(c *x509.Certificate) {
+        c.EmailAddresses = []string{"juliet@example.com"}
+    })
+
+    conn := testExternalServer(t, auth.EmailMapper, pool)
+    _, err := testExternalClient(t, conn, &cert, "romeo@example.com")
+    assert.Equal(t, ClientStreamAuthFailureError, err)
+}
+
+func Test_SASLExternalCommonName(t *testing.T) {
+    cert, pool := testClientCertificate(t, func(c *x509.Certificate) {
+        c.Subject = pkix.Name{CommonName: "sensor42"}
+    })
+
+    conn := testExternalServer(t, auth.ChainMappers(auth.XmppAddrMapper, auth.CommonNameMapper), pool)
+    client, err := testExternalClient(t, conn, &cert, "")
+    assert.NoError(t, err)
+    assert.Equal(t, "sensor42@example.com/balcony", client.JID().String())
+    client.Close(true)
+}
+
+// EXTERNAL is not offered without a verified client certificate
+func Test_SASLExternalNoCertificate(t *testing.T) {
+    _, pool := testClientCertificate(t, func(c *x509.Certificate) {})
+
+    conn := testExternalServer(t, auth.CommonNameMapper, pool)
+    _, err := testExternalClient(t, conn, nil, "")
+    assert.Equal(t, ClientStreamNoMechanismError, err)
+}
+
+func mustParseCertificate(t *testing.T, cert tls.Certificate) *x509.Certificate {
+    parsed, err := x509.ParseCertificate(cert.Certificate[0])
+    if err != nil {
+        t.Fatal(err)
+    }
+    return parsed
+}
@@ -0,0 +1,55 @@
+package stream
+
+import (
+    "errors"
+    "github.com/stretchr/testify/assert"
+    "github.com/zonyitoo/goxmpp/auth"
+    "github.com/zonyitoo/goxmpp/basic"
+    "testing"
+)
+
+func testPlainClient(t *testing.T, credentials auth.PlainCredentials, tls bool,
+    username, password string) (*ClientStream, error) {
+    cconn, sconn := testConnPair(t)
+    serverConfig, clientConfig := testTLSConfigs(t)
+
+    authenticator := auth.NewAuthenticator()
+    authenticator.Register(auth.NewPlainServer(credentials))
+    features := []FeatureNegotiator{NewSASLFeature(), NewBindFeature(NewSessionRegistry(), BindConflictReplace)}
+    if tls {
+        features = append([]FeatureNegotiator{NewTLSFeature(serverConfig, true)}, features...)
+    } else {
+        clientConfig = nil
+    }
+    server := NewServerClientStream(sconn, "example.com", features, authenticator, &nopStanzaHandler{})
+    go server.Run()
+
+    jid := xmpp.NewJID(username, "example.com", "balcony")
+    mechanisms := []auth.ClientMechanism{auth.NewPlainClient("", username, password)}
+    client := NewClientStream(cconn, jid, clientConfig, mechanisms, nil)
+    return client, client.Start()
+}
+
+func Test_SASLPlain(t *testing.T) {
+    credentials := auth.PlainCredentialsFunc(func(username, password string) (bool, error) {
+        if username == "romeo" {
+            return false, errors.New("Backend unavailable")
+        }
+        return username == "juliet" && password == "r0m30", nil
+    })
+
+    client, err := testPlainClient(t, credentials, true, "juliet", "r0m30")
+    assert.NoError(t, err)
+    assert.Equal(t, "juliet@example.com/balcony", client.JID().String())
+    client.Close(true)
+
+    _, err = testPlainClient(t, credentials, true, "juliet", "wrong")
+    assert.Equal(t, ClientStreamAuthFailureError, err)
+
+    _, err = testPlainClient(t, credentials, true, "romeo", "r0m30")
+    assert.Equal(t, ClientStreamAuthFailureError, err)
+
+    // The password is not sent without TLS
+    _, err = testPlainClient(t, credentials, false, "juliet", "r0m30")
+    assert.Equal(t, ClientStreamNoMechanismError, err)
+}
@@ -0,0 +1,231 @@
+package stream
+
+import (
+    "bytes"
+    "crypto/tls"
+    "github.com/stretchr/testify/assert"
+    "github.com/zonyitoo/goxmpp/auth"
+    "github.com/zonyitoo/goxmpp/basic"
+    "github.com/zonyitoo/goxmpp/protocol"
+    "net"
+    "strings"
+    "testing"
+)
+
+func testSCRAMCredentials(h *auth.SCRAMHash, username, password string) auth.SCRAMCredentials {
+    keys := auth.NewSCRAMKeys(h, password, []byte("68da3408-4f4f-467f-912e-49f53f43d033"), 4096)
+    return auth.SCRAMCredentialsFunc(func(name string, hash *auth.SCRAMHash) (*auth.SCRAMKeys, error) {
+        if name != username || hash != h {
+            return nil, nil
+        }
+        return keys, nil
+    })
+}
+
+// Replays the SCRAM-SHA-1 exchange of the decoder fixture (RFC6120 Section
+// 9.2) against the server mechanism.
+func Test_SASLSCRAMFixture(t *testing.T) {
+    decoder := NewDecoder(bytes.NewBufferString(xmpp_stream_sample))
+    var elems []interface{}
+    for range tests {
+        elem, err := decoder.GetNextElement()
+        if err != nil {
+            t.Fatal(err)
+        }
+        elems = append(elems, elem)
+    }
+    initial := elems[5].(*protocol.XMPPSASLAuth)
+    challenge := elems[6].(*protocol.XMPPSASLChallenge)
+    response := elems[7].(*protocol.XMPPSASLResponse)
+    success := elems[8].(*protocol.XMPPSASLSuccess)
+
+    mechanism := auth.NewSCRAMServer(auth.SCRAMSHA1, testSCRAMCredentials(auth.SCRAMSHA1, "juliet", "r0m30myr0m30"))
+    mechanism.Nonce = func() string { return "e124695b-69a9-4de6-9c30-b51b3808c59e" }
+    authenticator := auth.NewAuthenticator()
+    authenticator.Register(mechanism)
+
+    cconn, sconn := testConnPair(t)
+    defer cconn.Close()
+    server := NewServerClientStream(sconn, "im.example.com", nil, authenticator, &nopStanzaHandler{})
+    defer server.Close(false)
+
+    result := make(chan bool)
+    go func() {
+        exchange := authenticator.Start(initial.Mechanism, authContext(server))
+        identity, ok := serverExchange(exchange, initial, server)
+        result <- ok && identity.Username == "juliet"
+    }()
+
+    reader := NewReader(cconn)
+    elem, err := reader.NextElement()
+    assert.NoError(t, err)
+    assert.Equal(t, challenge, elem)
+
+    writer := NewWriter(cconn)
+    writer.SendElement(response)
+    elem, err = reader.NextElement()
+    assert.NoError(t, err)
+    assert.Equal(t, success, elem)
+
+    assert.True(t, <-result)
+    writer.Destroy()
+}
+
+func Test_SASLSCRAMSHA256(t *testing.T) {
+    cconn, sconn := testConnPair(t)
+
+    authenticator := auth.NewAuthenticator()
+    authenticator.Register(auth.NewSCRAMServer(auth.SCRAMSHA256,
+        testSCRAMCredentials(auth.SCRAMSHA256, "juliet", "r0m30")))
+    server := NewServerClientStream(sconn, "example.com",
+        []FeatureNegotiator{NewSASLFeature(), NewBindFeature(NewSessionRegistry(), BindConflictReplace)},
+        authenticator, &nopStanzaHandler{})
+    go server.Run()
+
+    jid := xmpp.NewJID("juliet", "example.com", "balcony")
+    mechanisms := []auth.ClientMechanism{auth.NewSCRAMClient(auth.SCRAMSHA256, "", "juliet", "r0m30")}
+    client := NewClientStream(cconn, jid, nil, mechanisms, nil)
+
+    assert.NoError(t, client.Start())
+    assert.Equal(t, "juliet@example.com/balcony", client.JID().String())
+    assert.NoError(t, client.Close(true))
+}
+
+func Test_SASLSCRAMWrongPassword(t *testing.T) {
+    cconn, sconn := testConnPair(t)
+
+    authenticator := auth.NewAuthenticator()
+    authenticator.Register(auth.NewSCRAMServer(auth.SCRAMSHA1,
+        testSCRAMCredentials(auth.SCRAMSHA1, "juliet", "r0m30")))
+    server := NewServerClientStream(sconn, "example.com",
+        []FeatureNegotiator{NewSASLFeature()}, authenticator, &nopStanzaHandler{})
+    go server.Run()
+
+    jid := xmpp.NewJID("juliet", "example.com", "balcony")
+    mechanisms := []auth.ClientMechanism{auth.NewSCRAMClient(auth.SCRAMSHA1, "", "juliet", "tybalt")}
+    client := NewClientStream(cconn, jid, nil, mechanisms, nil)
+
+    assert.Equal(t, ClientStreamAuthFailureError, client.Start())
+}
+
+// Plays a server which offers SCRAM-SHA-1 and sends an empty success after
+// the given number of challenges, without the server signature.
+func testSCRAMEarlySuccess(t *testing.T, challenges int) error {
+    cconn, sconn := testConnPair(t)
+    defer sconn.Close()
+    go func() {
+        reader, writer := NewReader(sconn), NewWriter(sconn)
+        reader.NextElement()
+        writer.Open(&protocol.XMPPStream{Id: "abcd", From: "example.com", Version: "1.0", Xmlns: protocol.XMLNS_JABBER_CLIENT})
+        writer.SendElement(&protocol.XMPPStreamFeatures{
+            SASLMechanisms: &protocol.XMPPSASLMechanisms{Mechanisms: []string{"SCRAM-SHA-1"}},
+        })
+        elem, _ := reader.NextElement()
+        for i := 0; i < challenges; i++ {
+            initial, ok := elem.(*protocol.XMPPSASLAuth)
+            if !ok {
+                return
+            }
+            data, _ := decodeSASLData(initial.Data)
+            nonce := strings.SplitN(strings.SplitN(string(data), ",r=", 2)[1], ",", 2)[0]
+            writer.SendElement(&protocol.XMPPSASLChallenge{
+                Data: encodeSASLData([]byte("r=" + nonce + "server,s=c2FsdA==,i=4096")),
+            })
+            reader.NextElement()
+        }
+        writer.SendElement(&protocol.XMPPSASLSuccess{})
+        writer.Flush()
+        reader.NextElement()
+    }()
+
+    jid := xmpp.NewJID("juliet", "example.com", "balcony")
+    mechanisms := []auth.ClientMechanism{auth.NewSCRAMClient(auth.SCRAMSHA1, "", "juliet", "r0m30")}
+    return NewClientStream(cconn, jid, nil, mechanisms, nil).Start()
+}
+
+// RFC5802 Section 5: a server which does not prove that it knows the
+// credentials is not accepted
+func Test_SASLSCRAMEarlySuccess(t *testing.T) {
+    assert.Equal(t, ClientStreamAuthIncompleteError, testSCRAMEarlySuccess(t, 0))
+    assert.Equal(t, ClientStreamAuthIncompleteError, testSCRAMEarlySuccess(t, 1))
+}
+
+// Starts a TLS server stream offering SCRAM-SHA-1 and SCRAM-SHA-1-PLUS and
+// returns the client side of the connection.
+func testSCRAMPlusServer(t *testing.T, serverConfig *tls.Config) net.Conn {
+    cconn, sconn := testConnPair(t)
+
+    credentials := testSCRAMCredentials(auth.SCRAMSHA1, "juliet", "r0m30")
+    authenticator := auth.NewAuthenticator()
+    authenticator.Register(auth.NewSCRAMServer(auth.SCRAMSHA1, credentials))
+    authenticator.Register(auth.NewSCRAMPlusServer(auth.SCRAMSHA1, credentials))
+    features := []FeatureNegotiator{
+        NewTLSFeature(serverConfig, true),
+        NewSASLFeature(),
+        NewBindFeature(NewSessionRegistry(), BindConflictReplace),
+    }
+    server := NewServerClientStream(sconn, "example.com", features, authenticator, &nopStanzaHandler{})
+    go server.Run()
+    return cconn
+}
+
+func Test_SASLSCRAMPlusExporter(t *testing.T) {
+    serverConfig, clientConfig := testTLSConfigs(t)
+    cconn := testSCRAMPlusServer(t, serverConfig)
+
+    jid := xmpp.NewJID("juliet", "example.com", "balcony")
+    mechanisms := []auth.ClientMechanism{
+        auth.NewSCRAMPlusClient(auth.SCRAMSHA1, auth.ChannelBindingTLSExporter, "", "juliet", "r0m30"),
+    }
+    client := NewClientStream(cconn, jid, clientConfig, mechanisms, nil)
+
+    assert.NoError(t, client.Start())
+    assert.Equal(t, "juliet@example.com/balcony", client.JID().String())
+    assert.NoError(t, client.Close(true))
+}
+
+func Test_SASLSCRAMPlusUnique(t *testing.T) {
+    serverConfig, clientConfig := testTLSConfigs(t)
+    serverConfig.MaxVersion = tls.VersionTLS12
+    cconn := testSCRAMPlusServer(t, serverConfig)
+
+    jid := xmpp.NewJID("juliet", "example.com", "balcony")
+    mechanisms := []auth.ClientMechanism{
+        auth.NewSCRAMPlusClient(auth.SCRAMSHA1, auth.ChannelBindingTLSUnique, "", "juliet", "r0m30"),
+    }
+    client := NewClientStream(cconn, jid, clientConfig, mechanisms, nil)
+
+    assert.NoError(t, client.Start())
+    assert.Equal(t, "juliet@example.com/balcony", client.JID().String())
+    assert.NoError(t, client.Close(true))
+}
+
+// tls-unique is not defined for TLS 1.3
+func Test_SASLSCRAMPlusUniqueUnavailable(t *testing.T) {
+    serverConfig, clientConfig := testTLSConfigs(t)
+    cconn := testSCRAMPlusServer(t, serverConfig)
+
+    jid := xmpp.NewJID("juliet", "example.com", "balcony")
+    mechanisms := []auth.ClientMechanism{
+        auth.NewSCRAMPlusClient(auth.SCRAMSHA1, auth.ChannelBindingTLSUnique, "", "juliet", "r0m30"),
+    }
+    client := NewClientStream(cconn, jid, clientConfig, mechanisms, nil)
+
+    assert.Equal(t, ClientStreamNoMechanismError, client.Start())
+}
+
+func Test_SASLSCRAMPlusNotOffered(t *testing.T) {
+    cconn, sconn := testConnPair(t)
+    defer cconn.Close()
+
+    credentials := testSCRAMCredentials(auth.SCRAMSHA1, "juliet", "r0m30")
+    authenticator := auth.NewAuthenticator()
+    authenticator.Register(auth.NewSCRAMServer(auth.SCRAMSHA1, credentials))
+    authenticator.Register(auth.NewSCRAMPlusServer(auth.SCRAMSHA1, credentials))
+    server := NewServerClientStream(sconn, "example.com", nil, authenticator, &nopStanzaHandler{})
+    defer server.Close(false)
+
+    assert.Equal(t, []string{"SCRAM-SHA-1-PLUS", "SCRAM-SHA-1"}, authenticator.Mechanisms())
+    assert.Equal(t, []string{"SCRAM-SHA-1"}, authenticator.Offered(authContext(server)))
+    assert.Nil(t, authenticator.Start("SCRAM-SHA-1-PLUS", authContext(server)))
+}
@@ -0,0 +1,108 @@
+package stream
+
+import (
+    "github.com/zonyitoo/goxmpp/basic"
+    "sync"
+)
+
+// SessionRegistry keeps track of the streams bound to full JIDs, indexed by
+// both full and bare JID.
+type SessionRegistry struct {
+    lock     sync.RWMutex
+    sessions map[string]Streamer
+    bare     map[string][]Streamer
+}
+
+func NewSessionRegistry() *SessionRegistry {
+    return &SessionRegistry{
+        sessions: make(map[string]Streamer),
+        bare:     make(map[string][]Streamer),
+    }
+}
+
+// Returns the stream bound to the full JID, or nil.
+func (r *SessionRegistry) Get(jid *xmpp.JID) Streamer {
+    r.lock.RLock()
+    defer r.lock.RUnlock()
+    return r.sessions[jid.String()]
+}
+
+// Returns all streams bound to a resource of the bare JID.
+func (r *SessionRegistry) Resources(jid *xmpp.BareJID) []Streamer {
+    r.lock.RLock()
+    defer r.lock.RUnlock()
+    streams := r.bare[jid.String()]
+    result := make([]Streamer, len(streams))
+    copy(result, streams)
+    return result
+}
+
+// Binds the stream to its full JID, replacing any stream previously bound to it.
+func (r *SessionRegistry) Bind(s Streamer) {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+    key := s.JID().String()
+    if old, ok := r.sessions[key]; ok {
+        r.removeBare(old)
+    }
+    r.sessions[key] = s
+    bareKey := s.JID().BareJID.String()
+    r.bare[bareKey] = append(r.bare[bareKey], s)
+}
+
+// Binds the stream to jid unless another stream is bound to it, in which case
+// policy resolves the conflict: the stream is rejected, replaces the other
+// one, which is returned, or is bound to a generated resource instead. The
+// check and the binding are atomic, so concurrent claims of a JID conflict.
+// The JID of the stream is set only if it is bound.
+func (r *SessionRegistry) Claim(s Streamer, jid *xmpp.JID, policy BindConflictPolicy) (replaced Streamer, ok bool) {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+    for {
+        existing := r.sessions[jid.String()]
+        if existing == nil || existing == s {
+            break
+        }
+        if policy == BindConflictReject {
+            return nil, false
+        } else if policy == BindConflictReplace {
+            r.removeBare(existing)
+            replaced = existing
+            break
+        }
+        jid = xmpp.NewJID(jid.Local, jid.Domain, generateResource())
+    }
+
+    s.SetJID(jid)
+    r.sessions[jid.String()] = s
+    bareKey := jid.BareJID.String()
+    r.bare[bareKey] = append(r.bare[bareKey], s)
+    return replaced, true
+}
+
+// Removes the stream from the registry if it is still bound to its full JID.
+func (r *SessionRegistry) Unbind(s Streamer) {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+    key := s.JID().String()
+    if r.sessions[key] == s {
+        delete(r.sessions, key)
+        r.removeBare(s)
+    }
+}
+
+func (r *SessionRegistry) removeBare(s Streamer) {
+    bareKey := s.JID().BareJID.String()
+    streams := r.bare[bareKey]
+    for idx, stream := range streams {
+        if stream == s {
+            streams = append(streams[:idx], streams[idx+1:]...)
+            break
+        }
+    }
+    if len(streams) == 0 {
+        delete(r.bare, bareKey)
+    } else {
+        r.bare[bareKey] = streams
+    }
+}
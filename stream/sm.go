@@ -0,0 +1,334 @@
+package stream
+
+import (
+    "code.google.com/p/go-uuid/uuid"
+    "errors"
+    "github.com/zonyitoo/goxmpp/basic"
+    "github.com/zonyitoo/goxmpp/protocol"
+    "sync"
+    "time"
+)
+
+var (
+    SMHandledCountTooHighError = errors.New("Acknowledged more stanzas than were sent")
+)
+
+// Implemented by the streams stream management can be enabled on.
+type smStream interface {
+    Streamer
+    streamManagement() *smState
+    setStreamManagement(*smState)
+}
+
+// XEP-0198
+//
+// The stream management state of a session. Once resumption is enabled the
+// state outlives the stream it was enabled on, until the session is resumed
+// on a new stream or the resumption timeout expires.
+type smState struct {
+    id      string
+    resume  bool
+    timeout time.Duration
+    lock    sync.Mutex
+    // The stream the session currently lives on
+    stream Streamer
+    // Number of stanzas handled from and sent to the entity, modulo 2^32
+    inbound  uint32
+    outbound uint32
+    // The last 'h' acknowledged by the entity
+    acked uint32
+    // Stanzas sent but not yet acknowledged, oldest first
+    queue   []protocol.Protocol
+    ended   bool
+    expired bool
+    timer   *time.Timer
+}
+
+// Called by the Writer with every stanza sent on the stream.
+func (sm *smState) sent(elem protocol.Protocol) {
+    sm.lock.Lock()
+    defer sm.lock.Unlock()
+    sm.outbound++
+    sm.queue = append(sm.queue, elem)
+}
+
+// Counts a stanza handled by the stream.
+func (sm *smState) handled() {
+    sm.lock.Lock()
+    defer sm.lock.Unlock()
+    sm.inbound++
+}
+
+// Marks the stream as closed by the entity with </stream:stream>, so that the
+// session is not kept for resumption (XEP-0198 Section 5).
+func (sm *smState) end() {
+    sm.lock.Lock()
+    defer sm.lock.Unlock()
+    sm.ended = true
+}
+
+// XEP-0198 Section 4
+//
+// Drops the stanzas acknowledged by h from the queue.
+func (sm *smState) ack(h uint32) error {
+    sm.lock.Lock()
+    defer sm.lock.Unlock()
+    return sm.ackLocked(h)
+}
+
+func (sm *smState) ackLocked(h uint32) error {
+    // Counters wrap around, so only the difference is meaningful
+    n := h - sm.acked
+    if n > uint32(len(sm.queue)) {
+        return SMHandledCountTooHighError
+    }
+    sm.queue = sm.queue[n:]
+    sm.acked = h
+    return nil
+}
+
+// XEP-0198
+//
+// Stream management is offered once the stream is authenticated. <enable/>
+// is accepted after resource binding and <resume/> instead of it. Sessions
+// that enabled resumption are kept for the given timeout after their stream
+// is lost; then, or when the stream is closed cleanly, the stanzas the entity
+// never acknowledged are passed to expired, e.g. to re-route or bounce them.
+//
+// A single SMFeature must be shared by all streams, as sessions are resumed
+// across streams.
+type SMFeature struct {
+    sessions  *SessionRegistry
+    timeout   time.Duration
+    expired   func(*xmpp.JID, []protocol.Protocol)
+    lock      sync.Mutex
+    resumable map[string]*smState
+}
+
+// A zero timeout disables resumption.
+func NewSMFeature(sessions *SessionRegistry, timeout time.Duration,
+    expired func(*xmpp.JID, []protocol.Protocol)) *SMFeature {
+    return &SMFeature{
+        sessions:  sessions,
+        timeout:   timeout,
+        expired:   expired,
+        resumable: make(map[string]*smState),
+    }
+}
+
+func (f *SMFeature) Offered(s Streamer) bool {
+    _, ok := s.(smStream)
+    return ok && s.IsAuthenticated()
+}
+
+func (f *SMFeature) Mandatory(s Streamer) bool {
+    return false
+}
+
+func (f *SMFeature) RequiresRestart() bool {
+    return false
+}
+
+func (f *SMFeature) Advertise(features *protocol.XMPPStreamFeatures, s Streamer) {
+    features.SM = &protocol.XMPPStreamFeatureSM{}
+}
+
+func (f *SMFeature) Handles(elem protocol.Protocol, s Streamer) bool {
+    switch elem.(type) {
+    case *protocol.XMPPSMEnable, *protocol.XMPPSMResume, *protocol.XMPPSMRequest, *protocol.XMPPSMAnswer:
+        return true
+    }
+    return false
+}
+
+func (f *SMFeature) Negotiate(elem protocol.Protocol, s Streamer) (bool, error) {
+    ss := s.(smStream)
+    switch t := elem.(type) {
+    case *protocol.XMPPSMEnable:
+        return f.enable(t, ss)
+    case *protocol.XMPPSMResume:
+        return f.resume(t, ss)
+    case *protocol.XMPPSMRequest:
+        sm := ss.streamManagement()
+        if sm == nil {
+            return false, sendSMFailed(s, nil, protocol.XMPPStanzaErrorGroup{
+                UnexpectedRequest: &protocol.XMPPStanzaErrorUnexpectedRequest{},
+            })
+        }
+        sm.lock.Lock()
+        h := sm.inbound
+        sm.lock.Unlock()
+        return true, s.Writer().SendElement(&protocol.XMPPSMAnswer{H: h})
+    case *protocol.XMPPSMAnswer:
+        sm := ss.streamManagement()
+        if sm == nil {
+            return false, sendSMFailed(s, nil, protocol.XMPPStanzaErrorGroup{
+                UnexpectedRequest: &protocol.XMPPStanzaErrorUnexpectedRequest{},
+            })
+        }
+        if err := sm.ack(t.H); err != nil {
+            s.Writer().SendElement(&protocol.XMPPStreamError{
+                UndefinedCondition: &protocol.XMPPStreamErrorUndefinedCondition{},
+            })
+            return false, err
+        }
+        return true, nil
+    }
+    return false, nil
+}
+
+// XEP-0198 Section 3
+func (f *SMFeature) enable(enable *protocol.XMPPSMEnable, s smStream) (bool, error) {
+    if !isBound(s) || s.streamManagement() != nil {
+        return false, sendSMFailed(s, nil, protocol.XMPPStanzaErrorGroup{
+            UnexpectedRequest: &protocol.XMPPStanzaErrorUnexpectedRequest{},
+        })
+    }
+
+    sm := &smState{
+        id:     uuid.New(),
+        stream: s,
+    }
+    enabled := &protocol.XMPPSMEnabled{}
+    if f.timeout > 0 && (enable.Resume == "true" || enable.Resume == "1") {
+        // The entity may ask for a shorter timeout than the server's
+        sm.resume = true
+        sm.timeout = f.timeout
+        if max := time.Duration(enable.Max) * time.Second; max > 0 && max < sm.timeout {
+            sm.timeout = max
+        }
+        enabled.Id = sm.id
+        enabled.Resume = "true"
+        enabled.Max = int(sm.timeout / time.Second)
+
+        f.lock.Lock()
+        f.resumable[sm.id] = sm
+        f.lock.Unlock()
+    }
+
+    s.setStreamManagement(sm)
+    s.AddCloseHandler(func(closed Streamer) {
+        f.closed(sm, closed)
+    })
+    // Counting starts with the first stanza after <enabled/>
+    return true, s.Writer().sendWithStanzaHook(enabled, sm.sent)
+}
+
+// XEP-0198 Section 5
+//
+// The new stream takes over the full JID and the state of the session. The
+// stanzas the entity did not acknowledge are sent again after <resumed/>.
+func (f *SMFeature) resume(resume *protocol.XMPPSMResume, s smStream) (bool, error) {
+    f.lock.Lock()
+    sm := f.resumable[resume.PrevId]
+    f.lock.Unlock()
+    if sm == nil || !s.IsAuthenticated() || isBound(s) || s.streamManagement() != nil {
+        return false, sendSMFailed(s, nil, protocol.XMPPStanzaErrorGroup{
+            ItemNotFound: &protocol.XMPPStanzaErrorItemNotFound{},
+        })
+    }
+
+    sm.lock.Lock()
+    old := sm.stream
+    if sm.expired || old.JID().BareJID.String() != s.JID().BareJID.String() {
+        sm.lock.Unlock()
+        return false, sendSMFailed(s, nil, protocol.XMPPStanzaErrorGroup{
+            ItemNotFound: &protocol.XMPPStanzaErrorItemNotFound{},
+        })
+    }
+    sm.stream = s
+    if sm.timer != nil {
+        sm.timer.Stop()
+        sm.timer = nil
+    }
+    sm.lock.Unlock()
+
+    // The old stream may not have noticed that its connection is gone
+    old.Writer().SendElement(&protocol.XMPPStreamError{
+        Conflict: &protocol.XMPPStreamErrorConflict{},
+    })
+    old.Close(true)
+
+    sm.lock.Lock()
+    if err := sm.ackLocked(resume.H); err != nil {
+        h := sm.inbound
+        sm.lock.Unlock()
+        sendSMFailed(s, &h, protocol.XMPPStanzaErrorGroup{
+            UndefinedCondition: &protocol.XMPPStanzaErrorUndefinedCondition{},
+        })
+        f.expire(sm, s)
+        return false, err
+    }
+    pending := sm.queue
+    sm.queue = nil
+    sm.outbound = sm.acked
+    sm.ended = false
+    h := sm.inbound
+    sm.lock.Unlock()
+
+    s.SetJID(old.JID())
+    s.setStreamManagement(sm)
+    s.AddCloseHandler(func(closed Streamer) {
+        f.closed(sm, closed)
+    })
+    err := s.Writer().sendWithStanzaHook(&protocol.XMPPSMResumed{H: h, PrevId: sm.id}, sm.sent)
+    if err != nil {
+        return false, err
+    }
+    for _, stanza := range pending {
+        s.Writer().SendElement(stanza)
+    }
+
+    // Only route new stanzas to the stream once the queue has been sent
+    f.sessions.Bind(s)
+    s.AddCloseHandler(f.sessions.Unbind)
+    return true, nil
+}
+
+// Keeps the session for resumption if the stream was lost, and expires it
+// otherwise. Nothing is done if the session has moved to another stream.
+func (f *SMFeature) closed(sm *smState, s Streamer) {
+    sm.lock.Lock()
+    if sm.stream != s {
+        sm.lock.Unlock()
+        return
+    }
+    if sm.resume && !sm.ended {
+        sm.timer = time.AfterFunc(sm.timeout, func() {
+            f.expire(sm, s)
+        })
+        sm.lock.Unlock()
+        return
+    }
+    sm.lock.Unlock()
+    f.expire(sm, s)
+}
+
+// Passes the unacknowledged stanzas to the expired handler, unless the
+// session has been resumed on another stream in the meantime.
+func (f *SMFeature) expire(sm *smState, s Streamer) {
+    sm.lock.Lock()
+    if sm.stream != s || sm.expired {
+        sm.lock.Unlock()
+        return
+    }
+    sm.expired = true
+    queue := sm.queue
+    sm.queue = nil
+    sm.lock.Unlock()
+
+    f.lock.Lock()
+    delete(f.resumable, sm.id)
+    f.lock.Unlock()
+
+    if f.expired != nil && len(queue) > 0 {
+        f.expired(s.JID(), queue)
+    }
+}
+
+func sendSMFailed(s Streamer, h *uint32, condition protocol.XMPPStanzaErrorGroup) error {
+    return s.Writer().SendElement(&protocol.XMPPSMFailed{
+        H:                    h,
+        XMPPStanzaErrorGroup: condition,
+    })
+}
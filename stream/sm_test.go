@@ -0,0 +1,213 @@
+package stream
+
+import (
+    "github.com/stretchr/testify/assert"
+    "github.com/zonyitoo/goxmpp/basic"
+    "github.com/zonyitoo/goxmpp/protocol"
+    "net"
+    "testing"
+    "time"
+)
+
+// Starts a server stream offering stream management and authenticates a raw
+// client as juliet.
+func testSMServer(t *testing.T, f *SMFeature, sessions *SessionRegistry) (*ServerClientStream, net.Conn, *Reader, *Writer) {
+    cconn, sconn := testConnPair(t)
+    features := []FeatureNegotiator{NewSASLFeature(), NewBindFeature(sessions, BindConflictReplace), f}
+    server := NewServerClientStream(sconn, "example.com", features, testPlainAuthenticator(), &nopStanzaHandler{})
+    go server.Run()
+
+    reader, writer := testRawClient(t, cconn)
+    writer.SendElement(testSASLAuth("PLAIN", "\x00juliet\x00r0m30"))
+    if elem, err := reader.NextElement(); err != nil {
+        t.Fatal(err)
+    } else {
+        assert.IsType(t, &protocol.XMPPSASLSuccess{}, elem)
+    }
+    reader, writer = testRawClient(t, cconn)
+    return server, cconn, reader, writer
+}
+
+func testSMBind(t *testing.T, reader *Reader, writer *Writer) {
+    writer.SendElement(&protocol.XMPPStanzaIQ{
+        Id:   "bind1",
+        Type: protocol.XMPP_STANZA_IQ_TYPE_SET,
+        Bind: &protocol.XMPPBind{Resource: "balcony"},
+    })
+    if _, err := reader.NextElement(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func testSMNext(t *testing.T, reader *Reader) protocol.Protocol {
+    elem, err := reader.NextElement()
+    if err != nil {
+        t.Fatal(err)
+    }
+    return elem
+}
+
+func testSMEnable(t *testing.T, reader *Reader, writer *Writer, resume string) *protocol.XMPPSMEnabled {
+    writer.SendElement(&protocol.XMPPSMEnable{Resume: resume})
+    enabled, ok := testSMNext(t, reader).(*protocol.XMPPSMEnabled)
+    if !ok {
+        t.Fatal("Expected <enabled/>")
+    }
+    return enabled
+}
+
+func testSMMessage(body string) *protocol.XMPPStanzaMessage {
+    return &protocol.XMPPStanzaMessage{
+        To:   "juliet@example.com/balcony",
+        Body: &protocol.XMPPStanzaMessageBody{Data: body},
+    }
+}
+
+func (sm *smState) pending() int {
+    sm.lock.Lock()
+    defer sm.lock.Unlock()
+    return len(sm.queue)
+}
+
+func Test_SMAcks(t *testing.T) {
+    f := NewSMFeature(NewSessionRegistry(), 0, nil)
+    server, _, reader, writer := testSMServer(t, f, NewSessionRegistry())
+
+    // Stream management requires a bound resource
+    writer.SendElement(&protocol.XMPPSMEnable{})
+    if failed, ok := testSMNext(t, reader).(*protocol.XMPPSMFailed); assert.True(t, ok) {
+        assert.NotNil(t, failed.UnexpectedRequest)
+    }
+    testSMBind(t, reader, writer)
+
+    // Resumption is not offered without a timeout
+    enabled := testSMEnable(t, reader, writer, "true")
+    assert.Empty(t, enabled.Id)
+    assert.Empty(t, enabled.Resume)
+
+    writer.SendElement(testSMMessage("Wherefore art thou?"))
+    writer.SendElement(testSMMessage("Deny thy father"))
+    writer.SendElement(&protocol.XMPPSMRequest{})
+    if answer, ok := testSMNext(t, reader).(*protocol.XMPPSMAnswer); assert.True(t, ok) {
+        assert.EqualValues(t, 2, answer.H)
+    }
+
+    server.Writer().SendElement(testSMMessage("Thou knowest the mask of night"))
+    server.Writer().SendElement(testSMMessage("Is on my face"))
+    testSMNext(t, reader)
+    testSMNext(t, reader)
+    writer.SendElement(&protocol.XMPPSMAnswer{H: 1})
+    writer.SendElement(&protocol.XMPPSMRequest{})
+    testSMNext(t, reader)
+    assert.Equal(t, 1, server.sm.pending())
+
+    // Acknowledging stanzas that were never sent terminates the stream
+    writer.SendElement(&protocol.XMPPSMAnswer{H: 5})
+    if streamError, ok := testSMNext(t, reader).(*protocol.XMPPStreamError); assert.True(t, ok) {
+        assert.NotNil(t, streamError.UndefinedCondition)
+    }
+}
+
+func Test_SMResume(t *testing.T) {
+    sessions := NewSessionRegistry()
+    f := NewSMFeature(sessions, time.Minute, nil)
+    server, cconn, reader, writer := testSMServer(t, f, sessions)
+    testSMBind(t, reader, writer)
+    enabled := testSMEnable(t, reader, writer, "true")
+    assert.NotEmpty(t, enabled.Id)
+    assert.Equal(t, 60, enabled.Max)
+
+    writer.SendElement(testSMMessage("Wherefore art thou?"))
+    writer.SendElement(&protocol.XMPPSMRequest{})
+    testSMNext(t, reader)
+    server.Writer().SendElement(testSMMessage("Thou knowest the mask of night"))
+    server.Writer().SendElement(testSMMessage("Is on my face"))
+    testSMNext(t, reader)
+    cconn.Close()
+
+    // Only the first message was received before the connection was lost
+    resumed, _, reader, writer := testSMServer(t, f, sessions)
+    writer.SendElement(&protocol.XMPPSMResume{PrevId: enabled.Id, H: 1})
+    if answer, ok := testSMNext(t, reader).(*protocol.XMPPSMResumed); assert.True(t, ok) {
+        assert.Equal(t, enabled.Id, answer.PrevId)
+        assert.EqualValues(t, 1, answer.H)
+    }
+    if msg, ok := testSMNext(t, reader).(*protocol.XMPPStanzaMessage); assert.True(t, ok) {
+        assert.Equal(t, "Is on my face", msg.Body.Data)
+    }
+    assert.Equal(t, "juliet@example.com/balcony", resumed.JID().String())
+    assert.Equal(t, resumed, sessions.Get(xmpp.NewJID("juliet", "example.com", "balcony")))
+
+    // Counting goes on from the resumed state
+    writer.SendElement(testSMMessage("Deny thy father"))
+    writer.SendElement(&protocol.XMPPSMRequest{})
+    if answer, ok := testSMNext(t, reader).(*protocol.XMPPSMAnswer); assert.True(t, ok) {
+        assert.EqualValues(t, 2, answer.H)
+    }
+}
+
+func Test_SMResumeUnknown(t *testing.T) {
+    f := NewSMFeature(NewSessionRegistry(), time.Minute, nil)
+    _, _, reader, writer := testSMServer(t, f, NewSessionRegistry())
+    writer.SendElement(&protocol.XMPPSMResume{PrevId: "unknown"})
+    if failed, ok := testSMNext(t, reader).(*protocol.XMPPSMFailed); assert.True(t, ok) {
+        assert.NotNil(t, failed.ItemNotFound)
+    }
+}
+
+type testExpired struct {
+    jid     *xmpp.JID
+    stanzas []protocol.Protocol
+}
+
+func Test_SMExpired(t *testing.T) {
+    sessions := NewSessionRegistry()
+    expired := make(chan testExpired, 1)
+    f := NewSMFeature(sessions, 50*time.Millisecond, func(jid *xmpp.JID, stanzas []protocol.Protocol) {
+        expired <- testExpired{jid, stanzas}
+    })
+
+    // The session is kept until the timeout when the connection is lost
+    server, cconn, reader, writer := testSMServer(t, f, sessions)
+    testSMBind(t, reader, writer)
+    enabled := testSMEnable(t, reader, writer, "true")
+    server.Writer().SendElement(testSMMessage("Thou knowest the mask of night"))
+    testSMNext(t, reader)
+    cconn.Close()
+
+    select {
+    case e := <-expired:
+        assert.Equal(t, "juliet@example.com/balcony", e.jid.String())
+        assert.Len(t, e.stanzas, 1)
+    case <-time.After(time.Second):
+        t.Fatal("Session did not expire")
+    }
+    _, _, reader, writer = testSMServer(t, f, sessions)
+    writer.SendElement(&protocol.XMPPSMResume{PrevId: enabled.Id})
+    if failed, ok := testSMNext(t, reader).(*protocol.XMPPSMFailed); assert.True(t, ok) {
+        assert.NotNil(t, failed.ItemNotFound)
+    }
+}
+
+// A session closed with </stream:stream> cannot be resumed
+func Test_SMClosed(t *testing.T) {
+    sessions := NewSessionRegistry()
+    expired := make(chan testExpired, 1)
+    f := NewSMFeature(sessions, time.Minute, func(jid *xmpp.JID, stanzas []protocol.Protocol) {
+        expired <- testExpired{jid, stanzas}
+    })
+
+    server, _, reader, writer := testSMServer(t, f, sessions)
+    testSMBind(t, reader, writer)
+    testSMEnable(t, reader, writer, "true")
+    server.Writer().SendElement(testSMMessage("Thou knowest the mask of night"))
+    testSMNext(t, reader)
+    writer.Close()
+
+    select {
+    case e := <-expired:
+        assert.Len(t, e.stanzas, 1)
+    case <-time.After(time.Second):
+        t.Fatal("Session did not expire")
+    }
+}
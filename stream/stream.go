@@ -2,40 +2,72 @@ package stream
 
 import (
     "code.google.com/p/go-uuid/uuid"
+    "crypto/tls"
+    "errors"
+    "github.com/zonyitoo/goxmpp/auth"
+    "github.com/zonyitoo/goxmpp/basic"
     "github.com/zonyitoo/goxmpp/protocol"
     "net"
+    "sync"
+)
+
+var (
+    StreamInvalidNamespaceError = errors.New("Invalid namespace")
+    StreamHostUnknownError      = errors.New("Host unknown")
+    StreamBadFormatError        = errors.New("Bad format")
 )
 
 type Streamer interface {
     Id() string
+    Domain() string
+    JID() *xmpp.JID
+    SetJID(*xmpp.JID)
     Start() error
     RemoteAddr() net.Addr
     Writer() *Writer
     Reader() *Reader
     IsAnonymous() bool
     IsAuthenticated() bool
-    SASLAuthenticator() *SASLAuthenticator
+    IsEncrypted() bool
+    SetAuthenticated(bool)
+    SetAnonymous(bool)
+    SASLAuthenticator() *auth.Authenticator
+    Conn() net.Conn
+    SetConn(net.Conn)
     Reset()
     Run()
     Close(bool) error
+    AddCloseHandler(func(Streamer))
 }
 
 type ServerClientStream struct {
     conn            net.Conn
+    tlsConn         *tls.Conn
     id              string
-    authenticator   *SASLAuthenticator
+    domain          string
+    jid             *xmpp.JID
+    authenticator   *auth.Authenticator
+    features        []FeatureNegotiator
+    advertised      []FeatureNegotiator
     writer          *Writer
     reader          *Reader
     isAnonymous     bool
     isAuthenticated bool
     stanzaHandler   StanzaHandler
+    closeHandlers   []func(Streamer)
+    closeLock       sync.Mutex
+    closeOnce       sync.Once
+    sm              *smState
 }
 
-func NewServerClientStream(conn net.Conn,
-    authenticator *SASLAuthenticator, shandler StanzaHandler) *ServerClientStream {
-    return &ServerClientStream{
-        conn:            conn,
+// Creates a stream serving domain, which negotiates the given features in
+// order, e.g. STARTTLS, SASL and resource binding. More features can be
+// appended with AddFeature.
+func NewServerClientStream(conn net.Conn, domain string, features []FeatureNegotiator,
+    authenticator *auth.Authenticator, shandler StanzaHandler) *ServerClientStream {
+    scs := &ServerClientStream{
         id:              uuid.New(),
+        domain:          domain,
         reader:          NewReader(conn),
         writer:          NewWriter(conn),
         authenticator:   authenticator,
@@ -43,18 +75,36 @@ func NewServerClientStream(conn net.Conn,
         isAnonymous:     false,
         stanzaHandler:   shandler,
     }
+    scs.SetConn(conn)
+
+    for _, f := range features {
+        scs.AddFeature(f)
+    }
+    return scs
 }
 
 func (scs *ServerClientStream) Id() string {
     return scs.id
 }
 
+func (scs *ServerClientStream) Domain() string {
+    return scs.domain
+}
+
+// JID returns the address of the entity on the other side of the stream. It
+// is the bare JID once SASL succeeded and the full JID after resource binding.
+func (scs *ServerClientStream) JID() *xmpp.JID {
+    return scs.jid
+}
+
+func (scs *ServerClientStream) SetJID(jid *xmpp.JID) {
+    scs.jid = jid
+}
+
 func (scs *ServerClientStream) Start() error {
     header, err := scs.Reader().NextElement()
     if err != nil {
-        scs.Writer().SendElement(&protocol.XMPPStreamError{
-            InvalidXML: &protocol.XMPPStreamErrorInvalidXML{},
-        })
+        scs.Writer().SendElement(streamErrorFor(err))
         scs.Close(true)
         return err
     }
@@ -65,18 +115,25 @@ func (scs *ServerClientStream) Start() error {
                 InvalidNamespace: &protocol.XMPPStreamErrorInvalidNamespace{},
             })
             scs.Close(true)
-            return err
+            return StreamInvalidNamespaceError
+        }
+        if t.To != "" && t.To != scs.domain {
+            scs.Writer().SendElement(&protocol.XMPPStreamError{
+                HostUnknown: &protocol.XMPPStreamErrorHostUnknown{},
+            })
+            scs.Close(true)
+            return StreamHostUnknownError
         }
     default:
         scs.Writer().SendElement(&protocol.XMPPStreamError{
             BadFormat: &protocol.XMPPStreamErrorBadFormat{},
         })
         scs.Close(false)
-        return err
+        return StreamBadFormatError
     }
     scs.Writer().Open(&protocol.XMPPStream{
         Id:    scs.Id(),
-        From:  "example.com",
+        From:  scs.domain,
         Xmlns: protocol.XMLNS_JABBER_CLIENT,
     })
     return nil
@@ -102,119 +159,125 @@ func (scs *ServerClientStream) IsAuthenticated() bool {
     return scs.isAuthenticated
 }
 
-func (scs *ServerClientStream) SASLAuthenticator() *SASLAuthenticator {
+func (scs *ServerClientStream) IsEncrypted() bool {
+    return scs.tlsConn != nil || transportTLS(scs.conn) != nil
+}
+
+func (scs *ServerClientStream) SetAuthenticated(authenticated bool) {
+    scs.isAuthenticated = authenticated
+}
+
+// Marks the entity as authenticated with a temporary identity, see the
+// ANONYMOUS mechanism.
+func (scs *ServerClientStream) SetAnonymous(anonymous bool) {
+    scs.isAnonymous = anonymous
+}
+
+func (scs *ServerClientStream) SASLAuthenticator() *auth.Authenticator {
     return scs.authenticator
 }
 
+func (scs *ServerClientStream) Conn() net.Conn {
+    return scs.conn
+}
+
+// Replaces the underlying connection, e.g. after a security layer has been
+// negotiated. The Reader and Writer are switched on the next Reset.
+func (scs *ServerClientStream) SetConn(conn net.Conn) {
+    if tlsConn, ok := conn.(*tls.Conn); ok {
+        scs.tlsConn = tlsConn
+    }
+    scs.conn = conn
+}
+
+func (scs *ServerClientStream) AddFeature(f FeatureNegotiator) {
+    scs.features = append(scs.features, f)
+}
+
+func (scs *ServerClientStream) Features() []FeatureNegotiator {
+    return scs.features
+}
+
+// RFC6120 Section 4.7.3: the restarted stream gets a new ID
 func (scs *ServerClientStream) Reset() {
-    scs.reader = NewReader(scs.conn)
+    scs.id = uuid.New()
+    scs.reader = NewReaderWithLimits(scs.conn, scs.reader.Limits())
     scs.writer.Destroy()
-    scs.writer = NewWriter(scs.conn)
+    writer := NewWriterWithConfig(scs.conn, scs.writer.Config())
+    if scs.sm != nil {
+        writer.setStanzaHook(scs.sm.sent)
+    }
+    scs.writer = writer
 }
 
-func (scs *ServerClientStream) Run() {
-    // Response Stream Header to Client
-    if scs.Start() != nil {
-        return
+func (scs *ServerClientStream) streamManagement() *smState {
+    return scs.sm
+}
+
+func (scs *ServerClientStream) setStreamManagement(sm *smState) {
+    scs.sm = sm
+}
+
+// Starts the stream and advertises the features offered in its current state.
+func (scs *ServerClientStream) restart() error {
+    if err := scs.Start(); err != nil {
+        return err
     }
 
-    // TLS Negociation
-    {
-        // Send Feature
-        tls := &protocol.XMPPStreamFeatures{
-            StartTLS: &protocol.XMPPStartTLS{
-                Required: &protocol.XMPPRequired{},
-            },
-        }
-        scs.Writer().SendElement(tls)
+    features, advertised := advertiseFeatures(scs, scs.features)
+    scs.advertised = advertised
+    return scs.Writer().SendElement(features)
+}
 
-        if resp, err := scs.Reader().NextElement(); err != nil {
-            scs.Writer().SendElement(&protocol.XMPPStreamError{
-                InvalidXML: &protocol.XMPPStreamErrorInvalidXML{},
-            })
-            scs.Close(true)
-            return
-        } else {
-            switch resp.(type) {
-            case *protocol.XMPPStartTLS:
-                scs.Writer().SendElement(&protocol.XMPPTLSProceed{})
-            case *protocol.XMPPTLSAbort:
-                scs.Close(true)
-                return
-            default:
-                scs.Writer().SendElement(&protocol.XMPPStreamError{
-                    BadFormat: &protocol.XMPPStreamErrorBadFormat{},
-                })
-                scs.Close(false)
-                return
-            }
-        }
+func (scs *ServerClientStream) negotiator(elem protocol.Protocol) FeatureNegotiator {
+    return negotiatorFor(scs, scs.advertised, elem)
+}
 
-        // TODO: Wrap TLS and Reset
-        scs.Reset()
-    }
+func (scs *ServerClientStream) isNegotiating() bool {
+    return isNegotiating(scs, scs.advertised)
+}
 
-    // Restart Stream
-    if scs.Start() != nil {
+func (scs *ServerClientStream) Run() {
+    // Response Stream Header to Client
+    if scs.restart() != nil {
         return
     }
 
-    // TODO: Send Feature
-    //       SASL Negociation
-    {
-        feature := &protocol.XMPPStreamFeatures{
-            SASLMechanisms: &protocol.XMPPSASLMechanisms{
-                Mechanisms: scs.authenticator.Mechanisms(),
-            },
-        }
-        scs.Writer().SendElement(feature)
-
-        // Waiting for XMPPSASLAuth
-        if auth, err := scs.Reader().NextElement(); err != nil {
-            scs.Writer().SendElement(&protocol.XMPPStreamError{
-                InvalidXML: &protocol.XMPPStreamErrorInvalidXML{},
-            })
+    for {
+        elem, err := scs.Reader().NextElement()
+        if err != nil {
+            scs.Writer().SendElement(streamErrorFor(err))
             scs.Close(true)
             return
-        } else {
-            if t, ok := auth.(*protocol.XMPPSASLAuth); !ok {
-                scs.Writer().SendElement(&protocol.XMPPStreamError{
-                    BadFormat: &protocol.XMPPStreamErrorBadFormat{},
-                })
+        }
+
+        if f := scs.negotiator(elem); f != nil {
+            completed, err := f.Negotiate(elem, scs)
+            if err != nil {
                 scs.Close(true)
                 return
-            } else {
-                if !scs.authenticator.CallMechanism(t.Mechanism, t, scs) {
-                    scs.Close(true)
+            }
+            if completed && f.RequiresRestart() {
+                scs.Reset()
+                if scs.restart() != nil {
                     return
                 }
-
-                scs.isAuthenticated = true
             }
+            continue
         }
 
-        // Reset
-        scs.Reset()
-    }
-
-    // Restart Stream
-    if scs.Start() != nil {
-        return
-    }
-
-    // TODO: Send Features
-    //       Send Optional Features
-    features := &protocol.XMPPStreamFeatures{
-        Bind: &protocol.XMPPBind{},
-    }
-    scs.Writer().SendElement(features)
+        if _, ok := elem.(*protocol.XMPPStreamEnd); ok {
+            if scs.sm != nil {
+                scs.sm.end()
+            }
+            scs.Close(true)
+            return
+        }
 
-    // TODO: Begin Stanza Exchanges
-    for {
-        elem, err := scs.Reader().NextElement()
-        if err != nil {
+        // Mandatory-to-negotiate features have not been negotiated yet
+        if scs.isNegotiating() {
             scs.Writer().SendElement(&protocol.XMPPStreamError{
-                InvalidXML: &protocol.XMPPStreamErrorInvalidXML{},
+                NotAuthorized: &protocol.XMPPStreamErrorNotAuthorized{},
             })
             scs.Close(true)
             return
@@ -223,40 +286,54 @@ func (scs *ServerClientStream) Run() {
         switch t := elem.(type) {
         case *protocol.XMPPStanzaIQ:
             if scs.stanzaHandler.HandleIQ(t, scs) != nil {
+                scs.Close(true)
                 return
             }
         case *protocol.XMPPStanzaMessage:
             if scs.stanzaHandler.HandleMessage(t, scs) != nil {
+                scs.Close(true)
                 return
             }
         case *protocol.XMPPStanzaPresence:
             if scs.stanzaHandler.HandlePresence(t, scs) != nil {
+                scs.Close(true)
                 return
             }
-        case *protocol.XMPPStreamEnd:
-            scs.Close(true)
-            return
+        case *protocol.XMPPSASLAuth, *protocol.XMPPSASLResponse, *protocol.XMPPSASLAbort:
+            // SASL negotiation is over once the entity is authenticated
+            scs.Writer().SendElement(saslFailure(auth.SASLMalformedRequestError))
+        }
+
+        // XEP-0198 Section 4
+        if scs.sm != nil && isStanza(elem) {
+            scs.sm.handled()
         }
     }
+}
 
-    scs.Close(true)
+// Registers a function called once when the stream is closed.
+func (scs *ServerClientStream) AddCloseHandler(handler func(Streamer)) {
+    scs.closeLock.Lock()
+    defer scs.closeLock.Unlock()
+    scs.closeHandlers = append(scs.closeHandlers, handler)
 }
 
 func (scs *ServerClientStream) Close(withCloseTag bool) error {
-    if withCloseTag {
-        if err := scs.Writer().Close(); err != nil {
-            return err
-        }
-    } else {
-        if err := scs.Writer().Destroy(); err != nil {
-            return err
+    var err error
+    scs.closeOnce.Do(func() {
+        if withCloseTag {
+            err = scs.Writer().Close()
+        } else {
+            err = scs.Writer().Destroy()
         }
-    }
-
-    scs.conn.Close()
-    return nil
-}
+        scs.conn.Close()
 
-type ServerServerStream struct {
-    authenticator *SASLAuthenticator
+        scs.closeLock.Lock()
+        handlers := scs.closeHandlers
+        scs.closeLock.Unlock()
+        for _, handler := range handlers {
+            handler(scs)
+        }
+    })
+    return err
 }
@@ -1,72 +1,371 @@
 package stream
 
 import (
+    "bufio"
     "encoding/xml"
+    "errors"
     "github.com/zonyitoo/goxmpp/protocol"
     "io"
+    "io/ioutil"
     "sync"
+    "time"
 )
 
+var (
+    WriterClosedError   = errors.New("Writer is closed")
+    WriterOverflowError = errors.New("Writer queue is full")
+)
+
+// What a Writer does with an element when its queue is full.
+type OverflowPolicy int
+
+const (
+    // The sender waits until the queue has room
+    OverflowBlock OverflowPolicy = iota
+    // The element is dropped
+    OverflowDrop
+    // The queued elements are dropped and the stream is closed with a
+    // resource-constraint stream error (RFC6120 Section 4.9.3.17)
+    OverflowClose
+)
+
+// WriterConfig controls how a Writer queues and writes elements.
+type WriterConfig struct {
+    // Number of elements waiting to be written beyond which Overflow
+    // applies. Unbounded if not positive.
+    QueueSize    int
+    Overflow     OverflowPolicy
+    // Deadline of every write to a transport implementing
+    // SetWriteDeadline, disabled if zero. A write which misses it fails the
+    // Writer.
+    WriteTimeout time.Duration
+}
+
+const DefaultWriterQueueSize = 256
+
+var DefaultWriterConfig = WriterConfig{
+    QueueSize: DefaultWriterQueueSize,
+    Overflow:  OverflowBlock,
+}
+
+type writeDeadliner interface {
+    SetWriteDeadline(time.Time) error
+}
+
+// Writer serializes elements onto a transport. Elements are queued and
+// written in order by a goroutine of the Writer, which batches those queued
+// meanwhile in a buffer and flushes it once the queue is empty. The first
+// transport error fails the Writer: it is returned by every later call, and
+// the elements still queued are dropped.
+//
+// The Writer may be shared between goroutines, e.g. when stanzas are routed
+// to the stream while it is being closed.
 type Writer struct {
-    transport io.Writer
-    wchan     chan []byte
-    wgroup    sync.WaitGroup
+    transport  io.Writer
+    buffer     *bufio.Writer
+    lock       sync.Mutex
+    // Signalled whenever the queue or the state of the Writer changes
+    cond       *sync.Cond
+    queue      [][]byte
+    // Whether a batch taken from the queue is being written
+    writing    bool
+    closed     bool
+    // Set when the stream is closed because the queue overflowed
+    overflowed bool
+    err        error
+    done       chan struct{}
+    config     WriterConfig
+    // Deadline of the writes of the current batch, only used by send
+    timeout    time.Duration
+    // RFC7395: elements are framed instead of enclosed in a stream root
+    framed     bool
+    // Called with every stanza in the order they are sent, see XEP-0198
+    stanzaHook func(protocol.Protocol)
 }
 
 func NewWriter(transport io.Writer) *Writer {
+    return NewWriterWithConfig(transport, DefaultWriterConfig)
+}
+
+func NewWriterWithConfig(transport io.Writer, config WriterConfig) *Writer {
     sw := &Writer{
         transport: transport,
-        wchan:     make(chan []byte),
+        done:      make(chan struct{}),
+        config:    config,
+        framed:    isFramed(transport),
     }
-    sw.wgroup.Add(1)
+    sw.cond = sync.NewCond(&sw.lock)
+    sw.buffer = bufio.NewWriter(writerFunc(sw.writeTransport))
     go sw.send()
     return sw
 }
 
+// Creates a Writer which passes every stanza sent to it to send instead of
+// writing it to a transport, e.g. to route what a handler answers to an
+// entity of another domain. Other elements are dropped. send is called in the
+// order the stanzas are sent, with the Writer locked.
+func NewStanzaWriter(send func(protocol.Protocol)) *Writer {
+    sw := NewWriter(ioutil.Discard)
+    sw.setStanzaHook(send)
+    return sw
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+    return f(p)
+}
+
+func (sw *Writer) Config() WriterConfig {
+    sw.lock.Lock()
+    defer sw.lock.Unlock()
+    return sw.config
+}
+
+// Changes the configuration; elements queued already are kept even if the
+// queue is now larger than allowed.
+func (sw *Writer) SetConfig(config WriterConfig) {
+    sw.lock.Lock()
+    defer sw.lock.Unlock()
+    sw.config = config
+    sw.cond.Broadcast()
+}
+
 func (sw *Writer) send() {
-    defer sw.wgroup.Done()
-    for data := range sw.wchan {
-        if _, err := sw.transport.Write(data); err != nil {
+    defer close(sw.done)
+    sw.lock.Lock()
+    for {
+        for len(sw.queue) == 0 && !sw.closed {
+            sw.cond.Wait()
+        }
+        if len(sw.queue) == 0 {
+            break
+        }
+        batch := sw.queue
+        sw.queue = nil
+        sw.writing = true
+        sw.timeout = sw.config.WriteTimeout
+        // Blocked senders may queue the next batch meanwhile
+        sw.cond.Broadcast()
+        sw.lock.Unlock()
+
+        err := sw.writeBatch(batch)
+
+        sw.lock.Lock()
+        sw.writing = false
+        if err != nil {
+            sw.err = err
+            sw.closed = true
+            sw.queue = nil
+        }
+        sw.cond.Broadcast()
+    }
+    overflowed := sw.overflowed
+    sw.lock.Unlock()
+
+    if closer, ok := sw.transport.(io.Closer); ok && overflowed {
+        closer.Close()
+    }
+}
+
+// Every element of a framed transport is a message of its own, so they are
+// not batched.
+func (sw *Writer) writeBatch(batch [][]byte) error {
+    for _, data := range batch {
+        var err error
+        if sw.framed {
+            _, err = sw.writeTransport(data)
+        } else {
+            _, err = sw.buffer.Write(data)
+        }
+        if err != nil {
+            return err
+        }
+    }
+    return sw.buffer.Flush()
+}
+
+func (sw *Writer) writeTransport(data []byte) (int, error) {
+    d, ok := sw.transport.(writeDeadliner)
+    if !ok || sw.timeout <= 0 {
+        return sw.transport.Write(data)
+    }
+    d.SetWriteDeadline(time.Now().Add(sw.timeout))
+    n, err := sw.transport.Write(data)
+    if err == nil {
+        d.SetWriteDeadline(time.Time{})
+    }
+    return n, err
+}
+
+// Queues data, applying the overflow policy if the queue is full. Once data
+// is queued the stanza hook is called with elem, if it is a stanza, and then
+// queued, if not nil, with the lock still held.
+func (sw *Writer) enqueue(data []byte, elem protocol.Protocol, queued func()) error {
+    sw.lock.Lock()
+    defer sw.lock.Unlock()
+    for {
+        if sw.err != nil {
+            return sw.err
+        }
+        if sw.closed {
+            return WriterClosedError
+        }
+        if sw.config.QueueSize <= 0 || len(sw.queue) < sw.config.QueueSize {
             break
         }
+        switch sw.config.Overflow {
+        case OverflowDrop:
+            return WriterOverflowError
+        case OverflowClose:
+            sw.overflow()
+            return WriterOverflowError
+        }
+        sw.cond.Wait()
     }
+
+    sw.queue = append(sw.queue, data)
+    if elem != nil && sw.stanzaHook != nil && isStanza(elem) {
+        sw.stanzaHook(elem)
+    }
+    if queued != nil {
+        queued()
+    }
+    sw.cond.Broadcast()
+    return nil
+}
+
+// RFC6120 Section 4.9.3.17
+//
+// Replaces the queued elements with a resource-constraint stream error and
+// the end of the stream. The transport is closed once they are written.
+// Called with the lock held.
+func (sw *Writer) overflow() {
+    streamError, _ := sw.marshal(&protocol.XMPPStreamError{
+        ResourceConstraint: &protocol.XMPPStreamErrorResourceConstraint{},
+    })
+    sw.queue = [][]byte{streamError, sw.end()}
+    sw.closed = true
+    sw.overflowed = true
+    sw.cond.Broadcast()
+}
+
+func (sw *Writer) end() []byte {
+    if sw.framed {
+        end, _ := xml.Marshal(&protocol.XMPPFramingClose{})
+        return end
+    }
+    return []byte(protocol.XMPPStreamEndFmt)
 }
 
 func (sw *Writer) Write(data []byte) (int, error) {
-    return len(data), sw.SendBytes(data)
+    if err := sw.SendBytes(data); err != nil {
+        return 0, err
+    }
+    return len(data), nil
 }
 
+// Queues data to be written as is. Returns the error which failed the
+// Writer, if any, or the outcome of the overflow policy.
 func (sw *Writer) SendBytes(data []byte) error {
-    sw.wchan <- data
-    return nil
+    return sw.enqueue(data, nil, nil)
 }
 
+// Waits until everything queued before has been written to the transport.
+func (sw *Writer) Flush() error {
+    sw.lock.Lock()
+    defer sw.lock.Unlock()
+    for (len(sw.queue) > 0 || sw.writing) && sw.err == nil {
+        sw.cond.Wait()
+    }
+    return sw.err
+}
+
+// Ends the stream and waits until everything queued has been written.
 func (sw *Writer) Close() error {
-    if err := sw.SendBytes([]byte(protocol.XMPPStreamEndFmt)); err != nil {
+    if err := sw.SendBytes(sw.end()); err != nil {
         return err
     }
     return sw.Destroy()
 }
 
+// Stops accepting elements and waits until those queued have been written.
+// Returns the transport error which failed the Writer, if any. Later calls
+// return the same.
 func (sw *Writer) Destroy() error {
-    close(sw.wchan)
-    sw.wgroup.Wait()
-    return nil
+    sw.lock.Lock()
+    sw.closed = true
+    sw.cond.Broadcast()
+    sw.lock.Unlock()
+
+    <-sw.done
+    sw.lock.Lock()
+    defer sw.lock.Unlock()
+    return sw.err
 }
 
 func (sw *Writer) Open(stream *protocol.XMPPStream) error {
-    sw.SendBytes([]byte(xml.Header))
-    header := protocol.GenXMPPStreamHeader(stream)
-    if err := sw.SendBytes([]byte(header)); err != nil {
-        return err
+    // RFC7395 Section 3.4
+    if sw.framed {
+        version := stream.Version
+        if version == "" {
+            version = "1.0"
+        }
+        return sw.SendElement(&protocol.XMPPFramingOpen{
+            From:    stream.From,
+            To:      stream.To,
+            Id:      stream.Id,
+            Version: version,
+            XMLLang: stream.XMLLang,
+        })
     }
-    return nil
+
+    header := xml.Header + protocol.GenXMPPStreamHeader(stream)
+    return sw.SendBytes([]byte(header))
 }
 
-func (sw *Writer) SendElement(elem protocol.Protocol) error {
+func (sw *Writer) marshal(elem protocol.Protocol) ([]byte, error) {
     data, err := xml.Marshal(elem)
+    if err != nil {
+        return nil, err
+    }
+    if sw.framed && isStanza(elem) {
+        data = qualifyStanza(data)
+    }
+    return data, nil
+}
+
+func (sw *Writer) SendElement(elem protocol.Protocol) error {
+    data, err := sw.marshal(elem)
     if err != nil {
         return err
     }
-    return sw.SendBytes(data)
+    return sw.enqueue(data, elem, nil)
+}
+
+// Sends elem and installs the stanza hook, so that exactly the stanzas sent
+// after elem are passed to it.
+func (sw *Writer) sendWithStanzaHook(elem protocol.Protocol, hook func(protocol.Protocol)) error {
+    data, err := sw.marshal(elem)
+    if err != nil {
+        return err
+    }
+    return sw.enqueue(data, nil, func() {
+        sw.stanzaHook = hook
+    })
+}
+
+// Installs the stanza hook before anything is sent.
+func (sw *Writer) setStanzaHook(hook func(protocol.Protocol)) {
+    sw.lock.Lock()
+    defer sw.lock.Unlock()
+    sw.stanzaHook = hook
+}
+
+func isStanza(elem protocol.Protocol) bool {
+    switch elem.(type) {
+    case *protocol.XMPPStanzaIQ, *protocol.XMPPStanzaMessage, *protocol.XMPPStanzaPresence:
+        return true
+    }
+    return false
 }
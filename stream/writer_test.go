@@ -2,10 +2,15 @@ package stream
 
 import (
     "bytes"
+    "encoding/xml"
+    "errors"
     "github.com/stretchr/testify/assert"
     "github.com/zonyitoo/goxmpp/protocol"
+    "net"
     // "io"
+    "strings"
     "testing"
+    "time"
 )
 
 func Test_Writer(t *testing.T) {
@@ -29,5 +34,146 @@ func Test_Writer(t *testing.T) {
     assert.NoError(t, sw.SendElement(features))
 
     assert.NoError(t, sw.Close())
-    assert.Equal(t, `<stream:stream from='juliet@example.com' to='example.com' version='1.0' xml:lang='en' id='abcd' xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams'><features xmlns="http://etherx.jabber.org/streams"><starttls xmlns="urn:ietf:params:xml:ns:xmpp-tls"></starttls></features></stream:stream>`, buf.String())
+    // The stream begins with the XML declaration (RFC6120 Section 11.5)
+    assert.Equal(t, xml.Header+`<stream:stream from='juliet@example.com' to='example.com' version='1.0' xml:lang='en' id='abcd' xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams'><features xmlns="http://etherx.jabber.org/streams"><starttls xmlns="urn:ietf:params:xml:ns:xmpp-tls"></starttls></features></stream:stream>`, buf.String())
+}
+
+// A buffer standing in for a WebSocket connection.
+type framedBuffer struct {
+    bytes.Buffer
+    messages []string
+}
+
+func (b *framedBuffer) IsFramed() bool {
+    return true
+}
+
+func (b *framedBuffer) Write(p []byte) (int, error) {
+    b.messages = append(b.messages, string(p))
+    return b.Buffer.Write(p)
+}
+
+// RFC7395 Section 3.3
+func Test_WriterFramed(t *testing.T) {
+    buf := &framedBuffer{}
+    sw := NewWriter(buf)
+
+    assert.NoError(t, sw.Open(&protocol.XMPPStream{
+        From:  "example.com",
+        Id:    "abcd",
+        Xmlns: protocol.XMLNS_JABBER_CLIENT,
+    }))
+    assert.NoError(t, sw.SendElement(&protocol.XMPPStanzaMessage{To: "juliet@example.com", Type: protocol.XMPP_STANZA_MESSAGE_TYPE_CHAT}))
+    assert.NoError(t, sw.Close())
+    assert.Equal(t, []string{
+        `<open xmlns="urn:ietf:params:xml:ns:xmpp-framing" from="example.com" id="abcd" version="1.0"></open>`,
+        `<message xmlns="jabber:client" to="juliet@example.com" type="chat"></message>`,
+        `<close xmlns="urn:ietf:params:xml:ns:xmpp-framing"></close>`,
+    }, buf.messages)
+}
+
+// A transport whose writes wait until released, recording what they write.
+type blockingTransport struct {
+    entered  chan struct{}
+    release  chan struct{}
+    writes   []string
+    closed   bool
+}
+
+func newBlockingTransport() *blockingTransport {
+    return &blockingTransport{
+        entered: make(chan struct{}, 16),
+        release: make(chan struct{}),
+    }
+}
+
+func (t *blockingTransport) Write(p []byte) (int, error) {
+    t.entered <- struct{}{}
+    <-t.release
+    t.writes = append(t.writes, string(p))
+    return len(p), nil
+}
+
+func (t *blockingTransport) Close() error {
+    t.closed = true
+    return nil
+}
+
+// Elements queued while the transport is busy are written at once
+func Test_WriterBatching(t *testing.T) {
+    transport := newBlockingTransport()
+    sw := NewWriter(transport)
+    assert.NoError(t, sw.SendBytes([]byte("a")))
+    <-transport.entered
+    for _, data := range []string{"b", "c", "d"} {
+        assert.NoError(t, sw.SendBytes([]byte(data)))
+    }
+    close(transport.release)
+    assert.NoError(t, sw.Flush())
+    assert.Equal(t, []string{"a", "bcd"}, transport.writes)
+    assert.NoError(t, sw.Destroy())
+}
+
+type failingTransport struct{}
+
+var testTransportError = errors.New("Broken pipe")
+
+func (failingTransport) Write(p []byte) (int, error) {
+    return 0, testTransportError
+}
+
+func Test_WriterTransportError(t *testing.T) {
+    sw := NewWriter(failingTransport{})
+    sw.SendBytes([]byte("a"))
+    assert.Equal(t, testTransportError, sw.Flush())
+    assert.Equal(t, testTransportError, sw.SendBytes([]byte("b")))
+    assert.Equal(t, testTransportError, sw.Close())
+    assert.Equal(t, testTransportError, sw.Destroy())
+    assert.Equal(t, testTransportError, sw.Destroy())
+}
+
+func Test_WriterOverflowDrop(t *testing.T) {
+    transport := newBlockingTransport()
+    sw := NewWriterWithConfig(transport, WriterConfig{QueueSize: 1, Overflow: OverflowDrop})
+    assert.NoError(t, sw.SendBytes([]byte("a")))
+    <-transport.entered
+    assert.NoError(t, sw.SendBytes([]byte("b")))
+    assert.Equal(t, WriterOverflowError, sw.SendBytes([]byte("c")))
+    close(transport.release)
+    assert.NoError(t, sw.Flush())
+    assert.Equal(t, []string{"a", "b"}, transport.writes)
+    assert.NoError(t, sw.Destroy())
+}
+
+// RFC6120 Section 4.9.3.17
+func Test_WriterOverflowClose(t *testing.T) {
+    transport := newBlockingTransport()
+    sw := NewWriterWithConfig(transport, WriterConfig{QueueSize: 1, Overflow: OverflowClose})
+    assert.NoError(t, sw.SendBytes([]byte("a")))
+    <-transport.entered
+    assert.NoError(t, sw.SendBytes([]byte("b")))
+    assert.Equal(t, WriterOverflowError, sw.SendBytes([]byte("c")))
+    assert.Equal(t, WriterClosedError, sw.SendBytes([]byte("d")))
+    close(transport.release)
+    assert.NoError(t, sw.Destroy())
+
+    assert.Len(t, transport.writes, 2)
+    assert.Equal(t, "a", transport.writes[0])
+    assert.True(t, strings.HasPrefix(transport.writes[1], `<error xmlns="http://etherx.jabber.org/streams"><resource-constraint`))
+    assert.True(t, strings.HasSuffix(transport.writes[1], `</stream:stream>`))
+    assert.True(t, transport.closed)
+}
+
+func Test_WriterTimeout(t *testing.T) {
+    conn, peer := net.Pipe()
+    defer peer.Close()
+    sw := NewWriterWithConfig(conn, WriterConfig{WriteTimeout: 50 * time.Millisecond})
+
+    // Nobody reads from the peer
+    sw.SendBytes([]byte("a"))
+    err := sw.Flush()
+    if assert.Error(t, err) {
+        assert.True(t, err.(net.Error).Timeout())
+    }
+    assert.Equal(t, err, sw.SendBytes([]byte("b")))
 }